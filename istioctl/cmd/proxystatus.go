@@ -98,7 +98,8 @@ Retrieves last sent and last acknowledged xDS sync from Istiod to each Envoy in
 				if err != nil {
 					return err
 				}
-				return c.Diff()
+				_, err = c.Diff()
+				return err
 			}
 			statuses, err := kubeClient.AllDiscoveryDo(context.TODO(), istioNamespace, "/debug/syncz")
 			if err != nil {
@@ -214,7 +215,8 @@ Retrieves last sent and last acknowledged xDS sync from Istiod to each Envoy in
 				if err != nil {
 					return err
 				}
-				return c.Diff()
+				_, err = c.Diff()
+				return err
 			}
 
 			xdsRequest := xdsapi.DiscoveryRequest{
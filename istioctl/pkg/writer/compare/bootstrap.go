@@ -0,0 +1,97 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// DefaultBootstrapNoise lists the bootstrap fields that legitimately vary between Envoy instances, and are
+// left out of the bootstrap diff. Fields are dotted paths of their JSON names.
+var DefaultBootstrapNoise = []string{
+	"admin.address.socketAddress.portValue",
+}
+
+// AddBootstrapNoise adds fields, as dotted paths of their JSON names, to leave out of the bootstrap diff.
+func (c *Comparator) AddBootstrapNoise(paths ...string) {
+	c.bootstrapNoise = append(c.bootstrapNoise, paths...)
+}
+
+// BootstrapDiff prints a diff between the expected bootstrap and the one Envoy started with to the passed writer
+func (c *Comparator) BootstrapDiff(expected *bootstrap.Bootstrap) error {
+	noise := append(append([]string{}, DefaultBootstrapNoise...), c.bootstrapNoise...)
+	envoyBytes, expectedBytes := &bytes.Buffer{}, &bytes.Buffer{}
+	envoyBootstrapDump, err := c.envoy.GetBootstrapConfigDump()
+	if err != nil {
+		envoyBytes.WriteString(err.Error())
+	} else if err := marshalWithoutNoise(envoyBytes, envoyBootstrapDump.Bootstrap, noise); err != nil {
+		return err
+	}
+	if err := marshalWithoutNoise(expectedBytes, expected, noise); err != nil {
+		return err
+	}
+	diff := c.unifiedDiff("Expected Bootstrap", difflib.SplitLines(expectedBytes.String()),
+		withRevision("Envoy Bootstrap", c.envoy), difflib.SplitLines(envoyBytes.String()))
+	text, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return err
+	}
+	if text != "" {
+		fmt.Fprintln(c.w, text)
+	} else {
+		fmt.Fprintln(c.w, "Bootstrap Matches")
+	}
+	return nil
+}
+
+// marshalWithoutNoise writes msg as indented JSON, without the noise fields.
+func marshalWithoutNoise(buf *bytes.Buffer, msg proto.Message, noise []string) error {
+	js, err := (&jsonpb.Marshaler{}).MarshalToString(msg)
+	if err != nil {
+		return err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(js), &fields); err != nil {
+		return err
+	}
+	for _, path := range noise {
+		removeField(fields, strings.Split(path, "."))
+	}
+	out, err := json.MarshalIndent(fields, "", "   ")
+	if err != nil {
+		return err
+	}
+	buf.Write(out)
+	return nil
+}
+
+// removeField deletes the field at path. Paths only go through objects, not lists.
+func removeField(fields map[string]interface{}, path []string) {
+	if len(path) == 1 {
+		delete(fields, path[0])
+		return
+	}
+	if next, ok := fields[path[0]].(map[string]interface{}); ok {
+		removeField(next, path[1:])
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
+	"github.com/golang/protobuf/jsonpb"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+func TestBootstrapDiff(t *testing.T) {
+	envoyResponse, err := ioutil.ReadFile("testdata/envoy-bootstrap.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envoyDump := &configdump.Wrapper{}
+	if err := json.Unmarshal(envoyResponse, envoyDump); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open("testdata/expected-bootstrap.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	expected := &bootstrap.Bootstrap{}
+	if err := jsonpb.Unmarshal(f, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &bytes.Buffer{}
+	c := &Comparator{envoy: envoyDump, w: w, context: 7}
+	if err := c.BootstrapDiff(expected); err != nil {
+		t.Fatal(err)
+	}
+	got := w.String()
+	for _, want := range []string{`-            "collectorCluster": "jaeger",`, `+            "collectorCluster": "zipkin",`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected the diff to contain %q, got:\n%s", want, got)
+		}
+	}
+	// The admin port differs as well, but is noise.
+	if strings.Contains(got, "portValue") {
+		t.Errorf("expected the admin port to be left out of the diff, got:\n%s", got)
+	}
+
+	// With the tracing config as noise too, the bootstrap matches.
+	w.Reset()
+	c.AddBootstrapNoise("tracing")
+	if err := c.BootstrapDiff(expected); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); got != "Bootstrap Matches\n" {
+		t.Errorf("expected the bootstrap to match, got:\n%s", got)
+	}
+}
@@ -18,41 +18,79 @@ import (
 	"bytes"
 	"fmt"
 
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pmezard/go-difflib/difflib"
 )
 
-// ClusterDiff prints a diff between Istiod and Envoy clusters to the passed writer
-func (c *Comparator) ClusterDiff() error {
+// ClusterDiff prints a diff between Istiod and Envoy clusters to the passed writer, and returns it along
+// with the clusters that differ.
+func (c *Comparator) ClusterDiff() (*DiffResult, error) {
 	jsonm := &jsonpb.Marshaler{Indent: "   "}
 	envoyBytes, istiodBytes := &bytes.Buffer{}, &bytes.Buffer{}
 	envoyClusterDump, err := c.envoy.GetDynamicClusterDump(true)
+	envoyRead := err == nil
 	if err != nil {
 		envoyBytes.WriteString(err.Error())
 	} else if err := jsonm.Marshal(envoyBytes, envoyClusterDump); err != nil {
-		return err
+		return nil, err
 	}
 	istiodClusterDump, err := c.istiod.GetDynamicClusterDump(true)
+	istiodRead := err == nil
 	if err != nil {
 		istiodBytes.WriteString(err.Error())
 	} else if err := jsonm.Marshal(istiodBytes, istiodClusterDump); err != nil {
-		return err
-	}
-	diff := difflib.UnifiedDiff{
-		FromFile: "Istiod Clusters",
-		A:        difflib.SplitLines(istiodBytes.String()),
-		ToFile:   "Envoy Clusters",
-		B:        difflib.SplitLines(envoyBytes.String()),
-		Context:  c.context,
+		return nil, err
 	}
+	diff := c.unifiedDiff(withRevision("Istiod Clusters", c.istiod), difflib.SplitLines(istiodBytes.String()),
+		withRevision("Envoy Clusters", c.envoy), difflib.SplitLines(envoyBytes.String()))
 	text, err := difflib.GetUnifiedDiffString(diff)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result := &DiffResult{Matched: text == "", Text: text}
+	if envoyRead && istiodRead {
+		if result.Changes, err = clusterChanges(istiodClusterDump, envoyClusterDump); err != nil {
+			return nil, err
+		}
 	}
 	if text != "" {
 		fmt.Fprintln(c.w, text)
 	} else {
 		fmt.Fprintln(c.w, "Clusters Match")
 	}
-	return nil
+	return result, nil
+}
+
+// clusterChanges returns the clusters that differ between the Istiod and Envoy dumps.
+func clusterChanges(istiod, envoy *adminapi.ClustersConfigDump) ([]ResourceChange, error) {
+	istiodClusters, err := clustersByName(istiod)
+	if err != nil {
+		return nil, err
+	}
+	envoyClusters, err := clustersByName(envoy)
+	if err != nil {
+		return nil, err
+	}
+	return resourceChanges(istiodClusters, envoyClusters), nil
+}
+
+// clustersByName returns the marshaled dynamic clusters of dump, keyed by cluster name.
+func clustersByName(dump *adminapi.ClustersConfigDump) (map[string]string, error) {
+	jsonm := &jsonpb.Marshaler{}
+	out := make(map[string]string, len(dump.DynamicActiveClusters))
+	for _, dac := range dump.DynamicActiveClusters {
+		c := &cluster.Cluster{}
+		if err := ptypes.UnmarshalAny(dac.Cluster, c); err != nil {
+			return nil, err
+		}
+		s, err := jsonm.MarshalToString(dac)
+		if err != nil {
+			return nil, err
+		}
+		out[c.Name] = s
+	}
+	return out, nil
 }
@@ -13,3 +13,91 @@
 // limitations under the License.
 
 package compare
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+// syntheticClusterDump returns a config dump of clusters clusters, the one at index changed having a different
+// connect timeout.
+func syntheticClusterDump(t testing.TB, clusters, changed int) *configdump.Wrapper {
+	t.Helper()
+	dump := &adminapi.ClustersConfigDump{}
+	for i := 0; i < clusters; i++ {
+		timeout := time.Second
+		if i == changed {
+			timeout = 2 * time.Second
+		}
+		ca, err := ptypes.MarshalAny(&cluster.Cluster{
+			Name:           fmt.Sprintf("cluster-%05d", i),
+			ConnectTimeout: ptypes.DurationProto(timeout),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump.DynamicActiveClusters = append(dump.DynamicActiveClusters, &adminapi.ClustersConfigDump_DynamicCluster{
+			Cluster: ca,
+		})
+	}
+	da, err := ptypes.MarshalAny(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &configdump.Wrapper{ConfigDump: &adminapi.ConfigDump{Configs: []*any.Any{da}}}
+}
+
+func TestClusterDiffResult(t *testing.T) {
+	testCases := []struct {
+		name    string
+		istiod  *configdump.Wrapper
+		envoy   *configdump.Wrapper
+		matched bool
+		changes []ResourceChange
+	}{
+		{
+			name:    "match",
+			istiod:  syntheticClusterDump(t, 3, -1),
+			envoy:   syntheticClusterDump(t, 3, -1),
+			matched: true,
+		},
+		{
+			name:    "cluster changed",
+			istiod:  syntheticClusterDump(t, 3, -1),
+			envoy:   syntheticClusterDump(t, 3, 1),
+			changes: []ResourceChange{{Name: "cluster-00001", Kind: Modified}},
+		},
+		{
+			name:    "cluster missing from envoy",
+			istiod:  syntheticClusterDump(t, 3, -1),
+			envoy:   syntheticClusterDump(t, 2, -1),
+			changes: []ResourceChange{{Name: "cluster-00002", Kind: IstiodOnly}},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			c := &Comparator{istiod: tt.istiod, envoy: tt.envoy, w: w, context: 7}
+			result, err := c.ClusterDiff()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Matched != tt.matched {
+				t.Errorf("expected matched %v, got %v", tt.matched, result.Matched)
+			}
+			if !reflect.DeepEqual(result.Changes, tt.changes) {
+				t.Errorf("expected changes %v, got %v", tt.changes, result.Changes)
+			}
+		})
+	}
+}
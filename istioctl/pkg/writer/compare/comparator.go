@@ -18,9 +18,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
 
 	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
 	xdsapi "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/pmezard/go-difflib/difflib"
 
 	"istio.io/istio/istioctl/pkg/util/configdump"
 )
@@ -31,6 +33,92 @@ type Comparator struct {
 	w             io.Writer
 	context       int
 	location      string
+	// bootstrapNoise are the bootstrap fields left out of the diff, on top of DefaultBootstrapNoise.
+	bootstrapNoise []string
+	// normalizeFilterChains sorts the filter chains of the listeners before diffing them.
+	normalizeFilterChains bool
+	// baseline is the config dump DeltaDiff compares both sides against, if set.
+	baseline *configdump.Wrapper
+	// direction of the diffs between Istiod and Envoy.
+	direction DiffDirection
+}
+
+// DiffDirection decides which side of the comparison the diffs go from, and which they go to.
+type DiffDirection int
+
+const (
+	// IstiodToEnvoy diffs from Istiod to Envoy: the added lines are those Envoy has and Istiod does not.
+	IstiodToEnvoy DiffDirection = iota
+	// EnvoyToIstiod diffs from Envoy to Istiod: the added lines are those Istiod has and Envoy does not.
+	EnvoyToIstiod
+)
+
+// SetDirection sets the direction of the diffs between Istiod and Envoy, IstiodToEnvoy by default. The expected
+// bootstrap of BootstrapDiff stands for Istiod. The diffs of DeltaDiff always go from the baseline.
+func (c *Comparator) SetDirection(direction DiffDirection) {
+	c.direction = direction
+}
+
+// DiffResult is the outcome of a diff between Istiod and Envoy, for callers building on the comparator rather
+// than reading its output.
+type DiffResult struct {
+	// Matched is true if both sides are the same.
+	Matched bool
+	// Text is the unified diff written, empty if both sides match.
+	Text string
+	// Changes are the resources that differ between both sides, sorted by name. Empty if either dump could
+	// not be read.
+	Changes []ResourceChange
+}
+
+// ResourceChange is a resource that differs between Istiod and Envoy.
+type ResourceChange struct {
+	Name string
+	Kind ChangeKind
+}
+
+// ChangeKind tells how a resource differs between Istiod and Envoy.
+type ChangeKind string
+
+const (
+	// IstiodOnly resources are only in the Istiod dump.
+	IstiodOnly ChangeKind = "IstiodOnly"
+	// EnvoyOnly resources are only in the Envoy dump.
+	EnvoyOnly ChangeKind = "EnvoyOnly"
+	// Modified resources are in both dumps, with different contents.
+	Modified ChangeKind = "Modified"
+)
+
+// resourceChanges returns the resources that differ between the Istiod and Envoy contents, keyed by resource
+// name, sorted by name.
+func resourceChanges(istiod, envoy map[string]string) []ResourceChange {
+	var changes []ResourceChange
+	for name, a := range istiod {
+		b, f := envoy[name]
+		if !f {
+			changes = append(changes, ResourceChange{Name: name, Kind: IstiodOnly})
+		} else if a != b {
+			changes = append(changes, ResourceChange{Name: name, Kind: Modified})
+		}
+	}
+	for name := range envoy {
+		if _, f := istiod[name]; !f {
+			changes = append(changes, ResourceChange{Name: name, Kind: EnvoyOnly})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// unifiedDiff returns the diff between the lines of the Istiod and Envoy sides of a comparison, labeled with
+// their file names, in the direction of the comparator.
+func (c *Comparator) unifiedDiff(istiodFile string, istiod []string, envoyFile string, envoy []string) difflib.UnifiedDiff {
+	if c.direction == EnvoyToIstiod {
+		return difflib.UnifiedDiff{FromFile: envoyFile, A: envoy, ToFile: istiodFile, B: istiod, Context: c.context}
+	}
+	return difflib.UnifiedDiff{FromFile: istiodFile, A: istiod, ToFile: envoyFile, B: envoy, Context: c.context}
 }
 
 // NewComparator is a comparator constructor
@@ -88,13 +176,19 @@ func NewXdsComparator(w io.Writer, istiodResponses map[string]*xdsapi.DiscoveryR
 	return c, nil
 }
 
-// Diff prints a diff between Istiod and Envoy to the passed writer
-func (c *Comparator) Diff() error {
-	if err := c.ClusterDiff(); err != nil {
-		return err
-	}
-	if err := c.ListenerDiff(); err != nil {
-		return err
+// Diff prints a diff between Istiod and Envoy to the passed writer, and returns the results of the cluster,
+// listener and route diffs combined. It only matches if all of them do; its changes are the ones of the
+// clusters, then of the listeners, then of the routes.
+func (c *Comparator) Diff() (*DiffResult, error) {
+	out := &DiffResult{Matched: true}
+	for _, diff := range []func() (*DiffResult, error){c.ClusterDiff, c.ListenerDiff, c.RouteDiff} {
+		result, err := diff()
+		if err != nil {
+			return nil, err
+		}
+		out.Matched = out.Matched && result.Matched
+		out.Text += result.Text
+		out.Changes = append(out.Changes, result.Changes...)
 	}
-	return c.RouteDiff()
+	return out, nil
 }
@@ -13,3 +13,136 @@
 // limitations under the License.
 
 package compare
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+// diffLines returns the removed and added lines of a unified diff, without their prefix, and its labels.
+func diffLines(diff string) (removed, added []string, from, to string) {
+	for _, l := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(l, "--- "):
+			from = strings.TrimPrefix(l, "--- ")
+		case strings.HasPrefix(l, "+++ "):
+			to = strings.TrimPrefix(l, "+++ ")
+		case strings.HasPrefix(l, "-"):
+			removed = append(removed, l[1:])
+		case strings.HasPrefix(l, "+"):
+			added = append(added, l[1:])
+		}
+	}
+	return
+}
+
+func TestDiffDirection(t *testing.T) {
+	diffs := map[string]func(c *Comparator) error{
+		"buffered": func(c *Comparator) error {
+			_, err := c.ListenerDiff()
+			return err
+		},
+		"streamed": (*Comparator).StreamListenerDiff,
+	}
+	for name, diff := range diffs {
+		t.Run(name, func(t *testing.T) {
+			out := map[DiffDirection]string{}
+			for _, direction := range []DiffDirection{IstiodToEnvoy, EnvoyToIstiod} {
+				w := &bytes.Buffer{}
+				c := &Comparator{
+					istiod:  syntheticListenerDump(t, 5, 5, -1),
+					envoy:   syntheticListenerDump(t, 5, 5, 2),
+					w:       w,
+					context: 7,
+				}
+				c.SetDirection(direction)
+				if err := diff(c); err != nil {
+					t.Fatal(err)
+				}
+				out[direction] = w.String()
+			}
+
+			removed, added, from, to := diffLines(out[IstiodToEnvoy])
+			if !strings.HasPrefix(from, "Istiod Listeners") || !strings.HasPrefix(to, "Envoy Listeners") {
+				t.Fatalf("expected the diff to go from Istiod to Envoy, got %q to %q", from, to)
+			}
+			if len(removed) == 0 || len(added) == 0 {
+				t.Fatalf("expected lines removed and added, got:\n%s", out[IstiodToEnvoy])
+			}
+			invRemoved, invAdded, invFrom, invTo := diffLines(out[EnvoyToIstiod])
+			if invFrom != to || invTo != from {
+				t.Errorf("expected the labels to be swapped, got %q to %q", invFrom, invTo)
+			}
+			if strings.Join(invRemoved, "\n") != strings.Join(added, "\n") ||
+				strings.Join(invAdded, "\n") != strings.Join(removed, "\n") {
+				t.Errorf("expected the inverse diff of:\n%s\ngot:\n%s", out[IstiodToEnvoy], out[EnvoyToIstiod])
+			}
+		})
+	}
+}
+
+// mergeDumps returns a config dump holding the configs of all dumps.
+func mergeDumps(dumps ...*configdump.Wrapper) *configdump.Wrapper {
+	out := &adminapi.ConfigDump{}
+	for _, d := range dumps {
+		out.Configs = append(out.Configs, d.Configs...)
+	}
+	return &configdump.Wrapper{ConfigDump: out}
+}
+
+func TestDiffResult(t *testing.T) {
+	// dump returns a config dump of three clusters, listeners and routes, with the ones at the given
+	// indexes changed.
+	dump := func(cluster, listener, route int) *configdump.Wrapper {
+		return mergeDumps(syntheticClusterDump(t, 3, cluster), syntheticListenerDump(t, 3, 3, listener),
+			syntheticRouteDump(t, 3, route))
+	}
+	istiod := dump(-1, -1, -1)
+	testCases := []struct {
+		name    string
+		envoy   *configdump.Wrapper
+		matched bool
+		changes []ResourceChange
+	}{
+		{
+			name:    "match",
+			envoy:   dump(-1, -1, -1),
+			matched: true,
+		},
+		{
+			name:    "route changed",
+			envoy:   dump(-1, -1, 1),
+			changes: []ResourceChange{{Name: "route-00001", Kind: Modified}},
+		},
+		{
+			name:    "cluster and listener changed",
+			envoy:   dump(2, 0, -1),
+			changes: []ResourceChange{{Name: "cluster-00002", Kind: Modified}, {Name: "listener-00000", Kind: Modified}},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			c := &Comparator{istiod: istiod, envoy: tt.envoy, w: w, context: 7, location: "UTC"}
+			result, err := c.Diff()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Matched != tt.matched {
+				t.Errorf("expected matched %v, got %v", tt.matched, result.Matched)
+			}
+			if tt.matched != (result.Text == "") {
+				t.Errorf("expected diff text only if the dumps differ, got:\n%s", result.Text)
+			}
+			if !reflect.DeepEqual(result.Changes, tt.changes) {
+				t.Errorf("expected changes %v, got %v", tt.changes, result.Changes)
+			}
+		})
+	}
+}
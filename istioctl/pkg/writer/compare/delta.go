@@ -0,0 +1,189 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+// SetBaseline sets the config dump DeltaDiff compares Istiod and Envoy against, typically an Envoy config dump
+// captured earlier.
+func (c *Comparator) SetBaseline(baseline []byte) error {
+	dump := &configdump.Wrapper{}
+	if err := json.Unmarshal(baseline, dump); err != nil {
+		return err
+	}
+	c.baseline = dump
+	return nil
+}
+
+// DeltaDiff prints, for clusters, listeners and routes, the resources of Istiod and of Envoy that were added,
+// removed or modified since the baseline to the passed writer, with the diff of the modified ones. Resources
+// unchanged since the baseline are left out
+func (c *Comparator) DeltaDiff() error {
+	if c.baseline == nil {
+		return errors.New("no baseline to compare against")
+	}
+	for _, resources := range []struct {
+		kind      string
+		resources func(*configdump.Wrapper) (map[string]proto.Message, error)
+	}{
+		{"Clusters", clusterResources},
+		{"Listeners", listenerResources},
+		{"Routes", routeResources},
+	} {
+		baseline, err := resources.resources(c.baseline)
+		if err != nil {
+			fmt.Fprintf(c.w, "%s: unable to read the baseline dump: %v\n", resources.kind, err)
+			continue
+		}
+		for _, side := range []struct {
+			name string
+			dump *configdump.Wrapper
+		}{
+			{"Istiod", c.istiod},
+			{"Envoy", c.envoy},
+		} {
+			current, err := resources.resources(side.dump)
+			if err != nil {
+				fmt.Fprintf(c.w, "%s: unable to read the %s dump: %v\n", resources.kind, side.name, err)
+				continue
+			}
+			added, removed, modified := deltaNames(baseline, current)
+			fmt.Fprintf(c.w, "%s in %s since the baseline: %d added, %d removed, %d modified\n",
+				resources.kind, side.name, len(added), len(removed), len(modified))
+			for _, name := range added {
+				fmt.Fprintf(c.w, "   Added: %s\n", name)
+			}
+			for _, name := range removed {
+				fmt.Fprintf(c.w, "   Removed: %s\n", name)
+			}
+			for _, name := range modified {
+				fmt.Fprintf(c.w, "   Modified: %s\n", name)
+				if err := c.resourceDiff(baseline[name], current[name], "Baseline "+name, side.name+" "+name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// resourceDiff prints the diff of a resource from its baseline version.
+func (c *Comparator) resourceDiff(from, to proto.Message, fromFile, toFile string) error {
+	jsonm := &jsonpb.Marshaler{Indent: "   "}
+	a, err := jsonm.MarshalToString(from)
+	if err != nil {
+		return err
+	}
+	b, err := jsonm.MarshalToString(to)
+	if err != nil {
+		return err
+	}
+	text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		FromFile: fromFile,
+		A:        difflib.SplitLines(a),
+		ToFile:   toFile,
+		B:        difflib.SplitLines(b),
+		Context:  c.context,
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.w, text)
+	return nil
+}
+
+// deltaNames returns the sorted names of the resources of current added, removed and modified since baseline.
+func deltaNames(baseline, current map[string]proto.Message) (added, removed, modified []string) {
+	for name, resource := range current {
+		old, f := baseline[name]
+		if !f {
+			added = append(added, name)
+		} else if !proto.Equal(old, resource) {
+			modified = append(modified, name)
+		}
+	}
+	for name := range baseline {
+		if _, f := current[name]; !f {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(modified)
+	return added, removed, modified
+}
+
+func clusterResources(dump *configdump.Wrapper) (map[string]proto.Message, error) {
+	clusterDump, err := dump.GetDynamicClusterDump(true)
+	if err != nil {
+		return nil, err
+	}
+	resources := make(map[string]proto.Message, len(clusterDump.DynamicActiveClusters))
+	for _, dc := range clusterDump.DynamicActiveClusters {
+		c := &cluster.Cluster{}
+		if err := ptypes.UnmarshalAny(dc.Cluster, c); err != nil {
+			return nil, err
+		}
+		resources[c.Name] = c
+	}
+	return resources, nil
+}
+
+func listenerResources(dump *configdump.Wrapper) (map[string]proto.Message, error) {
+	listenerDump, err := dump.GetDynamicListenerDump(true)
+	if err != nil {
+		return nil, err
+	}
+	resources := make(map[string]proto.Message, len(listenerDump.DynamicListeners))
+	for _, dl := range listenerDump.DynamicListeners {
+		l := &listener.Listener{}
+		if err := ptypes.UnmarshalAny(dl.ActiveState.Listener, l); err != nil {
+			return nil, err
+		}
+		resources[l.Name] = l
+	}
+	return resources, nil
+}
+
+func routeResources(dump *configdump.Wrapper) (map[string]proto.Message, error) {
+	routeDump, err := dump.GetDynamicRouteDump(true)
+	if err != nil {
+		return nil, err
+	}
+	resources := make(map[string]proto.Message, len(routeDump.DynamicRouteConfigs))
+	for _, drc := range routeDump.DynamicRouteConfigs {
+		r := &route.RouteConfiguration{}
+		if err := ptypes.UnmarshalAny(drc.RouteConfig, r); err != nil {
+			return nil, err
+		}
+		resources[r.Name] = r
+	}
+	return resources, nil
+}
@@ -0,0 +1,94 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// deltaDump returns a config dump with two listeners, the second of the given traffic direction.
+func deltaDump(direction string) string {
+	return fmt.Sprintf(`{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump"
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ListenersConfigDump",
+      "dynamicListeners": [
+        {
+          "name": "0.0.0.0_80",
+          "activeState": {
+            "listener": {
+              "@type": "type.googleapis.com/envoy.config.listener.v3.Listener",
+              "name": "0.0.0.0_80",
+              "trafficDirection": "OUTBOUND"
+            }
+          }
+        },
+        {
+          "name": "0.0.0.0_9080",
+          "activeState": {
+            "listener": {
+              "@type": "type.googleapis.com/envoy.config.listener.v3.Listener",
+              "name": "0.0.0.0_9080",
+              "trafficDirection": %q
+            }
+          }
+        }
+      ]
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.RoutesConfigDump"
+    }
+  ]
+}`, direction)
+}
+
+func TestDeltaDiff(t *testing.T) {
+	w := &bytes.Buffer{}
+	c, err := NewComparator(w, map[string][]byte{"istiod": []byte(deltaDump("INBOUND"))}, []byte(deltaDump("OUTBOUND")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeltaDiff(); err == nil {
+		t.Fatal("expected an error without a baseline")
+	}
+	if err := c.SetBaseline([]byte(deltaDump("OUTBOUND"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeltaDiff(); err != nil {
+		t.Fatal(err)
+	}
+	got := w.String()
+	for _, want := range []string{
+		"Listeners in Istiod since the baseline: 0 added, 0 removed, 1 modified\n",
+		"   Modified: 0.0.0.0_9080\n",
+		"--- Baseline 0.0.0.0_9080\n+++ Istiod 0.0.0.0_9080\n",
+		"+   \"trafficDirection\": \"INBOUND\"",
+		"Listeners in Envoy since the baseline: 0 added, 0 removed, 0 modified\n",
+		"Clusters in Istiod since the baseline: 0 added, 0 removed, 0 modified\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected the delta to contain %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "0.0.0.0_80\n") {
+		t.Errorf("expected the unchanged listener to be left out, got:\n%s", got)
+	}
+}
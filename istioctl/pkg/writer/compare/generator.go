@@ -0,0 +1,168 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+	"istio.io/istio/pilot/pkg/model"
+	configgen "istio.io/istio/pilot/pkg/networking/core"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pilot/test/xdstest"
+)
+
+// ConfigGenerator generates the XDS resources of a proxy directly, like an istiod running in the same process,
+// rather than going through the debug interface of istiod.
+type ConfigGenerator interface {
+	// Generate returns the resources of typeURL pushed to the proxy identified by node. For routes, these
+	// are all the route configurations its listeners refer to.
+	Generate(node *core.Node, typeURL string) ([]*any.Any, error)
+}
+
+// ConfigGeneratorFunc adapts a function to a ConfigGenerator.
+type ConfigGeneratorFunc func(node *core.Node, typeURL string) ([]*any.Any, error)
+
+// Generate calls f(node, typeURL).
+func (f ConfigGeneratorFunc) Generate(node *core.Node, typeURL string) ([]*any.Any, error) {
+	return f(node, typeURL)
+}
+
+// NewPilotConfigGenerator returns a ConfigGenerator backed by gen, the config generation of istiod, generating
+// the resources of the proxies of env with its current push context, like an istiod pushing to them would.
+func NewPilotConfigGenerator(gen configgen.ConfigGenerator, env *model.Environment) ConfigGenerator {
+	return ConfigGeneratorFunc(func(node *core.Node, typeURL string) ([]*any.Any, error) {
+		push := env.PushContext
+		proxy, err := pilotProxy(node, env, push)
+		if err != nil {
+			return nil, err
+		}
+		var resources []proto.Message
+		switch typeURL {
+		case v3.ClusterType:
+			for _, c := range gen.BuildClusters(proxy, push) {
+				resources = append(resources, c)
+			}
+		case v3.ListenerType:
+			for _, l := range gen.BuildListeners(proxy, push) {
+				resources = append(resources, l)
+			}
+		case v3.RouteType:
+			routeNames := xdstest.ExtractRoutesFromListeners(gen.BuildListeners(proxy, push))
+			for _, r := range gen.BuildHTTPRoutes(proxy, push, routeNames) {
+				resources = append(resources, r)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported type %s", typeURL)
+		}
+		out := make([]*any.Any, 0, len(resources))
+		for _, r := range resources {
+			a, err := ptypes.MarshalAny(r)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, a)
+		}
+		return out, nil
+	})
+}
+
+// pilotProxy returns the proxy of node, initialized for push like istiod does when the proxy connects.
+func pilotProxy(node *core.Node, env *model.Environment, push *model.PushContext) (*model.Proxy, error) {
+	meta, err := model.ParseMetadata(node.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := model.ParseServiceNodeWithMetadata(node.Id, meta)
+	if err != nil {
+		return nil, err
+	}
+	proxy.ConfigNamespace = model.GetProxyConfigNamespace(proxy)
+	proxy.SetWorkloadLabels(env)
+	proxy.SetServiceInstances(push.ServiceDiscovery)
+	proxy.SetSidecarScope(push)
+	proxy.SetGatewaysForProxy(push)
+	proxy.DiscoverIPVersions()
+	return proxy, nil
+}
+
+// NewGeneratorComparator is a comparator constructor, comparing Envoy against the config gen generates for node
+func NewGeneratorComparator(w io.Writer, gen ConfigGenerator, node *core.Node, envoyResponse []byte) (*Comparator, error) {
+	istiodDump, err := generatedConfigDump(gen, node)
+	if err != nil {
+		return nil, err
+	}
+	c := &Comparator{istiod: istiodDump}
+	envoyDump := &configdump.Wrapper{}
+	if err := json.Unmarshal(envoyResponse, envoyDump); err != nil {
+		return nil, err
+	}
+	c.envoy = envoyDump
+	c.w = w
+	c.context = 7
+	c.location = "Local" // the time.Location for formatting time.Time instances
+	return c, nil
+}
+
+// generatedConfigDump builds a config dump of the clusters, listeners and routes gen generates for node, as
+// the dynamic resources of the config dump of istiod.
+func generatedConfigDump(gen ConfigGenerator, node *core.Node) (*configdump.Wrapper, error) {
+	clusters, err := gen.Generate(node, v3.ClusterType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the clusters: %v", err)
+	}
+	listeners, err := gen.Generate(node, v3.ListenerType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the listeners: %v", err)
+	}
+	routes, err := gen.Generate(node, v3.RouteType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate the routes: %v", err)
+	}
+
+	clusterDump := &adminapi.ClustersConfigDump{}
+	for _, c := range clusters {
+		clusterDump.DynamicActiveClusters = append(clusterDump.DynamicActiveClusters,
+			&adminapi.ClustersConfigDump_DynamicCluster{Cluster: c})
+	}
+	listenerDump := &adminapi.ListenersConfigDump{}
+	for _, l := range listeners {
+		listenerDump.DynamicListeners = append(listenerDump.DynamicListeners,
+			&adminapi.ListenersConfigDump_DynamicListener{ActiveState: &adminapi.ListenersConfigDump_DynamicListenerState{Listener: l}})
+	}
+	routeDump := &adminapi.RoutesConfigDump{}
+	for _, r := range routes {
+		routeDump.DynamicRouteConfigs = append(routeDump.DynamicRouteConfigs,
+			&adminapi.RoutesConfigDump_DynamicRouteConfig{RouteConfig: r})
+	}
+
+	dump := &adminapi.ConfigDump{}
+	for _, section := range []proto.Message{clusterDump, listenerDump, routeDump} {
+		a, err := ptypes.MarshalAny(section)
+		if err != nil {
+			return nil, err
+		}
+		dump.Configs = append(dump.Configs, a)
+	}
+	return &configdump.Wrapper{ConfigDump: dump}, nil
+}
@@ -0,0 +1,152 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// listenerGenerator generates the listeners of deltaDump, the second of the given traffic direction, for the
+// sidecar node alone.
+func listenerGenerator(t *testing.T, direction core.TrafficDirection) ConfigGenerator {
+	return ConfigGeneratorFunc(func(node *core.Node, typeURL string) ([]*any.Any, error) {
+		if node.Id != "sidecar~10.0.0.1~productpage.ns1~ns1.svc.cluster.local" {
+			t.Errorf("unexpected node %v", node)
+		}
+		if typeURL != v3.ListenerType {
+			return nil, nil
+		}
+		var out []*any.Any
+		for _, l := range []*listener.Listener{
+			{Name: "0.0.0.0_80", TrafficDirection: core.TrafficDirection_OUTBOUND},
+			{Name: "0.0.0.0_9080", TrafficDirection: direction},
+		} {
+			a, err := ptypes.MarshalAny(l)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, a)
+		}
+		return out, nil
+	})
+}
+
+func TestGeneratorComparator(t *testing.T) {
+	node := &core.Node{Id: "sidecar~10.0.0.1~productpage.ns1~ns1.svc.cluster.local"}
+	w := &bytes.Buffer{}
+	c, err := NewGeneratorComparator(w, listenerGenerator(t, core.TrafficDirection_OUTBOUND), node, []byte(deltaDump("OUTBOUND")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListenerDiff(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); got != "Listeners Match\n" {
+		t.Errorf("expected the listeners to match, got:\n%s", got)
+	}
+
+	w.Reset()
+	c, err = NewGeneratorComparator(w, listenerGenerator(t, core.TrafficDirection_INBOUND), node, []byte(deltaDump("OUTBOUND")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.ListenerDiff(); err != nil {
+		t.Fatal(err)
+	}
+	got := w.String()
+	for _, want := range []string{`-\s+"trafficDirection": "INBOUND"`, `\+\s+"trafficDirection": "OUTBOUND"`} {
+		if !regexp.MustCompile(want).MatchString(got) {
+			t.Errorf("expected the diff to match %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestPilotConfigGenerator(t *testing.T) {
+	cg := v1alpha3.NewConfigGenTest(t, v1alpha3.TestOptions{
+		ConfigString: `
+apiVersion: networking.istio.io/v1alpha3
+kind: ServiceEntry
+metadata:
+  name: example
+  namespace: default
+spec:
+  hosts:
+  - example.com
+  ports:
+  - number: 80
+    name: http
+    protocol: HTTP
+  resolution: DNS
+`,
+	})
+	gen := NewPilotConfigGenerator(cg.ConfigGen, cg.Env())
+	node := &core.Node{
+		Id: "sidecar~1.1.1.1~app.default~default.svc.cluster.local",
+		Metadata: model.NodeMetadata{
+			Namespace:    "default",
+			IstioVersion: "1.9.0",
+		}.ToStruct(),
+	}
+
+	clusters, err := gen.Generate(node, v3.ClusterType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, a := range clusters {
+		c := &cluster.Cluster{}
+		if err := ptypes.UnmarshalAny(a, c); err != nil {
+			t.Fatal(err)
+		}
+		found = found || c.Name == "outbound|80||example.com"
+	}
+	if !found {
+		t.Fatalf("expected the cluster of the service entry to be generated, got %v", clusters)
+	}
+
+	// Envoy holding what istiod generates matches it.
+	envoyDump, err := generatedConfigDump(gen, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	envoyResponse, err := json.Marshal(envoyDump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewGeneratorComparator(&bytes.Buffer{}, gen, node, envoyResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Matched {
+		t.Errorf("expected the generated config to match, got:\n%s", result.Text)
+	}
+}
@@ -17,46 +17,267 @@ package compare
 import (
 	"bytes"
 	"fmt"
+	"sort"
 	"strings"
 
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pmezard/go-difflib/difflib"
 )
 
-// ListenerDiff prints a diff between Istiod and Envoy listeners to the passed writer
-func (c *Comparator) ListenerDiff() error {
+// NormalizeFilterChains sets whether the filter chains of the listeners are sorted by their match criteria
+// before the listener diff, so that chains Envoy merely reordered do not show up as differences.
+func (c *Comparator) NormalizeFilterChains(enabled bool) {
+	c.normalizeFilterChains = enabled
+}
+
+// ListenerDiff prints a diff between Istiod and Envoy listeners to the passed writer, and returns it along
+// with the listeners that differ.
+func (c *Comparator) ListenerDiff() (*DiffResult, error) {
 	jsonm := &jsonpb.Marshaler{Indent: "   "}
 	envoyBytes, istiodBytes := &bytes.Buffer{}, &bytes.Buffer{}
 	envoyListenerDump, err := c.envoy.GetDynamicListenerDump(true)
+	if err == nil && c.normalizeFilterChains {
+		err = sortFilterChains(envoyListenerDump)
+	}
+	envoyRead := err == nil
 	if err != nil {
 		envoyBytes.WriteString(err.Error())
 	} else if err := jsonm.Marshal(envoyBytes, envoyListenerDump); err != nil {
-		return err
+		return nil, err
 	}
 	istiodListenerDump, err := c.istiod.GetDynamicListenerDump(true)
+	if err == nil && c.normalizeFilterChains {
+		err = sortFilterChains(istiodListenerDump)
+	}
+	istiodRead := err == nil
 	if err != nil {
 		istiodBytes.WriteString(err.Error())
 	} else if err := jsonm.Marshal(istiodBytes, istiodListenerDump); err != nil {
-		return err
-	}
-	diff := difflib.UnifiedDiff{
-		FromFile: "Istiod Listeners",
-		// Drop useOriginalDst since Envoy changed from hiding it to showing it and back, so
-		// mismatched versions can causes redundant diffs.
-		A:       dropLine(difflib.SplitLines(istiodBytes.String()), "useOriginalDst"),
-		ToFile:  "Envoy Listeners",
-		B:       dropLine(difflib.SplitLines(envoyBytes.String()), "useOriginalDst"),
-		Context: c.context,
+		return nil, err
 	}
+	// Drop useOriginalDst since Envoy changed from hiding it to showing it and back, so
+	// mismatched versions can causes redundant diffs.
+	istiodLines := dropLine(difflib.SplitLines(istiodBytes.String()), "useOriginalDst")
+	envoyLines := dropLine(difflib.SplitLines(envoyBytes.String()), "useOriginalDst")
+	diff := c.unifiedDiff(withRevision("Istiod Listeners", c.istiod), istiodLines, withRevision("Envoy Listeners", c.envoy), envoyLines)
 	text, err := difflib.GetUnifiedDiffString(diff)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result := &DiffResult{Matched: text == "", Text: text}
+	if envoyRead && istiodRead {
+		if result.Changes, err = listenerChanges(istiodListenerDump, envoyListenerDump); err != nil {
+			return nil, err
+		}
 	}
 	if text != "" {
 		fmt.Fprintln(c.w, text)
 	} else {
 		fmt.Fprintln(c.w, "Listeners Match")
 	}
+	return result, nil
+}
+
+// listenerChanges returns the listeners that differ between the Istiod and Envoy dumps, ignoring
+// useOriginalDst like ListenerDiff.
+func listenerChanges(istiod, envoy *adminapi.ListenersConfigDump) ([]ResourceChange, error) {
+	istiodLines, err := listenerLinesByName(istiod)
+	if err != nil {
+		return nil, err
+	}
+	envoyLines, err := listenerLinesByName(envoy)
+	if err != nil {
+		return nil, err
+	}
+	return resourceChanges(joinLines(istiodLines), joinLines(envoyLines)), nil
+}
+
+// joinLines returns the contents of each resource of lines.
+func joinLines(lines map[string][]string) map[string]string {
+	out := make(map[string]string, len(lines))
+	for name, l := range lines {
+		out[name] = strings.Join(l, "")
+	}
+	return out
+}
+
+// listenerLinesByName returns the lines of each listener of dump, keyed by listener name.
+func listenerLinesByName(dump *adminapi.ListenersConfigDump) (map[string][]string, error) {
+	names, err := dynamicListenerNames(dump)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string][]string, len(names))
+	for i, dl := range dump.DynamicListeners {
+		if out[names[i]], err = listenerLines(dl, true); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// StreamListenerDiff prints the diff between Istiod and Envoy listeners like ListenerDiff, one listener at a time,
+// which bounds the memory used for very large configurations. Its output only differs from the one of ListenerDiff
+// for changes within the context lines of the start or end of a listener, which make up separate hunks.
+func (c *Comparator) StreamListenerDiff() error {
+	envoyListenerDump, envoyErr := c.envoy.GetDynamicListenerDump(true)
+	istiodListenerDump, istiodErr := c.istiod.GetDynamicListenerDump(true)
+	if envoyErr != nil || istiodErr != nil ||
+		len(envoyListenerDump.DynamicListeners) == 0 || len(istiodListenerDump.DynamicListeners) == 0 {
+		// Error messages and empty dumps are small, no need to stream them.
+		_, err := c.ListenerDiff()
+		return err
+	}
+	if c.normalizeFilterChains {
+		if err := sortFilterChains(envoyListenerDump); err != nil {
+			return err
+		}
+		if err := sortFilterChains(istiodListenerDump); err != nil {
+			return err
+		}
+	}
+	istiodListeners, envoyListeners := istiodListenerDump.DynamicListeners, envoyListenerDump.DynamicListeners
+	istiodNames, err := dynamicListenerNames(istiodListenerDump)
+	if err != nil {
+		return err
+	}
+	envoyNames, err := dynamicListenerNames(envoyListenerDump)
+	if err != nil {
+		return err
+	}
+
+	d := &unifiedDiffWriter{
+		w:        c.w,
+		fromFile: withRevision("Istiod Listeners", c.istiod),
+		toFile:   withRevision("Envoy Listeners", c.envoy),
+		context:  c.context,
+	}
+	if c.direction == EnvoyToIstiod {
+		d.fromFile, d.toFile = d.toFile, d.fromFile
+	}
+	// The lines of the dumps around the listeners are the same on both sides.
+	header, footer, err := listenerDumpFrame(istiodListeners[0])
+	if err != nil {
+		return err
+	}
+	if err := d.diff(header, header); err != nil {
+		return err
+	}
+	// Both dumps are sorted by listener name, walk them together.
+	i, j := 0, 0
+	for i < len(istiodListeners) || j < len(envoyListeners) {
+		var a, b []string
+		takeIstiod := i < len(istiodListeners) && (j == len(envoyListeners) || istiodNames[i] <= envoyNames[j])
+		takeEnvoy := j < len(envoyListeners) && (i == len(istiodListeners) || envoyNames[j] <= istiodNames[i])
+		if takeIstiod {
+			if a, err = listenerLines(istiodListeners[i], i == len(istiodListeners)-1); err != nil {
+				return err
+			}
+			i++
+		}
+		if takeEnvoy {
+			if b, err = listenerLines(envoyListeners[j], j == len(envoyListeners)-1); err != nil {
+				return err
+			}
+			j++
+		}
+		if c.direction == EnvoyToIstiod {
+			a, b = b, a
+		}
+		if err := d.diff(a, b); err != nil {
+			return err
+		}
+	}
+	if err := d.diff(footer, footer); err != nil {
+		return err
+	}
+
+	if d.started {
+		// ListenerDiff ends the diff with an empty line.
+		_, err = fmt.Fprintln(c.w)
+	} else {
+		_, err = fmt.Fprintln(c.w, "Listeners Match")
+	}
+	return err
+}
+
+// dynamicListenerNames returns the names of the listeners of dump, in order.
+func dynamicListenerNames(dump *adminapi.ListenersConfigDump) ([]string, error) {
+	names := make([]string, 0, len(dump.DynamicListeners))
+	for _, dl := range dump.DynamicListeners {
+		l := &listener.Listener{}
+		if err := ptypes.UnmarshalAny(dl.ActiveState.Listener, l); err != nil {
+			return nil, err
+		}
+		names = append(names, l.Name)
+	}
+	return names, nil
+}
+
+// marshalSingleListener returns the lines of a listener dump holding only dl, as ListenerDiff marshals it.
+func marshalSingleListener(dl *adminapi.ListenersConfigDump_DynamicListener) ([]string, error) {
+	jsonm := &jsonpb.Marshaler{Indent: "   "}
+	out := &bytes.Buffer{}
+	if err := jsonm.Marshal(out, &adminapi.ListenersConfigDump{
+		DynamicListeners: []*adminapi.ListenersConfigDump_DynamicListener{dl},
+	}); err != nil {
+		return nil, err
+	}
+	return difflib.SplitLines(out.String()), nil
+}
+
+// listenerDumpFrame returns the lines of a marshaled listener dump before and after the listeners.
+func listenerDumpFrame(dl *adminapi.ListenersConfigDump_DynamicListener) ([]string, []string, error) {
+	lines, err := marshalSingleListener(dl)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lines[:2], lines[len(lines)-2:], nil
+}
+
+// listenerLines returns the lines of dl within a marshaled listener dump, without useOriginalDst like in
+// ListenerDiff. Listeners are separated by commas, the last one is not followed by one.
+func listenerLines(dl *adminapi.ListenersConfigDump_DynamicListener, last bool) ([]string, error) {
+	lines, err := marshalSingleListener(dl)
+	if err != nil {
+		return nil, err
+	}
+	lines = lines[2 : len(lines)-2]
+	if !last {
+		end := lines[len(lines)-1]
+		lines[len(lines)-1] = strings.TrimSuffix(end, "\n") + ",\n"
+	}
+	return dropLine(lines, "useOriginalDst"), nil
+}
+
+// sortFilterChains orders the filter chains of each listener in dump by their match criteria, then by name.
+func sortFilterChains(dump *adminapi.ListenersConfigDump) error {
+	for _, dl := range dump.DynamicListeners {
+		l := &listener.Listener{}
+		if err := ptypes.UnmarshalAny(dl.ActiveState.Listener, l); err != nil {
+			return err
+		}
+		matches := make(map[*listener.FilterChain]string, len(l.FilterChains))
+		for _, fc := range l.FilterChains {
+			matches[fc] = proto.MarshalTextString(fc.FilterChainMatch)
+		}
+		sort.SliceStable(l.FilterChains, func(i, j int) bool {
+			a, b := l.FilterChains[i], l.FilterChains[j]
+			if matches[a] != matches[b] {
+				return matches[a] < matches[b]
+			}
+			return a.Name < b.Name
+		})
+		any, err := ptypes.MarshalAny(l)
+		if err != nil {
+			return err
+		}
+		dl.ActiveState.Listener = any
+	}
 	return nil
 }
 
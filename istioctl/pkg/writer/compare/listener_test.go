@@ -0,0 +1,262 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+const reorderedListenerIstiodDump = `{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ListenersConfigDump",
+      "dynamicListeners": [
+        {
+          "activeState": {
+            "listener": {
+              "@type": "type.googleapis.com/envoy.config.listener.v3.Listener",
+              "name": "virtualInbound",
+              "filterChains": [
+                {
+                  "name": "inbound-http",
+                  "filterChainMatch": {"destinationPort": 8080}
+                },
+                {
+                  "name": "inbound-tls",
+                  "filterChainMatch": {"destinationPort": 8443, "transportProtocol": "tls"}
+                }
+              ]
+            }
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+const reorderedListenerEnvoyDump = `{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ListenersConfigDump",
+      "dynamicListeners": [
+        {
+          "activeState": {
+            "listener": {
+              "@type": "type.googleapis.com/envoy.config.listener.v3.Listener",
+              "name": "virtualInbound",
+              "filterChains": [
+                {
+                  "name": "inbound-tls",
+                  "filterChainMatch": {"destinationPort": 8443, "transportProtocol": "tls"}
+                },
+                {
+                  "name": "inbound-http",
+                  "filterChainMatch": {"destinationPort": 8080}
+                }
+              ]
+            }
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+func TestListenerDiffNormalizeFilterChains(t *testing.T) {
+	for _, normalize := range []bool{false, true} {
+		w := &bytes.Buffer{}
+		c, err := NewComparator(w, map[string][]byte{"istiod": []byte(reorderedListenerIstiodDump)}, []byte(reorderedListenerEnvoyDump))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.NormalizeFilterChains(normalize)
+		if _, err := c.ListenerDiff(); err != nil {
+			t.Fatal(err)
+		}
+		match := strings.Contains(w.String(), "Listeners Match")
+		if normalize && !match {
+			t.Errorf("expected reordered filter chains to match once normalized, got:\n%s", w.String())
+		}
+		if !normalize && match {
+			t.Errorf("expected reordered filter chains to differ without normalization, got:\n%s", w.String())
+		}
+	}
+}
+
+// syntheticListenerDump returns a dump of listeners with the given number of filter chains each. The port of
+// a filter chain in the middle of listener changed, if any, is changed.
+func syntheticListenerDump(t testing.TB, listeners, chains, changed int) *configdump.Wrapper {
+	t.Helper()
+	dump := &adminapi.ListenersConfigDump{}
+	for i := 0; i < listeners; i++ {
+		l := &listener.Listener{Name: fmt.Sprintf("listener-%05d", i)}
+		for j := 0; j < chains; j++ {
+			port := uint32(8000 + j)
+			if i == changed && j == chains/2 {
+				port = 9999
+			}
+			l.FilterChains = append(l.FilterChains, &listener.FilterChain{
+				Name:             fmt.Sprintf("chain-%d", j),
+				FilterChainMatch: &listener.FilterChainMatch{DestinationPort: &wrappers.UInt32Value{Value: port}},
+			})
+		}
+		la, err := ptypes.MarshalAny(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump.DynamicListeners = append(dump.DynamicListeners, &adminapi.ListenersConfigDump_DynamicListener{
+			ActiveState: &adminapi.ListenersConfigDump_DynamicListenerState{Listener: la},
+		})
+	}
+	da, err := ptypes.MarshalAny(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &configdump.Wrapper{ConfigDump: &adminapi.ConfigDump{Configs: []*any.Any{da}}}
+}
+
+func TestStreamListenerDiff(t *testing.T) {
+	testCases := []struct {
+		name    string
+		changed int
+	}{
+		{"match", -1},
+		{"first listener changed", 0},
+		{"middle listener changed", 2},
+		{"last listener changed", 4},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			buffered, streamed := &bytes.Buffer{}, &bytes.Buffer{}
+			c := &Comparator{
+				istiod:  syntheticListenerDump(t, 5, 5, -1),
+				envoy:   syntheticListenerDump(t, 5, 5, tt.changed),
+				context: 7,
+			}
+			c.w = buffered
+			if _, err := c.ListenerDiff(); err != nil {
+				t.Fatal(err)
+			}
+			c.w = streamed
+			if err := c.StreamListenerDiff(); err != nil {
+				t.Fatal(err)
+			}
+			if buffered.String() != streamed.String() {
+				t.Errorf("streamed diff differs from the buffered one.\nbuffered:\n%s\nstreamed:\n%s", buffered, streamed)
+			}
+			if match := strings.Contains(streamed.String(), "Listeners Match"); match != (tt.changed < 0) {
+				t.Errorf("unexpected diff:\n%s", streamed)
+			}
+		})
+	}
+}
+
+func TestListenerDiffResult(t *testing.T) {
+	testCases := []struct {
+		name    string
+		istiod  *configdump.Wrapper
+		envoy   *configdump.Wrapper
+		matched bool
+		changes []ResourceChange
+	}{
+		{
+			name:    "match",
+			istiod:  syntheticListenerDump(t, 5, 5, -1),
+			envoy:   syntheticListenerDump(t, 5, 5, -1),
+			matched: true,
+		},
+		{
+			name:    "listener changed",
+			istiod:  syntheticListenerDump(t, 5, 5, -1),
+			envoy:   syntheticListenerDump(t, 5, 5, 2),
+			changes: []ResourceChange{{Name: "listener-00002", Kind: Modified}},
+		},
+		{
+			name:    "listener missing from envoy",
+			istiod:  syntheticListenerDump(t, 5, 5, -1),
+			envoy:   syntheticListenerDump(t, 4, 5, -1),
+			changes: []ResourceChange{{Name: "listener-00004", Kind: IstiodOnly}},
+		},
+		{
+			name:    "listener missing from istiod",
+			istiod:  syntheticListenerDump(t, 4, 5, 0),
+			envoy:   syntheticListenerDump(t, 5, 5, -1),
+			changes: []ResourceChange{{Name: "listener-00000", Kind: Modified}, {Name: "listener-00004", Kind: EnvoyOnly}},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			c := &Comparator{istiod: tt.istiod, envoy: tt.envoy, w: w, context: 7}
+			result, err := c.ListenerDiff()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Matched != tt.matched {
+				t.Errorf("expected matched %v, got %v", tt.matched, result.Matched)
+			}
+			if tt.matched && result.Text != "" {
+				t.Errorf("expected no diff text, got:\n%s", result.Text)
+			}
+			if !tt.matched && !strings.Contains(w.String(), result.Text) {
+				t.Errorf("expected the diff text to be written, got:\n%s", w.String())
+			}
+			if !reflect.DeepEqual(result.Changes, tt.changes) {
+				t.Errorf("expected changes %v, got %v", tt.changes, result.Changes)
+			}
+		})
+	}
+}
+
+func benchmarkListenerDiff(b *testing.B, diff func(c *Comparator) error) {
+	c := &Comparator{
+		istiod:  syntheticListenerDump(b, 2000, 20, -1),
+		envoy:   syntheticListenerDump(b, 2000, 20, 1000),
+		w:       ioutil.Discard,
+		context: 7,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := diff(c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListenerDiff(b *testing.B) {
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkListenerDiff(b, func(c *Comparator) error {
+			_, err := c.ListenerDiff()
+			return err
+		})
+	})
+	b.Run("streamed", func(b *testing.B) {
+		benchmarkListenerDiff(b, (*Comparator).StreamListenerDiff)
+	})
+}
@@ -0,0 +1,56 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"fmt"
+	"strings"
+
+	"istio.io/api/label"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+// withRevision appends the Istio revision and version a config dump comes from to a diff label, if known.
+func withRevision(name string, dump *configdump.Wrapper) string {
+	if info := revisionInfo(dump); info != "" {
+		return fmt.Sprintf("%s (%s)", name, info)
+	}
+	return name
+}
+
+// revisionInfo describes the Istio revision and version a config dump comes from. They are read from
+// the node metadata of the bootstrap, falling back to the version info of the clusters.
+func revisionInfo(dump *configdump.Wrapper) string {
+	if dump == nil || dump.ConfigDump == nil {
+		return ""
+	}
+	var info []string
+	if bootstrapDump, err := dump.GetBootstrapConfigDump(); err == nil {
+		metadata := bootstrapDump.GetBootstrap().GetNode().GetMetadata().GetFields()
+		if rev := metadata["LABELS"].GetStructValue().GetFields()[label.IstioRev].GetStringValue(); rev != "" {
+			info = append(info, "revision "+rev)
+		}
+		if version := metadata["ISTIO_VERSION"].GetStringValue(); version != "" {
+			info = append(info, "version "+version)
+		}
+	}
+	if len(info) == 0 {
+		if clusterDump, err := dump.GetClusterConfigDump(); err == nil && clusterDump.VersionInfo != "" {
+			info = append(info, "version_info "+clusterDump.VersionInfo)
+		}
+	}
+	return strings.Join(info, ", ")
+}
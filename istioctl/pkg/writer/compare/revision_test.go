@@ -0,0 +1,131 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const stableDump = `{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.BootstrapConfigDump",
+      "bootstrap": {
+        "node": {
+          "id": "sidecar~10.244.0.12~productpage-v1-6b746f74dc-9stvs.default~default.svc.cluster.local",
+          "metadata": {
+            "ISTIO_VERSION": "1.8.2",
+            "LABELS": {
+              "app": "productpage",
+              "istio.io/rev": "stable"
+            }
+          }
+        }
+      }
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+      "versionInfo": "2021-01-18T10:00:00Z/12"
+    }
+  ]
+}`
+
+const canaryDump = `{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.BootstrapConfigDump",
+      "bootstrap": {
+        "node": {
+          "id": "sidecar~10.244.0.13~productpage-v1-7c8f9d6b5-x2xkq.default~default.svc.cluster.local",
+          "metadata": {
+            "ISTIO_VERSION": "1.9.0",
+            "LABELS": {
+              "app": "productpage",
+              "istio.io/rev": "canary"
+            }
+          }
+        }
+      }
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+      "versionInfo": "2021-01-18T10:05:00Z/3",
+      "dynamicActiveClusters": [
+        {
+          "cluster": {
+            "@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+            "name": "outbound|9080||reviews.default.svc.cluster.local"
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+const noBootstrapDump = `{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+      "versionInfo": "2021-01-18T10:00:00Z/12"
+    }
+  ]
+}`
+
+func TestDiffRevisionLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		istiod string
+		envoy  string
+		want   []string
+	}{
+		{
+			name:   "revisions from the bootstrap",
+			istiod: stableDump,
+			envoy:  canaryDump,
+			want: []string{
+				"--- Istiod Clusters (revision stable, version 1.8.2)",
+				"+++ Envoy Clusters (revision canary, version 1.9.0)",
+			},
+		},
+		{
+			name:   "version info without a bootstrap",
+			istiod: noBootstrapDump,
+			envoy:  canaryDump,
+			want: []string{
+				"--- Istiod Clusters (version_info 2021-01-18T10:00:00Z/12)",
+				"+++ Envoy Clusters (revision canary, version 1.9.0)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			c, err := NewComparator(w, map[string][]byte{"istiod": []byte(tt.istiod)}, []byte(tt.envoy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.ClusterDiff(); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(w.String(), want) {
+					t.Errorf("expected the diff to contain %q, got:\n%s", want, w.String())
+				}
+			}
+		})
+	}
+}
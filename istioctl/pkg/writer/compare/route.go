@@ -19,40 +19,47 @@ import (
 	"fmt"
 	"time"
 
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/pmezard/go-difflib/difflib"
 )
 
-// RouteDiff prints a diff between Istiod and Envoy routes to the passed writer
-func (c *Comparator) RouteDiff() error {
+// RouteDiff prints a diff between Istiod and Envoy routes to the passed writer, and returns it along
+// with the route configurations that differ.
+func (c *Comparator) RouteDiff() (*DiffResult, error) {
 	jsonm := &jsonpb.Marshaler{Indent: "   "}
 	envoyBytes, istiodBytes := &bytes.Buffer{}, &bytes.Buffer{}
 	envoyRouteDump, err := c.envoy.GetDynamicRouteDump(true)
+	envoyRead := err == nil
 	if err != nil {
 		envoyBytes.WriteString(err.Error())
 	} else if err := jsonm.Marshal(envoyBytes, envoyRouteDump); err != nil {
-		return err
+		return nil, err
 	}
 	istiodRouteDump, err := c.istiod.GetDynamicRouteDump(true)
+	istiodRead := err == nil
 	if err != nil {
 		istiodBytes.WriteString(err.Error())
 	} else if err := jsonm.Marshal(istiodBytes, istiodRouteDump); err != nil {
-		return err
-	}
-	diff := difflib.UnifiedDiff{
-		FromFile: "Istiod Routes",
-		A:        difflib.SplitLines(istiodBytes.String()),
-		ToFile:   "Envoy Routes",
-		B:        difflib.SplitLines(envoyBytes.String()),
-		Context:  c.context,
+		return nil, err
 	}
+	diff := c.unifiedDiff(withRevision("Istiod Routes", c.istiod), difflib.SplitLines(istiodBytes.String()),
+		withRevision("Envoy Routes", c.envoy), difflib.SplitLines(envoyBytes.String()))
 	text, err := difflib.GetUnifiedDiffString(diff)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	result := &DiffResult{Matched: text == "", Text: text}
+	if envoyRead && istiodRead {
+		if result.Changes, err = routeChanges(istiodRouteDump, envoyRouteDump); err != nil {
+			return nil, err
+		}
 	}
 	lastUpdatedStr := ""
 	if lastUpdated, err := c.envoy.GetLastUpdatedDynamicRouteTime(); err != nil {
-		return err
+		return nil, err
 	} else if lastUpdated != nil {
 		loc, err := time.LoadLocation(c.location)
 		if err != nil {
@@ -66,5 +73,36 @@ func (c *Comparator) RouteDiff() error {
 	} else {
 		fmt.Fprintf(c.w, "Routes Match%s\n", lastUpdatedStr)
 	}
-	return nil
+	return result, nil
+}
+
+// routeChanges returns the route configurations that differ between the Istiod and Envoy dumps.
+func routeChanges(istiod, envoy *adminapi.RoutesConfigDump) ([]ResourceChange, error) {
+	istiodRoutes, err := routesByName(istiod)
+	if err != nil {
+		return nil, err
+	}
+	envoyRoutes, err := routesByName(envoy)
+	if err != nil {
+		return nil, err
+	}
+	return resourceChanges(istiodRoutes, envoyRoutes), nil
+}
+
+// routesByName returns the marshaled dynamic route configurations of dump, keyed by name.
+func routesByName(dump *adminapi.RoutesConfigDump) (map[string]string, error) {
+	jsonm := &jsonpb.Marshaler{}
+	out := make(map[string]string, len(dump.DynamicRouteConfigs))
+	for _, drc := range dump.DynamicRouteConfigs {
+		r := &route.RouteConfiguration{}
+		if err := ptypes.UnmarshalAny(drc.RouteConfig, r); err != nil {
+			return nil, err
+		}
+		s, err := jsonm.MarshalToString(drc)
+		if err != nil {
+			return nil, err
+		}
+		out[r.Name] = s
+	}
+	return out, nil
 }
@@ -0,0 +1,102 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+
+	adminapi "github.com/envoyproxy/go-control-plane/envoy/admin/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+// syntheticRouteDump returns a config dump of routes route configurations, the one at index changed having a
+// different domain.
+func syntheticRouteDump(t testing.TB, routes, changed int) *configdump.Wrapper {
+	t.Helper()
+	dump := &adminapi.RoutesConfigDump{}
+	for i := 0; i < routes; i++ {
+		domain := "*"
+		if i == changed {
+			domain = "example.com"
+		}
+		ra, err := ptypes.MarshalAny(&route.RouteConfiguration{
+			Name:         fmt.Sprintf("route-%05d", i),
+			VirtualHosts: []*route.VirtualHost{{Name: "vhost", Domains: []string{domain}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dump.DynamicRouteConfigs = append(dump.DynamicRouteConfigs, &adminapi.RoutesConfigDump_DynamicRouteConfig{
+			RouteConfig: ra,
+		})
+	}
+	da, err := ptypes.MarshalAny(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &configdump.Wrapper{ConfigDump: &adminapi.ConfigDump{Configs: []*any.Any{da}}}
+}
+
+func TestRouteDiffResult(t *testing.T) {
+	testCases := []struct {
+		name    string
+		istiod  *configdump.Wrapper
+		envoy   *configdump.Wrapper
+		matched bool
+		changes []ResourceChange
+	}{
+		{
+			name:    "match",
+			istiod:  syntheticRouteDump(t, 3, -1),
+			envoy:   syntheticRouteDump(t, 3, -1),
+			matched: true,
+		},
+		{
+			name:    "route changed",
+			istiod:  syntheticRouteDump(t, 3, -1),
+			envoy:   syntheticRouteDump(t, 3, 0),
+			changes: []ResourceChange{{Name: "route-00000", Kind: Modified}},
+		},
+		{
+			name:    "route missing from istiod",
+			istiod:  syntheticRouteDump(t, 2, -1),
+			envoy:   syntheticRouteDump(t, 3, -1),
+			changes: []ResourceChange{{Name: "route-00002", Kind: EnvoyOnly}},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &bytes.Buffer{}
+			c := &Comparator{istiod: tt.istiod, envoy: tt.envoy, w: w, context: 7, location: "UTC"}
+			result, err := c.RouteDiff()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Matched != tt.matched {
+				t.Errorf("expected matched %v, got %v", tt.matched, result.Matched)
+			}
+			if !reflect.DeepEqual(result.Changes, tt.changes) {
+				t.Errorf("expected changes %v, got %v", tt.changes, result.Changes)
+			}
+		})
+	}
+}
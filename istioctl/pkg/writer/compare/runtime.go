@@ -0,0 +1,133 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/pmezard/go-difflib/difflib"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+// RuntimeDiff prints a diff between the runtime flags of the bootstrap in the Istiod and Envoy config dumps to
+// the passed writer. Only the static layers are known from a config dump; later layers override earlier ones.
+func (c *Comparator) RuntimeDiff() error {
+	envoyBytes, istiodBytes := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := writeRuntimeFlags(envoyBytes, c.envoy); err != nil {
+		return err
+	}
+	if err := writeRuntimeFlags(istiodBytes, c.istiod); err != nil {
+		return err
+	}
+	diff := c.unifiedDiff(withRevision("Istiod Runtime", c.istiod), difflib.SplitLines(istiodBytes.String()),
+		withRevision("Envoy Runtime", c.envoy), difflib.SplitLines(envoyBytes.String()))
+	text, err := difflib.GetUnifiedDiffString(diff)
+	if err != nil {
+		return err
+	}
+	if text != "" {
+		fmt.Fprintln(c.w, text)
+	} else {
+		fmt.Fprintln(c.w, "Runtime Flags Match")
+	}
+	return nil
+}
+
+// writeRuntimeFlags writes the effective runtime flags of the bootstrap in dump as sorted "flag: value" lines,
+// or the error getting the bootstrap.
+func writeRuntimeFlags(buf *bytes.Buffer, dump *configdump.Wrapper) error {
+	bootstrapDump, err := dump.GetBootstrapConfigDump()
+	if err != nil {
+		buf.WriteString(err.Error())
+		return nil
+	}
+	flags, err := runtimeFlags(bootstrapDump.Bootstrap)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(buf, "%s: %s\n", name, flags[name])
+	}
+	return nil
+}
+
+// runtimeFlags flattens the static layers of the layered runtime of b into flags keyed by their dotted path.
+func runtimeFlags(b *bootstrap.Bootstrap) (map[string]string, error) {
+	flags := map[string]string{}
+	for _, layer := range b.GetLayeredRuntime().GetLayers() {
+		if layer.GetStaticLayer() == nil {
+			continue
+		}
+		js, err := (&jsonpb.Marshaler{}).MarshalToString(layer.GetStaticLayer())
+		if err != nil {
+			return nil, err
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(js), &fields); err != nil {
+			return nil, err
+		}
+		flattenRuntime(flags, "", fields)
+	}
+	return flags, nil
+}
+
+// flattenRuntime adds the values of fields to flags. Null values leave the flag at its default, and values
+// Envoy parses the same, like true and "true", are normalized to one form.
+func flattenRuntime(flags map[string]string, prefix string, fields map[string]interface{}) {
+	for key, value := range fields {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch v := value.(type) {
+		case nil:
+			delete(flags, name)
+		case map[string]interface{}:
+			flattenRuntime(flags, name, v)
+		case string:
+			flags[name] = normalizeRuntimeValue(v)
+		case bool:
+			flags[name] = strconv.FormatBool(v)
+		case float64:
+			flags[name] = strconv.FormatFloat(v, 'g', -1, 64)
+		default:
+			out, _ := json.Marshal(v)
+			flags[name] = string(out)
+		}
+	}
+}
+
+// normalizeRuntimeValue returns the canonical form of a string runtime value that is a boolean or a number.
+func normalizeRuntimeValue(v string) string {
+	if v == "true" || v == "false" {
+		return v
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return strconv.Quote(v)
+}
@@ -0,0 +1,92 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// runtimeDump returns a config dump with a bootstrap whose runtime overrides the given flag value.
+func runtimeDump(overload interface{}) string {
+	return fmt.Sprintf(`{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.BootstrapConfigDump",
+      "bootstrap": {
+        "layeredRuntime": {
+          "layers": [
+            {
+              "name": "deprecation",
+              "staticLayer": {
+                "envoy.deprecated_features:envoy.config.listener.v3.Listener.hidden_envoy_deprecated_use_original_dst": true,
+                "re2.max_program_size.error_level": 1024
+              }
+            },
+            {
+              "name": "global config",
+              "staticLayer": {
+                "overload.global_downstream_max_connections": %v
+              }
+            },
+            {
+              "name": "admin",
+              "adminLayer": {}
+            }
+          ]
+        }
+      }
+    }
+  ]
+}`, overload)
+}
+
+func TestRuntimeDiff(t *testing.T) {
+	w := &bytes.Buffer{}
+	c, err := NewComparator(w, map[string][]byte{"istiod": []byte(runtimeDump(2147483647))}, []byte(runtimeDump(1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RuntimeDiff(); err != nil {
+		t.Fatal(err)
+	}
+	got := w.String()
+	for _, want := range []string{
+		"-overload.global_downstream_max_connections: 2147483647\n",
+		"+overload.global_downstream_max_connections: 1024\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected the diff to contain %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "-re2.max_program_size") || strings.Contains(got, "+re2.max_program_size") {
+		t.Errorf("expected only the overridden flag to differ, got:\n%s", got)
+	}
+
+	// A string value Envoy parses the same as the number is not a difference.
+	w.Reset()
+	c, err = NewComparator(w, map[string][]byte{"istiod": []byte(runtimeDump(`"1024"`))}, []byte(runtimeDump(1024)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RuntimeDiff(); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); got != "Runtime Flags Match\n" {
+		t.Errorf("expected the runtime flags to match, got:\n%s", got)
+	}
+}
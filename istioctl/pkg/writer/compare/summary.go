@@ -0,0 +1,129 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"fmt"
+	"sort"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	"github.com/golang/protobuf/ptypes"
+
+	"istio.io/istio/istioctl/pkg/util/configdump"
+)
+
+// SummaryDiff prints, for clusters, listeners and routes, the names of the resources only Istiod has,
+// only Envoy has, and both have to the passed writer, without comparing their contents
+func (c *Comparator) SummaryDiff() error {
+	for _, resources := range []struct {
+		kind  string
+		names func(*configdump.Wrapper) ([]string, error)
+	}{
+		{"Clusters", clusterNames},
+		{"Listeners", listenerNames},
+		{"Routes", routeNames},
+	} {
+		istiodNames, err := resources.names(c.istiod)
+		if err != nil {
+			fmt.Fprintf(c.w, "%s: unable to read the Istiod dump: %v\n", resources.kind, err)
+			continue
+		}
+		envoyNames, err := resources.names(c.envoy)
+		if err != nil {
+			fmt.Fprintf(c.w, "%s: unable to read the Envoy dump: %v\n", resources.kind, err)
+			continue
+		}
+		istiodOnly, envoyOnly, both := splitNames(istiodNames, envoyNames)
+		fmt.Fprintf(c.w, "%s: %d only in Istiod, %d only in Envoy, %d in both\n",
+			resources.kind, len(istiodOnly), len(envoyOnly), len(both))
+		for _, name := range istiodOnly {
+			fmt.Fprintf(c.w, "   Istiod only: %s\n", name)
+		}
+		for _, name := range envoyOnly {
+			fmt.Fprintf(c.w, "   Envoy only: %s\n", name)
+		}
+		for _, name := range both {
+			fmt.Fprintf(c.w, "   Both: %s\n", name)
+		}
+	}
+	return nil
+}
+
+// splitNames returns the sorted names only in a, only in b, and in both.
+func splitNames(a, b []string) (aOnly, bOnly, both []string) {
+	inB := make(map[string]bool, len(b))
+	for _, name := range b {
+		inB[name] = true
+	}
+	inA := make(map[string]bool, len(a))
+	for _, name := range a {
+		inA[name] = true
+		if inB[name] {
+			both = append(both, name)
+		} else {
+			aOnly = append(aOnly, name)
+		}
+	}
+	for _, name := range b {
+		if !inA[name] {
+			bOnly = append(bOnly, name)
+		}
+	}
+	sort.Strings(aOnly)
+	sort.Strings(bOnly)
+	sort.Strings(both)
+	return aOnly, bOnly, both
+}
+
+func clusterNames(dump *configdump.Wrapper) ([]string, error) {
+	clusterDump, err := dump.GetDynamicClusterDump(true)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(clusterDump.DynamicActiveClusters))
+	for _, dc := range clusterDump.DynamicActiveClusters {
+		c := &cluster.Cluster{}
+		if err := ptypes.UnmarshalAny(dc.Cluster, c); err != nil {
+			return nil, err
+		}
+		names = append(names, c.Name)
+	}
+	return names, nil
+}
+
+func listenerNames(dump *configdump.Wrapper) ([]string, error) {
+	listenerDump, err := dump.GetDynamicListenerDump(true)
+	if err != nil {
+		return nil, err
+	}
+	return dynamicListenerNames(listenerDump)
+}
+
+func routeNames(dump *configdump.Wrapper) ([]string, error) {
+	routeDump, err := dump.GetDynamicRouteDump(true)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(routeDump.DynamicRouteConfigs))
+	for _, drc := range routeDump.DynamicRouteConfigs {
+		r := &route.RouteConfiguration{}
+		if err := ptypes.UnmarshalAny(drc.RouteConfig, r); err != nil {
+			return nil, err
+		}
+		names = append(names, r.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,97 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const summaryIstiodDump = `{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+      "dynamicActiveClusters": [
+        {
+          "cluster": {
+            "@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+            "name": "outbound|9080||details.default.svc.cluster.local"
+          }
+        },
+        {
+          "cluster": {
+            "@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+            "name": "outbound|9080||reviews.default.svc.cluster.local"
+          }
+        }
+      ]
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ListenersConfigDump"
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.RoutesConfigDump"
+    }
+  ]
+}`
+
+const summaryEnvoyDump = `{
+  "configs": [
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ClustersConfigDump",
+      "dynamicActiveClusters": [
+        {
+          "cluster": {
+            "@type": "type.googleapis.com/envoy.config.cluster.v3.Cluster",
+            "name": "outbound|9080||details.default.svc.cluster.local"
+          }
+        }
+      ]
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.ListenersConfigDump"
+    },
+    {
+      "@type": "type.googleapis.com/envoy.admin.v3.RoutesConfigDump"
+    }
+  ]
+}`
+
+func TestSummaryDiff(t *testing.T) {
+	w := &bytes.Buffer{}
+	c, err := NewComparator(w, map[string][]byte{"istiod": []byte(summaryIstiodDump)}, []byte(summaryEnvoyDump))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SummaryDiff(); err != nil {
+		t.Fatal(err)
+	}
+	got := w.String()
+	for _, want := range []string{
+		"Clusters: 1 only in Istiod, 0 only in Envoy, 1 in both\n",
+		"   Istiod only: outbound|9080||reviews.default.svc.cluster.local\n",
+		"   Both: outbound|9080||details.default.svc.cluster.local\n",
+		"Listeners: 0 only in Istiod, 0 only in Envoy, 0 in both\n",
+		"Routes: 0 only in Istiod, 0 only in Envoy, 0 in both\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected the summary to contain %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "Envoy only:") {
+		t.Errorf("expected no Envoy only resources, got:\n%s", got)
+	}
+}
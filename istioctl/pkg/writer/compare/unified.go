@@ -0,0 +1,95 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package compare
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// unifiedDiffWriter writes a unified diff of two documents piece by piece, so that they never need to be held
+// in memory whole. Each pair of pieces is diffed on its own: the output is that of difflib for the whole
+// documents, except that hunks never span two pieces.
+type unifiedDiffWriter struct {
+	w                io.Writer
+	fromFile, toFile string
+	context          int
+
+	// lines of the documents already diffed
+	aLines, bLines int
+	// started is set once the file header is written, with the first hunk.
+	started bool
+}
+
+// diff writes the hunks of the next pieces a and b of the documents.
+func (d *unifiedDiffWriter) diff(a, b []string) error {
+	for _, g := range difflib.NewMatcher(a, b).GetGroupedOpCodes(d.context) {
+		if !d.started {
+			d.started = true
+			if _, err := fmt.Fprintf(d.w, "--- %s\n+++ %s\n", d.fromFile, d.toFile); err != nil {
+				return err
+			}
+		}
+		first, last := g[0], g[len(g)-1]
+		if _, err := fmt.Fprintf(d.w, "@@ -%s +%s @@\n", formatRangeUnified(d.aLines+first.I1, d.aLines+last.I2),
+			formatRangeUnified(d.bLines+first.J1, d.bLines+last.J2)); err != nil {
+			return err
+		}
+		for _, c := range g {
+			var lines []string
+			switch c.Tag {
+			case 'e':
+				lines = prefixLines(" ", a[c.I1:c.I2])
+			case 'd':
+				lines = prefixLines("-", a[c.I1:c.I2])
+			case 'i':
+				lines = prefixLines("+", b[c.J1:c.J2])
+			case 'r':
+				lines = append(prefixLines("-", a[c.I1:c.I2]), prefixLines("+", b[c.J1:c.J2])...)
+			}
+			for _, l := range lines {
+				if _, err := io.WriteString(d.w, l); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	d.aLines += len(a)
+	d.bLines += len(b)
+	return nil
+}
+
+func prefixLines(prefix string, lines []string) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		out = append(out, prefix+l)
+	}
+	return out
+}
+
+// formatRangeUnified converts a range to the "ed" format, as difflib does.
+func formatRangeUnified(start, stop int) string {
+	beginning := start + 1 // lines start numbering with one
+	length := stop - start
+	if length == 1 {
+		return fmt.Sprintf("%d", beginning)
+	}
+	if length == 0 {
+		beginning-- // empty ranges begin at line just before the range
+	}
+	return fmt.Sprintf("%d,%d", beginning, length)
+}
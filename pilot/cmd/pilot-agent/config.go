@@ -25,6 +25,7 @@ import (
 
 	"istio.io/api/annotation"
 	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/pkg/dns"
 	"istio.io/istio/pilot/pkg/util/network"
 	"istio.io/istio/pkg/bootstrap"
 	"istio.io/istio/pkg/config/constants"
@@ -153,3 +154,72 @@ func getPilotSan(discoveryAddress string) string {
 	}
 	return discHost
 }
+
+// dnsConfigFromEnv returns the configuration of local dns resolution set by the DNS_ environment variables.
+func dnsConfigFromEnv() (dns.DNSConfig, error) {
+	cfg := dns.DNSConfig{
+		ListenAddress:            dnsListenAddress,
+		ResolvConfPath:           dnsResolvConf,
+		SearchNamespaces:         splitList(dnsSearchNamespaces),
+		Upstreams:                splitList(dnsUpstreams),
+		TTL:                      dnsTTL,
+		Scope:                    splitList(dnsScope),
+		AuthoritativeServices:    dnsAuthoritativeServices,
+		EmptyHostFallback:        dnsEmptyHostFallback,
+		SOA:                      dnsSOA,
+		NoData:                   dnsNoData,
+		PodHosts:                 dnsPodHosts,
+		UpstreamCacheSize:        dnsUpstreamCacheSize,
+		UpstreamCacheStaleWindow: dnsUpstreamCacheStaleWindow,
+		UpstreamQPS:              dnsUpstreamQPS,
+		UpstreamBurst:            dnsUpstreamBurst,
+		UpstreamLimitPerSource:   dnsUpstreamLimitPerSource,
+		UpstreamConcurrency:      dnsUpstreamConcurrency,
+		UpstreamConcurrencyWait:  dnsUpstreamConcurrencyWait,
+		DNS64Prefix:              dns64Prefix,
+		MaxUDPAnswers:            dnsMaxUDPAnswers,
+		MaxTCPAnswers:            dnsMaxTCPAnswers,
+		FilterUnhealthy:          dnsFilterUnhealthy,
+		Locality:                 dnsLocality,
+		GlueRecords:              dnsGlueRecords,
+		AllowEmptyTable:          dnsAllowEmptyTable,
+	}
+	var ok bool
+	if cfg.IPFamilyPreference, ok = map[string]dns.IPFamilyPreference{
+		"":     dns.IPFamilyAny,
+		"ipv4": dns.IPFamilyPreferIPv4,
+		"ipv6": dns.IPFamilyPreferIPv6,
+	}[dnsIPFamilyPreference]; !ok {
+		return cfg, fmt.Errorf("invalid DNS_IP_FAMILY_PREFERENCE %q", dnsIPFamilyPreference)
+	}
+	if cfg.AddressOrdering, ok = map[string]dns.AddressOrdering{
+		"":            dns.AddressOrderingNone,
+		"interleaved": dns.AddressOrderingInterleaved,
+		"grouped":     dns.AddressOrderingGrouped,
+	}[dnsAddressOrdering]; !ok {
+		return cfg, fmt.Errorf("invalid DNS_ADDRESS_ORDERING %q", dnsAddressOrdering)
+	}
+	if cfg.MultiQuestion, ok = map[string]dns.MultiQuestionPolicy{
+		"":        dns.MultiQuestionFirst,
+		"formerr": dns.MultiQuestionFormErr,
+		"all":     dns.MultiQuestionAnswerAll,
+	}[dnsMultiQuestion]; !ok {
+		return cfg, fmt.Errorf("invalid DNS_MULTI_QUESTION %q", dnsMultiQuestion)
+	}
+	if cfg.ConflictPolicy, ok = map[string]dns.ConflictPolicy{
+		"":           dns.ConflictPolicyOverwrite,
+		"keep-first": dns.ConflictPolicyKeepFirst,
+		"merge":      dns.ConflictPolicyMerge,
+	}[dnsConflictPolicy]; !ok {
+		return cfg, fmt.Errorf("invalid DNS_CONFLICT_POLICY %q", dnsConflictPolicy)
+	}
+	return cfg, nil
+}
+
+// splitList returns the elements of a comma separated list, none if it is empty.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -19,7 +19,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -101,6 +103,25 @@ var (
 	xdsRootCA = env.RegisterStringVar("XDS_ROOT_CA", "",
 		"Explicitly set the root CA to expect for the XDS connection.").Get()
 
+	xdsAdditionalRootCAs = env.RegisterStringVar("XDS_ADDITIONAL_ROOT_CAS", "",
+		"Comma separated list of more root CAs to trust for the XDS connection, for instance during a CA migration.").Get()
+
+	xdsSystemRootCAs = env.RegisterBoolVar("XDS_SYSTEM_ROOT_CAS", false,
+		"If enabled, the system root CAs are trusted for the XDS connection too.").Get()
+
+	xdsServerIdentities = env.RegisterStringVar("XDS_SERVER_IDENTITIES", "",
+		"Comma separated SPIFFE identities istiod must present one of in its certificate, on top of being issued by "+
+			"a trusted root. Any identity is accepted if unset.").Get()
+
+	xdsClientCertKeyMetadata = env.RegisterStringVar("XDS_CLIENT_CERT_KEY_METADATA", istio_agent.MetadataClientCertKey,
+		"The proxy metadata key of the path of the file mounted client key for the XDS connection.").Get()
+
+	xdsClientCertChainMetadata = env.RegisterStringVar("XDS_CLIENT_CERT_CHAIN_METADATA", istio_agent.MetadataClientCertChain,
+		"The proxy metadata key of the path of the file mounted client certificate chain for the XDS connection.").Get()
+
+	xdsRootCertMetadata = env.RegisterStringVar("XDS_ROOT_CA_METADATA", istio_agent.MetadataXDSRootCert,
+		"The proxy metadata key of the path of the root CA for the XDS connection, used instead of XDS_ROOT_CA if set.").Get()
+
 	// set to "/etc/ssl/certs/ca-certificates.crt" on debian/ubuntu for ACME/public signed CA servers.
 	caRootCA = env.RegisterStringVar("CA_ROOT_CA", "",
 		"Explicitly set the root CA to expect for the CA connection.").Get()
@@ -149,6 +170,136 @@ var (
 	// This is a copy of the env var in the init code.
 	dnsCaptureByAgent = env.RegisterBoolVar("ISTIO_META_DNS_CAPTURE", false,
 		"If set to true, enable the capture of outgoing DNS packets on port 53, redirecting to istio-agent on :15053").Get()
+	dnsServe = env.RegisterBoolVar("DNS_SERVE", false,
+		"If set to true, the agent answers DNS queries on DNS_LISTEN_ADDRESS without capture, for workloads using it as "+
+			"their nameserver. DNS_UPSTREAMS or DNS_RESOLV_CONF must then be set.").Get()
+	dnsListenAddress = env.RegisterStringVar("DNS_LISTEN_ADDRESS", "",
+		"The address the agent answers DNS queries on, :15053 if unset.").Get()
+	dnsResolvConf = env.RegisterStringVar("DNS_RESOLV_CONF", "",
+		"The resolv.conf listing the nameservers the names unknown to the agent are forwarded to, "+
+			"/etc/resolv.conf if unset.").Get()
+	dnsSearchNamespaces = env.RegisterStringVar("DNS_SEARCH_NAMESPACES", "",
+		"Comma separated list of search namespaces used instead of those of the resolv.conf.").Get()
+	dnsUpstreams = env.RegisterStringVar("DNS_UPSTREAMS", "",
+		"Comma separated list of nameservers, IP addresses with an optional port, the names unknown to the agent are "+
+			"forwarded to instead of those of the resolv.conf.").Get()
+	dnsTTL = env.RegisterDurationVar("DNS_TTL", 0,
+		"The TTL of the records the agent answers for the hosts of the name table, 30s if zero.").Get()
+	dnsScope = env.RegisterStringVar("DNS_SCOPE", "",
+		"Comma separated list of the domains the agent answers for. Unknown names outside of them are refused. "+
+			"Every name is in scope if unset.").Get()
+	dnsAuthoritativeServices = env.RegisterBoolVar("DNS_AUTHORITATIVE_SERVICES", false,
+		"If enabled, the agent answers NXDOMAIN for the names under the cluster domain of no known service, rather "+
+			"than forwarding them.").Get()
+	dnsEmptyHostFallback = env.RegisterBoolVar("DNS_EMPTY_HOST_FALLBACK", false,
+		"If enabled, the names of the known services without address are forwarded upstream.").Get()
+	dnsSOA = env.RegisterBoolVar("DNS_SOA", false,
+		"If enabled, the agent is authoritative for the cluster zone, answering its SOA record.").Get()
+	dnsNoData = env.RegisterBoolVar("DNS_NODATA", false,
+		"If enabled, the agent answers NOERROR rather than NXDOMAIN for known hosts without records of the "+
+			"queried type.").Get()
+	dnsPodHosts = env.RegisterBoolVar("DNS_POD_HOSTS", false,
+		"If enabled, the pods of headless services are resolved by the same short names as their service.").Get()
+	dnsUpstreamCacheSize = env.RegisterIntVar("DNS_UPSTREAM_CACHE_SIZE", 0,
+		"The number of upstream DNS responses the agent caches for their TTL. Disabled if zero.").Get()
+	dnsUpstreamCacheStaleWindow = env.RegisterDurationVar("DNS_UPSTREAM_CACHE_STALE_WINDOW", 0,
+		"How long past their TTL cached upstream DNS responses are served while they are refreshed.").Get()
+	dnsUpstreamQPS = env.RegisterFloatVar("DNS_UPSTREAM_QPS", 0,
+		"The number of DNS queries per second the agent forwards upstream at most. Disabled if zero.").Get()
+	dnsUpstreamBurst = env.RegisterIntVar("DNS_UPSTREAM_BURST", 1,
+		"The number of DNS queries the agent forwards upstream at once before DNS_UPSTREAM_QPS applies.").Get()
+	dnsUpstreamLimitPerSource = env.RegisterBoolVar("DNS_UPSTREAM_LIMIT_PER_SOURCE", false,
+		"If enabled, DNS_UPSTREAM_QPS applies to each client address separately.").Get()
+	dnsUpstreamConcurrency = env.RegisterIntVar("DNS_UPSTREAM_CONCURRENCY", 0,
+		"The number of DNS queries the agent forwards upstream at once at most. Disabled if zero.").Get()
+	dnsUpstreamConcurrencyWait = env.RegisterDurationVar("DNS_UPSTREAM_CONCURRENCY_WAIT", 0,
+		"How long a DNS query waits for DNS_UPSTREAM_CONCURRENCY to allow it before failing.").Get()
+	dnsIPFamilyPreference = env.RegisterStringVar("DNS_IP_FAMILY_PREFERENCE", "",
+		"The address family served for dual-stack hosts: ipv4, ipv6, or both if unset.").Get()
+	dnsAddressOrdering = env.RegisterStringVar("DNS_ADDRESS_ORDERING", "",
+		"If set, A and AAAA queries for dual-stack hosts are answered with the records of both families, "+
+			"interleaved or grouped.").Get()
+	dns64Prefix = env.RegisterStringVar("DNS64_PREFIX", "",
+		"The NAT64 /96 prefix AAAA records are synthesized under for the known hosts with IPv4 addresses only.").Get()
+	dnsMaxUDPAnswers = env.RegisterIntVar("DNS_MAX_UDP_ANSWERS", 0,
+		"The number of address records in a DNS answer over UDP at most. Unlimited if zero.").Get()
+	dnsMaxTCPAnswers = env.RegisterIntVar("DNS_MAX_TCP_ANSWERS", 0,
+		"The number of address records in a DNS answer over TCP at most. Unlimited if zero.").Get()
+	dnsFilterUnhealthy = env.RegisterBoolVar("DNS_FILTER_UNHEALTHY", false,
+		"If enabled, the unhealthy endpoints are left out of the DNS answers, unless all of them are.").Get()
+	dnsLocality = env.RegisterStringVar("DNS_LOCALITY", "",
+		"The locality of the proxy, region/zone/subzone. The addresses of the endpoints sharing more of it are "+
+			"answered first.").Get()
+	dnsGlueRecords = env.RegisterBoolVar("DNS_GLUE_RECORDS", false,
+		"If enabled, the address records of CNAME targets are added to the additional section too.").Get()
+	dnsMultiQuestion = env.RegisterStringVar("DNS_MULTI_QUESTION", "",
+		"How DNS queries with more than one question are answered: formerr, all, or the first question if unset.").Get()
+	dnsConflictPolicy = env.RegisterStringVar("DNS_CONFLICT_POLICY", "",
+		"The answers for the names several hosts expand to: keep-first, merge, or the last host built if unset.").Get()
+	dnsAllowEmptyTable = env.RegisterBoolVar("DNS_ALLOW_EMPTY_TABLE", false,
+		"If enabled, name tables without any host replace a table with hosts.").Get()
+	xdsEventLogSize = env.RegisterIntVar("XDS_EVENT_LOG_SIZE", 0,
+		"The number of XDS messages proxied by the agent to keep a record of, served on /debug/xds-events of the "+
+			"status port. Disabled if zero.").Get()
+	xdsDebugLogSampleRate = env.RegisterIntVar("XDS_DEBUG_LOG_SAMPLE_RATE", 0,
+		"The agent logs the debug lines of one in every XDS_DEBUG_LOG_SAMPLE_RATE XDS messages it proxies. "+
+			"Every message is logged if not above one.").Get()
+	xdsCaptureFile = env.RegisterStringVar("XDS_CAPTURE_FILE", "",
+		"The path of a file the agent writes every XDS message it proxies to, for offline debugging. "+
+			"Disabled if empty.").Get()
+	xdsSlowSendThreshold = env.RegisterDurationVar("XDS_SLOW_SEND_THRESHOLD", 0,
+		"The duration after which a request sent by the agent to istiod is logged as slow. Disabled if zero.").Get()
+	xdsRequestDedupWindow = env.RegisterDurationVar("XDS_REQUEST_DEDUP_WINDOW", 0,
+		"How long the agent holds back a request from Envoy identical to the previous one of its type URL, "+
+			"rather than forwarding it to istiod. Disabled if zero.").Get()
+	xdsCheckTokenExpiry = env.RegisterBoolVar("XDS_CHECK_TOKEN_EXPIRY", false,
+		"If enabled, an expired JWT token file fails with a clear error instead of being sent to istiod.").Get()
+	xdsMaxDownstreamConnections = env.RegisterIntVar("XDS_MAX_DOWNSTREAM_CONNECTIONS", 1,
+		"The number of Envoy XDS streams the agent serves at once, each with its own connection to istiod. "+
+			"Raise it to serve both Envoys during a hot restart. A new stream beyond it closes the oldest one.").Get()
+	xdsRequestsBufferSize = env.RegisterIntVar("XDS_REQUESTS_BUFFER_SIZE", 10,
+		"The number of requests to istiod each agent XDS connection queues.").Get()
+	xdsResponsesBufferSize = env.RegisterIntVar("XDS_RESPONSES_BUFFER_SIZE", 10,
+		"The number of responses to Envoy each agent XDS connection queues.").Get()
+	xdsNameTableDebounce = env.RegisterDurationVar("XDS_NAME_TABLE_DEBOUNCE", 0,
+		"How long the agent waits for more DNS name tables from istiod after receiving one, so that a burst of "+
+			"them is only built once. Disabled if zero.").Get()
+	xdsWarmupTimeout = env.RegisterDurationVar("XDS_WARMUP_TIMEOUT", 0,
+		"If set, the agent holds back the configuration of Envoy until it received the DNS name table from istiod, "+
+			"or for this long at most. Disabled if zero.").Get()
+	xdsDisableNameTable = env.RegisterBoolVar("XDS_DISABLE_NAME_TABLE", false,
+		"If enabled, the agent does not request the name table from istiod, nor update the DNS server with it.").Get()
+	xdsCompressNameTable = env.RegisterBoolVar("XDS_COMPRESS_NAME_TABLE", false,
+		"If enabled, the agent asks istiod to send the name table gzip compressed.").Get()
+	xdsRetryBudgetRate = env.RegisterFloatVar("XDS_RETRY_BUDGET_RATE", 0,
+		"The number of connections per second the agent opens to istiod at most, however often Envoy reconnects. "+
+			"Connections beyond it are delayed. Disabled if zero.").Get()
+	xdsRetryBudgetBurst = env.RegisterIntVar("XDS_RETRY_BUDGET_BURST", 1,
+		"The number of connections the agent opens to istiod at once before XDS_RETRY_BUDGET_RATE applies.").Get()
+	xdsFastReconnect = env.RegisterBoolVar("XDS_FAST_RECONNECT", false,
+		"If enabled, when istiod closes the XDS stream cleanly, the agent reconnects to istiod and replays the "+
+			"last requests, rather than ending Envoy's stream.").Get()
+	xdsAuthMode = env.RegisterStringVar("XDS_AUTH_MODE", "",
+		"The credentials the agent authenticates to istiod with: mtls for the client certificate only, token for "+
+			"the JWT token only, or both. If unset, the JWT token is only sent if no certificates are provisioned.").Get()
+	xdsFailoverAddresses = env.RegisterStringVar("XDS_FAILOVER_ADDRESSES", "",
+		"Comma separated list of istiod addresses, in priority order, the agent connects to when the discovery "+
+			"address is unreachable. Each is verified under its own host name.").Get()
+	xdsDownstreamGracePeriod = env.RegisterDurationVar("XDS_DOWNSTREAM_GRACE_PERIOD", 0,
+		"How long the agent keeps its connection to istiod after Envoy disconnects cleanly, so that an Envoy "+
+			"reconnecting within it reuses the connection. Disabled if zero.").Get()
+	xdsCircuitBreakerThreshold = env.RegisterIntVar("XDS_CIRCUIT_BREAKER_THRESHOLD", 0,
+		"The number of consecutive connection failures to istiod, within XDS_CIRCUIT_BREAKER_WINDOW, after which "+
+			"the agent stops connecting for XDS_CIRCUIT_BREAKER_COOLDOWN. Disabled if zero.").Get()
+	xdsCircuitBreakerWindow = env.RegisterDurationVar("XDS_CIRCUIT_BREAKER_WINDOW", time.Minute,
+		"The period the connection failures counted by XDS_CIRCUIT_BREAKER_THRESHOLD happen within.").Get()
+	xdsCircuitBreakerCooldown = env.RegisterDurationVar("XDS_CIRCUIT_BREAKER_COOLDOWN", 30*time.Second,
+		"How long the agent stops connecting to istiod once XDS_CIRCUIT_BREAKER_THRESHOLD is reached.").Get()
+	xdsAllowedPeerUIDs = env.RegisterStringVar("XDS_ALLOWED_PEER_UIDS", "",
+		"Comma separated list of user IDs of the processes allowed to connect to the agent XDS socket. If neither "+
+			"this nor XDS_ALLOWED_PEER_GIDS is set, any process with access to the socket file may connect.").Get()
+	xdsAllowedPeerGIDs = env.RegisterStringVar("XDS_ALLOWED_PEER_GIDS", "",
+		"Comma separated list of group IDs of the processes allowed to connect to the agent XDS socket.").Get()
 
 	rootCmd = &cobra.Command{
 		Use:          "pilot-agent",
@@ -296,11 +447,55 @@ var (
 				XDSHeaders:   map[string]string{},
 			}
 			extractXDSHeadersFromEnv(agentConfig)
+			if xdsAdditionalRootCAs != "" {
+				agentConfig.XDSAdditionalRootCerts = strings.Split(xdsAdditionalRootCAs, ",")
+			}
+			agentConfig.XDSRootCertsFromSystem = xdsSystemRootCAs
+			if xdsServerIdentities != "" {
+				agentConfig.XDSServerIdentities = strings.Split(xdsServerIdentities, ",")
+			}
+			agentConfig.XDSClientCertKeyMetadata = xdsClientCertKeyMetadata
+			agentConfig.XDSClientCertChainMetadata = xdsClientCertChainMetadata
+			agentConfig.XDSRootCertMetadata = xdsRootCertMetadata
 			if proxyXDSViaAgent {
 				agentConfig.ProxyXDSViaAgent = true
 				agentConfig.DNSCapture = dnsCaptureByAgent
+				agentConfig.DNSServe = dnsServe
+				if agentConfig.DNSConfig, err = dnsConfigFromEnv(); err != nil {
+					return err
+				}
 				agentConfig.ProxyNamespace = podNamespace
 				agentConfig.ProxyDomain = role.DNSDomain
+				agentConfig.XDSEventLogSize = xdsEventLogSize
+				agentConfig.XDSDebugLogSampleRate = xdsDebugLogSampleRate
+				agentConfig.XDSCaptureFile = xdsCaptureFile
+				agentConfig.XDSSlowSendThreshold = xdsSlowSendThreshold
+				agentConfig.XDSRequestDedupWindow = xdsRequestDedupWindow
+				agentConfig.XDSCheckTokenExpiry = xdsCheckTokenExpiry
+				agentConfig.XDSMaxDownstreamConnections = xdsMaxDownstreamConnections
+				agentConfig.XDSRequestsBufferSize = xdsRequestsBufferSize
+				agentConfig.XDSResponsesBufferSize = xdsResponsesBufferSize
+				agentConfig.XDSNameTableDebounce = xdsNameTableDebounce
+				agentConfig.XDSWarmupTimeout = xdsWarmupTimeout
+				agentConfig.XDSAuthMode = istio_agent.XDSAuthMode(xdsAuthMode)
+				agentConfig.XDSDisableNameTable = xdsDisableNameTable
+				agentConfig.XDSCompressNameTable = xdsCompressNameTable
+				agentConfig.XDSFastReconnect = xdsFastReconnect
+				agentConfig.XDSRetryBudgetRate = xdsRetryBudgetRate
+				agentConfig.XDSRetryBudgetBurst = xdsRetryBudgetBurst
+				if xdsFailoverAddresses != "" {
+					agentConfig.XDSFailoverAddresses = strings.Split(xdsFailoverAddresses, ",")
+				}
+				agentConfig.DownstreamGracePeriod = xdsDownstreamGracePeriod
+				agentConfig.XDSCircuitBreakerThreshold = xdsCircuitBreakerThreshold
+				agentConfig.XDSCircuitBreakerWindow = xdsCircuitBreakerWindow
+				agentConfig.XDSCircuitBreakerCooldown = xdsCircuitBreakerCooldown
+				if agentConfig.XDSAllowedPeerUIDs, err = parseIDs(xdsAllowedPeerUIDs); err != nil {
+					return fmt.Errorf("invalid XDS_ALLOWED_PEER_UIDS: %v", err)
+				}
+				if agentConfig.XDSAllowedPeerGIDs, err = parseIDs(xdsAllowedPeerGIDs); err != nil {
+					return fmt.Errorf("invalid XDS_ALLOWED_PEER_GIDS: %v", err)
+				}
 			}
 			sa := istio_agent.NewAgent(&proxyConfig, agentConfig, secOpts)
 
@@ -327,7 +522,7 @@ var (
 
 			// If a status port was provided, start handling status probes.
 			if proxyConfig.StatusPort > 0 {
-				if err := initStatusServer(ctx, proxyIPv6, proxyConfig); err != nil {
+				if err := initStatusServer(ctx, proxyIPv6, proxyConfig, sa.DebugHandlers()); err != nil {
 					return err
 				}
 			}
@@ -404,7 +599,24 @@ func extractXDSHeadersFromEnv(config *istio_agent.AgentConfig) {
 	}
 }
 
-func initStatusServer(ctx context.Context, proxyIPv6 bool, proxyConfig meshconfig.ProxyConfig) error {
+// parseIDs parses a comma separated list of user or group IDs.
+func parseIDs(s string) ([]uint32, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ids []uint32
+	for _, f := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(f), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+func initStatusServer(ctx context.Context, proxyIPv6 bool, proxyConfig meshconfig.ProxyConfig,
+	debugHandlers map[string]http.Handler) error {
 	localHostAddr := localHostIPv4
 	if proxyIPv6 {
 		localHostAddr = localHostIPv6
@@ -416,6 +628,7 @@ func initStatusServer(ctx context.Context, proxyIPv6 bool, proxyConfig meshconfi
 		StatusPort:     uint16(proxyConfig.StatusPort),
 		KubeAppProbers: prober,
 		NodeType:       role.Type,
+		DebugHandlers:  debugHandlers,
 	})
 	if err != nil {
 		return err
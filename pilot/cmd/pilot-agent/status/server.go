@@ -88,6 +88,8 @@ type Config struct {
 	NodeType       model.NodeType
 	StatusPort     uint16
 	AdminPort      uint16
+	// DebugHandlers are additional agent debug endpoints, keyed by path. They only serve requests from localhost.
+	DebugHandlers map[string]http.Handler
 }
 
 // Server provides an endpoint for handling status probes.
@@ -100,6 +102,7 @@ type Server struct {
 	statusPort          uint16
 	lastProbeSuccessful bool
 	envoyStatsPort      int
+	debugHandlers       map[string]http.Handler
 }
 
 func init() {
@@ -127,6 +130,7 @@ func NewServer(config Config) (*Server, error) {
 			NodeType:      config.NodeType,
 		},
 		envoyStatsPort: 15090,
+		debugHandlers:  config.DebugHandlers,
 	}
 
 	// Enable prometheus server if its configured and a sidecar
@@ -206,6 +210,9 @@ func (s *Server) Run(ctx context.Context) {
 	mux.HandleFunc(`/stats/prometheus`, s.handleStats)
 	mux.HandleFunc(quitPath, s.handleQuit)
 	mux.HandleFunc("/app-health/", s.handleAppProbe)
+	for path, handler := range s.debugHandlers {
+		mux.Handle(path, localhostOnly(handler))
+	}
 
 	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.statusPort))
 	if err != nil {
@@ -272,6 +279,17 @@ func isRequestFromLocalhost(r *http.Request) bool {
 	return userIP.IsLoopback()
 }
 
+// localhostOnly restricts handler to the requests from localhost, as the status port listens on all interfaces.
+func localhostOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isRequestFromLocalhost(r) {
+			http.Error(w, "Only requests from localhost are allowed", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 type PrometheusScrapeConfiguration struct {
 	Scrape string `json:"scrape"`
 	Path   string `json:"path"`
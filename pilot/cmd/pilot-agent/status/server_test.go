@@ -588,3 +588,23 @@ func TestHandleQuit(t *testing.T) {
 		})
 	}
 }
+
+func TestDebugHandlersLocalhostOnly(t *testing.T) {
+	handler := localhostOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	for remoteAddr, expected := range map[string]int{
+		"127.0.0.1:15020": http.StatusOK,
+		"[::1]:15020":     http.StatusOK,
+		"10.0.0.1:15020":  http.StatusForbidden,
+		"":                http.StatusForbidden,
+	} {
+		req := httptest.NewRequest("POST", "/debug/resync", nil)
+		req.RemoteAddr = remoteAddr
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		if resp.Code != expected {
+			t.Errorf("%q: expected response code %v got %v", remoteAddr, expected, resp.Code)
+		}
+	}
+}
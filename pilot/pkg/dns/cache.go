@@ -0,0 +1,200 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/miekg/dns"
+
+	"istio.io/pkg/monitoring"
+)
+
+func init() {
+	monitoring.MustRegister(upstreamCacheReads)
+	monitoring.MustRegister(upstreamCacheEvictions)
+}
+
+var (
+	typeTag   = monitoring.MustCreateLabel("type")
+	reasonTag = monitoring.MustCreateLabel("reason")
+
+	upstreamCacheReads = monitoring.NewSum(
+		"dns_upstream_cache_reads",
+		"Total number of reads of the cache of upstream DNS responses, by type hit, stale or miss.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	upstreamCacheEvictions = monitoring.NewSum(
+		"dns_upstream_cache_evictions",
+		"Total number of evictions from the cache of upstream DNS responses, by reason expired or capacity.",
+		monitoring.WithLabels(reasonTag),
+	)
+
+	upstreamCacheHits     = upstreamCacheReads.With(typeTag.Value("hit"))
+	upstreamCacheStale    = upstreamCacheReads.With(typeTag.Value("stale"))
+	upstreamCacheMisses   = upstreamCacheReads.With(typeTag.Value("miss"))
+	upstreamCacheExpired  = upstreamCacheEvictions.With(reasonTag.Value("expired"))
+	upstreamCacheCapacity = upstreamCacheEvictions.With(reasonTag.Value("capacity"))
+)
+
+// staleTTLInSeconds is the TTL of the records of the stale responses served while they are refreshed, short so
+// that clients come back for the refreshed ones, as RFC 8767 recommends.
+const staleTTLInSeconds = 30
+
+// upstreamCache keeps the positive responses of the upstream nameservers, for the lowest TTL of their answers.
+// It holds at most a fixed number of responses, evicting the least recently used one when full. Expired
+// responses are evicted as they are looked up. A nil cache caches nothing.
+type upstreamCache struct {
+	mu    sync.Mutex
+	store simplelru.LRUCache
+	now   func() time.Time
+	// staleWindow is how long past their TTL the responses are still served, while they are refreshed in the
+	// background, so that clients do not wait on the upstream nameservers as popular names expire. Expired
+	// responses are not served if zero.
+	staleWindow time.Duration
+}
+
+type upstreamCacheEntry struct {
+	response *dns.Msg
+	stored   time.Time
+	expires  time.Time
+	// refreshing is set while the stale response is refreshed, so that a single refresh is made.
+	refreshing bool
+}
+
+func newUpstreamCache(maxEntries int) (*upstreamCache, error) {
+	c := &upstreamCache{now: time.Now}
+	store, err := simplelru.NewLRU(maxEntries, c.evict)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream cache size %d: %v", maxEntries, err)
+	}
+	c.store = store
+	return c, nil
+}
+
+// evict accounts for the responses leaving the cache. The lock is held.
+func (c *upstreamCache) evict(_ interface{}, value interface{}) {
+	if c.now().Before(value.(*upstreamCacheEntry).expires.Add(c.staleWindow)) {
+		upstreamCacheCapacity.Increment()
+	} else {
+		upstreamCacheExpired.Increment()
+	}
+}
+
+// upstreamCacheKey identifies the responses that answer req. The DNSSEC OK bit is part of it, as the response
+// includes signatures only if it is set.
+func upstreamCacheKey(req *dns.Msg) string {
+	q := req.Question[0]
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s/%d/%d/%t", strings.ToLower(q.Name), q.Qtype, q.Qclass, do)
+}
+
+// get returns the cached response to req, with the TTLs of its records lowered by the time spent in the cache,
+// or nil if there is none. Within the stale window past their TTL, responses are returned with short TTLs, and
+// refresh is set for the first caller getting it stale, who must refresh it and then call endRefresh.
+func (c *upstreamCache) get(req *dns.Msg) (response *dns.Msg, refresh bool) {
+	if c == nil || len(req.Question) != 1 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := upstreamCacheKey(req)
+	v, f := c.store.Get(key)
+	if !f {
+		upstreamCacheMisses.Increment()
+		return nil, false
+	}
+	entry := v.(*upstreamCacheEntry)
+	now := c.now()
+	stale := !now.Before(entry.expires)
+	if stale && !now.Before(entry.expires.Add(c.staleWindow)) {
+		c.store.Remove(key)
+		upstreamCacheMisses.Increment()
+		return nil, false
+	}
+
+	response = entry.response.Copy()
+	response.Id = req.Id
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				// the TTL of the OPT record holds flags
+				continue
+			}
+			switch {
+			case stale:
+				rr.Header().Ttl = staleTTLInSeconds
+			case rr.Header().Ttl > elapsed:
+				rr.Header().Ttl -= elapsed
+			default:
+				rr.Header().Ttl = 0
+			}
+		}
+	}
+	if !stale {
+		upstreamCacheHits.Increment()
+		return response, false
+	}
+	upstreamCacheStale.Increment()
+	refresh = !entry.refreshing
+	entry.refreshing = true
+	return response, refresh
+}
+
+// endRefresh lets the response to req be refreshed again, if the refresh did not replace it.
+func (c *upstreamCache) endRefresh(req *dns.Msg) {
+	if c == nil || len(req.Question) != 1 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if v, f := c.store.Peek(upstreamCacheKey(req)); f {
+		v.(*upstreamCacheEntry).refreshing = false
+	}
+}
+
+// add caches the response of an upstream nameserver to req, if it has answers that may be cached.
+func (c *upstreamCache) add(req *dns.Msg, response *dns.Msg) {
+	if c == nil || len(req.Question) != 1 || response == nil || response.Rcode != dns.RcodeSuccess ||
+		len(response.Answer) == 0 || response.Truncated {
+		return
+	}
+	ttl := response.Answer[0].Header().Ttl
+	for _, rr := range response.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	c.store.Add(upstreamCacheKey(req), &upstreamCacheEntry{
+		response: response.Copy(),
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	})
+}
@@ -0,0 +1,285 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.opencensus.io/stats/view"
+
+	nds "istio.io/istio/pilot/pkg/proto"
+)
+
+func TestUpstreamCacheTTL(t *testing.T) {
+	c, err := newUpstreamCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	hits, misses, expired := metricValue(t, "dns_upstream_cache_reads", "hit"),
+		metricValue(t, "dns_upstream_cache_reads", "miss"), metricValue(t, "dns_upstream_cache_evictions", "expired")
+
+	req := query("www.example.com.")
+	c.add(req, upstreamResponse(req, 30))
+	now = now.Add(10 * time.Second)
+	second := query("www.example.com.")
+	got, _ := c.get(second)
+	if got == nil {
+		t.Fatal("expected a cached response")
+	}
+	if got.Id != second.Id {
+		t.Errorf("expected the id of the query %d, got %d", second.Id, got.Id)
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != 20 {
+		t.Errorf("expected the ttl to be lowered to 20, got %d", ttl)
+	}
+
+	now = now.Add(20 * time.Second)
+	if got, _ := c.get(req); got != nil {
+		t.Fatalf("expected the response to expire, got %v", got)
+	}
+	if c.store.Len() != 0 {
+		t.Errorf("expected the expired response to be evicted, %d left", c.store.Len())
+	}
+	if d := metricValue(t, "dns_upstream_cache_reads", "hit") - hits; d != 1 {
+		t.Errorf("expected 1 hit, got %v", d)
+	}
+	if d := metricValue(t, "dns_upstream_cache_reads", "miss") - misses; d != 1 {
+		t.Errorf("expected 1 miss, got %v", d)
+	}
+	if d := metricValue(t, "dns_upstream_cache_evictions", "expired") - expired; d != 1 {
+		t.Errorf("expected 1 expired eviction, got %v", d)
+	}
+}
+
+func TestUpstreamCacheCapacity(t *testing.T) {
+	c, err := newUpstreamCache(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capacity := metricValue(t, "dns_upstream_cache_evictions", "capacity")
+
+	first, second, third := query("first.example.com."), query("second.example.com."), query("third.example.com.")
+	c.add(first, upstreamResponse(first, 30))
+	c.add(second, upstreamResponse(second, 30))
+	// first is now the most recently used
+	if got, _ := c.get(first); got == nil {
+		t.Fatal("expected first to be cached")
+	}
+	c.add(third, upstreamResponse(third, 30))
+
+	if got, _ := c.get(second); got != nil {
+		t.Error("expected second, the least recently used, to be evicted")
+	}
+	gotFirst, _ := c.get(first)
+	gotThird, _ := c.get(third)
+	if gotFirst == nil || gotThird == nil {
+		t.Error("expected first and third to be cached")
+	}
+	if d := metricValue(t, "dns_upstream_cache_evictions", "capacity") - capacity; d != 1 {
+		t.Errorf("expected 1 eviction at capacity, got %v", d)
+	}
+}
+
+func TestUpstreamCacheSkipsUncacheable(t *testing.T) {
+	c, err := newUpstreamCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nxdomain := query("nx.example.com.")
+	response := new(dns.Msg)
+	response.SetRcode(nxdomain, dns.RcodeNameError)
+	c.add(nxdomain, response)
+	zeroTTL := query("zero.example.com.")
+	c.add(zeroTTL, upstreamResponse(zeroTTL, 0))
+	if c.store.Len() != 0 {
+		t.Errorf("expected nothing to be cached, got %v", c.store.Keys())
+	}
+
+	var disabled *upstreamCache
+	disabled.add(zeroTTL, upstreamResponse(zeroTTL, 30))
+	if got, _ := disabled.get(zeroTTL); got != nil {
+		t.Error("expected a nil cache to cache nothing")
+	}
+}
+
+func TestServeDNSUpstreamCache(t *testing.T) {
+	c, err := newUpstreamCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &LocalDNSServer{
+		resolvConfServers: []string{"10.0.0.53:53"},
+		upstreamCache:     c,
+	}
+	h.UpdateLookupTable(&nds.NameTable{})
+	upstream := &fakeExchanger{answers: map[string][]dns.RR{
+		"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+	}}
+	p := newDNSProxyWithClient("udp", h, upstream)
+	for i := 0; i < 2; i++ {
+		w := &recordingResponseWriter{}
+		p.ServeDNS(w, query("www.example.com."))
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("expected an answer, got %v", w.msg)
+		}
+	}
+	if len(upstream.queried) != 1 {
+		t.Errorf("expected the second query to be answered from the cache, upstream got %v", upstream.queried)
+	}
+}
+
+func TestUpstreamCacheStaleWhileRevalidate(t *testing.T) {
+	c, err := newUpstreamCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.staleWindow = time.Minute
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	stale := metricValue(t, "dns_upstream_cache_reads", "stale")
+
+	req := query("www.example.com.")
+	c.add(req, upstreamResponse(req, 300))
+	now = now.Add(330 * time.Second)
+	got, refresh := c.get(req)
+	if got == nil || !refresh {
+		t.Fatalf("expected the stale response to be served and refreshed, got %v", got)
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != staleTTLInSeconds {
+		t.Errorf("expected the stale response to have a ttl of %d, got %d", staleTTLInSeconds, ttl)
+	}
+	// A single refresh is made at once.
+	if got, refresh := c.get(req); got == nil || refresh {
+		t.Fatalf("expected the stale response to be served without another refresh, got %v, refresh %v", got, refresh)
+	}
+	// A failed refresh lets the next read try again.
+	c.endRefresh(req)
+	if _, refresh := c.get(req); !refresh {
+		t.Fatal("expected another refresh after the failed one")
+	}
+	if d := metricValue(t, "dns_upstream_cache_reads", "stale") - stale; d != 3 {
+		t.Errorf("expected 3 stale reads, got %v", d)
+	}
+
+	// Beyond the stale window, the response is gone.
+	now = now.Add(time.Minute)
+	if got, _ := c.get(req); got != nil {
+		t.Fatalf("expected the response to expire beyond the stale window, got %v", got)
+	}
+}
+
+func TestServeDNSStaleWhileRevalidate(t *testing.T) {
+	c, err := newUpstreamCache(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.staleWindow = time.Minute
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	h := &LocalDNSServer{
+		resolvConfServers: []string{"10.0.0.53:53"},
+		upstreamCache:     c,
+	}
+	h.UpdateLookupTable(&nds.NameTable{})
+	upstream := &fakeExchanger{answers: map[string][]dns.RR{
+		"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+	}}
+	p := newDNSProxyWithClient("udp", h, upstream)
+	answer := func() string {
+		t.Helper()
+		w := &recordingResponseWriter{}
+		p.ServeDNS(w, query("www.example.com."))
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("expected an answer, got %v", w.msg)
+		}
+		return w.msg.Answer[0].(*dns.A).A.String()
+	}
+	answer()
+
+	// Within the stale window, the stale answer is served while the cache is refreshed in the background.
+	now = now.Add(time.Duration(defaultTTLInSeconds)*time.Second + 10*time.Second)
+	upstream.answers["www.example.com."] = a("www.example.com.", []net.IP{net.ParseIP("93.184.216.35").To4()})
+	if got := answer(); got != "93.184.216.34" {
+		t.Fatalf("expected the stale answer, got %s", got)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		v, _ := c.store.Peek(upstreamCacheKey(query("www.example.com.")))
+		refreshed := v != nil && now.Before(v.(*upstreamCacheEntry).expires)
+		c.mu.Unlock()
+		if refreshed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the background refresh to update the cache")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := answer(); got != "93.184.216.35" {
+		t.Fatalf("expected the refreshed answer, got %s", got)
+	}
+	if len(upstream.queried) != 2 {
+		t.Fatalf("expected a single background refresh, upstream got %v", upstream.queried)
+	}
+
+	// Beyond the stale window, the query waits for upstream.
+	now = now.Add(time.Duration(defaultTTLInSeconds)*time.Second + 2*time.Minute)
+	upstream.answers["www.example.com."] = a("www.example.com.", []net.IP{net.ParseIP("93.184.216.36").To4()})
+	if got := answer(); got != "93.184.216.36" {
+		t.Fatalf("expected the answer from upstream, got %s", got)
+	}
+	if len(upstream.queried) != 3 {
+		t.Fatalf("expected a synchronous query upstream, got %v", upstream.queried)
+	}
+}
+
+func query(host string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(host, dns.TypeA)
+	return req
+}
+
+func upstreamResponse(req *dns.Msg, ttl uint32) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetReply(req)
+	response.Answer = withTTL(a(req.Question[0].Name, []net.IP{net.ParseIP("1.2.3.4").To4()}), ttl)
+	return response
+}
+
+// metricValue returns the value of the sum metric name for the label value tag.
+func metricValue(t *testing.T, name string, tag string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for metric %s: %v", name, err)
+	}
+	for _, row := range rows {
+		if tag == "" && len(row.Tags) == 0 {
+			return row.Data.(*view.SumData).Value
+		}
+		for _, tg := range row.Tags {
+			if tg.Value == tag {
+				return row.Data.(*view.SumData).Value
+			}
+		}
+	}
+	return 0
+}
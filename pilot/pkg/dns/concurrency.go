@@ -0,0 +1,69 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// concurrencyLimiter bounds the number of queries forwarded upstream at once. Queries beyond the limit wait
+// for one of them to complete, up to a timeout. A nil limiter lets every query through.
+type concurrencyLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+	// inFlight is the number of slots taken.
+	inFlight int64
+}
+
+// newConcurrencyLimiter creates a limiter letting max queries through at once, the others waiting up to wait.
+func newConcurrencyLimiter(max int, wait time.Duration) (*concurrencyLimiter, error) {
+	if max <= 0 || wait < 0 {
+		return nil, fmt.Errorf("invalid DNS concurrency limit of %d queries with a wait of %v", max, wait)
+	}
+	return &concurrencyLimiter{slots: make(chan struct{}, max), wait: wait}, nil
+}
+
+// acquire takes a slot for a query, waiting for one to free up if needed. It returns false if none did in time,
+// in which case the query must not be forwarded.
+func (l *concurrencyLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		timer := time.NewTimer(l.wait)
+		defer timer.Stop()
+		select {
+		case l.slots <- struct{}{}:
+		case <-timer.C:
+			upstreamRejected.Increment()
+			return false
+		}
+	}
+	upstreamInFlight.Record(float64(atomic.AddInt64(&l.inFlight, 1)))
+	return true
+}
+
+// release frees the slot of a query acquire let through.
+func (l *concurrencyLimiter) release() {
+	if l == nil {
+		return
+	}
+	upstreamInFlight.Record(float64(atomic.AddInt64(&l.inFlight, -1)))
+	<-l.slots
+}
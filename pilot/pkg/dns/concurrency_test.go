@@ -0,0 +1,124 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// blockingExchanger is an upstream nameserver holding each query until release is closed.
+type blockingExchanger struct {
+	entered chan struct{}
+	release chan struct{}
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (b *blockingExchanger) Exchange(m *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	b.mu.Lock()
+	b.inFlight++
+	if b.inFlight > b.maxInFlight {
+		b.maxInFlight = b.inFlight
+	}
+	b.mu.Unlock()
+	b.entered <- struct{}{}
+	<-b.release
+	b.mu.Lock()
+	b.inFlight--
+	b.mu.Unlock()
+	response := new(dns.Msg)
+	response.SetReply(m)
+	response.Answer = a(m.Question[0].Name, []net.IP{net.ParseIP("93.184.216.34").To4()})
+	return response, 0, nil
+}
+
+func TestUpstreamConcurrencyLimit(t *testing.T) {
+	slots, err := newConcurrencyLimiter(2, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &LocalDNSServer{
+		resolvConfServers: []string{"10.0.0.53:53"},
+		upstreamSlots:     slots,
+	}
+	upstream := &blockingExchanger{entered: make(chan struct{}, 10), release: make(chan struct{})}
+	p := newDNSProxyWithClient("udp", h, upstream)
+	rejected := metricValue(t, "dns_upstream_queries_rejected", "")
+
+	send := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		w := &pipeResponseWriter{}
+		p.ServeDNS(w, req)
+		res, err := w.reply()
+		if err != nil {
+			t.Error(err)
+		}
+		return res
+	}
+	responses := make(chan *dns.Msg, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			responses <- send()
+		}()
+	}
+	<-upstream.entered
+	<-upstream.entered
+	if v := gaugeValue(t, "dns_upstream_queries_in_flight", ""); v != 2 {
+		t.Errorf("expected 2 queries in flight, got %v", v)
+	}
+
+	// Both slots are taken, the next query gives up after the wait.
+	if res := send(); res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL beyond the concurrency limit, got %v", res)
+	}
+	if d := metricValue(t, "dns_upstream_queries_rejected", "") - rejected; d != 1 {
+		t.Errorf("expected 1 rejected query, got %v", d)
+	}
+
+	close(upstream.release)
+	for i := 0; i < 2; i++ {
+		if res := <-responses; res.Rcode != dns.RcodeSuccess {
+			t.Errorf("expected an answer for the queries in flight, got %v", res)
+		}
+	}
+	if upstream.maxInFlight != 2 {
+		t.Errorf("expected at most 2 upstream queries at once, got %d", upstream.maxInFlight)
+	}
+	if v := gaugeValue(t, "dns_upstream_queries_in_flight", ""); v != 0 {
+		t.Errorf("expected no queries in flight, got %v", v)
+	}
+
+	// With the slots free again, queries go through.
+	if res := send(); res.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected an answer once under the limit again, got %v", res)
+	}
+}
+
+func TestConcurrencyLimiterInvalid(t *testing.T) {
+	if _, err := newConcurrencyLimiter(0, time.Second); err == nil {
+		t.Error("expected an error for a limit of zero")
+	}
+	if _, err := newConcurrencyLimiter(1, -time.Second); err == nil {
+		t.Error("expected an error for a negative wait")
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSConfig configures the local DNS server. The zero value of every field keeps the default behavior, so that
+// only the knobs that matter need to be set.
+type DNSConfig struct {
+	// ProxyNamespace is the namespace of the proxy, whose services are resolved by their short names.
+	ProxyNamespace string
+	// ProxyDomain is the DNS domain of the proxy, like ns1.svc.cluster.local.
+	ProxyDomain string
+	// ResolvConfPath is the resolv.conf the nameservers and search namespaces are read from.
+	// Defaults to /etc/resolv.conf.
+	ResolvConfPath string
+	// SearchNamespaces, if not empty, are used instead of the search namespaces of resolv.conf.
+	SearchNamespaces []string
+	// Upstreams, if not empty, are the nameservers unknown names are forwarded to, instead of those of
+	// resolv.conf. The port is 53 if not set.
+	Upstreams []string
+	// ListenAddress is the address the server answers queries on, over UDP and TCP. Defaults to :15053, where
+	// the captured DNS traffic is redirected. Workloads whose DNS is not captured use it as their nameserver.
+	ListenAddress string
+
+	// TTL of the records answered for the hosts of the name table that do not set their own, rounded down to
+	// the second. Defaults to 30s.
+	TTL time.Duration
+
+	// Scope lists the domains the server answers for. Unknown names outside of them are refused rather than
+	// forwarded upstream. Every name is in scope if empty.
+	Scope []string
+	// AuthoritativeServices answers NXDOMAIN for the names under the proxy domain that belong to no service of
+	// the registry, rather than forwarding them upstream.
+	AuthoritativeServices bool
+	// EmptyHostFallback forwards the names of the services without address upstream, rather than answering
+	// NXDOMAIN, or NODATA, for them.
+	EmptyHostFallback bool
+	// SOA makes the server authoritative for the cluster zone, answering SOA queries for it and adding its SOA
+	// record to the negative answers.
+	SOA bool
+	// NoData answers NOERROR with no records, rather than NXDOMAIN, for known hosts without records of the
+	// queried type.
+	NoData bool
+	// PodHosts resolves the pods of headless services by the same short forms as their service.
+	PodHosts bool
+
+	// UpstreamCacheSize is the number of upstream responses kept for their TTL. Nothing is cached if zero.
+	UpstreamCacheSize int
+	// UpstreamCacheStaleWindow is how long past their TTL cached responses are still served, while they are
+	// refreshed in the background.
+	UpstreamCacheStaleWindow time.Duration
+	// UpstreamQPS and UpstreamBurst cap the rate of queries forwarded upstream, per client address if
+	// UpstreamLimitPerSource is set. Nothing is limited if UpstreamQPS is zero.
+	UpstreamQPS            float64
+	UpstreamBurst          int
+	UpstreamLimitPerSource bool
+	// UpstreamConcurrency bounds the number of queries forwarded upstream at once, each waiting at most
+	// UpstreamConcurrencyWait for a free slot. Nothing is bounded if zero.
+	UpstreamConcurrency     int
+	UpstreamConcurrencyWait time.Duration
+
+	// IPFamilyPreference decides which address family is served for dual-stack hosts.
+	IPFamilyPreference IPFamilyPreference
+	// AddressOrdering, if set, answers A and AAAA queries for dual-stack hosts with the records of both families.
+	AddressOrdering AddressOrdering
+	// DNS64Prefix, if set, is the NAT64 /96 prefix, like 64:ff9b::/96, AAAA records are synthesized under for
+	// the known hosts with IPv4 addresses only.
+	DNS64Prefix string
+	// MaxUDPAnswers and MaxTCPAnswers cap the number of address records in an answer. Unlimited if zero.
+	MaxUDPAnswers int
+	MaxTCPAnswers int
+	// FilterUnhealthy leaves the unhealthy endpoints out of the answers, unless all of them are.
+	FilterUnhealthy bool
+	// Locality of the proxy, "/" separated. Addresses of endpoints sharing more of it come first.
+	Locality string
+	// GlueRecords adds the address records of the CNAME targets to the additional section too.
+	GlueRecords bool
+
+	// MultiQuestion decides how queries with more than one question are answered.
+	MultiQuestion MultiQuestionPolicy
+	// ConflictPolicy decides the answers for the names several hosts of the name table expand to.
+	ConflictPolicy ConflictPolicy
+	// AllowEmptyTable applies the name tables without any host even over a table with hosts.
+	AllowEmptyTable bool
+	// ResponseTransform, if set, can modify or drop the responses before they are written to the clients.
+	ResponseTransform ResponseTransform
+}
+
+// apply sets the knobs of cfg on h.
+func (cfg DNSConfig) apply(h *LocalDNSServer) error {
+	if cfg.TTL < 0 || cfg.TTL > time.Duration(math.MaxInt32)*time.Second {
+		return fmt.Errorf("invalid DNS TTL %v", cfg.TTL)
+	}
+	h.ttl = uint32(cfg.TTL / time.Second)
+
+	for _, domain := range cfg.Scope {
+		h.scope = append(h.scope, dns.Fqdn(strings.ToLower(domain)))
+	}
+	h.authoritativeServices = cfg.AuthoritativeServices
+	h.emptyHostFallback = cfg.EmptyHostFallback
+	h.soa = cfg.SOA
+	h.nodata = cfg.NoData
+	h.podHosts = cfg.PodHosts
+
+	var err error
+	if cfg.UpstreamCacheSize > 0 {
+		if h.upstreamCache, err = newUpstreamCache(cfg.UpstreamCacheSize); err != nil {
+			return err
+		}
+		h.upstreamCache.staleWindow = cfg.UpstreamCacheStaleWindow
+	}
+	if cfg.UpstreamQPS > 0 {
+		h.upstreamLimiter, err = newQueryLimiter(cfg.UpstreamQPS, cfg.UpstreamBurst, cfg.UpstreamLimitPerSource)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.UpstreamConcurrency > 0 {
+		if h.upstreamSlots, err = newConcurrencyLimiter(cfg.UpstreamConcurrency, cfg.UpstreamConcurrencyWait); err != nil {
+			return err
+		}
+	}
+
+	h.ipFamilyPreference = cfg.IPFamilyPreference
+	h.addressOrdering = cfg.AddressOrdering
+	if cfg.DNS64Prefix != "" {
+		if h.dns64Prefix, err = newDNS64Prefix(cfg.DNS64Prefix); err != nil {
+			return err
+		}
+	}
+	h.maxUDPAnswers = cfg.MaxUDPAnswers
+	h.maxTCPAnswers = cfg.MaxTCPAnswers
+	h.filterUnhealthy = cfg.FilterUnhealthy
+	h.locality = cfg.Locality
+	h.glueRecords = cfg.GlueRecords
+
+	h.multiQuestion = cfg.MultiQuestion
+	h.conflictPolicy = cfg.ConflictPolicy
+	h.allowEmptyTable = cfg.AllowEmptyTable
+	h.responseTransform = cfg.ResponseTransform
+	return nil
+}
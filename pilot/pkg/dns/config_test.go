@@ -0,0 +1,173 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	nds "istio.io/istio/pilot/pkg/proto"
+)
+
+func TestDNSConfig(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	conf := "nameserver 10.96.0.10\nsearch ns1.svc.cluster.local\n"
+	if err := ioutil.WriteFile(resolvConf, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	transform := func(req *dns.Msg, resp *dns.Msg) *dns.Msg { return resp }
+	h, err := newLocalDNSServer(DNSConfig{
+		ProxyNamespace:           "ns1",
+		ProxyDomain:              "ns1.svc.cluster.local",
+		ResolvConfPath:           resolvConf,
+		SearchNamespaces:         []string{"tenant1.svc.cluster.local"},
+		Upstreams:                []string{"10.0.0.53"},
+		TTL:                      time.Minute,
+		Scope:                    []string{"Cluster.Local"},
+		AuthoritativeServices:    true,
+		EmptyHostFallback:        true,
+		SOA:                      true,
+		NoData:                   true,
+		PodHosts:                 true,
+		UpstreamCacheSize:        10,
+		UpstreamCacheStaleWindow: time.Minute,
+		UpstreamQPS:              100,
+		UpstreamBurst:            10,
+		UpstreamLimitPerSource:   true,
+		UpstreamConcurrency:      5,
+		UpstreamConcurrencyWait:  time.Second,
+		IPFamilyPreference:       IPFamilyPreferIPv6,
+		AddressOrdering:          AddressOrderingGrouped,
+		DNS64Prefix:              "64:ff9b::/96",
+		MaxUDPAnswers:            4,
+		MaxTCPAnswers:            8,
+		FilterUnhealthy:          true,
+		Locality:                 "region/zone",
+		GlueRecords:              true,
+		MultiQuestion:            MultiQuestionFormErr,
+		ConflictPolicy:           ConflictPolicyMerge,
+		AllowEmptyTable:          true,
+		ResponseTransform:        transform,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	knobs := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"proxyDomain", h.proxyDomain, "svc.cluster.local"},
+		{"searchNamespaces", h.searchNamespaces, []string{"tenant1.svc.cluster.local"}},
+		{"nameservers", h.nameservers(), []string{"10.0.0.53:53"}},
+		{"ttl", h.ttl, uint32(60)},
+		{"scope", h.scope, []string{"cluster.local."}},
+		{"authoritativeServices", h.authoritativeServices, true},
+		{"emptyHostFallback", h.emptyHostFallback, true},
+		{"soa", h.soa, true},
+		{"nodata", h.nodata, true},
+		{"podHosts", h.podHosts, true},
+		{"upstreamCache", h.upstreamCache != nil && h.upstreamCache.staleWindow == time.Minute, true},
+		{"upstreamLimiter", h.upstreamLimiter != nil, true},
+		{"upstreamSlots", h.upstreamSlots != nil, true},
+		{"ipFamilyPreference", h.ipFamilyPreference, IPFamilyPreferIPv6},
+		{"addressOrdering", h.addressOrdering, AddressOrderingGrouped},
+		{"dns64Prefix", h.dns64Prefix.String(), "64:ff9b::/96"},
+		{"maxAnswers", []int{h.maxAnswers("udp"), h.maxAnswers("tcp")}, []int{4, 8}},
+		{"filterUnhealthy", h.filterUnhealthy, true},
+		{"locality", h.locality, "region/zone"},
+		{"glueRecords", h.glueRecords, true},
+		{"multiQuestion", h.multiQuestion, MultiQuestionFormErr},
+		{"conflictPolicy", h.conflictPolicy, ConflictPolicyMerge},
+		{"allowEmptyTable", h.allowEmptyTable, true},
+		{"responseTransform", h.responseTransform != nil, true},
+	}
+	for _, k := range knobs {
+		if !reflect.DeepEqual(k.got, k.want) {
+			t.Errorf("%s: got %v, want %v", k.name, k.got, k.want)
+		}
+	}
+
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"productpage.ns1.svc.cluster.local": {
+				Ips:       []string{"9.9.9.9", "fd00::9"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "productpage",
+			},
+		},
+	})
+	// The configured TTL and the preferred family are served.
+	resp := h.Resolve(dns.TypeAAAA, "productpage.ns1.svc.cluster.local.", false)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != 60 {
+		t.Errorf("expected a single AAAA record with a ttl of 60, got %v", resp.Answer)
+	}
+	resp = h.Resolve(dns.TypeA, "productpage.ns1.svc.cluster.local.", false)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("expected no data for the A records of a dual-stack host preferring IPv6, got %v", resp)
+	}
+	// Unknown services are denied with the SOA record of the zone, and names out of scope refused.
+	resp = h.Resolve(dns.TypeA, "details.ns1.svc.cluster.local.", true)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("expected NXDOMAIN with the SOA record of the zone, got %v", resp)
+	}
+	resp = h.Resolve(dns.TypeA, "www.example.com.", true)
+	if resp.Rcode != dns.RcodeRefused {
+		t.Errorf("expected a name out of scope to be refused, got %v", resp)
+	}
+
+	// The zero value keeps the defaults.
+	h, err = newLocalDNSServer(DNSConfig{
+		ProxyNamespace: "ns1",
+		ProxyDomain:    "ns1.svc.cluster.local",
+		ResolvConfPath: resolvConf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"productpage.ns1.svc.cluster.local": {Ips: []string{"9.9.9.9"}, Registry: "Kubernetes", Namespace: "ns1"},
+		},
+	})
+	resp = h.Resolve(dns.TypeA, "productpage.ns1.svc.cluster.local.", false)
+	if len(resp.Answer) != 1 || resp.Answer[0].Header().Ttl != defaultTTLInSeconds {
+		t.Errorf("expected a single A record with the default ttl, got %v", resp.Answer)
+	}
+	if h.upstreamCache != nil || h.upstreamLimiter != nil || h.upstreamSlots != nil || h.dns64Prefix != nil {
+		t.Errorf("expected no cache, limits or DNS64 prefix by default")
+	}
+
+	invalid := map[string]DNSConfig{
+		"negative ttl":           {TTL: -time.Second},
+		"ipv4 dns64 prefix":      {DNS64Prefix: "10.0.0.0/8"},
+		"/64 dns64 prefix":       {DNS64Prefix: "64:ff9b::/64"},
+		"malformed dns64 prefix": {DNS64Prefix: "64:ff9b::"},
+		"no burst":               {UpstreamQPS: 10},
+		"negative wait":          {UpstreamConcurrency: 5, UpstreamConcurrencyWait: -time.Second},
+	}
+	for name, cfg := range invalid {
+		cfg.ResolvConfPath = resolvConf
+		if _, err := newLocalDNSServer(cfg); err == nil {
+			t.Errorf("%s: expected the config to be rejected", name)
+		}
+	}
+}
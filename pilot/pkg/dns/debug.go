@@ -0,0 +1,68 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// lookupTableEntry is the JSON form of the records of a host of the lookup table.
+type lookupTableEntry struct {
+	A     []string `json:"a,omitempty"`
+	AAAA  []string `json:"aaaa,omitempty"`
+	CNAME []string `json:"cname,omitempty"`
+}
+
+// ServeHTTP dumps the lookup table as JSON, keyed by host. The name query parameter, if set, narrows the hosts
+// down to those containing it.
+func (h *LocalDNSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entries := map[string]*lookupTableEntry{}
+	if lp := h.lookupTable.Load(); lp != nil {
+		entries = lp.(*LookupTable).entries(strings.ToLower(r.URL.Query().Get("name")))
+	}
+	b, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// entries returns the records of the hosts containing filter, or of all the hosts if empty.
+func (table *LookupTable) entries(filter string) map[string]*lookupTableEntry {
+	out := map[string]*lookupTableEntry{}
+	for host := range table.allHosts {
+		if !strings.Contains(host, filter) {
+			continue
+		}
+		entry := &lookupTableEntry{}
+		for _, rr := range table.name4[host] {
+			entry.A = append(entry.A, rr.(*dns.A).A.String())
+		}
+		for _, rr := range table.name6[host] {
+			entry.AAAA = append(entry.AAAA, rr.(*dns.AAAA).AAAA.String())
+		}
+		for _, rr := range table.cname[host] {
+			entry.CNAME = append(entry.CNAME, rr.(*dns.CNAME).Target)
+		}
+		out[host] = entry
+	}
+	return out
+}
@@ -0,0 +1,77 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	nds "istio.io/istio/pilot/pkg/proto"
+)
+
+func TestServeLookupTable(t *testing.T) {
+	h := &LocalDNSServer{
+		proxyNamespace:   "ns1",
+		proxyDomain:      "svc.cluster.local",
+		proxyDomainParts: []string{"svc", "cluster", "local"},
+		searchNamespaces: []string{"ns1.svc.cluster.local"},
+	}
+	get := func(url string) map[string]*lookupTableEntry {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		var got map[string]*lookupTableEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	if got := get("/debug/dns-table"); len(got) != 0 {
+		t.Fatalf("expected no hosts before the first name table, got %v", got)
+	}
+
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"productpage.ns1.svc.cluster.local": {
+				Ips:       []string{"9.9.9.9", "2001:db8::1"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "productpage",
+			},
+			"www.google.com": {
+				Ips:      []string{"1.1.1.1"},
+				Registry: "External",
+			},
+		},
+	})
+	got := get("/debug/dns-table")
+	if want := (&lookupTableEntry{A: []string{"1.1.1.1"}}); !reflect.DeepEqual(got["www.google.com."], want) {
+		t.Errorf("www.google.com.: got %+v, want %+v", got["www.google.com."], want)
+	}
+	want := &lookupTableEntry{A: []string{"9.9.9.9"}, AAAA: []string{"2001:db8::1"}}
+	if !reflect.DeepEqual(got["productpage.ns1.svc.cluster.local."], want) {
+		t.Errorf("productpage.ns1.svc.cluster.local.: got %+v, want %+v", got["productpage.ns1.svc.cluster.local."], want)
+	}
+	want = &lookupTableEntry{CNAME: []string{"productpage.ns1.svc.cluster.local."}}
+	if !reflect.DeepEqual(got["productpage.ns1.svc.cluster.local.ns1.svc.cluster.local."], want) {
+		t.Errorf("search expanded host: got %+v, want %+v", got["productpage.ns1.svc.cluster.local.ns1.svc.cluster.local."], want)
+	}
+
+	filtered := get("/debug/dns-table?name=Google")
+	if len(filtered) != 1 || filtered["www.google.com."] == nil {
+		t.Errorf("expected only www.google.com. with the filter, got %v", filtered)
+	}
+}
@@ -15,9 +15,15 @@
 package dns
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
 
@@ -35,14 +41,156 @@ type LocalDNSServer struct {
 
 	resolvConfServers []string
 	searchNamespaces  []string
+	// upstreamServers, if not empty, are the nameservers names the server does not know are forwarded to,
+	// instead of the ones of resolv.conf.
+	upstreamServers []string
 	// The namespace where the proxy resides
 	// determines the hosts used for shortname resolution
 	proxyNamespace string
 	// Optimizations to save space and time
 	proxyDomain      string
 	proxyDomainParts []string
+
+	// ttl of the records of the hosts of the name table that do not set their own, in seconds.
+	// defaultTTLInSeconds if zero.
+	ttl uint32
+
+	// ipFamilyPreference decides which address family is served for dual-stack hosts.
+	ipFamilyPreference IPFamilyPreference
+	// addressOrdering, if set, answers A and AAAA queries for dual-stack hosts with the records of both families.
+	addressOrdering AddressOrdering
+
+	// Maximum number of address records in an answer over UDP and TCP. Unlimited if zero.
+	// Answers clipped over UDP have the truncation bit set, so that clients can retry over TCP.
+	maxUDPAnswers int
+	maxTCPAnswers int
+
+	// filterUnhealthy leaves the endpoints the name table marks unhealthy out of the answers,
+	// unless all of them are.
+	filterUnhealthy bool
+	// locality of the proxy, "/" separated. Addresses of endpoints sharing more of it come first in the answers.
+	locality string
+
+	// nodata answers NOERROR with no records, rather than NXDOMAIN, for known hosts without records of the
+	// queried type. Resolvers caching the NXDOMAIN would otherwise fail the types the host does have.
+	nodata bool
+
+	// glueRecords adds the address records of the CNAME targets we know to the additional section too,
+	// for clients that do not look for them in the answer section.
+	glueRecords bool
+
+	// dns64Prefix, if set, is the NAT64 /96 prefix AAAA records are synthesized under for the IPv4 addresses
+	// of known hosts without IPv6 ones, as DNS64 (RFC 6147) does for IPv6-only clients.
+	dns64Prefix *net.IPNet
+
+	// upstreamCache keeps the positive responses of the upstream nameservers. Nothing is cached if nil.
+	upstreamCache *upstreamCache
+	// soa makes the server authoritative for the cluster zone, the proxy domain without its leading svc label.
+	// Explicit SOA queries for the zone are answered, and the negative answers for names in the zone carry
+	// its SOA record in the authority section, as negative caching expects.
+	soa bool
+	// authoritativeServices answers NXDOMAIN for the names under the proxy domain that belong to no service of
+	// the registry, rather than forwarding them upstream, like the names search domain expansion makes up.
+	// Names under a known service, like the pods of headless services, are still forwarded. Only meant for
+	// registries holding every service of the cluster.
+	authoritativeServices bool
+	// emptyHostFallback forwards the names of the services of the registry that have no address upstream, rather
+	// than answering NXDOMAIN, or NODATA, for them as for the other known hosts without records of the queried
+	// type. The registry may be catching up with the endpoints of a service that the upstream nameservers
+	// already resolve.
+	emptyHostFallback bool
+	// podHosts resolves the entries of the name table for the pods of a service, like the pods of headless
+	// services (pod-0.service.ns.svc.cluster.local), by the same short forms as the service, keeping the pod label.
+	// Otherwise they are only resolved by their FQDN.
+	podHosts bool
+
+	// specialNames are answered before the names of the registry, and never forwarded upstream. Nil if none.
+	specialNames *LookupTable
+
+	// upstreamLimiter caps the rate of queries forwarded to the upstream nameservers. Queries over the limit
+	// are refused. Nothing is limited if nil.
+	upstreamLimiter *queryLimiter
+	// upstreamSlots bounds the number of queries forwarded to the upstream nameservers at once. Queries that
+	// find no free slot in time fail with SERVFAIL. Nothing is bounded if nil.
+	upstreamSlots *concurrencyLimiter
+
+	// multiQuestion decides how queries with more than one question are answered.
+	multiQuestion MultiQuestionPolicy
+
+	// scope lists the domains the server answers for, as lowercase FQDNs. Names in neither the registry nor
+	// the special names are only forwarded upstream if in one of them, and refused otherwise, for servers
+	// meant to resolve the cluster domain alone. Every name is in scope if empty.
+	scope []string
+
+	// conflictPolicy decides the answers for the names several hosts of the name table expand to. The conflicts
+	// are logged and counted whatever the policy.
+	conflictPolicy ConflictPolicy
+
+	// allowEmptyTable applies the name tables without any host even over a table with hosts. Otherwise they are
+	// refused, as more likely to come from a fault of istiod than from a mesh losing all its services at once.
+	allowEmptyTable bool
+
+	// responseTransform is applied to the responses, local or from upstream, before they are written to the
+	// client. Responses are written as is if nil.
+	responseTransform ResponseTransform
 }
 
+// ResponseTransform can modify the response to req before it is written to the client, or drop it by returning
+// nil, to enforce policies specific to an environment. The records of the response may be shared with the
+// lookup table and the upstream cache, so the ones modified must be copied first.
+type ResponseTransform func(req *dns.Msg, resp *dns.Msg) *dns.Msg
+
+// IPFamilyPreference controls the address family served for hosts that have both IPv4 and IPv6 addresses.
+type IPFamilyPreference int
+
+const (
+	// IPFamilyAny serves both A and AAAA records.
+	IPFamilyAny IPFamilyPreference = iota
+	// IPFamilyPreferIPv4 suppresses the AAAA records of hosts that also have IPv4 addresses.
+	IPFamilyPreferIPv4
+	// IPFamilyPreferIPv6 suppresses the A records of hosts that also have IPv6 addresses.
+	IPFamilyPreferIPv6
+)
+
+// AddressOrdering controls how the records of both families are ordered in the answers for dual-stack hosts,
+// for clients implementing happy eyeballs (RFC 8305) off a single query.
+type AddressOrdering int
+
+const (
+	// AddressOrderingNone only answers with the records of the queried family.
+	AddressOrderingNone AddressOrdering = iota
+	// AddressOrderingInterleaved alternates between AAAA and A records, starting with AAAA.
+	AddressOrderingInterleaved
+	// AddressOrderingGrouped answers with all the AAAA records, followed by all the A records.
+	AddressOrderingGrouped
+)
+
+// MultiQuestionPolicy controls the answer to queries with more than one question, which the spec allows but
+// clients hardly ever send.
+type MultiQuestionPolicy int
+
+const (
+	// MultiQuestionFirst only answers the first question.
+	MultiQuestionFirst MultiQuestionPolicy = iota
+	// MultiQuestionFormErr answers FORMERR.
+	MultiQuestionFormErr
+	// MultiQuestionAnswerAll answers every question, in a single response.
+	MultiQuestionAnswerAll
+)
+
+// ConflictPolicy controls the answers for the names several hosts of the name table expand to, like the short
+// names of same named services of different namespaces, or different clusters.
+type ConflictPolicy int
+
+const (
+	// ConflictPolicyOverwrite answers with the addresses of any one of the hosts, whichever is built last.
+	ConflictPolicyOverwrite ConflictPolicy = iota
+	// ConflictPolicyKeepFirst answers with the addresses of the first of the hosts in name order.
+	ConflictPolicyKeepFirst
+	// ConflictPolicyMerge answers with the addresses of all the hosts.
+	ConflictPolicyMerge
+)
+
 // Borrowed from https://github.com/coredns/coredns/blob/master/plugin/hosts/hostsfile.go
 type LookupTable struct {
 	// This table will be first looked up to see if the host is something that we got a Nametable entry for
@@ -60,37 +208,154 @@ type LookupTable struct {
 	// The cname records here (comprised of different variants of the hosts above,
 	// expanded by the search namespaces) pointing to the actual host.
 	cname map[string][]dns.RR
+
+	// ordering of the address records of both families for dual-stack hosts.
+	ordering AddressOrdering
+
+	// emptyHosts are the names of the hosts of the name table without any address. They are known hosts
+	// without records, unless emptyHostFallback forwards them upstream.
+	emptyHosts        map[string]struct{}
+	emptyHostFallback bool
+
+	// The weights of the A and AAAA records of name4 and name6, in the same order, for the hosts whose
+	// endpoints do not all weigh the same. The records of these hosts are shuffled in proportion to their
+	// weights for each answer, so that clients picking the first address spread as the weights say.
+	weight4 map[string]*recordWeights
+	weight6 map[string]*recordWeights
+}
+
+// recordWeights are the weights of the address records of a host, and their locality tiers: how much of the
+// locality of the proxy each shares, decreasing as the records are ordered. Records are only shuffled among
+// those of the same tier, so that the weights do not undo the locality ordering.
+type recordWeights struct {
+	weights []uint32
+	// tiers is nil without a locality, all the records are then in one tier.
+	tiers []int
 }
 
 const (
 	// In case the client decides to honor the TTL, keep it low so that we can always serve
-	// the latest IP for a host.
-	// TODO: make it configurable
+	// the latest IP for a host. Hosts may override it in the name table, and DNSConfig for all of them.
 	defaultTTLInSeconds = 30
+
+	// maxAnyAnswersPerFamily is the number of A and of AAAA records answered at most to queries of type ANY.
+	maxAnyAnswersPerFamily = 8
+
+	defaultResolvConfPath = "/etc/resolv.conf"
+
+	// defaultListenAddress is where the DNS traffic of the workload is redirected when captured.
+	defaultListenAddress = ":15053"
+
+	// maxScannedIPs is the number of addresses of a host up to which duplicates are found by scanning them.
+	maxScannedIPs = 16
 )
 
-func NewLocalDNSServer(proxyNamespace, proxyDomain string) (*LocalDNSServer, error) {
+// defaultSpecialNames are the names answered with the loopback addresses, whatever the registry or the
+// upstream nameservers say.
+var defaultSpecialNames = map[string][]string{
+	"localhost":             {"127.0.0.1", "::1"},
+	"localhost.localdomain": {"127.0.0.1", "::1"},
+}
+
+// NewLocalDNSServer creates the local DNS server. Names it does not know are resolved with the nameservers of
+// resolvConfPath, /etc/resolv.conf if empty, or with upstreams if not empty. Upstreams are IP addresses, with
+// an optional port defaulting to 53. The names expanded with a search namespace are answered with a CNAME
+// record to the name; searchNamespaces, if not empty, replaces the search namespaces of resolvConfPath for them.
+func NewLocalDNSServer(cfg DNSConfig) (*LocalDNSServer, error) {
+	h, err := newLocalDNSServer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	address := cfg.ListenAddress
+	if address == "" {
+		address = defaultListenAddress
+	}
+	if h.udpDNSProxy, err = newDNSProxy("udp", address, h); err != nil {
+		return nil, err
+	}
+	if h.tcpDNSProxy, err = newDNSProxy("tcp", address, h); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// newLocalDNSServer creates the local DNS server without binding its downstream sockets.
+func newLocalDNSServer(cfg DNSConfig) (*LocalDNSServer, error) {
+	upstreamServers, err := parseUpstreamServers(cfg.Upstreams)
+	if err != nil {
+		return nil, err
+	}
 	h := &LocalDNSServer{
-		proxyNamespace: proxyNamespace,
+		proxyNamespace:  cfg.ProxyNamespace,
+		upstreamServers: upstreamServers,
+	}
+	if err = cfg.apply(h); err != nil {
+		return nil, err
 	}
 
 	// proxyDomain could contain the namespace making it redundant.
 	// we just need the .svc.cluster.local piece
-	parts := strings.Split(proxyDomain, ".")
+	parts := strings.Split(cfg.ProxyDomain, ".")
 	if len(parts) > 0 {
-		if parts[0] == proxyNamespace {
+		if parts[0] == cfg.ProxyNamespace {
 			parts = parts[1:]
 		}
 		h.proxyDomainParts = parts
 		h.proxyDomain = strings.Join(parts, ".")
 	}
 
+	resolvConfPath := cfg.ResolvConfPath
+	if resolvConfPath == "" {
+		resolvConfPath = defaultResolvConfPath
+	}
 	// We will use the local resolv.conf for resolving unknown names.
-	dnsConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
-	if err != nil {
-		log.Warnf("failed to load /etc/resolv.conf: %v", err)
+	if err = h.loadResolvConf(resolvConfPath); err != nil {
 		return nil, err
 	}
+	if len(cfg.SearchNamespaces) > 0 {
+		// Only the search namespaces are overridden, the nameservers are still those of resolv.conf.
+		h.searchNamespaces = cfg.SearchNamespaces
+	}
+	h.specialNames = newSpecialNames(defaultSpecialNames, h.searchNamespaces)
+
+	return h, nil
+}
+
+// parseUpstreamServers returns the addresses of the nameservers of upstreams, with the port 53 if they have none.
+func parseUpstreamServers(upstreams []string) ([]string, error) {
+	var out []string
+	for _, upstream := range upstreams {
+		host, port := upstream, "53"
+		if h, p, err := net.SplitHostPort(upstream); err == nil {
+			host, port = h, p
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid upstream nameserver %q: not an IP address", upstream)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid upstream nameserver %q: invalid port %q", upstream, port)
+		}
+		out = append(out, net.JoinHostPort(host, port))
+	}
+	return out, nil
+}
+
+// nameservers returns the addresses of the upstream nameservers names the server does not know are forwarded to.
+func (h *LocalDNSServer) nameservers() []string {
+	if len(h.upstreamServers) > 0 {
+		return h.upstreamServers
+	}
+	return h.resolvConfServers
+}
+
+// loadResolvConf reads the upstream nameservers and search namespaces from a resolv.conf file.
+func (h *LocalDNSServer) loadResolvConf(path string) error {
+	dnsConfig, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		log.Warnf("failed to load %s: %v", path, err)
+		return err
+	}
 
 	// Unlike traditional DNS resolvers, we do not need to append the search
 	// namespace to a given query and try to resolve it. This is because the
@@ -105,15 +370,10 @@ func NewLocalDNSServer(proxyNamespace, proxyDomain string) (*LocalDNSServer, err
 		}
 		h.searchNamespaces = dnsConfig.Search
 	}
-
-	if h.udpDNSProxy, err = newDNSProxy("udp", h); err != nil {
-		return nil, err
+	if len(h.resolvConfServers) == 0 {
+		log.Warnf("no nameservers found in %s, names not known to the agent will fail to resolve", path)
 	}
-	if h.tcpDNSProxy, err = newDNSProxy("tcp", h); err != nil {
-		return nil, err
-	}
-
-	return h, nil
+	return nil
 }
 
 // StartDNS starts the DNS-over-UDP downstreamUDPServer.
@@ -122,78 +382,536 @@ func (h *LocalDNSServer) StartDNS() {
 	go h.tcpDNSProxy.start()
 }
 
+// UpdateLookupTable replaces the lookup table with the one built from nt. An empty nt is refused while the
+// current table has hosts, unless empty tables are allowed.
 func (h *LocalDNSServer) UpdateLookupTable(nt *nds.NameTable) {
+	if len(nt.GetTable()) == 0 && !h.allowEmptyTable && h.tableHosts() > 0 {
+		log.Warnf("refusing an empty name table, keeping the %d hosts of the current one", h.tableHosts())
+		tableEmptyUpdatesRefused.Increment()
+		return
+	}
+	start := time.Now()
+	lookupTable := h.buildLookupTable(nt)
+	h.lookupTable.Store(lookupTable)
+	tableUpdateDuration.Record(time.Since(start).Seconds())
+	recordTableMetrics(lookupTable)
+}
+
+// tableHosts returns the number of names in the current lookup table.
+func (h *LocalDNSServer) tableHosts() int {
+	lp := h.lookupTable.Load()
+	if lp == nil {
+		return 0
+	}
+	return len(lp.(*LookupTable).allHosts)
+}
+
+// buildLookupTable builds the lookup table of a name table. Name tables of large meshes hold tens of thousands
+// of hosts, and the previous table is still in use meanwhile: the maps are sized upfront from the number of
+// hosts rather than grown, and the buffers of each host are reused for the next.
+func (h *LocalDNSServer) buildLookupTable(nt *nds.NameTable) *LookupTable {
+	// Every host has at least its FQDN, and most of them a CNAME record when there are search namespaces.
+	hosts := len(nt.Table)
+	cnames := 0
+	if len(h.searchNamespaces) > 0 {
+		cnames = hosts
+	}
 	lookupTable := &LookupTable{
-		allHosts: map[string]struct{}{},
-		name4:    map[string][]dns.RR{},
-		name6:    map[string][]dns.RR{},
-		cname:    map[string][]dns.RR{},
+		allHosts:          make(map[string]struct{}, hosts+cnames),
+		name4:             make(map[string][]dns.RR, hosts),
+		name6:             map[string][]dns.RR{},
+		cname:             make(map[string][]dns.RR, cnames),
+		ordering:          h.addressOrdering,
+		emptyHostFallback: h.emptyHostFallback,
+	}
+	altHosts := make(map[string]struct{}, 4)
+	var ipv4, ipv6 []net.IP
+	order := make([]string, 0, len(nt.Table))
+	for host := range nt.Table {
+		order = append(order, host)
 	}
-	for host, ni := range nt.Table {
+	if h.conflictPolicy != ConflictPolicyOverwrite {
+		// The host a conflict is settled for must not depend on the order of the map.
+		sort.Strings(order)
+	}
+	var conflicts []string
+	conflictCount, firstConflict := 0, ""
+	for _, host := range order {
+		ni := nt.Table[host]
 		// Given a host
 		// if its a non-k8s host, store the host+. as the key with the pre-computed DNS RR records
 		// if its a k8s host, store all variants (i.e. shortname+., shortname+namespace+., fqdn+., etc.)
 		// shortname+. is only for hosts in current namespace
-		var altHosts map[string]struct{}
+		for alt := range altHosts {
+			delete(altHosts, alt)
+		}
 		if ni.Registry == "Kubernetes" {
-			altHosts = generateAltHosts(host, ni, h.proxyNamespace, h.proxyDomain, h.proxyDomainParts)
+			if !h.podHosts || !addPodAltHosts(altHosts, host, ni, h.proxyNamespace, h.proxyDomain, h.proxyDomainParts) {
+				addAltHosts(altHosts, host, ni, h.proxyNamespace, h.proxyDomain, h.proxyDomainParts)
+			}
 		} else {
-			altHosts = map[string]struct{}{host + ".": {}}
+			altHosts[host+"."] = struct{}{}
 		}
-		ipv4, ipv6 := separateIPtypes(ni.Ips)
+		// The records only keep the addresses, not the slices holding them.
+		ipv4, ipv6 = appendIPtypes(ipv4[:0], ipv6[:0], h.orderIPs(ni))
 		if len(ipv6) == 0 && len(ipv4) == 0 {
 			// malformed ips
+			if lookupTable.emptyHosts == nil {
+				lookupTable.emptyHosts = map[string]struct{}{}
+			}
+			for alt := range altHosts {
+				lookupTable.emptyHosts[alt] = struct{}{}
+			}
 			continue
 		}
-		lookupTable.buildDNSAnswers(altHosts, ipv4, ipv6, h.searchNamespaces)
+		if len(ipv4) > 0 && len(ipv6) > 0 {
+			// dual-stack host, only serve the preferred family if there is one.
+			switch h.ipFamilyPreference {
+			case IPFamilyPreferIPv4:
+				ipv6 = nil
+			case IPFamilyPreferIPv6:
+				ipv4 = nil
+			}
+		}
+		ttl := h.ttl
+		if ttl == 0 {
+			ttl = defaultTTLInSeconds
+		}
+		if ni.Ttl > 0 {
+			ttl = ni.Ttl
+		}
+		conflicts = lookupTable.conflicts(altHosts, conflicts[:0])
+		if len(conflicts) > 0 && conflictCount == 0 {
+			firstConflict = conflicts[0]
+		}
+		conflictCount += len(conflicts)
+		if len(conflicts) == 0 || h.conflictPolicy == ConflictPolicyOverwrite {
+			lookupTable.buildDNSAnswers(altHosts, ipv4, ipv6, h.searchNamespaces, ttl)
+			lookupTable.addWeights(altHosts, ni, ipv4, ipv6, h.locality)
+			continue
+		}
+		switch h.conflictPolicy {
+		case ConflictPolicyKeepFirst:
+			for _, name := range conflicts {
+				delete(altHosts, name)
+			}
+			lookupTable.buildDNSAnswers(altHosts, ipv4, ipv6, h.searchNamespaces, ttl)
+			lookupTable.addWeights(altHosts, ni, ipv4, ipv6, h.locality)
+		case ConflictPolicyMerge:
+			prev := make(map[string][2][]dns.RR, len(conflicts))
+			for _, name := range conflicts {
+				prev[name] = [2][]dns.RR{lookupTable.name4[name], lookupTable.name6[name]}
+			}
+			lookupTable.buildDNSAnswers(altHosts, ipv4, ipv6, h.searchNamespaces, ttl)
+			lookupTable.addWeights(altHosts, ni, ipv4, ipv6, h.locality)
+			for name, records := range prev {
+				lookupTable.mergeAddresses(name, records[0], records[1])
+			}
+		}
 	}
-	h.lookupTable.Store(lookupTable)
+	if conflictCount > 0 {
+		log.Warnf("%d names are shared by several hosts of the name table, like %s", conflictCount, firstConflict)
+	}
+	tableHostConflicts.Record(float64(conflictCount))
+	return lookupTable
+}
+
+// conflicts appends the names of altHosts that already have address records in the table to out.
+func (table *LookupTable) conflicts(altHosts map[string]struct{}, out []string) []string {
+	for name := range altHosts {
+		_, f4 := table.name4[name]
+		_, f6 := table.name6[name]
+		if f4 || f6 {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// mergeAddresses adds prev4 and prev6, the address records name had before it was built for another host, to
+// its records, leaving out the addresses it already has. Merged names are answered without weights, as the
+// weights of the endpoints of different hosts do not compare.
+func (table *LookupTable) mergeAddresses(name string, prev4, prev6 []dns.RR) {
+	if merged := mergeRecords(prev4, table.name4[name]); len(merged) > 0 {
+		table.name4[name] = merged
+	}
+	if merged := mergeRecords(prev6, table.name6[name]); len(merged) > 0 {
+		table.name6[name] = merged
+	}
+	delete(table.weight4, name)
+	delete(table.weight6, name)
+}
+
+// mergeRecords returns the address records of a, followed by those of b for addresses not in a.
+func mergeRecords(a, b []dns.RR) []dns.RR {
+	if len(a) == 0 {
+		return b
+	}
+	out := make([]dns.RR, 0, len(a)+len(b))
+	seen := make(map[string]struct{}, len(a)+len(b))
+	for _, records := range [][]dns.RR{a, b} {
+		for _, rr := range records {
+			var addr string
+			switch rec := rr.(type) {
+			case *dns.A:
+				addr = rec.A.String()
+			case *dns.AAAA:
+				addr = rec.AAAA.String()
+			default:
+				addr = rr.String()
+			}
+			if _, f := seen[addr]; !f {
+				seen[addr] = struct{}{}
+				out = append(out, rr)
+			}
+		}
+	}
+	return out
+}
+
+// newSpecialNames builds the table of the names answered locally with the addresses in names. The names
+// expanded with the first search namespace are answered too, with a CNAME record to the name.
+func newSpecialNames(names map[string][]string, searchNamespaces []string) *LookupTable {
+	table := &LookupTable{
+		allHosts: map[string]struct{}{},
+		name4:    map[string][]dns.RR{},
+		name6:    map[string][]dns.RR{},
+		cname:    map[string][]dns.RR{},
+	}
+	for name, ips := range names {
+		ipv4, ipv6 := separateIPtypes(ips)
+		table.buildDNSAnswers(map[string]struct{}{dns.Fqdn(strings.ToLower(name)): {}}, ipv4, ipv6, searchNamespaces,
+			defaultTTLInSeconds)
+	}
+	return table
 }
 
 // ServerDNS is the implementation of DNS interface
 func (h *LocalDNSServer) ServeDNS(proxy *dnsProxy, w dns.ResponseWriter, req *dns.Msg) {
+	response := h.resolve(proxy, w.RemoteAddr(), req, true)
+	if h.responseTransform != nil {
+		if response = h.responseTransform(req, response); response == nil {
+			log.Debugf("response to %v dropped by transform", req.Question)
+			return
+		}
+	}
+	_ = w.WriteMsg(response)
+}
+
+// Resolve answers a query for name of type qtype in process, as ServeDNS answers it over TCP, for the subsystems
+// of the agent. Names the server does not know are only forwarded to the upstream nameservers if forward is set,
+// and refused otherwise.
+func (h *LocalDNSServer) Resolve(qtype uint16, name string, forward bool) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	proxy := &dnsProxy{protocol: "tcp"}
+	if h.tcpDNSProxy != nil {
+		proxy.upstreamClient = h.tcpDNSProxy.upstreamClient
+	} else {
+		// The server does not listen itself, names are forwarded with a client of its own.
+		proxy.upstreamClient = &dns.Client{Net: "tcp"}
+	}
+	return h.resolve(proxy, nil, req, forward)
+}
+
+// resolve returns the response to req, sent by source over proxy. Unknown names are refused unless forward is set.
+func (h *LocalDNSServer) resolve(proxy *dnsProxy, source net.Addr, req *dns.Msg, forward bool) *dns.Msg {
 	var response *dns.Msg
 
-	if len(req.Question) == 0 {
+	if len(req.Question) > 1 && h.multiQuestion == MultiQuestionFormErr {
+		response = new(dns.Msg)
+		response.SetRcode(req, dns.RcodeFormatError)
+	} else if len(req.Question) > 1 && h.multiQuestion == MultiQuestionAnswerAll {
+		response = h.resolveAll(proxy, source, req, forward)
+	} else if len(req.Question) == 0 {
 		response = new(dns.Msg)
 		response.SetReply(req)
 		response.Rcode = dns.RcodeNameError
 	} else {
 		// we expect only one question in the query even though the spec allows many
-		// clients usually do not do more than one query either.
+		// clients usually do not do more than one query either. Unless the multi question
+		// policy says otherwise, the others are ignored.
 
-		lp := h.lookupTable.Load()
-		if lp == nil {
+		// This name will always end in a dot
+		hostname := strings.ToLower(req.Question[0].Name)
+		zone := h.authoritativeZone()
+		if zone != "" && req.Question[0].Qtype == dns.TypeSOA && hostname == zone {
 			response = new(dns.Msg)
 			response.SetReply(req)
-			response.Rcode = dns.RcodeNameError
-			_ = w.WriteMsg(response)
-			return
+			response.Authoritative = true
+			response.Answer = []dns.RR{soa(zone)}
+			return response
 		}
-		lookupTable := lp.(*LookupTable)
-		var answers []dns.RR
-
-		// This name will always end in a dot
-		hostname := strings.ToLower(req.Question[0].Name)
+		// Special names, like localhost, are neither looked up in the registry nor forwarded upstream.
+		lookupTable := h.specialNames
 		answers, hostFound := lookupTable.lookupHost(req.Question[0].Qtype, hostname)
+		if !hostFound && lookupTable != nil {
+			if _, special := lookupTable.allHosts[hostname]; special {
+				// Special names only have address records, there is no data of the other types.
+				response = new(dns.Msg)
+				response.SetReply(req)
+				return response
+			}
+		}
+		if !hostFound {
+			lp := h.lookupTable.Load()
+			if lp == nil {
+				response = new(dns.Msg)
+				response.SetReply(req)
+				response.Rcode = dns.RcodeNameError
+				return response
+			}
+			lookupTable = lp.(*LookupTable)
+			answers, hostFound = lookupTable.lookupHost(req.Question[0].Qtype, hostname)
+		}
+		if hostFound && len(answers) == 0 && req.Question[0].Qtype == dns.TypeAAAA && h.dns64Prefix != nil {
+			v4, _ := lookupTable.lookupHost(dns.TypeA, hostname)
+			answers = synthesizeAAAA(h.dns64Prefix, v4)
+		}
 
 		if hostFound {
 			response = new(dns.Msg)
 			response.SetReply(req)
+			if max := h.maxAnswers(proxy.protocol); max > 0 {
+				var clipped bool
+				answers, clipped = clipAddressRecords(answers, max)
+				// Over TCP there is no better transport to retry with, the client gets what fits the cap.
+				response.Truncated = clipped && proxy.protocol == "udp"
+			}
 			response.Answer = answers
-			if len(answers) == 0 {
+			if h.glueRecords {
+				glue := lookupTable.glue(req.Question[0].Qtype, answers)
+				if max := h.maxAnswers(proxy.protocol); max > 0 {
+					glue, _ = clipAddressRecords(glue, max)
+				}
+				response.Extra = append(response.Extra, glue...)
+			}
+			// The answer is not signed, so AD is never set. The EDNS0 options of the query, DO bit included,
+			// are echoed so validating resolvers see a server that understood them, rather than one stripping them.
+			if opt := req.IsEdns0(); opt != nil {
+				response.SetEdns0(opt.UDPSize(), opt.Do())
+			}
+			if len(answers) == 0 && !h.nodata {
 				// we found the host in our pre-compiled list of known hosts but
 				// there was no valid record for this query type.
-				// so return NXDOMAIN
+				// so return NXDOMAIN, unless NODATA was asked for.
 				response.Rcode = dns.RcodeNameError
 			}
+			if len(answers) == 0 && zone != "" && dns.IsSubDomain(zone, hostname) {
+				response.Authoritative = true
+				response.Ns = []dns.RR{soa(zone)}
+			}
+			if proxy.protocol == "udp" {
+				// Answers larger than the client takes over UDP are cut down, with the truncation bit set,
+				// rather than dropped silently, so that it retries over TCP to get all of them.
+				response.Truncate(udpSize(req))
+			}
+		} else if h.unknownService(lookupTable, hostname) {
+			response = new(dns.Msg)
+			response.SetReply(req)
+			response.Rcode = dns.RcodeNameError
+			if zone != "" {
+				response.Authoritative = true
+				response.Ns = []dns.RR{soa(zone)}
+			}
+		} else if !forward || !h.inScope(hostname) {
+			// Out of scope names are refused rather than forwarded, an NXDOMAIN would claim they do not exist.
+			response = new(dns.Msg)
+			response.SetReply(req)
+			response.Rcode = dns.RcodeRefused
 		} else {
 			// We did not find the host in our internal cache. Query upstream and return the response as is.
-			response = h.queryUpstream(proxy.upstreamClient, req)
+			var refresh bool
+			response, refresh = h.upstreamCache.get(req)
+			if refresh {
+				// The stale response is served right away, the next queries get the refreshed one.
+				go h.refreshUpstream(proxy, source, req.Copy())
+			}
+			if response == nil {
+				if h.upstreamLimiter.allow(source) {
+					response = h.queryUpstream(proxy.upstreamClient, req)
+					h.upstreamCache.add(req, response)
+				} else {
+					response = new(dns.Msg)
+					response.SetReply(req)
+					response.Rcode = dns.RcodeRefused
+				}
+			}
 		}
 	}
+	return response
+}
 
-	_ = w.WriteMsg(response)
+// resolveAll answers each question of req as if asked on its own, in a single response. The response succeeds
+// if any of the questions does, and fails like the first question otherwise.
+func (h *LocalDNSServer) resolveAll(proxy *dnsProxy, source net.Addr, req *dns.Msg, forward bool) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetReply(req)
+	response.Question = req.Question
+	for i, q := range req.Question {
+		single := req.Copy()
+		single.Question = []dns.Question{q}
+		r := h.resolve(proxy, source, single, forward)
+		if i == 0 || r.Rcode == dns.RcodeSuccess {
+			response.Rcode = r.Rcode
+		}
+		response.Truncated = response.Truncated || r.Truncated
+		response.Answer = append(response.Answer, r.Answer...)
+		response.Ns = append(response.Ns, r.Ns...)
+		for _, rr := range r.Extra {
+			// The EDNS0 options are echoed once, below.
+			if rr.Header().Rrtype != dns.TypeOPT {
+				response.Extra = append(response.Extra, rr)
+			}
+		}
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		response.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	if proxy.protocol == "udp" {
+		response.Truncate(udpSize(req))
+	}
+	return response
+}
+
+// inScope returns whether hostname, a lowercase FQDN, is within the domains the server answers for.
+func (h *LocalDNSServer) inScope(hostname string) bool {
+	if len(h.scope) == 0 {
+		return true
+	}
+	for _, domain := range h.scope {
+		if dns.IsSubDomain(domain, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownService returns true if the server is authoritative for the services of the proxy domain, and
+// hostname is under the proxy domain but the service it would belong to, named by its two labels right
+// under the domain, is not in table. Services of table without any address are known too under the
+// fallback to upstream for them.
+func (h *LocalDNSServer) unknownService(table *LookupTable, hostname string) bool {
+	if !h.authoritativeServices || h.proxyDomain == "" {
+		return false
+	}
+	domain := dns.Fqdn(strings.ToLower(h.proxyDomain))
+	if !dns.IsSubDomain(domain, hostname) {
+		return false
+	}
+	labels := dns.SplitDomainName(hostname)
+	n := len(labels) - dns.CountLabel(domain)
+	if n < 2 {
+		// The domain itself, or a namespace.
+		return false
+	}
+	service := dns.Fqdn(strings.Join(labels[n-2:], "."))
+	if _, found := table.allHosts[service]; found {
+		return false
+	}
+	if h.emptyHostFallback {
+		if _, empty := table.emptyHosts[service]; empty {
+			return false
+		}
+	}
+	return true
+}
+
+// newDNS64Prefix parses the NAT64 prefix AAAA records are synthesized under, which must be an IPv6 /96.
+func newDNS64Prefix(cidr string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ones, bits := prefix.Mask.Size(); ip.To4() != nil || bits != net.IPv6len*8 || ones != 96 {
+		return nil, fmt.Errorf("invalid DNS64 prefix %s: must be an IPv6 /96", cidr)
+	}
+	return prefix, nil
+}
+
+// synthesizeAAAA returns the AAAA records embedding the addresses of the A records in rrs under prefix.
+// The CNAME records of rrs are kept, so that the chain is the same. Nil if rrs has no A record.
+func synthesizeAAAA(prefix *net.IPNet, rrs []dns.RR) []dns.RR {
+	var out []dns.RR
+	synthesized := false
+	for _, rr := range rrs {
+		rec, ok := rr.(*dns.A)
+		if !ok {
+			out = append(out, rr)
+			continue
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, prefix.IP.To16()[:12])
+		copy(ip[12:], rec.A.To4())
+		out = append(out, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: rec.Hdr.Name, Rrtype: dns.TypeAAAA, Class: rec.Hdr.Class, Ttl: rec.Hdr.Ttl},
+			AAAA: ip,
+		})
+		synthesized = true
+	}
+	if !synthesized {
+		return nil
+	}
+	return out
+}
+
+// udpSize returns the largest UDP response the client of req takes.
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// authoritativeZone returns the zone the server is authoritative for, as a FQDN, or "" if none.
+func (h *LocalDNSServer) authoritativeZone() string {
+	if !h.soa || h.proxyDomain == "" {
+		return ""
+	}
+	parts := h.proxyDomainParts
+	if len(parts) > 1 && parts[0] == "svc" {
+		parts = parts[1:]
+	}
+	return dns.Fqdn(strings.ToLower(strings.Join(parts, ".")))
+}
+
+// soa returns a minimal SOA record for zone. Its minimum TTL caps how long negative answers are cached.
+func soa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: defaultTTLInSeconds},
+		Ns:      "ns.dns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  defaultTTLInSeconds,
+	}
+}
+
+func (h *LocalDNSServer) maxAnswers(protocol string) int {
+	if protocol == "tcp" {
+		return h.maxTCPAnswers
+	}
+	return h.maxUDPAnswers
+}
+
+// clipAddressRecords keeps at most max A/AAAA records in answers. Other records, such as the CNAME
+// pointing to the addresses, are always kept. Returns whether any record was dropped.
+func clipAddressRecords(answers []dns.RR, max int) ([]dns.RR, bool) {
+	out := make([]dns.RR, 0, len(answers))
+	addresses := 0
+	for _, rr := range answers {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA:
+			if addresses == max {
+				continue
+			}
+			addresses++
+		}
+		out = append(out, rr)
+	}
+	return out, len(out) < len(answers)
 }
 
 func (h *LocalDNSServer) Close() {
@@ -201,13 +919,44 @@ func (h *LocalDNSServer) Close() {
 	h.tcpDNSProxy.close()
 }
 
+// refreshUpstream queries the upstream nameservers for req in the background, replacing the stale response cached.
+func (h *LocalDNSServer) refreshUpstream(proxy *dnsProxy, source net.Addr, req *dns.Msg) {
+	defer h.upstreamCache.endRefresh(req)
+	if !h.upstreamLimiter.allow(source) {
+		return
+	}
+	h.upstreamCache.add(req, h.queryUpstream(proxy.upstreamClient, req))
+}
+
+// queryUpstream forwards the query as is, DNSSEC OK bit included, and returns the first response with answers
+// unmodified. If no upstream has answers, the last response received is returned, so that signed denials
+// of existence reach the client intact.
 // TODO: Figure out how to send parallel queries to all nameservers
-func (h *LocalDNSServer) queryUpstream(upstreamClient *dns.Client, req *dns.Msg) *dns.Msg {
+func (h *LocalDNSServer) queryUpstream(upstreamClient upstreamExchanger, req *dns.Msg) *dns.Msg {
+	nameservers := h.nameservers()
+	if len(nameservers) == 0 {
+		// There is no one to ask, the name may well exist.
+		response := new(dns.Msg)
+		response.SetReply(req)
+		response.Rcode = dns.RcodeServerFailure
+		return response
+	}
+	if !h.upstreamSlots.acquire() {
+		// Too many queries upstream already, fail rather than pile more on.
+		response := new(dns.Msg)
+		response.SetReply(req)
+		response.Rcode = dns.RcodeServerFailure
+		return response
+	}
+	defer h.upstreamSlots.release()
 	var response *dns.Msg
-	for _, upstream := range h.resolvConfServers {
+	for _, upstream := range nameservers {
 		cResponse, _, err := upstreamClient.Exchange(req, upstream)
-		if err == nil && len(cResponse.Answer) > 0 {
-			response = cResponse
+		if err != nil {
+			continue
+		}
+		response = cResponse
+		if len(cResponse.Answer) > 0 {
 			break
 		}
 	}
@@ -219,29 +968,125 @@ func (h *LocalDNSServer) queryUpstream(upstreamClient *dns.Client, req *dns.Msg)
 	return response
 }
 
+// orderIPs returns the ips of a host, without the unhealthy ones if filtering is enabled, and
+// ordered by how close their locality is to the proxy.
+func (h *LocalDNSServer) orderIPs(ni *nds.NameTable_NameInfo) []string {
+	if len(ni.Endpoints) == 0 {
+		return ni.Ips
+	}
+	endpoints := make(map[string]*nds.NameTable_Endpoint, len(ni.Endpoints))
+	for _, ep := range ni.Endpoints {
+		endpoints[ep.Ip] = ep
+	}
+	ips := ni.Ips
+	if h.filterUnhealthy {
+		healthy := make([]string, 0, len(ips))
+		for _, ip := range ips {
+			if !endpoints[ip].GetUnhealthy() {
+				healthy = append(healthy, ip)
+			}
+		}
+		// With no healthy endpoint left, answering with all of them beats failing the lookup.
+		if len(healthy) > 0 {
+			ips = healthy
+		}
+	}
+	if h.locality == "" {
+		return ips
+	}
+	ordered := append([]string{}, ips...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return localityMatch(h.locality, endpoints[ordered[i]].GetLocality()) >
+			localityMatch(h.locality, endpoints[ordered[j]].GetLocality())
+	})
+	return ordered
+}
+
+// localityMatch returns the number of leading region, zone and subzone parts two localities share.
+func localityMatch(a, b string) int {
+	if a == "" || b == "" {
+		return 0
+	}
+	ap, bp := strings.Split(a, "/"), strings.Split(b, "/")
+	n := 0
+	for n < len(ap) && n < len(bp) && ap[n] == bp[n] {
+		n++
+	}
+	return n
+}
+
 func separateIPtypes(ips []string) (ipv4, ipv6 []net.IP) {
+	return appendIPtypes(nil, nil, ips)
+}
+
+// appendIPtypes appends the IPv4 and IPv6 addresses of ips to ipv4 and ipv6. An address listed several times
+// is only appended once, where it first appears.
+func appendIPtypes(ipv4, ipv6 []net.IP, ips []string) ([]net.IP, []net.IP) {
+	from4, from6 := len(ipv4), len(ipv6)
+	// Scanning the addresses appended is cheaper than a set for the few addresses most hosts have.
+	var seen map[string]struct{}
+	if len(ips) > maxScannedIPs {
+		seen = make(map[string]struct{}, len(ips))
+	}
 	for _, ip := range ips {
 		addr := net.ParseIP(ip)
 		if addr == nil {
 			continue
 		}
-		if addr.To4() != nil {
-			ipv4 = append(ipv4, addr.To4())
+		v4 := addr.To4()
+		if v4 != nil {
+			addr = v4
+		}
+		if seen != nil {
+			if _, dup := seen[string(addr)]; dup {
+				continue
+			}
+			seen[string(addr)] = struct{}{}
+		}
+		if v4 != nil {
+			if seen == nil && containsIP(ipv4[from4:], v4) {
+				continue
+			}
+			ipv4 = append(ipv4, v4)
 		} else {
+			if seen == nil && containsIP(ipv6[from6:], addr) {
+				continue
+			}
 			ipv6 = append(ipv6, addr)
 		}
 	}
-	return
+	return ipv4, ipv6
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func generateAltHosts(hostname string, nameinfo *nds.NameTable_NameInfo, proxyNamespace, proxyDomain string,
 	proxyDomainParts []string) map[string]struct{} {
 	out := make(map[string]struct{})
+	addAltHosts(out, hostname, nameinfo, proxyNamespace, proxyDomain, proxyDomainParts)
+	return out
+}
+
+// addAltHosts adds the names hostname is known by to out.
+func addAltHosts(out map[string]struct{}, hostname string, nameinfo *nds.NameTable_NameInfo, proxyNamespace, proxyDomain string,
+	proxyDomainParts []string) {
 	out[hostname+"."] = struct{}{}
 	// do not generate alt hostnames if the service is in a different domain (i.e. cluster) than the proxy
 	// as we have no way to resolve conflicts on name.namespace entries across clusters of different domains
 	if proxyDomain == "" || !strings.HasSuffix(hostname, proxyDomain) {
-		return out
+		return
+	}
+	// The name table comes from istiod, but a malformed entry must not take down the agent. Without all the
+	// pieces, only the FQDN can be resolved.
+	if nameinfo.Shortname == "" || nameinfo.Namespace == "" || len(proxyDomainParts) == 0 || proxyDomainParts[0] == "" {
+		return
 	}
 	out[nameinfo.Shortname+"."+nameinfo.Namespace+"."] = struct{}{}
 	if proxyNamespace == nameinfo.Namespace {
@@ -252,15 +1097,44 @@ func generateAltHosts(hostname string, nameinfo *nds.NameTable_NameInfo, proxyNa
 	// as some people have very long proxy domains with multiple dots
 	// For now, we will generate just one more domain (which is usually the .svc piece).
 	out[nameinfo.Shortname+"."+nameinfo.Namespace+"."+proxyDomainParts[0]+"."] = struct{}{}
-	return out
+}
+
+// addPodAltHosts adds the names hostname is known by to out if it is the name of a pod of the service of
+// nameinfo, and reports whether it is. The names are those of the service, prefixed with the pod label:
+// pod-0.service.ns., pod-0.service.ns.svc., and pod-0.service. in the namespace of the proxy.
+func addPodAltHosts(out map[string]struct{}, hostname string, nameinfo *nds.NameTable_NameInfo, proxyNamespace, proxyDomain string,
+	proxyDomainParts []string) bool {
+	if proxyDomain == "" || nameinfo.Shortname == "" || nameinfo.Namespace == "" || len(proxyDomainParts) == 0 || proxyDomainParts[0] == "" {
+		return false
+	}
+	service := nameinfo.Shortname + "." + nameinfo.Namespace + "."
+	pod := strings.TrimSuffix(hostname, "."+service+proxyDomain)
+	if pod == hostname || pod == "" || strings.Contains(pod, ".") {
+		return false
+	}
+	out[hostname+"."] = struct{}{}
+	out[pod+"."+service] = struct{}{}
+	if proxyNamespace == nameinfo.Namespace {
+		out[pod+"."+nameinfo.Shortname+"."] = struct{}{}
+	}
+	out[pod+"."+service+proxyDomainParts[0]+"."] = struct{}{}
+	return true
 }
 
 // Given a host, this function first decides if the host is part of our service registry.
 // If it is not part of the registry, return nil so that caller queries upstream. If it is part
 // of registry, we will look it up in one of our tables, failing which we will return NXDOMAIN.
+// A nil table has no hosts.
 func (table *LookupTable) lookupHost(qtype uint16, hostname string) ([]dns.RR, bool) {
+	if table == nil {
+		return nil, false
+	}
 	var hostFound bool
 	if _, hostFound = table.allHosts[hostname]; !hostFound {
+		if _, empty := table.emptyHosts[hostname]; empty && !table.emptyHostFallback {
+			// A host of our registry without any address, there is no record of any type to answer.
+			return nil, true
+		}
 		// this is not from our registry
 		return nil, false
 	}
@@ -277,13 +1151,29 @@ func (table *LookupTable) lookupHost(qtype uint16, hostname string) ([]dns.RR, b
 	var ipAnswers []dns.RR
 	switch qtype {
 	case dns.TypeA:
-		ipAnswers = table.name4[hostname]
+		ipAnswers = weightedOrder(table.name4[hostname], table.weight4[hostname])
 	case dns.TypeAAAA:
-		ipAnswers = table.name6[hostname]
+		ipAnswers = weightedOrder(table.name6[hostname], table.weight6[hostname])
+	case dns.TypeANY:
+		// Rather than every record of the host, which RFC 8482 lets servers refuse, only its addresses, a bounded
+		// number of each family so that the answer stays small.
+		ipv4, _ := clipAddressRecords(weightedOrder(table.name4[hostname], table.weight4[hostname]), maxAnyAnswersPerFamily)
+		ipv6, _ := clipAddressRecords(weightedOrder(table.name6[hostname], table.weight6[hostname]), maxAnyAnswersPerFamily)
+		ordering := table.ordering
+		if ordering == AddressOrderingNone {
+			ordering = AddressOrderingGrouped
+		}
+		ipAnswers = orderAddresses(ordering, ipv4, ipv6)
 	default:
 		// TODO: handle PTR records for reverse dns lookups
 		return nil, false
 	}
+	if qtype != dns.TypeANY && table.ordering != AddressOrderingNone &&
+		len(table.name4[hostname]) > 0 && len(table.name6[hostname]) > 0 {
+		// Whichever family was asked for, the answer is the same, so that clients racing both get a consistent view.
+		ipAnswers = orderAddresses(table.ordering, weightedOrder(table.name4[hostname], table.weight4[hostname]),
+			weightedOrder(table.name6[hostname], table.weight6[hostname]))
+	}
 
 	if len(ipAnswers) > 0 {
 		// We will return a chained response. In a chained response, the first entry is the cname record,
@@ -297,6 +1187,127 @@ func (table *LookupTable) lookupHost(qtype uint16, hostname string) ([]dns.RR, b
 	return out, hostFound
 }
 
+// addWeights records the weights of the addresses of the endpoints of ni for altHosts, if they differ, and
+// clears the ones recorded for another host otherwise. The addresses are ordered by locality already.
+func (table *LookupTable) addWeights(altHosts map[string]struct{}, ni *nds.NameTable_NameInfo, ipv4, ipv6 []net.IP,
+	locality string) {
+	var w4, w6 *recordWeights
+	if len(ni.Endpoints) > 0 {
+		endpoints := make(map[string]*nds.NameTable_Endpoint, len(ni.Endpoints))
+		for _, ep := range ni.Endpoints {
+			if ip := net.ParseIP(ep.Ip); ip != nil {
+				endpoints[ip.String()] = ep
+			}
+		}
+		w4, w6 = addressWeights(endpoints, ipv4, locality), addressWeights(endpoints, ipv6, locality)
+	}
+	if (w4 != nil || w6 != nil) && table.weight4 == nil {
+		table.weight4 = map[string]*recordWeights{}
+		table.weight6 = map[string]*recordWeights{}
+	}
+	for h := range altHosts {
+		if w4 != nil {
+			table.weight4[h] = w4
+		} else {
+			delete(table.weight4, h)
+		}
+		if w6 != nil {
+			table.weight6[h] = w6
+		} else {
+			delete(table.weight6, h)
+		}
+	}
+}
+
+// addressWeights returns the weights of ips, 1 for the ones without, and their locality tiers, or nil if they
+// all weigh the same.
+func addressWeights(endpoints map[string]*nds.NameTable_Endpoint, ips []net.IP, locality string) *recordWeights {
+	out := &recordWeights{weights: make([]uint32, len(ips))}
+	if locality != "" {
+		out.tiers = make([]int, len(ips))
+	}
+	uniform := true
+	for i, ip := range ips {
+		ep := endpoints[ip.String()]
+		out.weights[i] = ep.GetWeight()
+		if out.weights[i] == 0 {
+			out.weights[i] = 1
+		}
+		uniform = uniform && out.weights[i] == out.weights[0]
+		if out.tiers != nil {
+			out.tiers[i] = localityMatch(locality, ep.GetLocality())
+		}
+	}
+	if uniform {
+		return nil
+	}
+	return out
+}
+
+// weightedOrder returns records shuffled so that, within each locality tier, each record comes first with a
+// probability proportional to its weight, or records as is without weights. The records themselves are
+// shared, not copied.
+func weightedOrder(records []dns.RR, w *recordWeights) []dns.RR {
+	if len(records) < 2 || w == nil || len(w.weights) != len(records) {
+		return records
+	}
+	// Weighted random sampling without replacement (Efraimidis and Spirakis): the records are sorted by a
+	// random key u^(1/weight), u uniform in (0, 1).
+	keys := make([]float64, len(records))
+	order := make([]int, len(records))
+	for i, weight := range w.weights {
+		keys[i] = math.Pow(rand.Float64(), 1/float64(weight))
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		if w.tiers != nil && w.tiers[order[i]] != w.tiers[order[j]] {
+			return w.tiers[order[i]] > w.tiers[order[j]]
+		}
+		return keys[order[i]] > keys[order[j]]
+	})
+	out := make([]dns.RR, len(records))
+	for i, o := range order {
+		out[i] = records[o]
+	}
+	return out
+}
+
+// orderAddresses merges the A and AAAA records of a dual-stack host. IPv6 comes first, as RFC 8305 recommends.
+func orderAddresses(ordering AddressOrdering, ipv4, ipv6 []dns.RR) []dns.RR {
+	out := make([]dns.RR, 0, len(ipv4)+len(ipv6))
+	if ordering == AddressOrderingGrouped {
+		out = append(out, ipv6...)
+		return append(out, ipv4...)
+	}
+	for i := 0; i < len(ipv4) || i < len(ipv6); i++ {
+		if i < len(ipv6) {
+			out = append(out, ipv6[i])
+		}
+		if i < len(ipv4) {
+			out = append(out, ipv4[i])
+		}
+	}
+	return out
+}
+
+// glue returns the address records of qtype for the targets of the CNAME records in answers that are in the table.
+func (table *LookupTable) glue(qtype uint16, answers []dns.RR) []dns.RR {
+	var out []dns.RR
+	for _, rr := range answers {
+		cn, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		switch qtype {
+		case dns.TypeA:
+			out = append(out, table.name4[cn.Target]...)
+		case dns.TypeAAAA:
+			out = append(out, table.name6[cn.Target]...)
+		}
+	}
+	return out
+}
+
 // This function stores the list of hostnames along with the precomputed DNS response for that hostname.
 // Most hostnames have a DNS response containing the A/AAAA records. In addition, this function stores a
 // variant of the host+ the first search domain in resolv.conf as the first query
@@ -312,14 +1323,15 @@ func (table *LookupTable) lookupHost(qtype uint16, hostname string) ([]dns.RR, b
 // in the lookup table with a CNAME record as the DNS response. This technique eliminates the need
 // to do string parsing, memory allocations, etc. at query time at the cost of Nx number of entries (i.e. memory) to store
 // the lookup table, where N is number of search namespaces.
-func (table *LookupTable) buildDNSAnswers(altHosts map[string]struct{}, ipv4 []net.IP, ipv6 []net.IP, searchNamespaces []string) {
+func (table *LookupTable) buildDNSAnswers(altHosts map[string]struct{}, ipv4 []net.IP, ipv6 []net.IP, searchNamespaces []string,
+	ttl uint32) {
 	for h := range altHosts {
 		table.allHosts[h] = struct{}{}
 		if len(ipv4) > 0 {
-			table.name4[h] = a(h, ipv4)
+			table.name4[h] = withTTL(a(h, ipv4), ttl)
 		}
 		if len(ipv6) > 0 {
-			table.name6[h] = aaaa(h, ipv6)
+			table.name6[h] = withTTL(aaaa(h, ipv6), ttl)
 		}
 		if len(searchNamespaces) > 0 {
 			// NOTE: Right now, rather than storing one expanded host for each one of the search namespace
@@ -334,7 +1346,7 @@ func (table *LookupTable) buildDNSAnswers(altHosts map[string]struct{}, ipv4 []n
 			// then the expanded host productpage.ns1.svc.cluster.local is a valid hostname
 			// that is likely to be already present in the altHosts
 			if _, exists := altHosts[expandedHost]; !exists {
-				table.cname[expandedHost] = cname(expandedHost, h)
+				table.cname[expandedHost] = withTTL(cname(expandedHost, h), ttl)
 				table.allHosts[expandedHost] = struct{}{}
 			}
 		}
@@ -366,6 +1378,14 @@ func aaaa(host string, ips []net.IP) []dns.RR {
 	return answers
 }
 
+// withTTL sets the TTL of records, in seconds, overriding the default.
+func withTTL(records []dns.RR, ttl uint32) []dns.RR {
+	for _, rr := range records {
+		rr.Header().Ttl = ttl
+	}
+	return records
+}
+
 func cname(host string, targetHost string) []dns.RR {
 	answer := new(dns.CNAME)
 	answer.Hdr = dns.RR_Header{
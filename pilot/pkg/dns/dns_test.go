@@ -15,14 +15,22 @@
 package dns
 
 import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"net"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
+	fuzz "github.com/google/gofuzz"
 	"github.com/miekg/dns"
 
 	nds "istio.io/istio/pilot/pkg/proto"
+	"istio.io/pkg/log"
 )
 
 var (
@@ -37,7 +45,7 @@ func init() {
 
 func initDNS() error {
 	var err error
-	testAgentDNS, err = NewLocalDNSServer("ns1", "ns1.svc.cluster.local")
+	testAgentDNS, err = NewLocalDNSServer(DNSConfig{ProxyNamespace: "ns1", ProxyDomain: "ns1.svc.cluster.local"})
 	if err != nil {
 		return err
 	}
@@ -245,6 +253,2211 @@ func TestDNS(t *testing.T) {
 	testAgentDNS.Close()
 }
 
+func TestResolvConfPath(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := ioutil.WriteFile(resolvConf, []byte("nameserver 10.96.0.10\nnameserver 10.96.0.11\n"+
+		"search ns1.svc.cluster.local svc.cluster.local cluster.local\noptions ndots:5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &LocalDNSServer{}
+	if err := h.loadResolvConf(resolvConf); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.96.0.10:53", "10.96.0.11:53"}; !reflect.DeepEqual(h.resolvConfServers, want) {
+		t.Errorf("got servers %v, want %v", h.resolvConfServers, want)
+	}
+	if want := []string{"ns1.svc.cluster.local", "svc.cluster.local", "cluster.local"}; !reflect.DeepEqual(h.searchNamespaces, want) {
+		t.Errorf("got search namespaces %v, want %v", h.searchNamespaces, want)
+	}
+
+	if err := (&LocalDNSServer{}).loadResolvConf(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected a missing resolv.conf to fail")
+	}
+}
+
+func TestSearchNamespaces(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := ioutil.WriteFile(resolvConf, []byte("nameserver 10.96.0.10\nsearch ns1.svc.cluster.local svc.cluster.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	table := &nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"www.google.com": {Ips: []string{"1.1.1.1"}, Registry: "External"},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		override []string
+		want     string
+	}{
+		{name: "resolv.conf", want: "www.google.com.ns1.svc.cluster.local."},
+		{name: "override", override: []string{"tenant1.svc.cluster.local", "svc.cluster.local"}, want: "www.google.com.tenant1.svc.cluster.local."},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := newLocalDNSServer(DNSConfig{
+				ProxyNamespace:   "ns1",
+				ProxyDomain:      "ns1.svc.cluster.local",
+				ResolvConfPath:   resolvConf,
+				SearchNamespaces: tt.override,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"10.96.0.10:53"}; !reflect.DeepEqual(h.resolvConfServers, want) {
+				t.Errorf("got servers %v, want %v", h.resolvConfServers, want)
+			}
+			h.UpdateLookupTable(table)
+			cnames := h.lookupTable.Load().(*LookupTable).cname
+			if len(cnames) != 1 || cnames[tt.want] == nil {
+				t.Fatalf("expected a single CNAME record for %s, got %v", tt.want, cnames)
+			}
+			if _, f := h.specialNames.cname["localhost."+strings.TrimPrefix(tt.want, "www.google.com.")]; !f {
+				t.Errorf("expected localhost to be expanded with the same search namespace, got %v", h.specialNames.cname)
+			}
+		})
+	}
+}
+
+func TestUpstreamServers(t *testing.T) {
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := ioutil.WriteFile(resolvConf, []byte("nameserver 10.96.0.10\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := newLocalDNSServer(DNSConfig{
+		ProxyNamespace: "ns1",
+		ProxyDomain:    "ns1.svc.cluster.local",
+		ResolvConfPath: resolvConf,
+		Upstreams:      []string{"169.254.169.254", "10.0.0.2:5353", "fd00::53"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.UpdateLookupTable(&nds.NameTable{})
+
+	// Without answers, every upstream is asked in turn, and never the nameserver of resolv.conf.
+	upstream := &fakeExchanger{}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	h.queryUpstream(upstream, req)
+	if want := []string{"169.254.169.254:53", "10.0.0.2:5353", "[fd00::53]:53"}; !reflect.DeepEqual(upstream.queried, want) {
+		t.Errorf("expected the upstreams %v to be queried, got %v", want, upstream.queried)
+	}
+
+	h, err = newLocalDNSServer(DNSConfig{
+		ProxyNamespace: "ns1",
+		ProxyDomain:    "ns1.svc.cluster.local",
+		ResolvConfPath: resolvConf,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.queried = nil
+	h.queryUpstream(upstream, req)
+	if want := []string{"10.96.0.10:53"}; !reflect.DeepEqual(upstream.queried, want) {
+		t.Errorf("expected the nameservers of resolv.conf %v to be queried, got %v", want, upstream.queried)
+	}
+
+	for _, invalid := range []string{"dns.example.com", "10.0.0.1:dns", "10.0.0.1:0", "10.0.0.1:70000", ""} {
+		if _, err := newLocalDNSServer(DNSConfig{ResolvConfPath: resolvConf, Upstreams: []string{invalid}}); err == nil {
+			t.Errorf("expected the upstream %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestNoUpstreams(t *testing.T) {
+	// Configuring the log output resets the levels of all scopes, they are restored once done.
+	levels := map[*log.Scope]log.Level{}
+	for _, scope := range log.Scopes() {
+		levels[scope] = scope.GetOutputLevel()
+	}
+	t.Cleanup(func() {
+		_ = log.Configure(log.DefaultOptions())
+		for scope, level := range levels {
+			scope.SetOutputLevel(level)
+		}
+	})
+	logFile := filepath.Join(t.TempDir(), "dns.log")
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{logFile}
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := ioutil.WriteFile(resolvConf, []byte("search svc.cluster.local\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := &LocalDNSServer{}
+	if err := h.loadResolvConf(resolvConf); err != nil {
+		t.Fatal(err)
+	}
+	_ = log.Sync()
+	logs, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(logs), "no nameservers found in "+resolvConf) {
+		t.Errorf("expected a warning about the missing nameservers, got %q", logs)
+	}
+
+	h.UpdateLookupTable(&nds.NameTable{})
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	w := &recordingResponseWriter{}
+	h.ServeDNS(&dnsProxy{protocol: "udp", upstreamClient: &dns.Client{Net: "udp"}}, w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %v", w.msg)
+	}
+}
+
+func TestIPFamilyPreference(t *testing.T) {
+	dualStack := &nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"dual.localhost": {
+				Ips:      []string{"2.2.2.2", "2001:db8:0:0:0:ff00:42:8329"},
+				Registry: "External",
+			},
+			"ipv6.localhost": {
+				Ips:      []string{"2001:db8:0:0:0:ff00:42:8329"},
+				Registry: "External",
+			},
+		},
+	}
+	testCases := []struct {
+		name       string
+		preference IPFamilyPreference
+		host       string
+		qtype      uint16
+		expected   []dns.RR
+	}{
+		{
+			name:       "any: A for dual-stack host",
+			preference: IPFamilyAny,
+			host:       "dual.localhost.",
+			qtype:      dns.TypeA,
+			expected:   a("dual.localhost.", []net.IP{net.ParseIP("2.2.2.2").To4()}),
+		},
+		{
+			name:       "any: AAAA for dual-stack host",
+			preference: IPFamilyAny,
+			host:       "dual.localhost.",
+			qtype:      dns.TypeAAAA,
+			expected:   aaaa("dual.localhost.", []net.IP{net.ParseIP("2001:db8:0:0:0:ff00:42:8329")}),
+		},
+		{
+			name:       "prefer ipv4: A for dual-stack host",
+			preference: IPFamilyPreferIPv4,
+			host:       "dual.localhost.",
+			qtype:      dns.TypeA,
+			expected:   a("dual.localhost.", []net.IP{net.ParseIP("2.2.2.2").To4()}),
+		},
+		{
+			name:       "prefer ipv4: AAAA for dual-stack host is suppressed",
+			preference: IPFamilyPreferIPv4,
+			host:       "dual.localhost.",
+			qtype:      dns.TypeAAAA,
+		},
+		{
+			name:       "prefer ipv4: AAAA for ipv6 only host",
+			preference: IPFamilyPreferIPv4,
+			host:       "ipv6.localhost.",
+			qtype:      dns.TypeAAAA,
+			expected:   aaaa("ipv6.localhost.", []net.IP{net.ParseIP("2001:db8:0:0:0:ff00:42:8329")}),
+		},
+		{
+			name:       "prefer ipv6: AAAA for dual-stack host",
+			preference: IPFamilyPreferIPv6,
+			host:       "dual.localhost.",
+			qtype:      dns.TypeAAAA,
+			expected:   aaaa("dual.localhost.", []net.IP{net.ParseIP("2001:db8:0:0:0:ff00:42:8329")}),
+		},
+		{
+			name:       "prefer ipv6: A for dual-stack host is suppressed",
+			preference: IPFamilyPreferIPv6,
+			host:       "dual.localhost.",
+			qtype:      dns.TypeA,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{ipFamilyPreference: tt.preference}
+			h.UpdateLookupTable(dualStack)
+			answers, found := h.lookupTable.Load().(*LookupTable).lookupHost(tt.qtype, tt.host)
+			if !found {
+				t.Fatalf("expected %s to be found in the lookup table", tt.host)
+			}
+			if !equalsDNSrecords(answers, tt.expected) {
+				t.Errorf("dns responses for %s do not match. \n got %v\nwant %v", tt.host, answers, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAddressOrdering(t *testing.T) {
+	nt := &nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"dual.localhost": {
+				Ips:      []string{"2.2.2.2", "3.3.3.3", "2001:db8::1", "2001:db8::2", "2001:db8::3"},
+				Registry: "External",
+			},
+		},
+	}
+	host := "dual.localhost."
+	v4 := func(ip string) dns.RR { return a(host, []net.IP{net.ParseIP(ip).To4()})[0] }
+	v6 := func(ip string) dns.RR { return aaaa(host, []net.IP{net.ParseIP(ip)})[0] }
+	testCases := []struct {
+		name     string
+		ordering AddressOrdering
+		qtype    uint16
+		expected []dns.RR
+	}{
+		{
+			name:     "none: A",
+			ordering: AddressOrderingNone,
+			qtype:    dns.TypeA,
+			expected: []dns.RR{v4("2.2.2.2"), v4("3.3.3.3")},
+		},
+		{
+			name:     "none: AAAA",
+			ordering: AddressOrderingNone,
+			qtype:    dns.TypeAAAA,
+			expected: []dns.RR{v6("2001:db8::1"), v6("2001:db8::2"), v6("2001:db8::3")},
+		},
+		{
+			name:     "interleaved: A",
+			ordering: AddressOrderingInterleaved,
+			qtype:    dns.TypeA,
+			expected: []dns.RR{v6("2001:db8::1"), v4("2.2.2.2"), v6("2001:db8::2"), v4("3.3.3.3"), v6("2001:db8::3")},
+		},
+		{
+			name:     "interleaved: AAAA",
+			ordering: AddressOrderingInterleaved,
+			qtype:    dns.TypeAAAA,
+			expected: []dns.RR{v6("2001:db8::1"), v4("2.2.2.2"), v6("2001:db8::2"), v4("3.3.3.3"), v6("2001:db8::3")},
+		},
+		{
+			name:     "grouped: A",
+			ordering: AddressOrderingGrouped,
+			qtype:    dns.TypeA,
+			expected: []dns.RR{v6("2001:db8::1"), v6("2001:db8::2"), v6("2001:db8::3"), v4("2.2.2.2"), v4("3.3.3.3")},
+		},
+		{
+			name:     "grouped: AAAA",
+			ordering: AddressOrderingGrouped,
+			qtype:    dns.TypeAAAA,
+			expected: []dns.RR{v6("2001:db8::1"), v6("2001:db8::2"), v6("2001:db8::3"), v4("2.2.2.2"), v4("3.3.3.3")},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{addressOrdering: tt.ordering}
+			h.UpdateLookupTable(nt)
+			answers, found := h.lookupTable.Load().(*LookupTable).lookupHost(tt.qtype, host)
+			if !found {
+				t.Fatalf("expected %s to be found in the lookup table", host)
+			}
+			if !equalsDNSrecords(answers, tt.expected) {
+				t.Errorf("dns responses for %s do not match. \n got %v\nwant %v", host, answers, tt.expected)
+			}
+		})
+	}
+}
+
+func TestEndpointHealthAndLocality(t *testing.T) {
+	nt := &nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"mixed.localhost": {
+				Ips:      []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				Registry: "External",
+				Endpoints: []*nds.NameTable_Endpoint{
+					{Ip: "10.0.0.1", Locality: "us-west/zone2"},
+					{Ip: "10.0.0.2", Locality: "us-east/zone1", Unhealthy: true},
+					{Ip: "10.0.0.3", Locality: "us-east/zone1"},
+					{Ip: "10.0.0.4", Locality: "us-east/zone2"},
+				},
+			},
+			"down.localhost": {
+				Ips:      []string{"10.0.1.1", "10.0.1.2"},
+				Registry: "External",
+				Endpoints: []*nds.NameTable_Endpoint{
+					{Ip: "10.0.1.1", Unhealthy: true},
+					{Ip: "10.0.1.2", Unhealthy: true},
+				},
+			},
+		},
+	}
+	testCases := []struct {
+		name     string
+		server   *LocalDNSServer
+		host     string
+		expected []string
+	}{
+		{
+			name:     "no filtering or locality keeps the name table order",
+			server:   &LocalDNSServer{},
+			host:     "mixed.localhost.",
+			expected: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+		},
+		{
+			name:     "unhealthy endpoints filtered",
+			server:   &LocalDNSServer{filterUnhealthy: true},
+			host:     "mixed.localhost.",
+			expected: []string{"10.0.0.1", "10.0.0.3", "10.0.0.4"},
+		},
+		{
+			name:     "closest locality first",
+			server:   &LocalDNSServer{locality: "us-east/zone1/subzone1"},
+			host:     "mixed.localhost.",
+			expected: []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.1"},
+		},
+		{
+			name:     "healthy and closest locality first",
+			server:   &LocalDNSServer{filterUnhealthy: true, locality: "us-east/zone1/subzone1"},
+			host:     "mixed.localhost.",
+			expected: []string{"10.0.0.3", "10.0.0.4", "10.0.0.1"},
+		},
+		{
+			name:     "all unhealthy endpoints kept",
+			server:   &LocalDNSServer{filterUnhealthy: true},
+			host:     "down.localhost.",
+			expected: []string{"10.0.1.1", "10.0.1.2"},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.server.UpdateLookupTable(nt)
+			answers, found := tt.server.lookupTable.Load().(*LookupTable).lookupHost(dns.TypeA, tt.host)
+			if !found {
+				t.Fatalf("expected %s to be found in the lookup table", tt.host)
+			}
+			ips := make([]net.IP, 0, len(tt.expected))
+			for _, ip := range tt.expected {
+				ips = append(ips, net.ParseIP(ip).To4())
+			}
+			expected := a(tt.host, ips)
+			if !equalsDNSrecords(answers, expected) {
+				t.Errorf("dns responses for %s do not match. \n got %v\nwant %v", tt.host, answers, expected)
+			}
+		})
+	}
+}
+
+func TestDNSSECPassthrough(t *testing.T) {
+	rrsig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: "signed.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 300},
+		TypeCovered: dns.TypeA,
+		Algorithm:   dns.RSASHA256,
+		Labels:      2,
+		OrigTtl:     300,
+		Expiration:  uint32(time.Now().Add(time.Hour).Unix()),
+		Inception:   uint32(time.Now().Add(-time.Hour).Unix()),
+		KeyTag:      12345,
+		SignerName:  "example.",
+		Signature:   "c2lnbmF0dXJl",
+	}
+	upstreamDO := make(chan bool, 1)
+	upstream := startUpstreamDNS(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		opt := req.IsEdns0()
+		upstreamDO <- opt != nil && opt.Do()
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.AuthenticatedData = true
+		resp.Answer = append(a("signed.example.", []net.IP{net.ParseIP("1.2.3.4").To4()}), rrsig)
+		resp.SetEdns0(4096, true)
+		_ = w.WriteMsg(resp)
+	})
+
+	h := &LocalDNSServer{resolvConfServers: []string{upstream}}
+	h.UpdateLookupTable(&nds.NameTable{})
+	req := new(dns.Msg)
+	req.SetQuestion("signed.example.", dns.TypeA)
+	req.SetEdns0(4096, true)
+	w := &recordingResponseWriter{}
+	h.ServeDNS(&dnsProxy{protocol: "udp", upstreamClient: &dns.Client{Net: "udp"}}, w, req)
+
+	if !<-upstreamDO {
+		t.Fatal("expected the DO bit to be forwarded upstream")
+	}
+	if w.msg == nil {
+		t.Fatal("no response written")
+	}
+	if !w.msg.AuthenticatedData {
+		t.Error("expected the AD flag of the upstream response to be preserved")
+	}
+	var signed bool
+	for _, rr := range w.msg.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeA && sig.Signature == rrsig.Signature {
+			signed = true
+		}
+	}
+	if !signed {
+		t.Errorf("expected the RRSIG record to be preserved, got %v", w.msg.Answer)
+	}
+	if opt := w.msg.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("expected the DO bit in the response, got %v", w.msg.Extra)
+	}
+}
+
+// startUpstreamDNS serves handler over protocol, udp or tcp, on a local port, returning its address.
+func startUpstreamDNS(t *testing.T, protocol string, handler dns.HandlerFunc) string {
+	t.Helper()
+	started := make(chan struct{})
+	server := &dns.Server{Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	var address string
+	if protocol == "udp" {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn, address = pc, pc.LocalAddr().String()
+	} else {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Listener, address = l, l.Addr().String()
+	}
+	go func() {
+		_ = server.ActivateAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = server.Shutdown()
+	})
+	<-started
+	return address
+}
+
+func TestMaxAnswers(t *testing.T) {
+	ips := make([]string, 0, 300)
+	for i := 0; i < 300; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	h := &LocalDNSServer{maxUDPAnswers: 20, maxTCPAnswers: 500}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"large.localhost": {
+				Ips:      ips,
+				Registry: "External",
+			},
+		},
+	})
+	testCases := []struct {
+		protocol  string
+		answers   int
+		truncated bool
+	}{
+		{protocol: "udp", answers: 20, truncated: true},
+		{protocol: "tcp", answers: 300, truncated: false},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.protocol, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("large.localhost.", dns.TypeA)
+			w := &recordingResponseWriter{}
+			h.ServeDNS(&dnsProxy{protocol: tt.protocol}, w, req)
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			if len(w.msg.Answer) != tt.answers {
+				t.Errorf("got %d answers, want %d", len(w.msg.Answer), tt.answers)
+			}
+			if w.msg.Truncated != tt.truncated {
+				t.Errorf("got truncated %v, want %v", w.msg.Truncated, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestUDPTruncation(t *testing.T) {
+	ips := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+	}
+	h := &LocalDNSServer{}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"large.localhost": {
+				Ips:      ips,
+				Registry: "External",
+			},
+		},
+	})
+	testCases := []struct {
+		name      string
+		protocol  string
+		udpSize   uint16
+		truncated bool
+	}{
+		{name: "udp", protocol: "udp", truncated: true},
+		{name: "udp with a large edns0 buffer", protocol: "udp", udpSize: 4096},
+		{name: "tcp", protocol: "tcp"},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("large.localhost.", dns.TypeA)
+			size := dns.MinMsgSize
+			if tt.udpSize > 0 {
+				req.SetEdns0(tt.udpSize, false)
+				size = int(tt.udpSize)
+			}
+			w := &recordingResponseWriter{}
+			h.ServeDNS(&dnsProxy{protocol: tt.protocol}, w, req)
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			if w.msg.Truncated != tt.truncated {
+				t.Errorf("got truncated %v, want %v", w.msg.Truncated, tt.truncated)
+			}
+			if tt.truncated {
+				if len(w.msg.Answer) == 0 || len(w.msg.Answer) >= len(ips) {
+					t.Errorf("got %d answers, want some but not all of them", len(w.msg.Answer))
+				}
+			} else if len(w.msg.Answer) != len(ips) {
+				t.Errorf("got %d answers, want %d", len(w.msg.Answer), len(ips))
+			}
+			if tt.protocol == "udp" {
+				buf, err := w.msg.Pack()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(buf) > size {
+					t.Errorf("got a %d bytes response, larger than the %d bytes the client takes", len(buf), size)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateAltHosts(t *testing.T) {
+	testCases := []struct {
+		name             string
+		hostname         string
+		nameinfo         *nds.NameTable_NameInfo
+		proxyDomain      string
+		proxyDomainParts []string
+		expected         []string
+	}{
+		{
+			name:             "all variants",
+			hostname:         "productpage.ns1.svc.cluster.local",
+			nameinfo:         &nds.NameTable_NameInfo{Shortname: "productpage", Namespace: "ns1"},
+			proxyDomain:      "svc.cluster.local",
+			proxyDomainParts: []string{"svc", "cluster", "local"},
+			expected: []string{"productpage.ns1.svc.cluster.local.", "productpage.ns1.", "productpage.",
+				"productpage.ns1.svc."},
+		},
+		{
+			name:        "no proxy domain parts",
+			hostname:    "productpage.ns1.svc.cluster.local",
+			nameinfo:    &nds.NameTable_NameInfo{Shortname: "productpage", Namespace: "ns1"},
+			proxyDomain: "svc.cluster.local",
+			expected:    []string{"productpage.ns1.svc.cluster.local."},
+		},
+		{
+			name:             "empty first proxy domain part",
+			hostname:         "productpage.ns1.svc.cluster.local",
+			nameinfo:         &nds.NameTable_NameInfo{Shortname: "productpage", Namespace: "ns1"},
+			proxyDomain:      "svc.cluster.local",
+			proxyDomainParts: []string{""},
+			expected:         []string{"productpage.ns1.svc.cluster.local."},
+		},
+		{
+			name:             "no shortname",
+			hostname:         "productpage.ns1.svc.cluster.local",
+			nameinfo:         &nds.NameTable_NameInfo{Namespace: "ns1"},
+			proxyDomain:      "svc.cluster.local",
+			proxyDomainParts: []string{"svc", "cluster", "local"},
+			expected:         []string{"productpage.ns1.svc.cluster.local."},
+		},
+		{
+			name:             "no namespace",
+			hostname:         "productpage.ns1.svc.cluster.local",
+			nameinfo:         &nds.NameTable_NameInfo{Shortname: "productpage"},
+			proxyDomain:      "svc.cluster.local",
+			proxyDomainParts: []string{"svc", "cluster", "local"},
+			expected:         []string{"productpage.ns1.svc.cluster.local."},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := generateAltHosts(tt.hostname, tt.nameinfo, "ns1", tt.proxyDomain, tt.proxyDomainParts)
+			expected := map[string]struct{}{}
+			for _, h := range tt.expected {
+				expected[h] = struct{}{}
+			}
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("expected %v, got %v", expected, got)
+			}
+		})
+	}
+}
+
+// Feeds random hostnames, namespaces and domains to generateAltHosts, which must neither panic
+// nor lose the FQDN.
+func TestGenerateAltHostsFuzz(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed %d", seed)
+	fz := fuzz.New().NilChance(.2).NumElements(0, 4).RandSource(rand.NewSource(seed))
+	for i := 0; i < 1000; i++ {
+		var hostname, proxyNamespace string
+		var proxyDomainParts []string
+		nameinfo := &nds.NameTable_NameInfo{}
+		fz.Fuzz(&nameinfo.Shortname)
+		fz.Fuzz(&nameinfo.Namespace)
+		fz.Fuzz(&proxyNamespace)
+		fz.Fuzz(&proxyDomainParts)
+		proxyDomain := strings.Join(proxyDomainParts, ".")
+		if i%2 == 0 {
+			// a host of the proxy domain, which gets the alternative names
+			hostname = nameinfo.Shortname + "." + nameinfo.Namespace + "." + proxyDomain
+		} else {
+			fz.Fuzz(&hostname)
+		}
+
+		out := generateAltHosts(hostname, nameinfo, proxyNamespace, proxyDomain, proxyDomainParts)
+		if _, f := out[hostname+"."]; !f {
+			t.Fatalf("FQDN %q missing from %v", hostname+".", out)
+		}
+		for h := range out {
+			if !strings.HasSuffix(h, ".") {
+				t.Fatalf("host %q generated for %q is not fully qualified", h, hostname)
+			}
+		}
+		if (nameinfo.Shortname == "" || nameinfo.Namespace == "" || len(proxyDomainParts) == 0 || proxyDomainParts[0] == "") &&
+			len(out) != 1 {
+			t.Fatalf("expected only the FQDN for incomplete input %q %v %v, got %v", hostname, nameinfo, proxyDomainParts, out)
+		}
+	}
+}
+
+// largeNameTable returns a name table of n hosts, of the proxy namespace or not, of the registry or not, with
+// IPv4, IPv6 or both addresses.
+func largeNameTable(n int) *nds.NameTable {
+	nt := &nds.NameTable{Table: make(map[string]*nds.NameTable_NameInfo, n)}
+	for i := 0; i < n; i++ {
+		ni := &nds.NameTable_NameInfo{Ips: []string{fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)}}
+		switch i % 3 {
+		case 1:
+			ni.Ips = append(ni.Ips, fmt.Sprintf("2001:db8::%x", i))
+		case 2:
+			ni.Ips = []string{fmt.Sprintf("2001:db8::%x", i)}
+			ni.Ttl = 60
+		}
+		var host string
+		if i%4 == 3 {
+			host = fmt.Sprintf("external-%d.example.com", i)
+			ni.Registry = "External"
+		} else {
+			ni.Registry = "Kubernetes"
+			ni.Shortname = fmt.Sprintf("svc-%d", i)
+			ni.Namespace = fmt.Sprintf("ns%d", i%2+1)
+			host = ni.Shortname + "." + ni.Namespace + ".svc.cluster.local"
+		}
+		nt.Table[host] = ni
+	}
+	return nt
+}
+
+// naiveLookupTable builds the lookup table of nt with a fresh map per host and maps grown as they fill up.
+func naiveLookupTable(h *LocalDNSServer, nt *nds.NameTable) *LookupTable {
+	table := &LookupTable{
+		allHosts: map[string]struct{}{},
+		name4:    map[string][]dns.RR{},
+		name6:    map[string][]dns.RR{},
+		cname:    map[string][]dns.RR{},
+		ordering: h.addressOrdering,
+	}
+	for host, ni := range nt.Table {
+		altHosts := map[string]struct{}{host + ".": {}}
+		if ni.Registry == "Kubernetes" {
+			altHosts = generateAltHosts(host, ni, h.proxyNamespace, h.proxyDomain, h.proxyDomainParts)
+		}
+		ipv4, ipv6 := separateIPtypes(h.orderIPs(ni))
+		if len(ipv4) == 0 && len(ipv6) == 0 {
+			continue
+		}
+		if len(ipv4) > 0 && len(ipv6) > 0 {
+			switch h.ipFamilyPreference {
+			case IPFamilyPreferIPv4:
+				ipv6 = nil
+			case IPFamilyPreferIPv6:
+				ipv4 = nil
+			}
+		}
+		ttl := uint32(defaultTTLInSeconds)
+		if ni.Ttl > 0 {
+			ttl = ni.Ttl
+		}
+		table.buildDNSAnswers(altHosts, ipv4, ipv6, h.searchNamespaces, ttl)
+	}
+	return table
+}
+
+func TestBuildLookupTable(t *testing.T) {
+	nt := largeNameTable(1000)
+	// A malformed host has no record.
+	nt.Table["malformed.ns1.svc.cluster.local"] = &nds.NameTable_NameInfo{Ips: []string{"not an ip"}, Registry: "Kubernetes",
+		Shortname: "malformed", Namespace: "ns1"}
+	for _, preference := range []IPFamilyPreference{IPFamilyAny, IPFamilyPreferIPv4, IPFamilyPreferIPv6} {
+		for _, search := range [][]string{nil, {"ns1.svc.cluster.local", "svc.cluster.local"}} {
+			h := &LocalDNSServer{
+				proxyNamespace:     "ns1",
+				proxyDomain:        "svc.cluster.local",
+				proxyDomainParts:   []string{"svc", "cluster", "local"},
+				searchNamespaces:   search,
+				ipFamilyPreference: preference,
+			}
+			got, want := h.buildLookupTable(nt), naiveLookupTable(h, nt)
+			if !reflect.DeepEqual(got.allHosts, want.allHosts) {
+				t.Fatalf("preference %v, search %v: hosts differ from the naive build", preference, search)
+			}
+			for name, records := range map[string][2]map[string][]dns.RR{
+				"A":     {got.name4, want.name4},
+				"AAAA":  {got.name6, want.name6},
+				"CNAME": {got.cname, want.cname},
+			} {
+				if !reflect.DeepEqual(records[0], records[1]) {
+					t.Fatalf("preference %v, search %v: %s records differ from the naive build", preference, search, name)
+				}
+			}
+		}
+	}
+}
+
+func TestDuplicateIPs(t *testing.T) {
+	var many []string
+	for i := 0; i < 2*maxScannedIPs; i++ {
+		many = append(many, fmt.Sprintf("10.1.0.%d", i%maxScannedIPs), fmt.Sprintf("2001:db8:1::%x", i%maxScannedIPs))
+	}
+	var many4, many6 []net.IP
+	for i := 0; i < maxScannedIPs; i++ {
+		many4 = append(many4, net.ParseIP(fmt.Sprintf("10.1.0.%d", i)).To4())
+		many6 = append(many6, net.ParseIP(fmt.Sprintf("2001:db8:1::%x", i)))
+	}
+	h := &LocalDNSServer{}
+	table := h.buildLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"dup.localhost": {
+				Ips:      []string{"10.0.0.2", "10.0.0.1", "2001:db8::1", "10.0.0.2", "2001:db8:0:0:0:0:0:1", "::ffff:10.0.0.1"},
+				Registry: "External",
+			},
+			"many.localhost": {
+				Ips:      many,
+				Registry: "External",
+			},
+		},
+	})
+	for _, tt := range []struct {
+		host  string
+		want4 []dns.RR
+		want6 []dns.RR
+	}{
+		{
+			host:  "dup.localhost.",
+			want4: a("dup.localhost.", []net.IP{net.ParseIP("10.0.0.2").To4(), net.ParseIP("10.0.0.1").To4()}),
+			want6: aaaa("dup.localhost.", []net.IP{net.ParseIP("2001:db8::1")}),
+		},
+		{
+			host:  "many.localhost.",
+			want4: a("many.localhost.", many4),
+			want6: aaaa("many.localhost.", many6),
+		},
+	} {
+		if got := table.name4[tt.host]; !equalsDNSrecords(got, tt.want4) {
+			t.Errorf("%s: expected each IPv4 address once in order, got %v", tt.host, got)
+		}
+		if got := table.name6[tt.host]; !equalsDNSrecords(got, tt.want6) {
+			t.Errorf("%s: expected each IPv6 address once in order, got %v", tt.host, got)
+		}
+	}
+}
+
+func BenchmarkUpdateLookupTable(b *testing.B) {
+	nt := largeNameTable(50000)
+	h := &LocalDNSServer{
+		proxyNamespace:   "ns1",
+		proxyDomain:      "svc.cluster.local",
+		proxyDomainParts: []string{"svc", "cluster", "local"},
+		searchNamespaces: []string{"ns1.svc.cluster.local", "svc.cluster.local", "cluster.local"},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.UpdateLookupTable(nt)
+	}
+}
+
+func TestWeightedAnswers(t *testing.T) {
+	h := &LocalDNSServer{
+		proxyNamespace:   "ns1",
+		proxyDomain:      "svc.cluster.local",
+		proxyDomainParts: []string{"svc", "cluster", "local"},
+		searchNamespaces: []string{"ns1.svc.cluster.local"},
+	}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"weighted.ns1.svc.cluster.local": {
+				Ips:       []string{"10.0.0.1", "10.0.0.2"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "weighted",
+				Endpoints: []*nds.NameTable_Endpoint{
+					{Ip: "10.0.0.1", Weight: 1},
+					{Ip: "10.0.0.2", Weight: 3},
+				},
+			},
+			"uniform.ns1.svc.cluster.local": {
+				Ips:       []string{"10.0.1.1", "10.0.1.2"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "uniform",
+				Endpoints: []*nds.NameTable_Endpoint{
+					{Ip: "10.0.1.1", Weight: 2},
+					{Ip: "10.0.1.2", Weight: 2},
+				},
+			},
+		},
+	})
+	table := h.lookupTable.Load().(*LookupTable)
+
+	const lookups = 4000
+	first := 0
+	for i := 0; i < lookups; i++ {
+		// The short name goes through the CNAME of the search namespace to the same weights.
+		host := "weighted.ns1.svc.cluster.local."
+		if i%2 == 1 {
+			host = "weighted.ns1.svc.cluster.local.ns1.svc.cluster.local."
+		}
+		answers, _ := table.lookupHost(dns.TypeA, host)
+		var ips []string
+		for _, rr := range answers {
+			if a, ok := rr.(*dns.A); ok {
+				ips = append(ips, a.A.String())
+			}
+		}
+		if len(ips) != 2 {
+			t.Fatalf("expected both addresses for %s, got %v", host, answers)
+		}
+		if ips[0] == "10.0.0.2" {
+			first++
+		}
+	}
+	if ratio := float64(first) / lookups; ratio < 0.7 || ratio > 0.8 {
+		t.Errorf("expected the address weighing 3 to come first about 75%% of the time, got %.2f", ratio)
+	}
+	// The records of the table keep their order.
+	if a := table.name4["weighted.ns1.svc.cluster.local."][0].(*dns.A); a.A.String() != "10.0.0.1" {
+		t.Errorf("expected the table records to be left alone, got %v first", a.A)
+	}
+
+	if _, f := table.weight4["uniform.ns1.svc.cluster.local."]; f {
+		t.Error("expected no weights for endpoints that weigh the same")
+	}
+	for i := 0; i < 10; i++ {
+		answers, _ := table.lookupHost(dns.TypeA, "uniform.ns1.svc.cluster.local.")
+		if a := answers[0].(*dns.A); a.A.String() != "10.0.1.1" {
+			t.Fatalf("expected the order of the name table for uniform weights, got %v", answers)
+		}
+	}
+}
+
+func TestWeightedAnswersLocality(t *testing.T) {
+	h := &LocalDNSServer{
+		proxyNamespace:   "ns1",
+		proxyDomain:      "svc.cluster.local",
+		proxyDomainParts: []string{"svc", "cluster", "local"},
+		locality:         "us-east/zone1",
+	}
+	weighted := &nds.NameTable_NameInfo{
+		Ips:       []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		Registry:  "Kubernetes",
+		Namespace: "ns1",
+		Shortname: "weighted",
+		Endpoints: []*nds.NameTable_Endpoint{
+			{Ip: "10.0.0.1", Weight: 100, Locality: "us-west/zone1"},
+			{Ip: "10.0.0.2", Weight: 1, Locality: "us-east/zone1"},
+			{Ip: "10.0.0.3", Weight: 3, Locality: "us-east/zone1"},
+		},
+	}
+	h.UpdateLookupTable(&nds.NameTable{Table: map[string]*nds.NameTable_NameInfo{
+		"weighted.ns1.svc.cluster.local": weighted,
+	}})
+	table := h.lookupTable.Load().(*LookupTable)
+
+	const lookups = 4000
+	first := 0
+	for i := 0; i < lookups; i++ {
+		answers, _ := table.lookupHost(dns.TypeA, "weighted.ns1.svc.cluster.local.")
+		var ips []string
+		for _, rr := range answers {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		// However heavy, the endpoint of another locality comes after the local ones.
+		if len(ips) != 3 || ips[2] != "10.0.0.1" {
+			t.Fatalf("expected the endpoint of the remote locality last, got %v", ips)
+		}
+		if ips[0] == "10.0.0.3" {
+			first++
+		}
+	}
+	if ratio := float64(first) / lookups; ratio < 0.7 || ratio > 0.8 {
+		t.Errorf("expected the local address weighing 3 to come first about 75%% of the time, got %.2f", ratio)
+	}
+
+	// The short names of the hosts conflict. Whichever is built last overwrites the answers, along with the
+	// weights: the one without endpoints must not keep those of the other.
+	h.locality = ""
+	nt := &nds.NameTable{Table: map[string]*nds.NameTable_NameInfo{
+		"weighted.ns1.svc.cluster.local": weighted,
+		"weighted.ns1.svc.other.svc.cluster.local": {
+			Ips:       []string{"10.0.1.1", "10.0.1.2"},
+			Registry:  "Kubernetes",
+			Namespace: "ns1",
+			Shortname: "weighted",
+		},
+	}}
+	for i := 0; i < 20; i++ {
+		table := h.buildLookupTable(nt)
+		_, weights := table.weight4["weighted.ns1."]
+		overwritten := table.name4["weighted.ns1."][0].(*dns.A).A.String() == "10.0.1.1"
+		if weights == overwritten {
+			t.Fatalf("got weights %v for the answers %v", weights, table.name4["weighted.ns1."])
+		}
+	}
+}
+
+func TestPerHostTTL(t *testing.T) {
+	h := &LocalDNSServer{
+		proxyNamespace:   "ns1",
+		proxyDomain:      "svc.cluster.local",
+		proxyDomainParts: []string{"svc", "cluster", "local"},
+		searchNamespaces: []string{"ns1.svc.cluster.local"},
+	}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"ttl.example.com": {
+				Ips:      []string{"1.1.1.1", "2001:db8::1"},
+				Registry: "External",
+				Ttl:      300,
+			},
+			"default.example.com": {
+				Ips:      []string{"2.2.2.2"},
+				Registry: "External",
+			},
+		},
+	})
+	lookupTable := h.lookupTable.Load().(*LookupTable)
+	testCases := []struct {
+		host  string
+		qtype uint16
+		ttl   uint32
+	}{
+		{"ttl.example.com.", dns.TypeA, 300},
+		{"ttl.example.com.", dns.TypeAAAA, 300},
+		// the cname of the expanded host and the records it points to
+		{"ttl.example.com.ns1.svc.cluster.local.", dns.TypeA, 300},
+		{"default.example.com.", dns.TypeA, defaultTTLInSeconds},
+		{"default.example.com.ns1.svc.cluster.local.", dns.TypeA, defaultTTLInSeconds},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.host+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			answers, found := lookupTable.lookupHost(tt.qtype, tt.host)
+			if !found || len(answers) == 0 {
+				t.Fatalf("expected answers for %s", tt.host)
+			}
+			for _, rr := range answers {
+				if rr.Header().Ttl != tt.ttl {
+					t.Errorf("expected ttl %d, got %v", tt.ttl, rr)
+				}
+			}
+		})
+	}
+}
+
+func TestPodHosts(t *testing.T) {
+	nt := &nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"web.ns1.svc.cluster.local": {
+				Ips:       []string{"10.0.0.10"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "web",
+			},
+			"web-0.web.ns1.svc.cluster.local": {
+				Ips:       []string{"10.0.0.1"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "web",
+			},
+			"db-0.db.ns2.svc.cluster.local": {
+				Ips:       []string{"10.0.1.1"},
+				Registry:  "Kubernetes",
+				Namespace: "ns2",
+				Shortname: "db",
+			},
+		},
+	}
+	testCases := []struct {
+		name     string
+		podHosts bool
+		host     string
+		want     string
+	}{
+		{"pod fqdn", true, "web-0.web.ns1.svc.cluster.local.", "10.0.0.1"},
+		{"pod with namespace", true, "web-0.web.ns1.", "10.0.0.1"},
+		{"pod with svc", true, "web-0.web.ns1.svc.", "10.0.0.1"},
+		{"pod in proxy namespace", true, "web-0.web.", "10.0.0.1"},
+		{"pod in other namespace", true, "db-0.db.ns2.", "10.0.1.1"},
+		{"pod short name outside proxy namespace", true, "db-0.db.", ""},
+		{"service of the pods", true, "web.", "10.0.0.10"},
+		{"service with namespace", true, "web.ns1.", "10.0.0.10"},
+		{"legacy pod fqdn", false, "web-0.web.ns1.svc.cluster.local.", "10.0.0.1"},
+		{"legacy pod with namespace", false, "web-0.web.ns1.", ""},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{
+				proxyNamespace:   "ns1",
+				proxyDomain:      "svc.cluster.local",
+				proxyDomainParts: []string{"svc", "cluster", "local"},
+				podHosts:         tt.podHosts,
+			}
+			h.UpdateLookupTable(nt)
+			answers, found := h.lookupTable.Load().(*LookupTable).lookupHost(dns.TypeA, tt.host)
+			if tt.want == "" {
+				if found {
+					t.Fatalf("expected %s not to be found, got %v", tt.host, answers)
+				}
+				return
+			}
+			if len(answers) != 1 || answers[0].(*dns.A).A.String() != tt.want {
+				t.Fatalf("expected %s for %s, got %v", tt.want, tt.host, answers)
+			}
+		})
+	}
+}
+
+func TestConflictPolicy(t *testing.T) {
+	// The service entry host web.ns1 is also the namespaced short name of the web service of ns1.
+	nt := &nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"web.ns1.svc.cluster.local": {
+				Ips:       []string{"10.0.0.1", "10.0.0.2"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "web",
+			},
+			"web.ns1": {
+				Ips:      []string{"10.0.0.2"},
+				Registry: "External",
+			},
+		},
+	}
+	testCases := []struct {
+		name   string
+		policy ConflictPolicy
+		host   string
+		want   []string
+	}{
+		// web.ns1 comes first in name order.
+		{"keep first", ConflictPolicyKeepFirst, "web.ns1.", []string{"10.0.0.2"}},
+		{"keep first leaves the other names alone", ConflictPolicyKeepFirst, "web.ns1.svc.cluster.local.", []string{"10.0.0.1", "10.0.0.2"}},
+		// the address of both hosts is only answered once
+		{"merge", ConflictPolicyMerge, "web.ns1.", []string{"10.0.0.1", "10.0.0.2"}},
+		{"merge leaves the other names alone", ConflictPolicyMerge, "web.ns1.svc.cluster.local.", []string{"10.0.0.1", "10.0.0.2"}},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{
+				proxyNamespace:   "ns1",
+				proxyDomain:      "svc.cluster.local",
+				proxyDomainParts: []string{"svc", "cluster", "local"},
+				conflictPolicy:   tt.policy,
+			}
+			h.UpdateLookupTable(nt)
+			if got := gaugeValue(t, "dns_table_host_conflicts", ""); got != 1 {
+				t.Errorf("expected 1 conflict, got %v", got)
+			}
+			answers, _ := h.lookupTable.Load().(*LookupTable).lookupHost(dns.TypeA, tt.host)
+			var got []string
+			for _, rr := range answers {
+				got = append(got, rr.(*dns.A).A.String())
+			}
+			sort.Strings(got)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v for %s, got %v", tt.want, tt.host, got)
+			}
+		})
+	}
+}
+
+func TestGlueRecords(t *testing.T) {
+	for _, glueRecords := range []bool{false, true} {
+		t.Run(fmt.Sprintf("glue-%t", glueRecords), func(t *testing.T) {
+			h := &LocalDNSServer{
+				searchNamespaces: []string{"ns1.svc.cluster.local"},
+				glueRecords:      glueRecords,
+			}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"www.google.com": {
+						Ips:      []string{"1.1.1.1"},
+						Registry: "External",
+					},
+				},
+			})
+			req := new(dns.Msg)
+			req.SetQuestion("www.google.com.ns1.svc.cluster.local.", dns.TypeA)
+			w := &recordingResponseWriter{}
+			h.ServeDNS(&dnsProxy{protocol: "udp"}, w, req)
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			targetA := a("www.google.com.", []net.IP{net.ParseIP("1.1.1.1").To4()})
+			// The chained answer is kept either way.
+			expectedAnswer := append(cname("www.google.com.ns1.svc.cluster.local.", "www.google.com."), targetA...)
+			if !equalsDNSrecords(w.msg.Answer, expectedAnswer) {
+				t.Errorf("expected answers %v, got %v", expectedAnswer, w.msg.Answer)
+			}
+			var expectedExtra []dns.RR
+			if glueRecords {
+				expectedExtra = targetA
+			}
+			if !equalsDNSrecords(w.msg.Extra, expectedExtra) {
+				t.Errorf("expected additional records %v, got %v", expectedExtra, w.msg.Extra)
+			}
+		})
+	}
+}
+
+func TestNoData(t *testing.T) {
+	testCases := []struct {
+		name   string
+		nodata bool
+		rcode  int
+	}{
+		{
+			name:  "legacy",
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:   "nodata",
+			nodata: true,
+			rcode:  dns.RcodeSuccess,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{nodata: tt.nodata}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"ipv4.localhost": {
+						Ips:      []string{"2.2.2.2"},
+						Registry: "External",
+					},
+				},
+			})
+			req := new(dns.Msg)
+			req.SetQuestion("ipv4.localhost.", dns.TypeAAAA)
+			w := &recordingResponseWriter{}
+			h.ServeDNS(&dnsProxy{protocol: "udp"}, w, req)
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if len(w.msg.Answer) != 0 {
+				t.Errorf("expected no answers, got %v", w.msg.Answer)
+			}
+		})
+	}
+}
+
+func TestSOA(t *testing.T) {
+	zoneSOA := []dns.RR{soa("cluster.local.")}
+	testCases := []struct {
+		name      string
+		soa       bool
+		host      string
+		qtype     uint16
+		rcode     int
+		answer    []dns.RR
+		authority []dns.RR
+	}{
+		{
+			name:      "negative answer in the zone",
+			soa:       true,
+			host:      "productpage.ns1.svc.cluster.local.",
+			qtype:     dns.TypeAAAA,
+			rcode:     dns.RcodeNameError,
+			authority: zoneSOA,
+		},
+		{
+			name:  "negative answer out of the zone",
+			soa:   true,
+			host:  "www.google.com.",
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:   "SOA query for the zone",
+			soa:    true,
+			host:   "cluster.local.",
+			qtype:  dns.TypeSOA,
+			rcode:  dns.RcodeSuccess,
+			answer: zoneSOA,
+		},
+		{
+			name:  "legacy negative answer in the zone",
+			host:  "productpage.ns1.svc.cluster.local.",
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeNameError,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{
+				proxyNamespace:   "ns1",
+				proxyDomain:      "svc.cluster.local",
+				proxyDomainParts: []string{"svc", "cluster", "local"},
+				soa:              tt.soa,
+			}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"productpage.ns1.svc.cluster.local": {
+						Ips:       []string{"9.9.9.9"},
+						Registry:  "Kubernetes",
+						Namespace: "ns1",
+						Shortname: "productpage",
+					},
+					"www.google.com": {
+						Ips:      []string{"1.1.1.1"},
+						Registry: "External",
+					},
+				},
+			})
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, tt.qtype)
+			w := &recordingResponseWriter{}
+			h.ServeDNS(&dnsProxy{protocol: "udp"}, w, req)
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if !equalsDNSrecords(w.msg.Answer, tt.answer) {
+				t.Errorf("expected answers %v, got %v", tt.answer, w.msg.Answer)
+			}
+			if !equalsDNSrecords(w.msg.Ns, tt.authority) {
+				t.Errorf("expected authority records %v, got %v", tt.authority, w.msg.Ns)
+			}
+		})
+	}
+}
+
+func TestDNS64(t *testing.T) {
+	prefix, err := newDNS64Prefix("64:ff9b::/96")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		name   string
+		prefix *net.IPNet
+		nodata bool
+		host   string
+		qtype  uint16
+		rcode  int
+		answer []dns.RR
+	}{
+		{
+			name:   "synthesized for an IPv4-only host",
+			prefix: prefix,
+			host:   "productpage.ns1.svc.cluster.local.",
+			qtype:  dns.TypeAAAA,
+			rcode:  dns.RcodeSuccess,
+			answer: aaaa("productpage.ns1.svc.cluster.local.", []net.IP{net.ParseIP("64:ff9b::909:909")}),
+		},
+		{
+			name:   "native IPv6 of a dual-stack host",
+			prefix: prefix,
+			host:   "details.ns1.svc.cluster.local.",
+			qtype:  dns.TypeAAAA,
+			rcode:  dns.RcodeSuccess,
+			answer: aaaa("details.ns1.svc.cluster.local.", []net.IP{net.ParseIP("2001:db8::1")}),
+		},
+		{
+			name:   "A query unchanged",
+			prefix: prefix,
+			host:   "productpage.ns1.svc.cluster.local.",
+			qtype:  dns.TypeA,
+			rcode:  dns.RcodeSuccess,
+			answer: a("productpage.ns1.svc.cluster.local.", []net.IP{net.ParseIP("9.9.9.9").To4()}),
+		},
+		{
+			name:  "disabled",
+			host:  "productpage.ns1.svc.cluster.local.",
+			qtype: dns.TypeAAAA,
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:   "disabled with NODATA",
+			nodata: true,
+			host:   "productpage.ns1.svc.cluster.local.",
+			qtype:  dns.TypeAAAA,
+			rcode:  dns.RcodeSuccess,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{
+				proxyNamespace:   "ns1",
+				proxyDomain:      "svc.cluster.local",
+				proxyDomainParts: []string{"svc", "cluster", "local"},
+				dns64Prefix:      tt.prefix,
+				nodata:           tt.nodata,
+			}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"productpage.ns1.svc.cluster.local": {
+						Ips:       []string{"9.9.9.9"},
+						Registry:  "Kubernetes",
+						Namespace: "ns1",
+						Shortname: "productpage",
+					},
+					"details.ns1.svc.cluster.local": {
+						Ips:       []string{"10.0.0.1", "2001:db8::1"},
+						Registry:  "Kubernetes",
+						Namespace: "ns1",
+						Shortname: "details",
+					},
+				},
+			})
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, tt.qtype)
+			w := &recordingResponseWriter{}
+			h.ServeDNS(&dnsProxy{protocol: "udp"}, w, req)
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			if !equalsDNSrecords(w.msg.Answer, tt.answer) {
+				t.Errorf("expected answers %v, got %v", tt.answer, w.msg.Answer)
+			}
+		})
+	}
+}
+
+func TestDNS64PrefixInvalid(t *testing.T) {
+	for _, cidr := range []string{"64:ff9b::/64", "10.0.0.0/8", "not a prefix"} {
+		if _, err := newDNS64Prefix(cidr); err == nil {
+			t.Errorf("expected %q to be rejected", cidr)
+		}
+	}
+}
+
+func TestInMemoryTransport(t *testing.T) {
+	h := &LocalDNSServer{
+		resolvConfServers: []string{"10.0.0.53:53"},
+	}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"productpage.ns1.svc.cluster.local": {
+				Ips:       []string{"9.9.9.9"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "productpage",
+			},
+		},
+	})
+	upstream := &fakeExchanger{answers: map[string][]dns.RR{
+		"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+	}}
+	p := newDNSProxyWithClient("udp", h, upstream)
+
+	testCases := []struct {
+		name     string
+		host     string
+		expected []dns.RR
+		queried  []string
+	}{
+		{
+			name:     "known host",
+			host:     "productpage.ns1.svc.cluster.local.",
+			expected: a("productpage.ns1.svc.cluster.local.", []net.IP{net.ParseIP("9.9.9.9").To4()}),
+		},
+		{
+			name:     "forwarded host",
+			host:     "www.example.com.",
+			expected: a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+			queried:  []string{"10.0.0.53:53"},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream.queried = nil
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, dns.TypeA)
+			w := &pipeResponseWriter{}
+			p.ServeDNS(w, req)
+
+			res, err := w.reply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Id != req.Id {
+				t.Errorf("expected response id %d, got %d", req.Id, res.Id)
+			}
+			if !equalsDNSrecords(res.Answer, tt.expected) {
+				t.Errorf("expected answers %v, got %v", tt.expected, res.Answer)
+			}
+			if !reflect.DeepEqual(upstream.queried, tt.queried) {
+				t.Errorf("expected upstream queries to %v, got %v", tt.queried, upstream.queried)
+			}
+		})
+	}
+}
+
+func TestSpecialNames(t *testing.T) {
+	searchNamespaces := []string{"ns1.svc.cluster.local"}
+	h := &LocalDNSServer{
+		resolvConfServers: []string{"10.0.0.53:53"},
+		searchNamespaces:  searchNamespaces,
+		specialNames:      newSpecialNames(defaultSpecialNames, searchNamespaces),
+	}
+	upstream := &fakeExchanger{answers: map[string][]dns.RR{
+		"localhost.":       a("localhost.", []net.IP{net.ParseIP("10.0.0.1").To4()}),
+		"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+	}}
+	p := newDNSProxyWithClient("udp", h, upstream)
+
+	// Special names are answered before the first name table is received.
+	req := new(dns.Msg)
+	req.SetQuestion("localhost.", dns.TypeA)
+	w := &recordingResponseWriter{}
+	h.ServeDNS(p, w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Fatalf("expected localhost to resolve without a name table, got %v", w.msg)
+	}
+	h.UpdateLookupTable(&nds.NameTable{})
+
+	testCases := []struct {
+		name     string
+		host     string
+		qtype    uint16
+		expected []dns.RR
+		queried  []string
+	}{
+		{
+			name:     "localhost",
+			host:     "localhost.",
+			qtype:    dns.TypeA,
+			expected: a("localhost.", []net.IP{net.ParseIP("127.0.0.1").To4()}),
+		},
+		{
+			name:     "localhost ipv6",
+			host:     "localhost.",
+			qtype:    dns.TypeAAAA,
+			expected: aaaa("localhost.", []net.IP{net.ParseIP("::1")}),
+		},
+		{
+			name:     "localhost.localdomain",
+			host:     "LOCALHOST.localdomain.",
+			qtype:    dns.TypeA,
+			expected: a("localhost.localdomain.", []net.IP{net.ParseIP("127.0.0.1").To4()}),
+		},
+		{
+			name:  "localhost expanded with the search namespace",
+			host:  "localhost.ns1.svc.cluster.local.",
+			qtype: dns.TypeA,
+			expected: append(cname("localhost.ns1.svc.cluster.local.", "localhost."),
+				a("localhost.", []net.IP{net.ParseIP("127.0.0.1").To4()})...),
+		},
+		{
+			name:  "localhost txt",
+			host:  "localhost.",
+			qtype: dns.TypeTXT,
+		},
+		{
+			name:  "localhost mx",
+			host:  "localhost.",
+			qtype: dns.TypeMX,
+		},
+		{
+			name:     "unrelated name",
+			host:     "www.example.com.",
+			qtype:    dns.TypeA,
+			expected: a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+			queried:  []string{"10.0.0.53:53"},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream.queried = nil
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, tt.qtype)
+			w := &pipeResponseWriter{}
+			p.ServeDNS(w, req)
+
+			res, err := w.reply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Rcode != dns.RcodeSuccess {
+				t.Errorf("expected NOERROR, got %s", dns.RcodeToString[res.Rcode])
+			}
+			if !equalsDNSrecords(res.Answer, tt.expected) {
+				t.Errorf("expected answers %v, got %v", tt.expected, res.Answer)
+			}
+			if !reflect.DeepEqual(upstream.queried, tt.queried) {
+				t.Errorf("expected upstream queries to %v, got %v", tt.queried, upstream.queried)
+			}
+		})
+	}
+}
+
+func TestResolve(t *testing.T) {
+	h := &LocalDNSServer{
+		resolvConfServers: []string{"10.0.0.53:53"},
+	}
+	upstream := &fakeExchanger{answers: map[string][]dns.RR{
+		"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+	}}
+	h.tcpDNSProxy = newDNSProxyWithClient("tcp", h, upstream)
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"www.google.com": {
+				Ips:      []string{"1.1.1.1"},
+				Registry: "External",
+			},
+		},
+	})
+
+	res := h.Resolve(dns.TypeA, "www.google.com", true)
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Errorf("expected the registry answer, got %v", res)
+	}
+	if len(upstream.queried) != 0 {
+		t.Errorf("expected registry hosts not to be forwarded upstream, got %v", upstream.queried)
+	}
+
+	res = h.Resolve(dns.TypeA, "www.example.com.", true)
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Errorf("expected the upstream answer, got %v", res)
+	}
+	if len(upstream.queried) != 1 {
+		t.Errorf("expected one upstream query, got %v", upstream.queried)
+	}
+
+	res = h.Resolve(dns.TypeA, "www.example.com.", false)
+	if res.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED without forwarding, got %v", res)
+	}
+	if len(upstream.queried) != 1 {
+		t.Errorf("expected no more upstream queries without forwarding, got %v", upstream.queried)
+	}
+}
+
+// Validates Resolve forwards over TCP when the server does not listen itself, as when DNS is not captured.
+func TestResolveWithoutProxies(t *testing.T) {
+	upstream := startUpstreamDNS(t, "tcp", func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		resp.Answer = a(req.Question[0].Name, []net.IP{net.ParseIP("93.184.216.34").To4()})
+		_ = w.WriteMsg(resp)
+	})
+	h := &LocalDNSServer{resolvConfServers: []string{upstream}}
+
+	res := h.Resolve(dns.TypeA, "www.example.com.", true)
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "93.184.216.34" {
+		t.Errorf("expected the upstream answer, got %v", res)
+	}
+}
+
+func TestANYQuery(t *testing.T) {
+	h := &LocalDNSServer{
+		resolvConfServers: []string{"10.0.0.53:53"},
+	}
+	upstream := &fakeExchanger{answers: map[string][]dns.RR{
+		"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+	}}
+	h.tcpDNSProxy = newDNSProxyWithClient("tcp", h, upstream)
+	var many []string
+	for i := 1; i <= 10; i++ {
+		many = append(many, fmt.Sprintf("10.0.0.%d", i), fmt.Sprintf("2001:db8::%d", i))
+	}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"dual.localhost": {
+				Ips:      []string{"2.2.2.2", "2001:db8:0:0:0:ff00:42:8329"},
+				Registry: "External",
+			},
+			"many.localhost": {
+				Ips:      many,
+				Registry: "External",
+			},
+		},
+	})
+
+	res := h.Resolve(dns.TypeANY, "dual.localhost.", true)
+	expected := append(aaaa("dual.localhost.", []net.IP{net.ParseIP("2001:db8:0:0:0:ff00:42:8329")}),
+		a("dual.localhost.", []net.IP{net.ParseIP("2.2.2.2").To4()})...)
+	if res.Rcode != dns.RcodeSuccess || !equalsDNSrecords(res.Answer, expected) {
+		t.Errorf("expected both addresses of the dual-stack host, got %v", res)
+	}
+
+	res = h.Resolve(dns.TypeANY, "many.localhost.", true)
+	var v4, v6 int
+	for _, rr := range res.Answer {
+		switch rr.(type) {
+		case *dns.A:
+			v4++
+		case *dns.AAAA:
+			v6++
+		}
+	}
+	if v4 != maxAnyAnswersPerFamily || v6 != maxAnyAnswersPerFamily {
+		t.Errorf("expected %d records of each family, got %d A and %d AAAA", maxAnyAnswersPerFamily, v4, v6)
+	}
+	if len(upstream.queried) != 0 {
+		t.Errorf("expected known hosts not to be forwarded upstream, got %v", upstream.queried)
+	}
+
+	res = h.Resolve(dns.TypeANY, "www.example.com.", true)
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+		t.Errorf("expected the upstream answer, got %v", res)
+	}
+	if len(upstream.queried) != 1 {
+		t.Errorf("expected the unknown host to be forwarded upstream, got %v", upstream.queried)
+	}
+}
+
+func TestMultipleQuestions(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  MultiQuestionPolicy
+		rcode   int
+		answers []string
+	}{
+		{
+			name:    "first question",
+			policy:  MultiQuestionFirst,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"1.1.1.1"},
+		},
+		{
+			name:   "format error",
+			policy: MultiQuestionFormErr,
+			rcode:  dns.RcodeFormatError,
+		},
+		{
+			name:    "answer all",
+			policy:  MultiQuestionAnswerAll,
+			rcode:   dns.RcodeSuccess,
+			answers: []string{"1.1.1.1", "2.2.2.2"},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{multiQuestion: tt.policy}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"www.google.com": {
+						Ips:      []string{"1.1.1.1"},
+						Registry: "External",
+					},
+					"www.bing.com": {
+						Ips:      []string{"2.2.2.2"},
+						Registry: "External",
+					},
+				},
+			})
+			req := new(dns.Msg)
+			req.SetQuestion("www.google.com.", dns.TypeA)
+			req.Question = append(req.Question, dns.Question{Name: "www.bing.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+			req.SetEdns0(1232, false)
+			w := &recordingResponseWriter{}
+			h.ServeDNS(&dnsProxy{protocol: "udp"}, w, req)
+			if w.msg == nil {
+				t.Fatal("no response written")
+			}
+			if w.msg.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[w.msg.Rcode])
+			}
+			var answers []string
+			for _, rr := range w.msg.Answer {
+				answers = append(answers, rr.(*dns.A).A.String())
+			}
+			if !reflect.DeepEqual(answers, tt.answers) {
+				t.Errorf("expected answers %v, got %v", tt.answers, answers)
+			}
+			if tt.policy == MultiQuestionAnswerAll {
+				if len(w.msg.Question) != 2 {
+					t.Errorf("expected both questions in the response, got %v", w.msg.Question)
+				}
+				var opts int
+				for _, rr := range w.msg.Extra {
+					if rr.Header().Rrtype == dns.TypeOPT {
+						opts++
+					}
+				}
+				if opts != 1 {
+					t.Errorf("expected a single OPT record, got %d", opts)
+				}
+			}
+		})
+	}
+}
+
+func TestScope(t *testing.T) {
+	testCases := []struct {
+		name      string
+		scope     []string
+		host      string
+		rcode     int
+		forwarded bool
+	}{
+		{
+			name:      "in scope",
+			scope:     []string{"cluster.local."},
+			host:      "kube-dns.kube-system.svc.cluster.local.",
+			rcode:     dns.RcodeSuccess,
+			forwarded: true,
+		},
+		{
+			name:      "in scope not found upstream",
+			scope:     []string{"cluster.local."},
+			host:      "missing.ns1.svc.cluster.local.",
+			rcode:     dns.RcodeNameError,
+			forwarded: true,
+		},
+		{
+			name:  "out of scope",
+			scope: []string{"cluster.local."},
+			host:  "www.example.com.",
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "suffix of a label is out of scope",
+			scope: []string{"cluster.local."},
+			host:  "mycluster.local.",
+			rcode: dns.RcodeRefused,
+		},
+		{
+			name:  "registry host out of scope",
+			scope: []string{"cluster.local."},
+			host:  "www.google.com.",
+			rcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "no scope",
+			host:      "www.example.com.",
+			rcode:     dns.RcodeSuccess,
+			forwarded: true,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{
+				resolvConfServers: []string{"10.0.0.53:53"},
+				scope:             tt.scope,
+			}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"www.google.com": {
+						Ips:      []string{"1.1.1.1"},
+						Registry: "External",
+					},
+				},
+			})
+			upstream := &fakeExchanger{answers: map[string][]dns.RR{
+				"kube-dns.kube-system.svc.cluster.local.": a("kube-dns.kube-system.svc.cluster.local.",
+					[]net.IP{net.ParseIP("10.96.0.10").To4()}),
+				"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+			}}
+			p := newDNSProxyWithClient("udp", h, upstream)
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, dns.TypeA)
+			w := &pipeResponseWriter{}
+			p.ServeDNS(w, req)
+			res, err := w.reply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[res.Rcode])
+			}
+			if forwarded := len(upstream.queried) > 0; forwarded != tt.forwarded {
+				t.Errorf("expected forwarded upstream %v, got %v", tt.forwarded, forwarded)
+			}
+		})
+	}
+}
+
+func TestAuthoritativeServices(t *testing.T) {
+	testCases := []struct {
+		name          string
+		authoritative bool
+		host          string
+		rcode         int
+		forwarded     bool
+	}{
+		{
+			name:          "unknown service",
+			authoritative: true,
+			host:          "nonexistent.ns1.svc.cluster.local.",
+			rcode:         dns.RcodeNameError,
+		},
+		{
+			name:          "search domain expansion",
+			authoritative: true,
+			host:          "www.example.com.ns1.svc.cluster.local.",
+			rcode:         dns.RcodeNameError,
+		},
+		{
+			name:          "pod of a known headless service",
+			authoritative: true,
+			host:          "web-0.web.ns1.svc.cluster.local.",
+			rcode:         dns.RcodeSuccess,
+			forwarded:     true,
+		},
+		{
+			name:          "pod name outside the service domain",
+			authoritative: true,
+			host:          "10-0-0-1.ns1.pod.cluster.local.",
+			rcode:         dns.RcodeSuccess,
+			forwarded:     true,
+		},
+		{
+			name:          "external name",
+			authoritative: true,
+			host:          "www.example.com.",
+			rcode:         dns.RcodeSuccess,
+			forwarded:     true,
+		},
+		{
+			name:      "legacy unknown service",
+			host:      "nonexistent.ns1.svc.cluster.local.",
+			rcode:     dns.RcodeNameError,
+			forwarded: true,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{
+				resolvConfServers:     []string{"10.0.0.53:53"},
+				proxyNamespace:        "ns1",
+				proxyDomain:           "svc.cluster.local",
+				proxyDomainParts:      []string{"svc", "cluster", "local"},
+				authoritativeServices: tt.authoritative,
+			}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"web.ns1.svc.cluster.local": {
+						Ips:       []string{"10.0.0.1"},
+						Registry:  "Kubernetes",
+						Namespace: "ns1",
+						Shortname: "web",
+					},
+				},
+			})
+			upstream := &fakeExchanger{answers: map[string][]dns.RR{
+				"web-0.web.ns1.svc.cluster.local.": a("web-0.web.ns1.svc.cluster.local.",
+					[]net.IP{net.ParseIP("10.0.0.1").To4()}),
+				"10-0-0-1.ns1.pod.cluster.local.": a("10-0-0-1.ns1.pod.cluster.local.",
+					[]net.IP{net.ParseIP("10.0.0.1").To4()}),
+				"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+			}}
+			p := newDNSProxyWithClient("udp", h, upstream)
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, dns.TypeA)
+			w := &pipeResponseWriter{}
+			p.ServeDNS(w, req)
+			res, err := w.reply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[res.Rcode])
+			}
+			if forwarded := len(upstream.queried) > 0; forwarded != tt.forwarded {
+				t.Errorf("expected forwarded upstream %v, got %v", tt.forwarded, forwarded)
+			}
+		})
+	}
+}
+
+func TestEmptyHostFallback(t *testing.T) {
+	testCases := []struct {
+		name          string
+		authoritative bool
+		fallback      bool
+		nodata        bool
+		host          string
+		rcode         int
+		forwarded     bool
+	}{
+		{
+			name:          "known service without addresses",
+			authoritative: true,
+			host:          "pending.ns1.svc.cluster.local.",
+			rcode:         dns.RcodeNameError,
+		},
+		{
+			name:          "known service without addresses with fallback",
+			authoritative: true,
+			fallback:      true,
+			host:          "pending.ns1.svc.cluster.local.",
+			rcode:         dns.RcodeSuccess,
+			forwarded:     true,
+		},
+		{
+			name:          "unknown service with fallback",
+			authoritative: true,
+			fallback:      true,
+			host:          "nonexistent.ns1.svc.cluster.local.",
+			rcode:         dns.RcodeNameError,
+		},
+		{
+			name:          "known service with fallback",
+			authoritative: true,
+			fallback:      true,
+			host:          "web.ns1.svc.cluster.local.",
+			rcode:         dns.RcodeSuccess,
+		},
+		{
+			name:  "default known service without addresses",
+			host:  "pending.ns1.svc.cluster.local.",
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:  "default short name of a known service without addresses",
+			host:  "pending.",
+			rcode: dns.RcodeNameError,
+		},
+		{
+			name:   "default known service without addresses with nodata",
+			nodata: true,
+			host:   "pending.ns1.svc.cluster.local.",
+			rcode:  dns.RcodeSuccess,
+		},
+		{
+			name:      "default known service without addresses with fallback",
+			fallback:  true,
+			host:      "pending.ns1.svc.cluster.local.",
+			rcode:     dns.RcodeSuccess,
+			forwarded: true,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LocalDNSServer{
+				resolvConfServers:     []string{"10.0.0.53:53"},
+				proxyNamespace:        "ns1",
+				proxyDomain:           "svc.cluster.local",
+				proxyDomainParts:      []string{"svc", "cluster", "local"},
+				authoritativeServices: tt.authoritative,
+				emptyHostFallback:     tt.fallback,
+				nodata:                tt.nodata,
+			}
+			h.UpdateLookupTable(&nds.NameTable{
+				Table: map[string]*nds.NameTable_NameInfo{
+					"web.ns1.svc.cluster.local": {
+						Ips:       []string{"10.0.0.1"},
+						Registry:  "Kubernetes",
+						Namespace: "ns1",
+						Shortname: "web",
+					},
+					"pending.ns1.svc.cluster.local": {
+						Registry:  "Kubernetes",
+						Namespace: "ns1",
+						Shortname: "pending",
+					},
+				},
+			})
+			upstream := &fakeExchanger{answers: map[string][]dns.RR{
+				"pending.ns1.svc.cluster.local.": a("pending.ns1.svc.cluster.local.",
+					[]net.IP{net.ParseIP("10.0.0.2").To4()}),
+			}}
+			p := newDNSProxyWithClient("udp", h, upstream)
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.host, dns.TypeA)
+			w := &pipeResponseWriter{}
+			p.ServeDNS(w, req)
+			res, err := w.reply()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Rcode != tt.rcode {
+				t.Errorf("expected rcode %s, got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[res.Rcode])
+			}
+			if forwarded := len(upstream.queried) > 0; forwarded != tt.forwarded {
+				t.Errorf("expected forwarded upstream %v, got %v", tt.forwarded, forwarded)
+			}
+		})
+	}
+}
+
+// fakeExchanger is an upstream nameserver answering from a fixed set of records.
+type fakeExchanger struct {
+	answers map[string][]dns.RR
+	queried []string
+}
+
+func (f *fakeExchanger) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	f.queried = append(f.queried, address)
+	response := new(dns.Msg)
+	response.SetReply(m)
+	response.Answer = f.answers[m.Question[0].Name]
+	if len(response.Answer) == 0 {
+		response.Rcode = dns.RcodeNameError
+	}
+	return response, 0, nil
+}
+
+func TestResponseTransform(t *testing.T) {
+	h := &LocalDNSServer{
+		proxyNamespace:    "ns1",
+		proxyDomain:       "svc.cluster.local",
+		proxyDomainParts:  []string{"svc", "cluster", "local"},
+		resolvConfServers: []string{"10.0.0.53:53"},
+	}
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"productpage.ns1.svc.cluster.local": {
+				Ips:       []string{"9.9.9.9"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "productpage",
+			},
+		},
+	})
+	upstream := &fakeExchanger{answers: map[string][]dns.RR{
+		"www.example.com.": withTTL(a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}), 300),
+	}}
+	p := newDNSProxyWithClient("udp", h, upstream)
+
+	// The transform caps the TTLs, and drops the answers for dropped.example.com.
+	const maxTTL = 5
+	h.responseTransform = func(req *dns.Msg, resp *dns.Msg) *dns.Msg {
+		if req.Question[0].Name == "dropped.example.com." {
+			return nil
+		}
+		for i, rr := range resp.Answer {
+			if rr.Header().Ttl > maxTTL {
+				rr = dns.Copy(rr)
+				rr.Header().Ttl = maxTTL
+				resp.Answer[i] = rr
+			}
+		}
+		return resp
+	}
+
+	for _, host := range []string{"productpage.ns1.svc.cluster.local.", "www.example.com."} {
+		t.Run(host, func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion(host, dns.TypeA)
+			w := &recordingResponseWriter{}
+			p.ServeDNS(w, req)
+			if w.msg == nil || len(w.msg.Answer) != 1 {
+				t.Fatalf("expected a single answer, got %v", w.msg)
+			}
+			if ttl := w.msg.Answer[0].Header().Ttl; ttl != maxTTL {
+				t.Errorf("expected the TTL to be capped to %d, got %d", maxTTL, ttl)
+			}
+		})
+	}
+	// The records of the lookup table are left alone.
+	answers, _ := h.lookupTable.Load().(*LookupTable).lookupHost(dns.TypeA, "productpage.ns1.svc.cluster.local.")
+	if ttl := answers[0].Header().Ttl; ttl != defaultTTLInSeconds {
+		t.Errorf("expected the lookup table to keep its TTL, got %d", ttl)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("dropped.example.com.", dns.TypeA)
+	w := &recordingResponseWriter{}
+	p.ServeDNS(w, req)
+	if w.msg != nil {
+		t.Errorf("expected no response to be written, got %v", w.msg)
+	}
+}
+
+// pipeResponseWriter is a dns.ResponseWriter keeping the wire format of the message written to it.
+type pipeResponseWriter struct {
+	recordingResponseWriter
+	buf []byte
+}
+
+func (w *pipeResponseWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func (w *pipeResponseWriter) Write(buf []byte) (int, error) {
+	w.buf = append([]byte(nil), buf...)
+	return len(buf), nil
+}
+
+// reply decodes the message written to the pipe, as a client reading it off the socket would.
+func (w *pipeResponseWriter) reply() (*dns.Msg, error) {
+	if w.buf == nil {
+		return nil, fmt.Errorf("no response written")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(w.buf); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// recordingResponseWriter is a dns.ResponseWriter keeping the message written to it.
+type recordingResponseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *recordingResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 15053}
+}
+
+func (w *recordingResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+}
+
+func (w *recordingResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *recordingResponseWriter) Write([]byte) (int, error) {
+	return 0, nil
+}
+
+func (w *recordingResponseWriter) Close() error {
+	return nil
+}
+
+func (w *recordingResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (w *recordingResponseWriter) TsigTimersOnly(bool) {}
+
+func (w *recordingResponseWriter) Hijack() {}
+
 // reflect.DeepEqual doesn't seem to work well for dns.RR
 // as the Rdlength field is not updated in the a(), or aaaa() calls.
 // so zero them out before doing reflect.Deepequal
@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"time"
+
+	"istio.io/pkg/monitoring"
+)
+
+func init() {
+	monitoring.MustRegister(tableHosts, tableRecords, tableLastUpdate, tableUpdateDuration, tableEmptyUpdatesRefused,
+		tableHostConflicts, upstreamInFlight, upstreamRejected)
+}
+
+var (
+	tableHosts = monitoring.NewGauge(
+		"dns_table_hosts",
+		"The number of names in the DNS lookup table built from the name table of istiod.",
+	)
+
+	tableRecords = monitoring.NewGauge(
+		"dns_table_records",
+		"The number of records in the DNS lookup table built from the name table of istiod, by type A, AAAA or CNAME.",
+		monitoring.WithLabels(typeTag),
+	)
+
+	tableLastUpdate = monitoring.NewGauge(
+		"dns_table_last_update_timestamp_seconds",
+		"The time the DNS lookup table was last built from the name table of istiod, in seconds since the epoch.",
+	)
+
+	tableUpdateDuration = monitoring.NewDistribution(
+		"dns_table_update_duration_seconds",
+		"The time in seconds taken to build the DNS lookup table from the name table of istiod.",
+		[]float64{.001, .01, .1, .5, 1, 5},
+	)
+
+	tableEmptyUpdatesRefused = monitoring.NewSum(
+		"dns_table_empty_updates_refused",
+		"The number of name tables without any host refused as the DNS lookup table had hosts.",
+	)
+
+	tableHostConflicts = monitoring.NewGauge(
+		"dns_table_host_conflicts",
+		"The number of names of the DNS lookup table last built that several hosts of the name table of istiod expand to.",
+	)
+
+	upstreamInFlight = monitoring.NewGauge(
+		"dns_upstream_queries_in_flight",
+		"The number of DNS queries forwarded upstream and waiting for an answer.",
+	)
+
+	upstreamRejected = monitoring.NewSum(
+		"dns_upstream_queries_rejected",
+		"Total number of DNS queries failed rather than forwarded upstream, for exceeding the concurrency limit.",
+	)
+)
+
+// recordTableMetrics reports the size of a lookup table, just built.
+func recordTableMetrics(table *LookupTable) {
+	var a, aaaa, cname int
+	for _, rrs := range table.name4 {
+		a += len(rrs)
+	}
+	for _, rrs := range table.name6 {
+		aaaa += len(rrs)
+	}
+	for _, rrs := range table.cname {
+		cname += len(rrs)
+	}
+	tableHosts.Record(float64(len(table.allHosts)))
+	tableRecords.With(typeTag.Value("A")).Record(float64(a))
+	tableRecords.With(typeTag.Value("AAAA")).Record(float64(aaaa))
+	tableRecords.With(typeTag.Value("CNAME")).Record(float64(cname))
+	tableLastUpdate.Record(float64(time.Now().UnixNano()) / float64(time.Second))
+}
@@ -0,0 +1,128 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+
+	nds "istio.io/istio/pilot/pkg/proto"
+)
+
+func TestTableMetrics(t *testing.T) {
+	h := &LocalDNSServer{
+		proxyNamespace:   "ns1",
+		proxyDomain:      "svc.cluster.local",
+		proxyDomainParts: []string{"svc", "cluster", "local"},
+		searchNamespaces: []string{"ns1.svc.cluster.local"},
+	}
+	h.UpdateLookupTable(&nds.NameTable{})
+	if hosts := gaugeValue(t, "dns_table_hosts", ""); hosts != 0 {
+		t.Errorf("expected an empty table, got %v hosts", hosts)
+	}
+	before := gaugeValue(t, "dns_table_last_update_timestamp_seconds", "")
+
+	time.Sleep(10 * time.Millisecond)
+	h.UpdateLookupTable(&nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"www.google.com": {
+				Ips:      []string{"1.1.1.1", "2001:db8::1"},
+				Registry: "External",
+			},
+			"productpage.ns1.svc.cluster.local": {
+				Ips:       []string{"9.9.9.9"},
+				Registry:  "Kubernetes",
+				Namespace: "ns1",
+				Shortname: "productpage",
+			},
+		},
+	})
+	table := h.lookupTable.Load().(*LookupTable)
+	if hosts := gaugeValue(t, "dns_table_hosts", ""); hosts != float64(len(table.allHosts)) {
+		t.Errorf("expected %d hosts, got %v", len(table.allHosts), hosts)
+	}
+	for recordType, expected := range map[string]float64{
+		// www.google.com., and productpage., productpage.ns1., productpage.ns1.svc. and the FQDN
+		"A":    5,
+		"AAAA": 1,
+		// the names expanded with the search namespace, but for the productpage FQDN it already is
+		"CNAME": 4,
+	} {
+		if got := gaugeValue(t, "dns_table_records", recordType); got != expected {
+			t.Errorf("expected %v %s records, got %v", expected, recordType, got)
+		}
+	}
+	if after := gaugeValue(t, "dns_table_last_update_timestamp_seconds", ""); after <= before {
+		t.Errorf("expected the last update timestamp to advance from %v, got %v", before, after)
+	}
+}
+
+// gaugeValue returns the value of a gauge, for the tag value if set.
+func gaugeValue(t *testing.T, name string, tag string) float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for metric %s: %v", name, err)
+	}
+	for _, row := range rows {
+		if tag == "" && len(row.Tags) == 0 {
+			return row.Data.(*view.LastValueData).Value
+		}
+		for _, tg := range row.Tags {
+			if tg.Value == tag {
+				return row.Data.(*view.LastValueData).Value
+			}
+		}
+	}
+	return 0
+}
+
+func TestEmptyTableRefused(t *testing.T) {
+	nt := &nds.NameTable{
+		Table: map[string]*nds.NameTable_NameInfo{
+			"www.google.com": {Ips: []string{"1.1.1.1"}, Registry: "External"},
+		},
+	}
+	hosts := func(h *LocalDNSServer) int {
+		return len(h.lookupTable.Load().(*LookupTable).allHosts)
+	}
+
+	// An empty table replaces an empty one.
+	h := &LocalDNSServer{}
+	h.UpdateLookupTable(&nds.NameTable{})
+	if h.lookupTable.Load() == nil {
+		t.Fatal("expected the empty table to be applied over no table")
+	}
+
+	// But not one with hosts.
+	h.UpdateLookupTable(nt)
+	before := metricValue(t, "dns_table_empty_updates_refused", "")
+	h.UpdateLookupTable(&nds.NameTable{})
+	if got := hosts(h); got != 1 {
+		t.Errorf("expected the table to keep its host, got %d hosts", got)
+	}
+	if got := metricValue(t, "dns_table_empty_updates_refused", ""); got != before+1 {
+		t.Errorf("expected dns_table_empty_updates_refused to be %v, got %v", before+1, got)
+	}
+
+	// Unless allowed.
+	h.allowEmptyTable = true
+	h.UpdateLookupTable(&nds.NameTable{})
+	if got := hosts(h); got != 0 {
+		t.Errorf("expected the empty table to be applied, got %d hosts", got)
+	}
+}
@@ -16,6 +16,7 @@ package dns
 
 import (
 	"net"
+	"time"
 
 	"github.com/miekg/dns"
 
@@ -28,39 +29,64 @@ type dnsProxy struct {
 
 	// This is the upstream Client used to make upstream DNS queries
 	// in case the data is not in our cache.
-	upstreamClient *dns.Client
+	upstreamClient upstreamExchanger
 	protocol       string
 	resolver       *LocalDNSServer
 }
 
-func newDNSProxy(protocol string, resolver *LocalDNSServer) (*dnsProxy, error) {
-	p := &dnsProxy{
-		downstreamMux:    dns.NewServeMux(),
-		downstreamServer: &dns.Server{},
-		upstreamClient: &dns.Client{
-			Net: protocol,
-		},
-		protocol: protocol,
-		resolver: resolver,
-	}
+// upstreamExchanger sends a query to an upstream nameserver. It is implemented by dns.Client.
+type upstreamExchanger interface {
+	Exchange(m *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error)
+}
+
+var _ upstreamExchanger = &dns.Client{}
+
+func newDNSProxy(protocol, address string, resolver *LocalDNSServer) (*dnsProxy, error) {
+	p := newDNSProxyWithClient(protocol, resolver, &dns.Client{
+		Net: protocol,
+	})
 
 	var err error
-	p.downstreamMux.Handle(".", p)
-	p.downstreamServer.Handler = p.downstreamMux
 	if protocol == "udp" {
-		p.downstreamServer.PacketConn, err = net.ListenPacket("udp", ":15053")
+		p.downstreamServer.PacketConn, err = net.ListenPacket("udp", address)
 	} else {
-		p.downstreamServer.Listener, err = net.Listen("tcp", ":15053")
+		p.downstreamServer.Listener, err = net.Listen("tcp", address)
 	}
 	if err != nil {
-		log.Errorf("Failed to listen on %s port 15053: %v", protocol, err)
+		log.Errorf("Failed to listen on %s %s: %v", protocol, address, err)
 		return nil, err
 	}
 	return p, nil
 }
 
+// newDNSProxyWithClient creates a proxy querying upstream with client. Its downstream server is not bound
+// to a socket yet, so queries can be served in memory through ServeDNS.
+func newDNSProxyWithClient(protocol string, resolver *LocalDNSServer, client upstreamExchanger) *dnsProxy {
+	p := &dnsProxy{
+		downstreamMux:    dns.NewServeMux(),
+		downstreamServer: &dns.Server{},
+		upstreamClient:   client,
+		protocol:         protocol,
+		resolver:         resolver,
+	}
+	p.downstreamMux.Handle(".", p)
+	p.downstreamServer.Handler = p.downstreamMux
+	return p
+}
+
+// downstreamAddress returns the address the downstream server listens on.
+func (p *dnsProxy) downstreamAddress() string {
+	if p.downstreamServer.PacketConn != nil {
+		return p.downstreamServer.PacketConn.LocalAddr().String()
+	}
+	if p.downstreamServer.Listener != nil {
+		return p.downstreamServer.Listener.Addr().String()
+	}
+	return ""
+}
+
 func (p *dnsProxy) start() {
-	log.Infof("Starting local %s DNS server at 0.0.0.0:15053", p.protocol)
+	log.Infof("Starting local %s DNS server at %s", p.protocol, p.downstreamAddress())
 	err := p.downstreamServer.ActivateAndServe()
 	if err != nil {
 		log.Errorf("Local %s DNS server terminated: %v", p.protocol, err)
@@ -0,0 +1,116 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+	"golang.org/x/time/rate"
+
+	"istio.io/pkg/monitoring"
+)
+
+func init() {
+	monitoring.MustRegister(queriesThrottled)
+}
+
+var queriesThrottled = monitoring.NewSum(
+	"dns_queries_throttled",
+	"Total number of DNS queries refused rather than forwarded upstream, for exceeding the rate limit.",
+)
+
+// maxLimitedSources bounds the number of clients a per source limiter keeps track of. The least recently seen
+// client is forgotten first, and starts over with a full burst when it comes back.
+const maxLimitedSources = 1024
+
+// queryLimiter caps the rate of queries forwarded to the upstream nameservers, either for all the clients
+// together or for each client address. A nil limiter lets every query through.
+type queryLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu sync.Mutex
+	// global is the limiter shared by all clients, nil if limiting per source.
+	global *rate.Limiter
+	// sources holds the limiter of each client address, if limiting per source.
+	sources simplelru.LRUCache
+	now     func() time.Time
+}
+
+// newQueryLimiter creates a limiter letting qps queries per second through, with bursts of up to burst queries.
+func newQueryLimiter(qps float64, burst int, perSource bool) (*queryLimiter, error) {
+	if qps <= 0 || burst <= 0 {
+		return nil, fmt.Errorf("invalid DNS rate limit of %v queries per second with a burst of %d", qps, burst)
+	}
+	l := &queryLimiter{
+		limit: rate.Limit(qps),
+		burst: burst,
+		now:   time.Now,
+	}
+	if !perSource {
+		l.global = rate.NewLimiter(l.limit, l.burst)
+		return l, nil
+	}
+	sources, err := simplelru.NewLRU(maxLimitedSources, nil)
+	if err != nil {
+		return nil, err
+	}
+	l.sources = sources
+	return l, nil
+}
+
+// allow reports whether a query from addr may be forwarded upstream now.
+func (l *queryLimiter) allow(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter := l.global
+	if limiter == nil {
+		source := sourceIP(addr)
+		if v, f := l.sources.Get(source); f {
+			limiter = v.(*rate.Limiter)
+		} else {
+			limiter = rate.NewLimiter(l.limit, l.burst)
+			l.sources.Add(source, limiter)
+		}
+	}
+	if limiter.AllowN(l.now(), 1) {
+		return true
+	}
+	queriesThrottled.Increment()
+	return false
+}
+
+// sourceIP is the address of a client, without the port that changes from one query to the next.
+func sourceIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
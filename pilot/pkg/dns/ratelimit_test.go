@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamRateLimit(t *testing.T) {
+	clientA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	clientB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 40000}
+	testCases := []struct {
+		name      string
+		perSource bool
+		// the client sending each query, and whether it is expected to be forwarded upstream
+		clients  []net.Addr
+		resolved []bool
+	}{
+		{
+			name:     "global",
+			clients:  []net.Addr{clientA, clientA, clientB, clientA},
+			resolved: []bool{true, true, false, false},
+		},
+		{
+			name:      "per source",
+			perSource: true,
+			clients:   []net.Addr{clientA, clientA, clientB, clientA, clientB},
+			resolved:  []bool{true, true, true, false, true},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, err := newQueryLimiter(1, 2, tt.perSource)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now := time.Now()
+			limiter.now = func() time.Time { return now }
+			h := &LocalDNSServer{
+				resolvConfServers: []string{"10.0.0.53:53"},
+				upstreamLimiter:   limiter,
+			}
+			upstream := &fakeExchanger{answers: map[string][]dns.RR{
+				"www.example.com.": a("www.example.com.", []net.IP{net.ParseIP("93.184.216.34").To4()}),
+			}}
+			p := newDNSProxyWithClient("udp", h, upstream)
+
+			throttled := metricValue(t, "dns_queries_throttled", "")
+			send := func(client net.Addr) *dns.Msg {
+				req := new(dns.Msg)
+				req.SetQuestion("www.example.com.", dns.TypeA)
+				w := &sourceResponseWriter{source: client}
+				p.ServeDNS(w, req)
+				res, err := w.reply()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return res
+			}
+			expectedThrottled := 0
+			for i, client := range tt.clients {
+				res := send(client)
+				if tt.resolved[i] {
+					if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+						t.Errorf("query %d from %v: expected an answer, got %v", i, client, res)
+					}
+				} else {
+					expectedThrottled++
+					if res.Rcode != dns.RcodeRefused || len(res.Answer) != 0 {
+						t.Errorf("query %d from %v: expected REFUSED, got %v", i, client, res)
+					}
+				}
+			}
+			if d := metricValue(t, "dns_queries_throttled", "") - throttled; d != float64(expectedThrottled) {
+				t.Errorf("expected %d throttled queries, got %v", expectedThrottled, d)
+			}
+			if len(upstream.queried) != len(tt.clients)-expectedThrottled {
+				t.Errorf("expected %d upstream queries, got %d", len(tt.clients)-expectedThrottled, len(upstream.queried))
+			}
+
+			// The bucket refills at the configured rate.
+			now = now.Add(time.Second)
+			if res := send(clientA); res.Rcode != dns.RcodeSuccess {
+				t.Errorf("expected an answer once under the rate again, got %v", res)
+			}
+		})
+	}
+}
+
+func TestQueryLimiterInvalid(t *testing.T) {
+	if _, err := newQueryLimiter(0, 10, false); err == nil {
+		t.Error("expected an error for a zero rate")
+	}
+	if _, err := newQueryLimiter(10, 0, true); err == nil {
+		t.Error("expected an error for a zero burst")
+	}
+}
+
+// sourceResponseWriter is a pipeResponseWriter for queries from source.
+type sourceResponseWriter struct {
+	pipeResponseWriter
+	source net.Addr
+}
+
+func (w *sourceResponseWriter) RemoteAddr() net.Addr {
+	return w.source
+}
@@ -510,6 +510,9 @@ type NodeMetadata struct {
 	// DNSCapture indicates whether the workload has enabled dns capture
 	DNSCapture string `json:"DNS_CAPTURE,omitempty"`
 
+	// NameTableCompression is the compression of the name tables the agent accepts, if any. Only "gzip" is supported.
+	NameTableCompression string `json:"NAME_TABLE_COMPRESSION,omitempty"`
+
 	// AutoRegister will enable auto registration of the connected endpoint to the service registry using the given WorkloadGroup name
 	AutoRegisterGroup string `json:"AUTO_REGISTER_GROUP,omitempty"`
 
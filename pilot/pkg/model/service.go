@@ -433,6 +433,10 @@ type ServiceAttributes struct {
 	// Applicable to both Kubernetes and ServiceEntries.
 	LabelSelectors map[string]string
 
+	// DNSTTL is the ttl, in seconds, of the DNS records served by the agents for the service.
+	// Zero means the agent default. Applicable to ServiceEntries.
+	DNSTTL uint32
+
 	// For Kubernetes platform
 
 	// ClusterExternalAddresses is a mapping between a cluster name and the external
@@ -15,6 +15,8 @@
 package v1alpha3
 
 import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+
 	"istio.io/istio/pilot/pkg/model"
 	nds "istio.io/istio/pilot/pkg/proto"
 	"istio.io/istio/pilot/pkg/serviceregistry"
@@ -66,6 +68,7 @@ func (configgen *ConfigGeneratorImpl) BuildNameTable(node *model.Proxy, push *mo
 
 		svcAddress := svc.GetServiceAddressForProxy(node, push)
 		var addressList []string
+		var endpoints []*nds.NameTable_Endpoint
 
 		// The IP will be unspecified here if its headless service or if the auto
 		// IP allocation logic for service entry was unable to allocate an IP.
@@ -81,6 +84,12 @@ func (configgen *ConfigGeneratorImpl) BuildNameTable(node *model.Proxy, push *mo
 				for _, instance := range push.ServiceInstancesByPort(svc, svc.Ports[0].Port, nil) {
 					// TODO: should we skip the node's own IP like we do in listener?
 					addressList = append(addressList, instance.Endpoint.Address)
+					endpoints = append(endpoints, &nds.NameTable_Endpoint{
+						Ip:        instance.Endpoint.Address,
+						Unhealthy: instance.Endpoint.EnvoyEndpoint.GetHealthStatus() == core.HealthStatus_UNHEALTHY,
+						Locality:  instance.Endpoint.Locality.Label,
+						Weight:    instance.Endpoint.LbWeight,
+					})
 				}
 			}
 
@@ -94,8 +103,10 @@ func (configgen *ConfigGeneratorImpl) BuildNameTable(node *model.Proxy, push *mo
 		}
 
 		nameInfo := &nds.NameTable_NameInfo{
-			Ips:      addressList,
-			Registry: svc.Attributes.ServiceRegistry,
+			Ips:       addressList,
+			Registry:  svc.Attributes.ServiceRegistry,
+			Endpoints: endpoints,
+			Ttl:       svc.Attributes.DNSTTL,
 		}
 		if svc.Attributes.ServiceRegistry == string(serviceregistry.Kubernetes) {
 			// The agent will take care of resolving a, a.ns, a.ns.svc, etc.
@@ -0,0 +1,99 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v1alpha3
+
+import (
+	"testing"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"istio.io/istio/pilot/pkg/model"
+	nds "istio.io/istio/pilot/pkg/proto"
+	"istio.io/istio/pilot/pkg/serviceregistry"
+	"istio.io/istio/pkg/config/constants"
+	"istio.io/istio/pkg/config/host"
+	"istio.io/istio/pkg/config/protocol"
+)
+
+func TestBuildNameTableHeadlessEndpoints(t *testing.T) {
+	servicePort := &model.Port{
+		Name:     "http",
+		Port:     80,
+		Protocol: protocol.HTTP,
+	}
+	service := &model.Service{
+		Hostname:   host.Name("headless.default.svc.cluster.local"),
+		Address:    constants.UnspecifiedIP,
+		Ports:      model.PortList{servicePort},
+		Resolution: model.Passthrough,
+		Attributes: model.ServiceAttributes{
+			ServiceRegistry: string(serviceregistry.Kubernetes),
+			Name:            "headless",
+			Namespace:       "default",
+		},
+	}
+	instances := []*model.ServiceInstance{
+		{
+			Service:     service,
+			ServicePort: servicePort,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "10.0.0.1",
+				EndpointPort: 8080,
+				Locality: model.Locality{
+					Label: "region1/zone1/subzone1",
+				},
+				LbWeight: 3,
+			},
+		},
+		{
+			Service:     service,
+			ServicePort: servicePort,
+			Endpoint: &model.IstioEndpoint{
+				Address:      "10.0.0.2",
+				EndpointPort: 8080,
+				Locality: model.Locality{
+					Label: "region1/zone2/subzone1",
+				},
+				EnvoyEndpoint: &endpoint.LbEndpoint{
+					HealthStatus: core.HealthStatus_UNHEALTHY,
+				},
+			},
+		},
+	}
+
+	cg := NewConfigGenTest(t, TestOptions{
+		Services:  []*model.Service{service},
+		Instances: instances,
+	})
+	proxy := cg.SetupProxy(nil)
+	nt := cg.ConfigGen.BuildNameTable(proxy, cg.PushContext())
+
+	want := &nds.NameTable_NameInfo{
+		Ips:       []string{"10.0.0.1", "10.0.0.2"},
+		Registry:  string(serviceregistry.Kubernetes),
+		Shortname: "headless",
+		Namespace: "default",
+		Endpoints: []*nds.NameTable_Endpoint{
+			{Ip: "10.0.0.1", Locality: "region1/zone1/subzone1", Weight: 3},
+			{Ip: "10.0.0.2", Unhealthy: true, Locality: "region1/zone2/subzone1"},
+		},
+	}
+	if diff := cmp.Diff(nt.Table[string(service.Hostname)], want, protocmp.Transform()); diff != "" {
+		t.Fatalf("name table entry does not match expected value:\n %v", diff)
+	}
+}
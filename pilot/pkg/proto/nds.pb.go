@@ -33,7 +33,7 @@ func (m *NameTable) Reset()         { *m = NameTable{} }
 func (m *NameTable) String() string { return proto.CompactTextString(m) }
 func (*NameTable) ProtoMessage()    {}
 func (*NameTable) Descriptor() ([]byte, []int) {
-	return fileDescriptor_nds_e4011d50349a6001, []int{0}
+	return fileDescriptor_nds_b6d9b63f980cb1d0, []int{0}
 }
 func (m *NameTable) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_NameTable.Unmarshal(m, b)
@@ -65,8 +65,13 @@ type NameTable_NameInfo struct {
 	// the registry where this
 	Registry string `protobuf:"bytes,2,opt,name=registry,proto3" json:"registry,omitempty"`
 	// these are set only for k8s services
-	Shortname            string   `protobuf:"bytes,3,opt,name=shortname,proto3" json:"shortname,omitempty"`
-	Namespace            string   `protobuf:"bytes,4,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	Shortname string `protobuf:"bytes,3,opt,name=shortname,proto3" json:"shortname,omitempty"`
+	Namespace string `protobuf:"bytes,4,opt,name=namespace,proto3" json:"namespace,omitempty"`
+	// health and locality of the ips, when known. Ips without an entry are healthy,
+	// with no locality.
+	Endpoints []*NameTable_Endpoint `protobuf:"bytes,5,rep,name=endpoints,proto3" json:"endpoints,omitempty"`
+	// ttl of the records of the host, in seconds. The agent default applies if zero.
+	Ttl                  uint32   `protobuf:"varint,6,opt,name=ttl,proto3" json:"ttl,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -76,7 +81,7 @@ func (m *NameTable_NameInfo) Reset()         { *m = NameTable_NameInfo{} }
 func (m *NameTable_NameInfo) String() string { return proto.CompactTextString(m) }
 func (*NameTable_NameInfo) ProtoMessage()    {}
 func (*NameTable_NameInfo) Descriptor() ([]byte, []int) {
-	return fileDescriptor_nds_e4011d50349a6001, []int{0, 0}
+	return fileDescriptor_nds_b6d9b63f980cb1d0, []int{0, 0}
 }
 func (m *NameTable_NameInfo) XXX_Unmarshal(b []byte) error {
 	return xxx_messageInfo_NameTable_NameInfo.Unmarshal(m, b)
@@ -124,29 +129,114 @@ func (m *NameTable_NameInfo) GetNamespace() string {
 	return ""
 }
 
+func (m *NameTable_NameInfo) GetEndpoints() []*NameTable_Endpoint {
+	if m != nil {
+		return m.Endpoints
+	}
+	return nil
+}
+
+func (m *NameTable_NameInfo) GetTtl() uint32 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+type NameTable_Endpoint struct {
+	Ip string `protobuf:"bytes,1,opt,name=ip,proto3" json:"ip,omitempty"`
+	// set if the endpoint is failing its health checks
+	Unhealthy bool `protobuf:"varint,2,opt,name=unhealthy,proto3" json:"unhealthy,omitempty"`
+	// "/" separated region, zone and subzone of the endpoint
+	Locality string `protobuf:"bytes,3,opt,name=locality,proto3" json:"locality,omitempty"`
+	// relative weight of the endpoint in the answers. Endpoints without weight count as 1.
+	Weight               uint32   `protobuf:"varint,4,opt,name=weight,proto3" json:"weight,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *NameTable_Endpoint) Reset()         { *m = NameTable_Endpoint{} }
+func (m *NameTable_Endpoint) String() string { return proto.CompactTextString(m) }
+func (*NameTable_Endpoint) ProtoMessage()    {}
+func (*NameTable_Endpoint) Descriptor() ([]byte, []int) {
+	return fileDescriptor_nds_b6d9b63f980cb1d0, []int{0, 1}
+}
+func (m *NameTable_Endpoint) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_NameTable_Endpoint.Unmarshal(m, b)
+}
+func (m *NameTable_Endpoint) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_NameTable_Endpoint.Marshal(b, m, deterministic)
+}
+func (dst *NameTable_Endpoint) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_NameTable_Endpoint.Merge(dst, src)
+}
+func (m *NameTable_Endpoint) XXX_Size() int {
+	return xxx_messageInfo_NameTable_Endpoint.Size(m)
+}
+func (m *NameTable_Endpoint) XXX_DiscardUnknown() {
+	xxx_messageInfo_NameTable_Endpoint.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_NameTable_Endpoint proto.InternalMessageInfo
+
+func (m *NameTable_Endpoint) GetIp() string {
+	if m != nil {
+		return m.Ip
+	}
+	return ""
+}
+
+func (m *NameTable_Endpoint) GetUnhealthy() bool {
+	if m != nil {
+		return m.Unhealthy
+	}
+	return false
+}
+
+func (m *NameTable_Endpoint) GetLocality() string {
+	if m != nil {
+		return m.Locality
+	}
+	return ""
+}
+
+func (m *NameTable_Endpoint) GetWeight() uint32 {
+	if m != nil {
+		return m.Weight
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*NameTable)(nil), "istio.networking.nds.v1.NameTable")
 	proto.RegisterMapType((map[string]*NameTable_NameInfo)(nil), "istio.networking.nds.v1.NameTable.TableEntry")
 	proto.RegisterType((*NameTable_NameInfo)(nil), "istio.networking.nds.v1.NameTable.NameInfo")
-}
-
-func init() { proto.RegisterFile("nds.proto", fileDescriptor_nds_e4011d50349a6001) }
-
-var fileDescriptor_nds_e4011d50349a6001 = []byte{
-	// 229 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xcc, 0x4b, 0x29, 0xd6,
-	0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x12, 0xcf, 0x2c, 0x2e, 0xc9, 0xcc, 0xd7, 0xcb, 0x4b, 0x2d,
-	0x29, 0xcf, 0x2f, 0xca, 0xce, 0xcc, 0x4b, 0xd7, 0x03, 0xc9, 0x95, 0x19, 0x2a, 0xad, 0x65, 0xe2,
-	0xe2, 0xf4, 0x4b, 0xcc, 0x4d, 0x0d, 0x49, 0x4c, 0xca, 0x49, 0x15, 0x72, 0xe6, 0x62, 0x2d, 0x01,
-	0x31, 0x24, 0x18, 0x15, 0x98, 0x35, 0xb8, 0x8d, 0x74, 0xf5, 0x70, 0x68, 0xd3, 0x83, 0x6b, 0xd1,
-	0x03, 0x93, 0xae, 0x79, 0x25, 0x45, 0x95, 0x41, 0x10, 0xbd, 0x52, 0x25, 0x5c, 0x1c, 0x20, 0x69,
-	0xcf, 0xbc, 0xb4, 0x7c, 0x21, 0x01, 0x2e, 0xe6, 0xcc, 0x82, 0x62, 0xb0, 0x71, 0x9c, 0x41, 0x20,
-	0xa6, 0x90, 0x14, 0x17, 0x47, 0x51, 0x6a, 0x7a, 0x66, 0x71, 0x49, 0x51, 0xa5, 0x04, 0x93, 0x02,
-	0xa3, 0x06, 0x67, 0x10, 0x9c, 0x2f, 0x24, 0xc3, 0xc5, 0x59, 0x9c, 0x91, 0x5f, 0x54, 0x92, 0x97,
-	0x98, 0x9b, 0x2a, 0xc1, 0x0c, 0x96, 0x44, 0x08, 0x80, 0x64, 0x41, 0x74, 0x71, 0x41, 0x62, 0x72,
-	0xaa, 0x04, 0x0b, 0x44, 0x16, 0x2e, 0x20, 0x95, 0xca, 0xc5, 0x85, 0x70, 0x0a, 0xc8, 0xde, 0xec,
-	0xd4, 0x4a, 0x09, 0x46, 0xb0, 0x2a, 0x10, 0x53, 0xc8, 0x91, 0x8b, 0xb5, 0x2c, 0x31, 0xa7, 0x34,
-	0x15, 0x6c, 0x29, 0xb7, 0x91, 0x36, 0x11, 0x5e, 0x83, 0xf9, 0x22, 0x08, 0xa2, 0xd3, 0x8a, 0xc9,
-	0x82, 0x31, 0x89, 0x0d, 0x1c, 0x9e, 0xc6, 0x80, 0x00, 0x00, 0x00, 0xff, 0xff, 0x4b, 0x59, 0x9f,
-	0x74, 0x5c, 0x01, 0x00, 0x00,
+	proto.RegisterType((*NameTable_Endpoint)(nil), "istio.networking.nds.v1.NameTable.Endpoint")
+}
+
+func init() { proto.RegisterFile("nds.proto", fileDescriptor_nds_b6d9b63f980cb1d0) }
+
+var fileDescriptor_nds_b6d9b63f980cb1d0 = []byte{
+	// 316 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x52, 0x3f, 0x6b, 0xfb, 0x30,
+	0x10, 0xc5, 0xce, 0x1f, 0xec, 0x0b, 0xf9, 0xf1, 0x43, 0x43, 0x2b, 0x4c, 0x87, 0xd0, 0x29, 0x50,
+	0x2a, 0x68, 0xda, 0xa1, 0x74, 0x2b, 0x25, 0x43, 0x97, 0x0e, 0xa2, 0x5f, 0x40, 0x49, 0xd4, 0x58,
+	0x44, 0x91, 0x8c, 0x74, 0x49, 0xf0, 0xda, 0x8f, 0xd9, 0x4f, 0x53, 0x24, 0x3b, 0xf6, 0x54, 0x68,
+	0x17, 0xfb, 0xdd, 0x3d, 0xbd, 0xbb, 0xf7, 0x84, 0x20, 0x37, 0x1b, 0xcf, 0x2a, 0x67, 0xd1, 0x92,
+	0x4b, 0xe5, 0x51, 0x59, 0x66, 0x24, 0x9e, 0xac, 0xdb, 0x29, 0xb3, 0x65, 0x81, 0x3b, 0xde, 0x5d,
+	0x7f, 0x0e, 0x21, 0x7f, 0x13, 0x7b, 0xf9, 0x2e, 0x56, 0x5a, 0x92, 0x17, 0x18, 0x61, 0x00, 0x34,
+	0x99, 0x0d, 0xe6, 0x93, 0xc5, 0x2d, 0xfb, 0x41, 0xc6, 0x3a, 0x09, 0x8b, 0xdf, 0xa5, 0x41, 0x57,
+	0xf3, 0x46, 0x5b, 0x7c, 0x25, 0x90, 0x05, 0xfe, 0xd5, 0x7c, 0x58, 0xf2, 0x1f, 0x06, 0xaa, 0xf2,
+	0x71, 0x5e, 0xce, 0x03, 0x24, 0x05, 0x64, 0x4e, 0x6e, 0x95, 0x47, 0x57, 0xd3, 0x74, 0x96, 0xcc,
+	0x73, 0xde, 0xd5, 0xe4, 0x0a, 0x72, 0x5f, 0x5a, 0x87, 0x46, 0xec, 0x25, 0x1d, 0x44, 0xb2, 0x6f,
+	0x04, 0x36, 0xfc, 0x7d, 0x25, 0xd6, 0x92, 0x0e, 0x1b, 0xb6, 0x6b, 0x10, 0x0e, 0xb9, 0x34, 0x9b,
+	0xca, 0x2a, 0x83, 0x9e, 0x8e, 0xa2, 0xff, 0x87, 0x5f, 0xf8, 0x3f, 0x3b, 0x65, 0xcb, 0x56, 0xcc,
+	0xfb, 0x31, 0xc1, 0x3d, 0xa2, 0xa6, 0xe3, 0x59, 0x32, 0x9f, 0xf2, 0x00, 0x0b, 0x0d, 0xd9, 0xf9,
+	0x20, 0xf9, 0x07, 0xa9, 0xaa, 0x68, 0x12, 0x8d, 0xa4, 0xaa, 0x0a, 0xfe, 0x0e, 0xa6, 0x94, 0x42,
+	0x63, 0xd9, 0x44, 0xcb, 0x78, 0xdf, 0x08, 0xb9, 0xb5, 0x5d, 0x0b, 0xad, 0xb0, 0x6e, 0xa3, 0x75,
+	0x35, 0xb9, 0x80, 0xf1, 0x49, 0xaa, 0x6d, 0x89, 0x31, 0xd6, 0x94, 0xb7, 0x55, 0x21, 0x01, 0xfa,
+	0xfb, 0x0d, 0x6e, 0x76, 0xb2, 0x6e, 0x17, 0x06, 0x48, 0x9e, 0x61, 0x74, 0x14, 0xfa, 0x20, 0xe3,
+	0xb6, 0xc9, 0xe2, 0xe6, 0x0f, 0x79, 0x79, 0xa3, 0x7c, 0x4a, 0x1f, 0x93, 0xd5, 0x38, 0x3e, 0x92,
+	0xfb, 0xef, 0x01, 0x00, 0x6a, 0xf1, 0x9a, 0xa9, 0x31, 0x02, 0x00, 0x00,
 }
@@ -16,6 +16,7 @@ package serviceentry
 
 import (
 	"net"
+	"strconv"
 	"strings"
 
 	"istio.io/api/label"
@@ -29,10 +30,15 @@ import (
 	"istio.io/istio/pkg/config/schema/gvk"
 	"istio.io/istio/pkg/config/visibility"
 	"istio.io/istio/pkg/spiffe"
+	"istio.io/pkg/log"
 )
 
 // TODO: rename 'external' to service_entries or other specific name, the term 'external' is too broad
 
+// DNSTTLAnnotation sets the ttl, in seconds, of the DNS records served by the agents for the hosts
+// of a ServiceEntry.
+const DNSTTLAnnotation = "networking.istio.io/dnsTTL"
+
 func convertPort(port *networking.Port) *model.Port {
 	return &model.Port{
 		Name:     port.Name,
@@ -133,6 +139,21 @@ func ServiceToServiceEntry(svc *model.Service) *config.Config {
 	return cfg
 }
 
+// dnsTTL returns the ttl set by the DNSTTLAnnotation of cfg, or zero if it is not set or invalid.
+func dnsTTL(cfg config.Config) uint32 {
+	value, f := cfg.Annotations[DNSTTLAnnotation]
+	if !f {
+		return 0
+	}
+	ttl, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.Warnf("ignoring invalid %s annotation %q of service entry %s/%s", DNSTTLAnnotation, value,
+			cfg.Namespace, cfg.Name)
+		return 0
+	}
+	return uint32(ttl)
+}
+
 // convertServices transforms a ServiceEntry config to a list of internal Service objects.
 func convertServices(cfg config.Config) []*model.Service {
 	serviceEntry := cfg.Spec.(*networking.ServiceEntry)
@@ -167,6 +188,7 @@ func convertServices(cfg config.Config) []*model.Service {
 	if serviceEntry.WorkloadSelector != nil {
 		labelSelectors = serviceEntry.WorkloadSelector.Labels
 	}
+	ttl := dnsTTL(cfg)
 	for _, hostname := range serviceEntry.Hosts {
 		if len(serviceEntry.Addresses) > 0 {
 			for _, address := range serviceEntry.Addresses {
@@ -190,6 +212,7 @@ func convertServices(cfg config.Config) []*model.Service {
 							Namespace:       cfg.Namespace,
 							ExportTo:        exportTo,
 							LabelSelectors:  labelSelectors,
+							DNSTTL:          ttl,
 						},
 						ServiceAccounts: serviceEntry.SubjectAltNames,
 					})
@@ -207,6 +230,7 @@ func convertServices(cfg config.Config) []*model.Service {
 							Namespace:       cfg.Namespace,
 							ExportTo:        exportTo,
 							LabelSelectors:  labelSelectors,
+							DNSTTL:          ttl,
 						},
 						ServiceAccounts: serviceEntry.SubjectAltNames,
 					})
@@ -226,6 +250,7 @@ func convertServices(cfg config.Config) []*model.Service {
 					Namespace:       cfg.Namespace,
 					ExportTo:        exportTo,
 					LabelSelectors:  labelSelectors,
+					DNSTTL:          ttl,
 				},
 				ServiceAccounts: serviceEntry.SubjectAltNames,
 			})
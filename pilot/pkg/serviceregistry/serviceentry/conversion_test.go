@@ -624,6 +624,30 @@ func TestConvertService(t *testing.T) {
 	}
 }
 
+func TestConvertServiceDNSTTL(t *testing.T) {
+	cases := []struct {
+		name        string
+		annotations map[string]string
+		want        uint32
+	}{
+		{"no annotation", nil, 0},
+		{"ttl", map[string]string{DNSTTLAnnotation: "30"}, 30},
+		{"invalid ttl", map[string]string{DNSTTLAnnotation: "30s"}, 0},
+		{"negative ttl", map[string]string{DNSTTLAnnotation: "-1"}, 0},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := *tcpStatic
+			cfg.Annotations = tt.annotations
+			for _, svc := range convertServices(cfg) {
+				if svc.Attributes.DNSTTL != tt.want {
+					t.Errorf("%s: got ttl %d, want %d", svc.Hostname, svc.Attributes.DNSTTL, tt.want)
+				}
+			}
+		})
+	}
+}
+
 func TestConvertInstances(t *testing.T) {
 	serviceInstanceTests := []struct {
 		externalSvc *config.Config
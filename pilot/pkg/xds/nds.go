@@ -15,12 +15,27 @@
 package xds
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
+	nds "istio.io/istio/pilot/pkg/proto"
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/config"
 	"istio.io/istio/pkg/config/schema/gvk"
 )
 
+// NameTableCompressionGzip is the NAME_TABLE_COMPRESSION node metadata value of the agents accepting gzip
+// compressed name tables.
+const NameTableCompressionGzip = "gzip"
+
 // Nds stands for Name Discovery Service. Istio agents send NDS requests to istiod
 // istiod responds with a list of service entries and their associated IPs (including k8s services)
 // The agent then updates its internal DNS based on this data. If DNS capture is enabled in the pod
@@ -73,6 +88,48 @@ func (n NdsGenerator) Generate(proxy *model.Proxy, push *model.PushContext, w *m
 	if nt == nil {
 		return nil
 	}
+	if proxy.Metadata != nil && proxy.Metadata.NameTableCompression == NameTableCompressionGzip {
+		compressed, err := CompressNameTable(nt)
+		if err == nil {
+			return model.Resources{compressed}
+		}
+		adsLog.Warnf("failed to compress name table for %s, sending it uncompressed: %v", proxy.ID, err)
+	}
 	resources := model.Resources{util.MessageToAny(nt)}
 	return resources
 }
+
+// CompressNameTable returns nt as a GzipNameTableType resource.
+func CompressNameTable(nt *nds.NameTable) (*any.Any, error) {
+	b, err := proto.Marshal(nt)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &any.Any{TypeUrl: v3.GzipNameTableType, Value: buf.Bytes()}, nil
+}
+
+// UnmarshalNameTable unmarshals the name table resource res into nt, decompressing it first if it is a
+// GzipNameTableType resource.
+func UnmarshalNameTable(res *any.Any, nt *nds.NameTable) error {
+	if res.GetTypeUrl() != v3.GzipNameTableType {
+		return ptypes.UnmarshalAny(res, nt)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(res.Value))
+	if err != nil {
+		return fmt.Errorf("failed to decompress name table: %v", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to decompress name table: %v", err)
+	}
+	return proto.Unmarshal(b, nt)
+}
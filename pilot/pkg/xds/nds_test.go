@@ -16,10 +16,13 @@ package xds_test
 import (
 	"testing"
 
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/google/go-cmp/cmp"
 	"google.golang.org/protobuf/testing/protocmp"
 
+	"istio.io/istio/pilot/pkg/model"
 	nds "istio.io/istio/pilot/pkg/proto"
 	"istio.io/istio/pilot/pkg/xds"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
@@ -66,6 +69,7 @@ func TestNDS(t *testing.T) {
 			"random-2.host.example": {
 				Ips:      []string{"9.9.9.9"},
 				Registry: "External",
+				Ttl:      30,
 			},
 			"random-3.host.example": {
 				Ips:      []string{"240.240.0.2"},
@@ -77,3 +81,59 @@ func TestNDS(t *testing.T) {
 		t.Fatalf("name table does not match expected value:\n %v", diff)
 	}
 }
+
+func TestNDSCompressed(t *testing.T) {
+	s := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{
+		ConfigString: mustReadFile(t, "./testdata/nds-se.yaml"),
+	})
+
+	// An agent not accepting compressed name tables gets them uncompressed.
+	plain := s.ConnectADS()
+	if err := sendNDSReq(sidecarID(app3Ip, "app3"), "ns2", plain); err != nil {
+		t.Fatal(err)
+	}
+	res, err := plain.Recv()
+	if err != nil {
+		t.Fatal("Failed to receive NDS", err)
+	}
+	if len(res.Resources) == 0 || res.Resources[0].GetTypeUrl() != v3.NameTableType {
+		t.Fatalf("expected an uncompressed name table, got %v", res.Resources)
+	}
+	var want nds.NameTable
+	if err := xds.UnmarshalNameTable(res.Resources[0], &want); err != nil {
+		t.Fatal("Failed to unmarshall name table", err)
+	}
+
+	compressed := s.ConnectADS()
+	err = compressed.Send(&discovery.DiscoveryRequest{
+		Node: &corev3.Node{
+			Id: sidecarID(app3Ip, "app3"),
+			Metadata: model.NodeMetadata{
+				Namespace:            "ns2",
+				DNSCapture:           "agent",
+				NameTableCompression: xds.NameTableCompressionGzip,
+			}.ToStruct(),
+		},
+		TypeUrl: v3.NameTableType,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = compressed.Recv()
+	if err != nil {
+		t.Fatal("Failed to receive NDS", err)
+	}
+	if len(res.Resources) == 0 || res.Resources[0].GetTypeUrl() != v3.GzipNameTableType {
+		t.Fatalf("expected a compressed name table, got %v", res.Resources)
+	}
+	var got nds.NameTable
+	if err := xds.UnmarshalNameTable(res.Resources[0], &got); err != nil {
+		t.Fatal("Failed to decompress name table", err)
+	}
+	if len(got.Table) == 0 {
+		t.Fatalf("expected more than 0 entries in name table")
+	}
+	if diff := cmp.Diff(&got, &want, protocmp.Transform()); diff != "" {
+		t.Fatalf("compressed name table does not match the uncompressed one:\n %v", diff)
+	}
+}
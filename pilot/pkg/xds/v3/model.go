@@ -25,6 +25,10 @@ const (
 	RouteType     = resource.RouteType
 	SecretType    = resource.SecretType
 	NameTableType = "type.googleapis.com/istio.networking.nds.v1.NameTable"
+
+	// GzipNameTableType is the type of the name table resources holding a gzip compressed NameTable, sent to
+	// the agents accepting them.
+	GzipNameTableType = NameTableType + "+gzip"
 )
 
 // GetShortType returns an abbreviated form of a type, useful for logging or human friendly messages
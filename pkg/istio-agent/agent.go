@@ -15,9 +15,11 @@
 package istioagent
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"strings"
@@ -78,6 +80,12 @@ const (
 	MetadataClientCertKey   = "ISTIO_META_TLS_CLIENT_KEY"
 	MetadataClientCertChain = "ISTIO_META_TLS_CLIENT_CERT_CHAIN"
 	MetadataClientRootCert  = "ISTIO_META_TLS_CLIENT_ROOT_CERT"
+	// MetadataXDSRootCert is the path of the root CA for the XDS connection, taking precedence over the one
+	// found by FindRootCAForXDS.
+	MetadataXDSRootCert = "ISTIO_META_XDS_ROOT_CERT"
+	// MetadataTokenCommand is a credential helper command line printing the tokens for istiod,
+	// used instead of the JWT file.
+	MetadataTokenCommand = "ISTIO_META_XDS_TOKEN_COMMAND"
 )
 
 // Agent contains the configuration of the agent, based on the injected
@@ -131,6 +139,13 @@ type AgentConfig struct {
 	// ProxyDomain is the DNS domain associated with the proxy (assumed
 	// to include the namespace as well) (for local dns resolution)
 	ProxyDomain string
+	// DNSServe serves local dns resolution without DNS capture, for the workloads using the agent as their
+	// nameserver. Their resolv.conf then lists the agent, so the names it does not know are forwarded to
+	// DNSConfig.Upstreams, or to the nameservers of DNSConfig.ResolvConfPath, which must be set.
+	// This option will not be considered if proxyXDSViaAgent is false.
+	DNSServe bool
+	// DNSConfig configures local dns resolution. Its ProxyNamespace and ProxyDomain are those of the agent.
+	DNSConfig dns.DNSConfig
 
 	// LocalXDSGeneratorListenAddress is the address where the agent will listen for XDS connections and generate all
 	// xds configurations locally. If not set, the env variable LOCAL_XDS_GENERATOR will be used.
@@ -144,14 +159,152 @@ type AgentConfig struct {
 	// using custom roots.
 	XDSRootCerts string
 
+	// XDSAdditionalRootCerts are the locations of more root CAs trusted for the XDS connection, along with
+	// XDSRootCerts. For instance, the old and new roots during a CA migration.
+	XDSAdditionalRootCerts []string
+
+	// XDSRootCertsFromSystem trusts the system root CAs for the XDS connection too.
+	XDSRootCertsFromSystem bool
+
+	// XDSServerIdentities, if not empty, are the SPIFFE identities istiod must present one of as a URI SAN of its
+	// certificate, like spiffe://cluster.local/ns/istio-system/sa/istiod, on top of being issued by a trusted root
+	// for the discovery address.
+	XDSServerIdentities []string
+
+	// XDSClientCertKeyMetadata and XDSClientCertChainMetadata are the proxy metadata keys of the paths of the file
+	// mounted client key and certificate chain. Default to MetadataClientCertKey and MetadataClientCertChain.
+	XDSClientCertKeyMetadata   string
+	XDSClientCertChainMetadata string
+	// XDSRootCertMetadata is the proxy metadata key of the path of the root CA for the XDS connection.
+	// Defaults to MetadataXDSRootCert.
+	XDSRootCertMetadata string
+
 	// CARootCerts of the location of the root CA for the CA connection. Used for setting platform certs or
 	// using custom roots.
 	CARootCerts string
 
 	// Extra headers to add to the XDS connection.
 	XDSHeaders map[string]string
+
+	// XDSFailoverAddresses are additional istiod addresses, in priority order, used by the XDS proxy
+	// when the discovery address is unreachable. The proxy returns to a higher priority address
+	// once it is reachable again.
+	XDSFailoverAddresses []string
+
+	// DownstreamGracePeriod is how long the XDS proxy keeps the upstream connection after Envoy
+	// disconnects cleanly. An Envoy reconnecting within this period reuses it. Disabled if zero.
+	DownstreamGracePeriod time.Duration
+
+	// XDSFastReconnect makes the XDS proxy move Envoy's stream over to a new istiod connection when istiod
+	// closes the stream cleanly, as it does when draining, rather than ending the stream to Envoy.
+	XDSFastReconnect bool
+
+	// XDSEventLogSize is the number of XDS messages the XDS proxy keeps a record of, served on its
+	// debug endpoint. Disabled if zero.
+	XDSEventLogSize int
+
+	// XDSDebugLogSampleRate makes the XDS proxy log the debug lines of one in every XDSDebugLogSampleRate
+	// messages proxied, so that debug logging stays tractable on a busy proxy. Every message is logged if
+	// not above one.
+	XDSDebugLogSampleRate int
+
+	// XDSCaptureFile is the path of a file the XDS proxy writes every XDS message it proxies to, in order,
+	// to replay the session offline. Disabled if empty.
+	XDSCaptureFile string
+
+	// XDSResponseTransform, if set, can modify or drop the responses from istiod before the XDS proxy
+	// forwards them to Envoy.
+	XDSResponseTransform ResponseTransform
+
+	// XDSClientCertProvider, if set, supplies the client certificate the XDS proxy presents to istiod
+	// from memory. Otherwise the certificate is read from the provisioned or mounted files.
+	XDSClientCertProvider ClientCertProvider
+
+	// XDSMetadataProvider, if set, is called on every connection to istiod for gRPC metadata added to the
+	// XDSHeaders, such as short lived tokens. Its values take precedence over the XDSHeaders.
+	XDSMetadataProvider MetadataProvider
+
+	// XDSSlowSendThreshold is the duration after which the XDS proxy reports a request sent to istiod as slow,
+	// an early sign of control plane congestion. Disabled if zero.
+	XDSSlowSendThreshold time.Duration
+
+	// XDSRequestDedupWindow is how long the XDS proxy suppresses a request identical to the last one forwarded
+	// for its type URL, as Envoy may repeat them while re-subscribing. Disabled if zero.
+	XDSRequestDedupWindow time.Duration
+
+	// XDSCheckTokenExpiry makes the XDS proxy check the "exp" claim of the JWT file, failing with a clear error
+	// rather than sending an expired token to istiod.
+	XDSCheckTokenExpiry bool
+
+	// XDSCircuitBreakerThreshold is the number of consecutive connection failures to istiod, within
+	// XDSCircuitBreakerWindow, after which the XDS proxy stops connecting for XDSCircuitBreakerCooldown.
+	// Disabled if zero.
+	XDSCircuitBreakerThreshold int
+	XDSCircuitBreakerWindow    time.Duration
+	XDSCircuitBreakerCooldown  time.Duration
+
+	// XDSRetryBudgetRate is the number of connections per second the XDS proxy opens to istiod at most, with
+	// bursts of up to XDSRetryBudgetBurst, however often Envoy reconnects. Connections beyond it are delayed,
+	// which spreads the reconnects of the whole mesh after an istiod outage. Disabled if zero.
+	XDSRetryBudgetRate  float64
+	XDSRetryBudgetBurst int
+
+	// XDSMaxDownstreamConnections is the number of Envoy streams the XDS proxy serves at once, each over
+	// its own connection to istiod, for instance for the overlapping Envoys of a hot restart. A new stream
+	// beyond it closes the oldest one. Only the most recent stream is served if zero or one.
+	XDSMaxDownstreamConnections int
+
+	// XDSRequestsBufferSize and XDSResponsesBufferSize are the number of requests to istiod and responses to
+	// Envoy each XDS proxy connection queues. Requests are small and come in bursts as Envoy subscribes, while
+	// responses are large and drained as fast as Envoy applies them. Default to 10 if zero.
+	XDSRequestsBufferSize  int
+	XDSResponsesBufferSize int
+
+	// XDSNameTableDebounce is how long the XDS proxy waits for more name tables after receiving one, so
+	// that a burst of them is built into the DNS server once. Disabled if zero.
+	XDSNameTableDebounce time.Duration
+
+	// XDSAllowedPeerUIDs and XDSAllowedPeerGIDs, if either is set, restrict the processes that may connect to
+	// the XDS proxy socket to those running with one of these user or group IDs. The credentials of the peers
+	// are only available on Linux, elsewhere every connection is rejected. If both are empty, no peer check
+	// is done and any process with access to the socket file may connect.
+	XDSAllowedPeerUIDs []uint32
+	XDSAllowedPeerGIDs []uint32
+
+	// XDSWarmupTimeout, if set, makes the XDS proxy request the name table as soon as it connects to istiod,
+	// and hold Envoy's configuration back until the name table is built into the DNS server, or this long at
+	// most. Envoy then does not start sending DNS queries before the agent can answer them.
+	XDSWarmupTimeout time.Duration
+
+	// XDSAuthMode selects the credentials the XDS proxy authenticates to istiod with, when the control plane
+	// auth policy is not NONE. Defaults to XDSAuthAuto.
+	XDSAuthMode XDSAuthMode
+
+	// XDSDisableNameTable stops the XDS proxy from requesting name tables and building them into the dns server,
+	// for instance when DNS is not captured at the data plane. Name tables pushed anyway are ACKed and dropped.
+	XDSDisableNameTable bool
+
+	// XDSCompressNameTable makes the XDS proxy tell istiod, in the node metadata, that it accepts gzip compressed
+	// name tables, which are much smaller over the XDS stream for large meshes. Uncompressed name tables from
+	// an istiod that ignores it are still accepted.
+	XDSCompressNameTable bool
 }
 
+// XDSAuthMode selects the credentials the XDS proxy authenticates to istiod with.
+type XDSAuthMode string
+
+const (
+	// XDSAuthAuto presents the client certificate, if there is one, and the JWT token unless certificates
+	// are file mounted and provisioned.
+	XDSAuthAuto XDSAuthMode = ""
+	// XDSAuthMTLS only presents the client certificate.
+	XDSAuthMTLS XDSAuthMode = "mtls"
+	// XDSAuthToken only presents the JWT token, keeping the provisioned certificates for the data plane.
+	XDSAuthToken XDSAuthMode = "token"
+	// XDSAuthBoth presents both the client certificate and the JWT token.
+	XDSAuthBoth XDSAuthMode = "both"
+)
+
 // NewAgent wraps the logic for a local SDS. It will check if the JWT token required for local SDS is
 // present, and set additional config options for the in-process SDS agent.
 //
@@ -274,15 +427,40 @@ func (sa *Agent) Start(isSidecar bool, podNamespace string) (*sds.Server, error)
 
 func (sa *Agent) initLocalDNSServer(isSidecar bool) (err error) {
 	// we dont need dns server on gateways
-	if sa.cfg.DNSCapture && sa.cfg.ProxyXDSViaAgent && isSidecar {
-		if sa.localDNSServer, err = dns.NewLocalDNSServer(sa.cfg.ProxyNamespace, sa.cfg.ProxyDomain); err != nil {
-			return err
-		}
-		sa.localDNSServer.StartDNS()
+	if !sa.cfg.ProxyXDSViaAgent || !isSidecar {
+		return nil
 	}
+	cfg, enabled, err := sa.localDNSConfig()
+	if err != nil || !enabled {
+		return err
+	}
+	if sa.localDNSServer, err = dns.NewLocalDNSServer(cfg); err != nil {
+		return err
+	}
+	sa.localDNSServer.StartDNS()
 	return nil
 }
 
+// localDNSConfig returns the configuration of local dns resolution, and whether it is served at all: for the
+// workloads whose DNS is captured, or which use the agent as their nameserver.
+func (sa *Agent) localDNSConfig() (dns.DNSConfig, bool, error) {
+	cfg := sa.cfg.DNSConfig
+	cfg.ProxyNamespace = sa.cfg.ProxyNamespace
+	cfg.ProxyDomain = sa.cfg.ProxyDomain
+	switch {
+	case sa.cfg.DNSCapture:
+		return cfg, true, nil
+	case sa.cfg.DNSServe:
+		// The resolv.conf of the workload lists the agent, forwarding to its nameservers would loop.
+		if len(cfg.Upstreams) == 0 && cfg.ResolvConfPath == "" {
+			return cfg, false, errors.New("the upstream nameservers must be set to serve DNS without capture")
+		}
+		return cfg, true, nil
+	default:
+		return cfg, false, nil
+	}
+}
+
 func (sa *Agent) Close() {
 	if sa.xdsProxy != nil {
 		sa.xdsProxy.close()
@@ -293,6 +471,14 @@ func (sa *Agent) Close() {
 	sa.closeLocalXDSGenerator()
 }
 
+// DebugHandlers returns the debug endpoints of the agent, keyed by path.
+func (sa *Agent) DebugHandlers() map[string]http.Handler {
+	if sa.xdsProxy == nil {
+		return nil
+	}
+	return sa.xdsProxy.debugHandlers()
+}
+
 func (sa *Agent) GetLocalXDSGeneratorListener() net.Listener {
 	if sa.localXDSGenerator != nil {
 		return sa.localXDSGenerator.listener
@@ -348,6 +534,32 @@ func (sa *Agent) FindRootCAForXDS() string {
 	}
 }
 
+// xdsRootCert returns the root CA for the XDS connection: the path in the proxy metadata if any, or else the
+// one found by FindRootCAForXDS.
+func (sa *Agent) xdsRootCert() string {
+	key := MetadataXDSRootCert
+	if sa.cfg.XDSRootCertMetadata != "" {
+		key = sa.cfg.XDSRootCertMetadata
+	}
+	if root := sa.proxyConfig.ProxyMetadata[key]; root != "" {
+		return root
+	}
+	return sa.FindRootCAForXDS()
+}
+
+// clientCertMetadataKeys returns the proxy metadata keys of the paths of the file mounted client key and
+// certificate chain.
+func (sa *Agent) clientCertMetadataKeys() (string, string) {
+	key, chain := MetadataClientCertKey, MetadataClientCertChain
+	if sa.cfg.XDSClientCertKeyMetadata != "" {
+		key = sa.cfg.XDSClientCertKeyMetadata
+	}
+	if sa.cfg.XDSClientCertChainMetadata != "" {
+		chain = sa.cfg.XDSClientCertChainMetadata
+	}
+	return key, chain
+}
+
 // Find the root CA to use when connecting to the CA (Istiod or external).
 //
 func (sa *Agent) FindRootCAForCA() string {
@@ -17,6 +17,7 @@ package istioagent
 import (
 	"testing"
 
+	"istio.io/istio/pilot/pkg/dns"
 	"istio.io/istio/pkg/config/mesh"
 	"istio.io/istio/pkg/security"
 )
@@ -81,3 +82,42 @@ func TestNewAgent(t *testing.T) {
 		}
 	}
 }
+
+func TestLocalDNSConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		cfg     AgentConfig
+		enabled bool
+		err     bool
+	}{
+		{"disabled", AgentConfig{}, false, false},
+		{"capture", AgentConfig{DNSCapture: true}, true, false},
+		{"serve without upstreams", AgentConfig{DNSServe: true}, false, true},
+		{
+			"serve with upstreams",
+			AgentConfig{DNSServe: true, DNSConfig: dns.DNSConfig{Upstreams: []string{"10.0.0.10"}}},
+			true, false,
+		},
+		{
+			"serve with resolv.conf",
+			AgentConfig{DNSServe: true, DNSConfig: dns.DNSConfig{ResolvConfPath: "/etc/agent-resolv.conf"}},
+			true, false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.ProxyNamespace = "ns1"
+			tt.cfg.ProxyDomain = "ns1.svc.cluster.local"
+			sa := &Agent{cfg: &tt.cfg}
+			cfg, enabled, err := sa.localDNSConfig()
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+			if enabled != tt.enabled {
+				t.Errorf("got enabled %v, want %v", enabled, tt.enabled)
+			}
+			if cfg.ProxyNamespace != "ns1" || cfg.ProxyDomain != "ns1.svc.cluster.local" {
+				t.Errorf("got proxy namespace %q and domain %q, want those of the agent", cfg.ProxyNamespace, cfg.ProxyDomain)
+			}
+		})
+	}
+}
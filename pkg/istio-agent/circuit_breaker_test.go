@@ -0,0 +1,77 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(3, time.Minute, 10*time.Second)
+	b.now = func() time.Time { return now }
+	trips := counterValue(t, "istiod_circuit_breaker_trips")
+
+	// Failures spread beyond the window do not add up.
+	b.failure()
+	b.failure()
+	now = now.Add(2 * time.Minute)
+	b.failure()
+	if !b.allow() {
+		t.Fatal("expected the breaker to stay closed on failures outside of the window")
+	}
+	// A success resets the count.
+	b.success()
+	b.failure()
+	b.failure()
+	if !b.allow() {
+		t.Fatal("expected the breaker to stay closed after a success")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Fatal("expected the breaker to open after 3 consecutive failures")
+	}
+	now = now.Add(5 * time.Second)
+	if b.allow() {
+		t.Fatal("expected the breaker to stay open during the cool-down")
+	}
+
+	// Half-open: a single trial, failing it opens the breaker again.
+	now = now.Add(5 * time.Second)
+	if !b.allow() {
+		t.Fatal("expected a trial after the cool-down")
+	}
+	if b.allow() {
+		t.Fatal("expected a single trial while half-open")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatal("expected the breaker to open again on a failed trial")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !b.allow() {
+		t.Fatal("expected a trial after the cool-down")
+	}
+	b.success()
+	if !b.allow() || !b.allow() {
+		t.Fatal("expected the breaker to close on a successful trial")
+	}
+	if d := counterValue(t, "istiod_circuit_breaker_trips") - trips; d != 2 {
+		t.Errorf("expected 2 trips, got %v", d)
+	}
+}
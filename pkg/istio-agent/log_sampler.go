@@ -0,0 +1,65 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync/atomic"
+)
+
+// logSampler samples the per-message debug logs of the XDS proxy, which are too many to log under churn: only
+// the first of every rate messages is logged. Warnings and errors are never sampled.
+// A nil sampler logs every message.
+type logSampler struct {
+	rate  uint64
+	count uint64
+}
+
+func newLogSampler(rate int) *logSampler {
+	if rate <= 1 {
+		return nil
+	}
+	return &logSampler{rate: uint64(rate)}
+}
+
+// sample returns whether to log the next message, and how many messages were left out since the last one logged.
+func (s *logSampler) sample() (bool, uint64) {
+	if s == nil {
+		return true, 0
+	}
+	n := atomic.AddUint64(&s.count, 1)
+	if (n-1)%s.rate != 0 {
+		return false, 0
+	}
+	if n == 1 {
+		return true, 0
+	}
+	return true, s.rate - 1
+}
+
+// debugf logs a per-message debug line of the proxy, subject to the debug log sampling.
+func (p *XdsProxy) debugf(format string, args ...interface{}) {
+	if !proxyLog.DebugEnabled() {
+		return
+	}
+	logged, skipped := p.logSampler.sample()
+	if !logged {
+		return
+	}
+	if skipped > 0 {
+		format += " (%d messages not logged since)"
+		args = append(args, skipped)
+	}
+	proxyLog.Debugf(format, args...)
+}
@@ -21,12 +21,51 @@ import (
 var (
 	disconnectionTypeTag = monitoring.MustCreateLabel("type")
 
+	// TypeURLTag is the type url of XDS requests and responses.
+	TypeURLTag = monitoring.MustCreateLabel("type_url")
+
 	// IstiodConnectionFailures records total number of connection failures to Istiod.
 	IstiodConnectionFailures = monitoring.NewSum(
 		"istiod_connection_failures",
 		"The total number of connection failures to Istiod",
 	)
 
+	// IstiodStreamCreationFailures records total number of failures to open a stream to Istiod once connected.
+	IstiodStreamCreationFailures = monitoring.NewSum(
+		"istiod_stream_creation_failures",
+		"The total number of failures to open an XDS stream to Istiod after the connection succeeded",
+	)
+
+	// IstiodCircuitBreakerTrips records total number of times the circuit breaker opened on Istiod connection failures.
+	IstiodCircuitBreakerTrips = monitoring.NewSum(
+		"istiod_circuit_breaker_trips",
+		"The total number of times the circuit breaker opened after consecutive connection failures to Istiod",
+	)
+
+	// IstiodConnectionsThrottled records total number of connections to Istiod delayed by the retry budget.
+	IstiodConnectionsThrottled = monitoring.NewSum(
+		"istiod_connections_throttled",
+		"The total number of connections to Istiod delayed as the retry budget was exhausted",
+	)
+
+	// IstiodConnectionShortCircuits records total number of connections to Istiod skipped by the circuit breaker.
+	IstiodConnectionShortCircuits = monitoring.NewSum(
+		"istiod_connection_short_circuits",
+		"The total number of connections to Istiod skipped as the circuit breaker was open",
+	)
+
+	// IstiodFastReconnects records total number of streams moved to a new Istiod after Istiod closed them.
+	IstiodFastReconnects = monitoring.NewSum(
+		"istiod_fast_reconnects",
+		"The total number of streams moved over to a new Istiod connection after Istiod closed them cleanly",
+	)
+
+	// IstiodCircuitBreakerState records the state of the circuit breaker: 0 closed, 1 open, 2 half-open.
+	IstiodCircuitBreakerState = monitoring.NewGauge(
+		"istiod_circuit_breaker_state",
+		"The state of the circuit breaker on Istiod connections: 0 closed, 1 open, 2 half-open",
+	)
+
 	// istiodDisconnections records total number of unexpected disconnections by Istiod.
 	istiodDisconnections = monitoring.NewSum(
 		"istiod_connection_terminations",
@@ -41,6 +80,12 @@ var (
 		monitoring.WithLabels(disconnectionTypeTag),
 	)
 
+	// EnvoyDownstreamSendErrors records total number of failures to send a response to Envoy.
+	EnvoyDownstreamSendErrors = monitoring.NewSum(
+		"envoy_downstream_send_errors",
+		"The total number of failures to send a response to envoy",
+	)
+
 	// TODO: Add type url as type for requeasts and responses if needed.
 
 	// XdsProxyRequests records total number of downstream requests.
@@ -49,12 +94,65 @@ var (
 		"The total number of Xds Proxy Requests",
 	)
 
+	// XdsProxyResponseBytes records total number of bytes of the upstream responses, once decoded.
+	XdsProxyResponseBytes = monitoring.NewSum(
+		"xds_proxy_response_bytes",
+		"The total number of bytes of the responses received by the Xds Proxy, once decoded",
+	)
+
+	// XdsProxyResponseWireBytes records total number of bytes of the upstream responses on the wire.
+	XdsProxyResponseWireBytes = monitoring.NewSum(
+		"xds_proxy_response_wire_bytes",
+		"The total number of bytes of the responses received by the Xds Proxy on the wire, compressed if compression is on",
+	)
+
+	// XdsProxyExpiredRequests records total number of agent requests dropped as their deadline passed.
+	XdsProxyExpiredRequests = monitoring.NewSum(
+		"xds_proxy_expired_requests",
+		"The total number of agent requests dropped by the Xds Proxy as their deadline passed before they were sent",
+	)
+
+	// XdsProxyDuplicateRequests records total number of Envoy requests suppressed as duplicates.
+	XdsProxyDuplicateRequests = monitoring.NewSum(
+		"xds_proxy_duplicate_requests",
+		"The total number of requests not forwarded by the Xds Proxy as they repeated the previous one of their type",
+	)
+
+	// XdsProxyResyncs records total number of full resyncs of the subscriptions with the upstream.
+	XdsProxyResyncs = monitoring.NewSum(
+		"xds_proxy_resyncs",
+		"The total number of times the Xds Proxy requested the full state of all subscriptions from the upstream",
+	)
+
 	// XdsProxyResponses records total number of upstream responses.
 	XdsProxyResponses = monitoring.NewSum(
 		"xds_proxy_responses",
 		"The total number of Xds Proxy Responses",
 	)
 
+	// XdsProxyTeeDrops records total number of responses not delivered to a tee of the Xds Proxy with a full queue.
+	XdsProxyTeeDrops = monitoring.NewSum(
+		"xds_proxy_tee_drops",
+		"The total number of responses dropped rather than delivered to a tee of the Xds Proxy, by type url",
+		monitoring.WithLabels(TypeURLTag),
+	)
+
+	// XdsProxyResponseLatency records the time istiod takes to answer the requests, ACKs included, by type url.
+	XdsProxyResponseLatency = monitoring.NewDistribution(
+		"xds_proxy_response_latency_seconds",
+		"Time in seconds between a request of the Xds Proxy and the response answering it",
+		[]float64{.01, .05, .1, .5, 1, 5, 10, 30},
+		monitoring.WithLabels(TypeURLTag),
+	)
+
+	// XdsProxySlowUpstreamSends records the duration of upstream requests sends that were reported as slow.
+	XdsProxySlowUpstreamSends = monitoring.NewDistribution(
+		"xds_proxy_slow_upstream_send_seconds",
+		"Time in seconds taken by the upstream sends of the Xds Proxy above the slow send threshold",
+		[]float64{.1, .5, 1, 2, 3, 5},
+		monitoring.WithLabels(TypeURLTag),
+	)
+
 	IstiodConnectionCancellations = istiodDisconnections.With(disconnectionTypeTag.Value(Cancel))
 	IstiodConnectionErrors        = istiodDisconnections.With(disconnectionTypeTag.Value(Error))
 	EnvoyConnectionCancellations  = envoyDisconnections.With(disconnectionTypeTag.Value(Cancel))
@@ -69,8 +167,23 @@ var (
 func init() {
 	monitoring.MustRegister(
 		IstiodConnectionFailures,
+		IstiodStreamCreationFailures,
+		IstiodCircuitBreakerTrips,
+		IstiodConnectionShortCircuits,
+		IstiodConnectionsThrottled,
+		IstiodFastReconnects,
+		IstiodCircuitBreakerState,
 		IstiodConnectionErrors,
 		istiodDisconnections,
 		envoyDisconnections,
+		EnvoyDownstreamSendErrors,
+		XdsProxyExpiredRequests,
+		XdsProxyDuplicateRequests,
+		XdsProxyResyncs,
+		XdsProxyResponseBytes,
+		XdsProxyResponseWireBytes,
+		XdsProxySlowUpstreamSends,
+		XdsProxyResponseLatency,
+		XdsProxyTeeDrops,
 	)
 }
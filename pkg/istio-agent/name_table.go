@@ -0,0 +1,64 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+	"time"
+
+	nds "istio.io/istio/pilot/pkg/proto"
+)
+
+// nameTableDebouncer coalesces the name tables received in a burst, so that the dns server only builds the
+// last one. A table is applied at most delay after the first table of the burst was received.
+type nameTableDebouncer struct {
+	delay time.Duration
+	apply func(nt *nds.NameTable)
+
+	// applyMu keeps the tables applied in the order they were received.
+	applyMu sync.Mutex
+	mu      sync.Mutex
+	// pending is the last table received, not applied yet.
+	pending *nds.NameTable
+	timer   *time.Timer
+}
+
+func newNameTableDebouncer(delay time.Duration, apply func(nt *nds.NameTable)) *nameTableDebouncer {
+	return &nameTableDebouncer{delay: delay, apply: apply}
+}
+
+// update schedules nt to be applied, superseding the table pending, if any.
+func (d *nameTableDebouncer) update(nt *nds.NameTable) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.pending = nt
+	if d.timer == nil {
+		d.timer = time.AfterFunc(d.delay, d.flush)
+	}
+}
+
+// flush applies the table pending, if any.
+func (d *nameTableDebouncer) flush() {
+	d.applyMu.Lock()
+	defer d.applyMu.Unlock()
+	d.mu.Lock()
+	nt := d.pending
+	d.pending = nil
+	d.timer = nil
+	d.mu.Unlock()
+	if nt != nil {
+		d.apply(nt)
+	}
+}
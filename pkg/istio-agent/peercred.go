@@ -0,0 +1,123 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// peerCredAuthInfo identifies the process on the other end of the XDS socket, from the credentials the
+// kernel recorded when it connected.
+type peerCredAuthInfo struct {
+	pid int32
+	uid uint32
+	gid uint32
+}
+
+func (*peerCredAuthInfo) AuthType() string {
+	return "peercred"
+}
+
+// peerCredTransport records the credentials of the processes connecting to the XDS socket, so that they can be
+// checked for each stream. It does not secure the connection, which never leaves the host.
+type peerCredTransport struct{}
+
+var _ credentials.TransportCredentials = peerCredTransport{}
+
+func (peerCredTransport) ClientHandshake(context.Context, string, net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("peer credentials are only checked by the server")
+}
+
+func (peerCredTransport) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	info, err := getPeerCred(conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get the credentials of the peer: %v", err)
+	}
+	return conn, info, nil
+}
+
+func (peerCredTransport) Info() credentials.ProtocolInfo {
+	return credentials.ProtocolInfo{SecurityProtocol: "peercred"}
+}
+
+func (t peerCredTransport) Clone() credentials.TransportCredentials {
+	return t
+}
+
+func (peerCredTransport) OverrideServerName(string) error {
+	return nil
+}
+
+// peerCredChecker only lets the processes running with one of the allowed user or group IDs call the XDS proxy.
+type peerCredChecker struct {
+	uids map[uint32]struct{}
+	gids map[uint32]struct{}
+}
+
+func newPeerCredChecker(uids, gids []uint32) *peerCredChecker {
+	c := &peerCredChecker{uids: map[uint32]struct{}{}, gids: map[uint32]struct{}{}}
+	for _, uid := range uids {
+		c.uids[uid] = struct{}{}
+	}
+	for _, gid := range gids {
+		c.gids[gid] = struct{}{}
+	}
+	return c
+}
+
+// check returns a PermissionDenied error unless the caller is allowed.
+func (c *peerCredChecker) check(ctx context.Context) error {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "unknown peer")
+	}
+	info, ok := p.AuthInfo.(*peerCredAuthInfo)
+	if !ok {
+		return status.Error(codes.PermissionDenied, "no peer credentials")
+	}
+	if _, f := c.uids[info.uid]; f {
+		return nil
+	}
+	if _, f := c.gids[info.gid]; f {
+		return nil
+	}
+	proxyLog.Warnf("rejecting XDS connection from process %d with uid %d and gid %d", info.pid, info.uid, info.gid)
+	return status.Errorf(codes.PermissionDenied, "uid %d and gid %d may not connect to the XDS proxy", info.uid, info.gid)
+}
+
+func (c *peerCredChecker) streamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+	if err := c.check(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (c *peerCredChecker) unaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	if err := c.check(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
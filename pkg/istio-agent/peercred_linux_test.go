@@ -0,0 +1,113 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestXdsProxyPeerCredentials(t *testing.T) {
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	testCases := []struct {
+		name    string
+		uids    []uint32
+		gids    []uint32
+		allowed bool
+	}{
+		{
+			name:    "allowed uid",
+			uids:    []uint32{uid},
+			allowed: true,
+		},
+		{
+			name:    "allowed gid",
+			uids:    []uint32{uid + 1},
+			gids:    []uint32{gid},
+			allowed: true,
+		},
+		{
+			name: "disallowed uid",
+			uids: []uint32{uid + 1},
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := setupXdsProxy(t)
+			proxy.downstreamPeerCheck = newPeerCredChecker(tt.uids, tt.gids)
+			upstream := newFakeUpstream()
+			defer close(upstream.responses)
+			proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+				return &fakeADSClient{upstream: upstream}, ioutil.NopCloser(nil), nil
+			}
+
+			socket := filepath.Join(t.TempDir(), "XDS")
+			l, err := newDownstreamListener(socket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := proxy.newDownstreamServer()
+			go func() {
+				_ = server.Serve(l)
+			}()
+			defer server.Stop()
+
+			conn, err := grpc.Dial("unix://"+socket, grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			streamCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			downstream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(streamCtx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A denied stream may already be closed, in which case the send fails with io.EOF and Recv has the status.
+			err = downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: &core.Node{Id: "envoy"}})
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+
+			if !tt.allowed {
+				if _, err := downstream.Recv(); status.Code(err) != codes.PermissionDenied {
+					t.Fatalf("expected the stream to be denied, got %v", err)
+				}
+				return
+			}
+			select {
+			case req := <-upstream.requests:
+				if req.TypeUrl != v3.ClusterType {
+					t.Fatalf("unexpected request %v", req)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("request of an allowed peer was not forwarded upstream")
+			}
+		})
+	}
+}
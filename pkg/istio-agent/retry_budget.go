@@ -0,0 +1,64 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// retryBudget is a token bucket limiting the rate of connections to istiod across all the Envoy streams and
+// reconnects of the XDS proxy. When istiod goes down, every agent of the mesh reconnects at once; the budget
+// spreads these attempts over time, however often Envoy reconnects to the agent.
+type retryBudget struct {
+	limiter *rate.Limiter
+	now     func() time.Time
+	after   func(time.Duration) <-chan time.Time
+}
+
+// newRetryBudget creates a budget of qps connections per second, with bursts of up to burst connections.
+func newRetryBudget(qps float64, burst int) *retryBudget {
+	if burst < 1 {
+		burst = 1
+	}
+	return &retryBudget{
+		limiter: rate.NewLimiter(rate.Limit(qps), burst),
+		now:     time.Now,
+		after:   time.After,
+	}
+}
+
+// wait takes a connection from the budget, delaying the caller until one is available once it is exhausted.
+// It returns the error of ctx if ctx is done first, giving the connection back.
+func (b *retryBudget) wait(ctx context.Context) error {
+	r := b.limiter.ReserveN(b.now(), 1)
+	delay := r.DelayFrom(b.now())
+	if delay == 0 {
+		return nil
+	}
+	metrics.IstiodConnectionsThrottled.Increment()
+	proxyLog.Debugf("retry budget exhausted, delaying the connection to istiod by %v", delay)
+	select {
+	case <-b.after(delay):
+		return nil
+	case <-ctx.Done():
+		r.CancelAt(b.now())
+		return ctx.Err()
+	}
+}
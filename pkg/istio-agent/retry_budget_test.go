@@ -0,0 +1,87 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	var delays []time.Duration
+	b := newRetryBudget(10, 2)
+	b.now = func() time.Time { return now }
+	b.after = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		// The fake clock moves on as the caller waits.
+		now = now.Add(d)
+		c := make(chan time.Time, 1)
+		c <- now
+		return c
+	}
+	throttled := counterValue(t, "istiod_connections_throttled")
+
+	// A burst of reconnects is let through, then spaced at the configured rate.
+	start := now
+	for i := 0; i < 6; i++ {
+		if err := b.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(delays) != 4 {
+		t.Fatalf("expected the 4 connections beyond the burst to be delayed, got %v", delays)
+	}
+	for _, d := range delays {
+		if d != 100*time.Millisecond {
+			t.Fatalf("expected connections spaced by 100ms, got %v", delays)
+		}
+	}
+	if elapsed := now.Sub(start); elapsed != 400*time.Millisecond {
+		t.Fatalf("expected 6 connections to take 400ms at 10 per second with a burst of 2, took %v", elapsed)
+	}
+	if got := counterValue(t, "istiod_connections_throttled") - throttled; got != 4 {
+		t.Fatalf("expected 4 throttled connections, got %v", got)
+	}
+
+	// The budget refills over time.
+	now = now.Add(time.Second)
+	delays = nil
+	for i := 0; i < 2; i++ {
+		if err := b.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(delays) != 0 {
+		t.Fatalf("expected the refilled budget to let a burst through, got %v", delays)
+	}
+
+	// A caller going away while delayed gives its connection back.
+	b.after = func(time.Duration) <-chan time.Time { return nil }
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.wait(cctx); err != context.Canceled {
+		t.Fatalf("expected the wait to end with the context, got %v", err)
+	}
+	now = now.Add(100 * time.Millisecond)
+	b.after = func(d time.Duration) <-chan time.Time {
+		t.Fatalf("expected the cancelled connection to be given back, delayed by %v", d)
+		return nil
+	}
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// execTokenTimeout bounds the run of a credential helper.
+const execTokenTimeout = 10 * time.Second
+
+// xdsTokenSource returns the source of the bearer tokens presented to istiod: the credential helper
+// of the proxy metadata if there is one, the JWT file otherwise.
+func (sa *Agent) xdsTokenSource() (oauth2.TokenSource, error) {
+	if command := sa.proxyConfig.ProxyMetadata[MetadataTokenCommand]; command != "" {
+		return newExecTokenSource(command)
+	}
+	return &fileTokenSource{path: sa.secOpts.JWTPath, checkExpiry: sa.cfg.XDSCheckTokenExpiry}, nil
+}
+
+// execTokenSource gets tokens from a credential helper, run without a shell. The helper prints the token as
+// a JSON object, with an optional RFC 3339 expiry: {"access_token": "...", "expiry": "2021-01-01T00:00:00Z"}.
+type execTokenSource struct {
+	command string
+	args    []string
+}
+
+var _ = oauth2.TokenSource(&execTokenSource{})
+
+// newExecTokenSource returns a source running the command line for tokens. Tokens are cached until shortly
+// before they expire, those without expiry are not cached.
+func newExecTokenSource(commandLine string) (oauth2.TokenSource, error) {
+	fields := strings.Fields(commandLine)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("invalid token command %q: no command", commandLine)
+	}
+	return &expiringTokenSource{src: &execTokenSource{command: fields[0], args: fields[1:]}}, nil
+}
+
+// expiringTokenSource caches the tokens of src until shortly before they expire. Unlike oauth2.ReuseTokenSource,
+// which keeps tokens without expiry forever, it gets a new token each time for those.
+type expiringTokenSource struct {
+	src oauth2.TokenSource
+
+	mu  sync.Mutex
+	tok *oauth2.Token
+}
+
+func (ts *expiringTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.tok != nil && !ts.tok.Expiry.IsZero() && ts.tok.Valid() {
+		return ts.tok, nil
+	}
+	tok, err := ts.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	ts.tok = tok
+	return tok, nil
+}
+
+func (ts *execTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execTokenTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, ts.command, ts.args...).Output()
+	if err != nil {
+		proxyLog.Errorf("failed to run token command %q: %v", ts.command, err)
+		return nil, fmt.Errorf("failed to run token command %q: %v", ts.command, err)
+	}
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(out, tok); err != nil {
+		proxyLog.Errorf("failed to parse the output of token command %q: %v", ts.command, err)
+		return nil, fmt.Errorf("failed to parse the output of token command %q: %v", ts.command, err)
+	}
+	if tok.AccessToken == "" {
+		proxyLog.Errorf("read empty token from command %q", ts.command)
+		return nil, fmt.Errorf("read empty token from command %q", ts.command)
+	}
+	return tok, nil
+}
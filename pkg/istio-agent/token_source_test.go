@@ -0,0 +1,174 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeTokenCommand writes a credential helper printing a token with expiry, none if zero, and recording its runs
+// in the returned file.
+func fakeTokenCommand(t *testing.T, expiry time.Time) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	command := filepath.Join(dir, "token-helper")
+	token := `{"access_token": "fake-token"}`
+	if !expiry.IsZero() {
+		token = fmt.Sprintf(`{"access_token": "fake-token", "expiry": "%s"}`, expiry.Format(time.RFC3339))
+	}
+	script := fmt.Sprintf("#!/bin/sh\necho run >> %s\necho '%s'\n", runs, token)
+	if err := ioutil.WriteFile(command, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return command, runs
+}
+
+func TestExecTokenSource(t *testing.T) {
+	testCases := []struct {
+		name   string
+		expiry time.Time
+		runs   int
+	}{
+		{
+			name:   "cached until expiry",
+			expiry: time.Now().Add(time.Hour),
+			runs:   1,
+		},
+		{
+			name:   "expired",
+			expiry: time.Now().Add(-time.Hour),
+			runs:   2,
+		},
+		{
+			name: "no expiry",
+			runs: 2,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			command, runs := fakeTokenCommand(t, tt.expiry)
+			ts, err := newExecTokenSource(command + " --audience istio-ca")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				tok, err := ts.Token()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tok.AccessToken != "fake-token" {
+					t.Errorf("expected the token of the command, got %q", tok.AccessToken)
+				}
+				if !tok.Expiry.Equal(tt.expiry.Truncate(time.Second)) {
+					t.Errorf("expected expiry %v, got %v", tt.expiry, tok.Expiry)
+				}
+			}
+			out, err := ioutil.ReadFile(runs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Count(string(out), "run"); got != tt.runs {
+				t.Errorf("expected the command to run %d times, got %d", tt.runs, got)
+			}
+		})
+	}
+}
+
+func TestExecTokenSourceInvalidOutput(t *testing.T) {
+	dir := t.TempDir()
+	command := filepath.Join(dir, "token-helper")
+	if err := ioutil.WriteFile(command, []byte("#!/bin/sh\necho not-json\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, commandLine := range []string{command, filepath.Join(dir, "missing")} {
+		ts, err := newExecTokenSource(commandLine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ts.Token(); err == nil {
+			t.Errorf("expected an error for the token command %q", commandLine)
+		}
+	}
+	if _, err := newExecTokenSource("  \t "); err == nil {
+		t.Error("expected an error for a blank token command")
+	}
+}
+
+// fakeJWT returns an unsigned JWT expiring at exp.
+func fakeJWT(exp time.Time) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		enc.EncodeToString([]byte(fmt.Sprintf(`{"sub":"test","exp":%d}`, exp.Unix()))) + "." +
+		enc.EncodeToString([]byte("signature"))
+}
+
+func TestFileTokenSourceExpiry(t *testing.T) {
+	testCases := []struct {
+		name        string
+		token       string
+		checkExpiry bool
+		err         string
+	}{
+		{
+			name:        "valid",
+			token:       fakeJWT(time.Now().Add(time.Hour)),
+			checkExpiry: true,
+		},
+		{
+			name:        "expired",
+			token:       fakeJWT(time.Now().Add(-time.Hour)),
+			checkExpiry: true,
+			err:         "has expired",
+		},
+		{
+			name:  "expired without check",
+			token: fakeJWT(time.Now().Add(-time.Hour)),
+		},
+		{
+			name:        "not a JWT",
+			token:       "opaque-token",
+			checkExpiry: true,
+			err:         "failed to parse the JWT",
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "token")
+			if err := ioutil.WriteFile(path, []byte(tt.token+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			tok, err := (&fileTokenSource{path: path, checkExpiry: tt.checkExpiry}).Token()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tok.AccessToken != tt.token {
+				t.Errorf("expected token %q, got %q", tt.token, tok.AccessToken)
+			}
+		})
+	}
+}
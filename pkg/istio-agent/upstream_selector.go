@@ -0,0 +1,125 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	upstreamProbeInterval = 10 * time.Second // how often addresses marked down are probed.
+	upstreamProbeTimeout  = 2 * time.Second  // timeout of a single probe.
+)
+
+// upstreamSelector tracks the health of the configured istiod addresses. Addresses are kept in
+// priority order (the discovery address first, followed by the failover addresses), and reconnects
+// try the healthy ones first. Once a higher priority address is probed healthy again, the next
+// reconnect goes back to it rather than staying pinned to the address we failed over to.
+type upstreamSelector struct {
+	mu   sync.RWMutex
+	down map[string]struct{}
+	// address of the upstream we are currently connected to.
+	active string
+
+	// probe checks whether an address is reachable. Overridden in tests.
+	probe func(addr string) error
+}
+
+func newUpstreamSelector() *upstreamSelector {
+	return &upstreamSelector{
+		down:  map[string]struct{}{},
+		probe: tcpProbe,
+	}
+}
+
+func tcpProbe(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, upstreamProbeTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// order returns the addresses to try, healthy ones first. Both groups keep their priority order.
+func (s *upstreamSelector) order(addresses []string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]string, 0, len(addresses))
+	var unhealthy []string
+	for _, addr := range addresses {
+		if _, f := s.down[addr]; f {
+			unhealthy = append(unhealthy, addr)
+		} else {
+			out = append(out, addr)
+		}
+	}
+	return append(out, unhealthy...)
+}
+
+// connected marks addr as healthy and records it as the active upstream.
+func (s *upstreamSelector) connected(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.down, addr)
+	s.active = addr
+}
+
+func (s *upstreamSelector) markDown(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down[addr] = struct{}{}
+}
+
+func (s *upstreamSelector) activeAddress() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// probeDown probes every address currently marked down, and marks the reachable ones healthy again.
+func (s *upstreamSelector) probeDown() {
+	s.mu.RLock()
+	down := make([]string, 0, len(s.down))
+	for addr := range s.down {
+		down = append(down, addr)
+	}
+	s.mu.RUnlock()
+
+	for _, addr := range down {
+		if err := s.probe(addr); err != nil {
+			continue
+		}
+		proxyLog.Infof("upstream %s is reachable again", addr)
+		s.mu.Lock()
+		delete(s.down, addr)
+		s.mu.Unlock()
+	}
+}
+
+// run probes the addresses marked down every interval, until stop is closed.
+func (s *upstreamSelector) run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.probeDown()
+		case <-stop:
+			return
+		}
+	}
+}
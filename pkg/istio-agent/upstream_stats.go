@@ -0,0 +1,45 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+
+	"google.golang.org/grpc/stats"
+
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// upstreamStatsHandler accounts for the bytes received from istiod as they are on the wire, compressed if
+// compression is on. The decoded size of the responses is accounted for as they are proxied.
+type upstreamStatsHandler struct{}
+
+var _ stats.Handler = upstreamStatsHandler{}
+
+func (upstreamStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (upstreamStatsHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	if in, ok := s.(*stats.InPayload); ok {
+		metrics.XdsProxyResponseWireBytes.Record(float64(in.WireLength))
+	}
+}
+
+func (upstreamStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (upstreamStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
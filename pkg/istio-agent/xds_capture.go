@@ -0,0 +1,154 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+// Kinds of the messages in a session capture.
+const (
+	captureRequest  byte = 1
+	captureResponse byte = 2
+)
+
+// sessionCapture writes every XDS message proxied to a file, in order, so that the session can be replayed
+// offline. Each message is written as its kind, its length as a varint, and its protobuf encoding.
+// A nil capture records nothing.
+type sessionCapture struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+	// err is the first write error, after which nothing more is captured.
+	err error
+}
+
+func newSessionCapture(path string) (*sessionCapture, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the XDS capture file: %v", err)
+	}
+	proxyLog.Infof("capturing the XDS session to %s", path)
+	return &sessionCapture{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (c *sessionCapture) captureRequest(req *discovery.DiscoveryRequest) {
+	if c == nil {
+		return
+	}
+	c.write(captureRequest, req)
+}
+
+func (c *sessionCapture) captureResponse(resp *discovery.DiscoveryResponse) {
+	if c == nil {
+		return
+	}
+	c.write(captureResponse, resp)
+}
+
+func (c *sessionCapture) write(kind byte, msg proto.Message) {
+	b, err := proto.Marshal(msg)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	if err == nil {
+		header := make([]byte, 1+binary.MaxVarintLen64)
+		header[0] = kind
+		n := 1 + binary.PutUvarint(header[1:], uint64(len(b)))
+		if _, err = c.w.Write(header[:n]); err == nil {
+			_, err = c.w.Write(b)
+		}
+	}
+	if err != nil {
+		proxyLog.Errorf("stopping the XDS capture: %v", err)
+		c.err = err
+	}
+}
+
+// Close flushes the capture and closes its file.
+func (c *sessionCapture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == os.ErrClosed {
+		return nil
+	}
+	err := c.w.Flush()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	// Nothing is captured past this point.
+	c.err = os.ErrClosed
+	return err
+}
+
+// capturedMessage is a message of a session capture, either a request to istiod or a response from it.
+type capturedMessage struct {
+	request  *discovery.DiscoveryRequest
+	response *discovery.DiscoveryResponse
+}
+
+// readCapture reads back the messages of a session capture, in order.
+func readCapture(r io.Reader) ([]capturedMessage, error) {
+	br := bufio.NewReader(r)
+	var out []capturedMessage
+	for {
+		kind, err := br.ReadByte()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, fmt.Errorf("truncated capture: %v", err)
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(br, b); err != nil {
+			return nil, fmt.Errorf("truncated capture: %v", err)
+		}
+		var m capturedMessage
+		switch kind {
+		case captureRequest:
+			m.request = &discovery.DiscoveryRequest{}
+			err = proto.Unmarshal(b, m.request)
+		case captureResponse:
+			m.response = &discovery.DiscoveryResponse{}
+			err = proto.Unmarshal(b, m.response)
+		default:
+			err = fmt.Errorf("unknown message kind %d", kind)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid capture: %v", err)
+		}
+		out = append(out, m)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// replaySession feeds a captured session through HandleUpstream against a fake istiod and Envoy: the requests
+// as if Envoy sent them, and the responses as if istiod did. Each message waits for the proxy to pass it on, so
+// the session keeps its order. The responses must be of types forwarded to Envoy, and the session must not hold
+// the requests the proxy makes by itself, like the ACKs of subscribed responses.
+func replaySession(t *testing.T, proxy *XdsProxy, session []capturedMessage) {
+	t.Helper()
+	upstream := newFakeUpstream()
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, len(session))}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	done := make(chan error, 1)
+	go func() { done <- proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream}) }()
+
+	for i, m := range session {
+		if m.request != nil {
+			con.requestsChan <- &upstreamRequest{req: proto.Clone(m.request).(*discovery.DiscoveryRequest)}
+			select {
+			case <-upstream.requests:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message %d: request was not sent upstream", i)
+			}
+		} else {
+			upstream.responses <- proto.Clone(m.response).(*discovery.DiscoveryResponse)
+			select {
+			case <-downstream.sent:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("message %d: response was not sent downstream", i)
+			}
+		}
+	}
+	close(upstream.responses)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the session did not end")
+	}
+}
+
+// captureSession replays session through a new proxy capturing to a file, and returns the captured messages.
+func captureSession(t *testing.T, session []capturedMessage) []capturedMessage {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "session.xds")
+	proxy := setupXdsProxy(t)
+	var err error
+	if proxy.capture, err = newSessionCapture(path); err != nil {
+		t.Fatal(err)
+	}
+	replaySession(t, proxy, session)
+	if err := proxy.capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	captured, err := readCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return captured
+}
+
+func assertSession(t *testing.T, got, want []capturedMessage) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		var same bool
+		if want[i].request != nil {
+			same = got[i].request != nil && proto.Equal(got[i].request, want[i].request)
+		} else {
+			same = got[i].response != nil && proto.Equal(got[i].response, want[i].response)
+		}
+		if !same {
+			t.Errorf("message %d: got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+// Validates a session captured from the proxy replays through another proxy into the same capture.
+func TestSessionCaptureReplay(t *testing.T) {
+	res, err := ptypes.MarshalAny(&cluster.Cluster{Name: "outbound|9080||productpage.ns1.svc.cluster.local"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := []capturedMessage{
+		{request: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}},
+		{response: &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, VersionInfo: "1", Nonce: "a", Resources: []*any.Any{res}}},
+		{request: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a"}},
+		{request: &discovery.DiscoveryRequest{TypeUrl: v3.ListenerType}},
+		{response: &discovery.DiscoveryResponse{TypeUrl: v3.ListenerType, VersionInfo: "1", Nonce: "b"}},
+	}
+
+	captured := captureSession(t, session)
+	assertSession(t, captured, session)
+	// The capture replays into the same session.
+	assertSession(t, captureSession(t, captured), session)
+}
+
+func TestSessionCaptureDisabled(t *testing.T) {
+	c, err := newSessionCapture("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.captureRequest(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
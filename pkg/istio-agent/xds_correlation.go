@@ -0,0 +1,135 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/metadata"
+
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// correlationIDHeader carries the correlation ID of an upstream stream in its gRPC metadata. istiod may echo
+// it in its response headers.
+const correlationIDHeader = "x-istio-xds-correlation-id"
+
+// maxResponseWait is how long a request is timed for, at most. A request still waiting for its response by then
+// is assumed to be left unanswered, and is forgotten.
+const maxResponseWait = 5 * time.Minute
+
+// xdsCorrelation ties the responses of istiod to the requests forwarded on an upstream stream, for logging.
+// Requests are identified by the stream correlation ID and their sequence number on the stream. As gRPC metadata
+// is per stream, responses are matched with the last request of their type, which they answer or follow.
+//
+// The time istiod takes to answer is recorded for each request, keyed by its type url and response nonce. A
+// response answers the request of its type carrying the nonce of the previous response of that type, or no
+// nonce for the first one: the initial request, or the ACK or NACK of the previous response. Requests it
+// supersedes are forgotten.
+type xdsCorrelation struct {
+	id string
+
+	mu  sync.Mutex
+	seq int
+	// echoed is set if istiod echoed the correlation ID, which confirms it answers this stream.
+	echoed bool
+	// pending holds the ID of the last request sent for each type url.
+	pending map[string]string
+	// inFlight holds the time the requests waiting for a response were sent.
+	inFlight map[requestKey]time.Time
+	// nonces holds the nonce of the last response received for each type url.
+	nonces map[string]string
+	now    func() time.Time
+}
+
+// requestKey identifies a request waiting for a response by its type url and the nonce of the response it
+// acknowledges, if any.
+type requestKey struct {
+	typeURL string
+	nonce   string
+}
+
+func newXdsCorrelation() *xdsCorrelation {
+	return &xdsCorrelation{
+		id:       uuid.New().String(),
+		pending:  map[string]string{},
+		inFlight: map[requestKey]time.Time{},
+		nonces:   map[string]string{},
+		now:      time.Now,
+	}
+}
+
+// request returns the ID of req, the next request sent on the stream.
+func (c *xdsCorrelation) request(req *discovery.DiscoveryRequest) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	id := fmt.Sprintf("%s/%d", c.id, c.seq)
+	c.pending[req.TypeUrl] = id
+
+	now := c.now()
+	for key, sent := range c.inFlight {
+		if now.Sub(sent) > maxResponseWait {
+			delete(c.inFlight, key)
+		}
+	}
+	key := requestKey{typeURL: req.TypeUrl, nonce: req.ResponseNonce}
+	if _, f := c.inFlight[key]; !f {
+		c.inFlight[key] = now
+	}
+	return id
+}
+
+// headers records whether the response headers of istiod echo the correlation ID.
+func (c *xdsCorrelation) headers(md metadata.MD) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, v := range md.Get(correlationIDHeader) {
+		if v == c.id {
+			c.echoed = true
+		}
+	}
+}
+
+// response returns a description of the request resp is matched with, to log alongside it.
+func (c *xdsCorrelation) response(resp *discovery.DiscoveryResponse) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	answered := requestKey{typeURL: resp.TypeUrl, nonce: c.nonces[resp.TypeUrl]}
+	if sent, f := c.inFlight[answered]; f {
+		if took := c.now().Sub(sent); took <= maxResponseWait {
+			metrics.XdsProxyResponseLatency.With(metrics.TypeURLTag.Value(resp.TypeUrl)).Record(took.Seconds())
+		}
+	}
+	for key := range c.inFlight {
+		if key.typeURL == resp.TypeUrl {
+			delete(c.inFlight, key)
+		}
+	}
+	c.nonces[resp.TypeUrl] = resp.Nonce
+	id, f := c.pending[resp.TypeUrl]
+	if !f {
+		id = c.id
+	}
+	if c.echoed {
+		return id
+	}
+	// istiod does not know about the correlation ID, the match relies on the type url and nonce only.
+	return fmt.Sprintf("%s (by type url and nonce %q)", id, resp.Nonce)
+}
@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+// requestDeduper suppresses the requests identical to the last one forwarded for their type URL within a
+// window, like the ones Envoy repeats while re-subscribing during config churn. Requests with a new version,
+// nonce or error detail are never identical, so the ACKs and NACKs always go through.
+// It is only used by the goroutine handling the upstream. A nil deduper suppresses nothing.
+type requestDeduper struct {
+	window time.Duration
+	now    func() time.Time
+	// last is the last request forwarded for each type URL, and when.
+	last map[string]dedupEntry
+}
+
+type dedupEntry struct {
+	req *discovery.DiscoveryRequest
+	at  time.Time
+}
+
+func newRequestDeduper(window time.Duration) *requestDeduper {
+	if window <= 0 {
+		return nil
+	}
+	return &requestDeduper{window: window, now: time.Now, last: map[string]dedupEntry{}}
+}
+
+// duplicate returns true if req should be suppressed, and records it as forwarded otherwise.
+func (d *requestDeduper) duplicate(req *discovery.DiscoveryRequest) bool {
+	if d == nil {
+		return false
+	}
+	now := d.now()
+	if last, f := d.last[req.TypeUrl]; f && now.Sub(last.at) < d.window && sameRequest(last.req, req) {
+		return true
+	}
+	d.last[req.TypeUrl] = dedupEntry{req: req, at: now}
+	return false
+}
+
+// sameRequest returns true if a and b subscribe to the same resources at the same version and nonce.
+// The node is left out, Envoy only sends it on its first request.
+func sameRequest(a, b *discovery.DiscoveryRequest) bool {
+	if a.TypeUrl != b.TypeUrl || a.VersionInfo != b.VersionInfo || a.ResponseNonce != b.ResponseNonce ||
+		len(a.ResourceNames) != len(b.ResourceNames) {
+		return false
+	}
+	for i := range a.ResourceNames {
+		if a.ResourceNames[i] != b.ResourceNames[i] {
+			return false
+		}
+	}
+	if a.ErrorDetail == nil || b.ErrorDetail == nil {
+		return a.ErrorDetail == b.ErrorDetail
+	}
+	return proto.Equal(a.ErrorDetail, b.ErrorDetail)
+}
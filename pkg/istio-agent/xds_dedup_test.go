@@ -0,0 +1,61 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestRequestDeduper(t *testing.T) {
+	now := time.Unix(0, 0)
+	d := newRequestDeduper(time.Second)
+	d.now = func() time.Time { return now }
+
+	ack := &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a"}
+	steps := []struct {
+		name      string
+		req       *discovery.DiscoveryRequest
+		after     time.Duration
+		duplicate bool
+	}{
+		{name: "first", req: ack},
+		{name: "repeated", req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a"}, duplicate: true},
+		{name: "other type", req: &discovery.DiscoveryRequest{TypeUrl: v3.ListenerType, VersionInfo: "1", ResponseNonce: "a"}},
+		{name: "nack", req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a",
+			ErrorDetail: &google_rpc.Status{Message: "rejected"}}},
+		{name: "repeated nack", req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a",
+			ErrorDetail: &google_rpc.Status{Message: "rejected"}}, duplicate: true},
+		{name: "repeated after the window", req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a",
+			ErrorDetail: &google_rpc.Status{Message: "rejected"}}, after: time.Second},
+		{name: "new resource names", req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a",
+			ResourceNames: []string{"outbound|80||productpage.ns1.svc.cluster.local"}}},
+	}
+	for _, s := range steps {
+		now = now.Add(s.after)
+		if got := d.duplicate(s.req); got != s.duplicate {
+			t.Errorf("%s: expected duplicate %v, got %v", s.name, s.duplicate, got)
+		}
+	}
+
+	if newRequestDeduper(0).duplicate(ack) {
+		t.Error("expected no request to be suppressed without a window")
+	}
+}
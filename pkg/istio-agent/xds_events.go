@@ -0,0 +1,127 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// Direction of the recorded XDS messages.
+	eventRequest  = "request"
+	eventResponse = "response"
+)
+
+// xdsEvent summarizes a single XDS message that flowed through the proxy.
+type xdsEvent struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"`
+	TypeURL   string    `json:"typeUrl"`
+	Version   string    `json:"version,omitempty"`
+	Nonce     string    `json:"nonce,omitempty"`
+	// ResourceNames are the names subscribed to by a request.
+	ResourceNames []string `json:"resourceNames,omitempty"`
+	// Resources is the number of resources in a response.
+	Resources int `json:"resources,omitempty"`
+	Size      int `json:"size"`
+}
+
+// eventRecorder keeps the last XDS messages proxied in a fixed size ring buffer, for debugging.
+// A nil recorder records nothing.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []xdsEvent
+	// next is the index the next event is written to.
+	next int
+	full bool
+}
+
+func newEventRecorder(capacity int) *eventRecorder {
+	if capacity <= 0 {
+		return nil
+	}
+	return &eventRecorder{events: make([]xdsEvent, capacity)}
+}
+
+func (r *eventRecorder) recordRequest(req *discovery.DiscoveryRequest) {
+	if r == nil {
+		return
+	}
+	r.record(xdsEvent{
+		Time:          time.Now(),
+		Direction:     eventRequest,
+		TypeURL:       req.TypeUrl,
+		Version:       req.VersionInfo,
+		Nonce:         req.ResponseNonce,
+		ResourceNames: req.ResourceNames,
+		Size:          proto.Size(req),
+	})
+}
+
+func (r *eventRecorder) recordResponse(resp *discovery.DiscoveryResponse) {
+	if r == nil {
+		return
+	}
+	r.record(xdsEvent{
+		Time:      time.Now(),
+		Direction: eventResponse,
+		TypeURL:   resp.TypeUrl,
+		Version:   resp.VersionInfo,
+		Nonce:     resp.Nonce,
+		Resources: len(resp.Resources),
+		Size:      proto.Size(resp),
+	})
+}
+
+func (r *eventRecorder) record(e xdsEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[r.next] = e
+	r.next++
+	if r.next == len(r.events) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// list returns the recorded events, oldest first.
+func (r *eventRecorder) list() []xdsEvent {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]xdsEvent{}, r.events[:r.next]...)
+	}
+	return append(append([]xdsEvent{}, r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// ServeHTTP dumps the recorded events as JSON.
+func (r *eventRecorder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b, err := json.MarshalIndent(r.list(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
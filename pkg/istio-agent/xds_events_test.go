@@ -0,0 +1,69 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+func TestEventRecorder(t *testing.T) {
+	r := newEventRecorder(3)
+	r.recordRequest(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, ResourceNames: []string{"a"}})
+	r.recordResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1"})
+	if got, want := typeURLs(r.list()), []string{eventRequest + v3.ClusterType, eventResponse + v3.ClusterType}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+
+	// Two more events wrap the buffer, dropping the oldest.
+	r.recordRequest(&discovery.DiscoveryRequest{TypeUrl: v3.ListenerType})
+	r.recordResponse(&discovery.DiscoveryResponse{TypeUrl: v3.ListenerType})
+	want := []string{eventResponse + v3.ClusterType, eventRequest + v3.ListenerType, eventResponse + v3.ListenerType}
+	if got := typeURLs(r.list()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got events %v, want %v", got, want)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/debug/xds-events", nil))
+	var served []xdsEvent
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if got := typeURLs(served); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got served events %v, want %v", got, want)
+	}
+}
+
+func TestEventRecorderDisabled(t *testing.T) {
+	r := newEventRecorder(0)
+	r.recordRequest(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+	if got := r.list(); len(got) != 0 {
+		t.Fatalf("expected no events, got %v", got)
+	}
+}
+
+func typeURLs(events []xdsEvent) []string {
+	out := make([]string, 0, len(events))
+	for _, e := range events {
+		out = append(out, e.Direction+e.TypeURL)
+	}
+	return out
+}
@@ -24,14 +24,18 @@ import (
 	"io/ioutil"
 	"math"
 	"net"
+	"net/http"
 	"os"
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
-	"github.com/golang/protobuf/ptypes"
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/protobuf/proto"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 	"golang.org/x/oauth2"
 	google_rpc "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
@@ -45,18 +49,26 @@ import (
 	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/dns"
 	nds "istio.io/istio/pilot/pkg/proto"
+	"istio.io/istio/pilot/pkg/xds"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/istio/pkg/istio-agent/health"
 	"istio.io/istio/pkg/istio-agent/metrics"
 	"istio.io/istio/pkg/mcp/status"
 	"istio.io/istio/pkg/uds"
+	"istio.io/istio/security/pkg/util"
 	"istio.io/pkg/filewatcher"
 	"istio.io/pkg/log"
 )
 
 var (
 	newFileWatcher = filewatcher.NewWatcher
+
+	// reportSlowSend is called for the upstream sends that succeeded, but took longer than the slow send threshold.
+	reportSlowSend = func(typeURL string, took time.Duration) {
+		proxyLog.Warnf("slow upstream send for type url %s, took %v", typeURL, took)
+		metrics.XdsProxySlowUpstreamSends.With(metrics.TypeURLTag.Value(typeURL)).Record(took.Seconds())
+	}
 )
 
 const (
@@ -64,11 +76,15 @@ const (
 	defaultInitialConnWindowSize       = 1024 * 1024            // default gRPC InitialWindowSize
 	defaultInitialWindowSize           = 1024 * 1024            // default gRPC ConnWindowSize
 	sendTimeout                        = 5 * time.Second        // default upstream send timeout.
+	circuitBreakerRejectDelay          = time.Second            // delay before Envoy is told istiod is unavailable.
 	watchDebounceDelay                 = 100 * time.Millisecond // file watcher event debounce delay.
 )
 
 const (
 	xdsUdsPath = "./etc/istio/proxy/XDS"
+
+	// nameTableCompressionMetadata is the node metadata telling istiod the name table compression accepted.
+	nameTableCompressionMetadata = "NAME_TABLE_COMPRESSION"
 )
 
 // XDS Proxy proxies all XDS requests from envoy to istiod, in addition to allowing
@@ -85,30 +101,226 @@ type XdsProxy struct {
 	downstreamListener   net.Listener
 	downstreamGrpcServer *grpc.Server
 	istiodAddress        string
-	istiodDialOptions    []grpc.DialOption
-	localDNSServer       *dns.LocalDNSServer
-	healthChecker        *health.WorkloadHealthChecker
-	fileWatcher          filewatcher.FileWatcher
-	agent                *Agent
+	// istiodFailoverAddresses are tried, in order, when istiodAddress is unreachable.
+	istiodFailoverAddresses []string
+	istiodDialOptions       []grpc.DialOption
+	// failoverDialOptions are the dial options of each failover address, verifying istiod under the name of the
+	// address. The addresses without any are dialed with istiodDialOptions.
+	failoverDialOptions map[string][]grpc.DialOption
+	upstreams           *upstreamSelector
+	localDNSServer      dnsServer
+	healthChecker       *health.WorkloadHealthChecker
+	fileWatcher         filewatcher.FileWatcher
+	agent               *Agent
+	// after returns a channel receiving the time once d has elapsed. It is time.After, unless replaced by tests.
+	after func(d time.Duration) <-chan time.Time
+	// dialOptionsMutex guards istiodDialOptions and failoverDialOptions, rebuilt when the certificates rotate.
+	dialOptionsMutex sync.RWMutex
 
-	// connected stores the active gRPC stream. The proxy will only have 1 connection at a time
+	// connected stores the most recent gRPC stream, which the requests of the agent subsystems are sent on.
 	connected      *ProxyConnection
 	connectedMutex sync.RWMutex
+	// maxDownstreamConnections is the number of Envoy streams served at once, each over its own upstream
+	// connection, so that the old and new Envoy of a hot restart are both served. A new stream beyond it
+	// closes the oldest one. The proxy only serves the most recent stream if zero or one.
+	maxDownstreamConnections int
+	// requestsBufferSize and responsesBufferSize are the capacities of the request and response queues of the
+	// connections, or the default if zero.
+	requestsBufferSize  int
+	responsesBufferSize int
+	// downstreams are the streams served, keyed by connection ID, if more than one may be.
+	downstreams map[uint64]*ProxyConnection
+
+	// disableNameTable leaves the dns server alone: name tables are neither requested nor built into it.
+	disableNameTable bool
+	// compressNameTable advertises to istiod that gzip compressed name tables are accepted.
+	compressNameTable bool
+
+	// downstreamGracePeriod is how long the upstream connection is kept after Envoy disconnects,
+	// so that an Envoy reconnecting right away can reuse it. Disabled if zero.
+	downstreamGracePeriod time.Duration
+	// parked is the connection waiting out its downstream grace period, if any.
+	parked *ProxyConnection
+
+	// fastReconnect moves a stream istiod closed cleanly over to a new upstream connection, replaying the
+	// last requests, instead of ending the stream to Envoy.
+	fastReconnect bool
+
+	// logSampler samples the debug logs of each message proxied. Nil if every message is logged.
+	logSampler *logSampler
+
+	// events records the last XDS messages proxied, for debugging. Nil if disabled.
+	events *eventRecorder
+	// capture writes every XDS message proxied to a file, to replay the session offline. Nil if disabled.
+	capture *sessionCapture
+
+	// responseTransform is applied to responses before they are forwarded to Envoy.
+	responseTransform ResponseTransform
+
+	// slowSendThreshold is the duration after which a successful upstream send is reported as slow. Disabled if zero.
+	slowSendThreshold time.Duration
+	// dedupWindow is how long a request identical to the last one of its type URL is suppressed. Disabled if zero.
+	dedupWindow time.Duration
+
+	// nameTables coalesces the name tables received in a burst before they are fed to the dns server.
+	// Each table is fed right away if nil.
+	nameTables *nameTableDebouncer
+
+	// warmupTimeout is how long, at most, Envoy waits for the first name table from istiod to be built into the
+	// dns server before its responses are forwarded, so that its first DNS queries do not fail. Disabled if zero.
+	warmupTimeout time.Duration
+	// nameTableWarm is closed once the first name table is built into the dns server.
+	nameTableWarm     chan struct{}
+	nameTableWarmOnce sync.Once
+
+	// nameTableRefresh holds a pending refresh of the name table, refreshes requested meanwhile are coalesced.
+	nameTableRefresh chan struct{}
+	// resync holds a pending full resync of the subscriptions, resyncs requested meanwhile are coalesced.
+	resync chan struct{}
+
+	// subscriptions of agent subsystems, keyed by type URL.
+	subscriptions      map[string]subscription
+	subscriptionsMutex sync.RWMutex
+
+	// newUpstreamClient connects to istiod for each new Envoy stream. Overridden in tests.
+	newUpstreamClient upstreamClientFactory
+
+	// clientCertProvider, if set, supplies the client certificate for mTLS to istiod instead of the
+	// certificate files.
+	clientCertProvider ClientCertProvider
+
+	// metadataProvider, if set, supplies metadata for each stream to istiod on top of the XDS headers.
+	metadataProvider MetadataProvider
+
+	// breaker skips the connections to istiod after consecutive failures. Nil if disabled.
+	breaker *circuitBreaker
+	// breakerRejectDelay slows down the Envoy reconnects while the breaker is open.
+	breakerRejectDelay time.Duration
+
+	// retryBudget limits the rate of connections to istiod. Nil if disabled.
+	retryBudget *retryBudget
+
+	// downstreamPeerCheck only lets the processes with the allowed credentials connect to the XDS socket.
+	// Any process that can open the socket is served if nil.
+	downstreamPeerCheck *peerCredChecker
+
+	// state is the state of the proxy reported in its snapshots.
+	state proxyState
+
+	// observers are told of the transitions of the connection to istiod.
+	observers      []ConnectionObserver
+	observersMutex sync.RWMutex
+
+	// tees receive copies of the responses forwarded to Envoy.
+	tees      []*responseTee
+	teesMutex sync.RWMutex
+}
+
+// ResponseHandler processes the responses from istiod for a type URL an agent subsystem subscribed to.
+// Returning an error NACKs the response, unless it is also forwarded to Envoy, which ACKs it itself.
+type ResponseHandler func(resp *discovery.DiscoveryResponse) error
+
+type subscription struct {
+	handler        ResponseHandler
+	forwardToEnvoy bool
+}
+
+// subscribedResponse is a response queued for the handler of its subscription.
+type subscribedResponse struct {
+	resp *discovery.DiscoveryResponse
+	sub  subscription
 }
 
+// upstreamClientFactory returns an ADS client to istiod, along with the connection to close once the stream is done.
+type upstreamClientFactory func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error)
+
+// ClientCertProvider supplies the client certificate used for mTLS to istiod from memory, for instance
+// when it is provisioned by the agent's own SDS rather than written to disk. It is consulted on every
+// handshake, so rotated certificates are picked up by the next connection.
+type ClientCertProvider interface {
+	GetClientCertificate() (*tls.Certificate, error)
+}
+
+// ResponseTransform can modify a response from istiod before it is forwarded to Envoy, or drop it by
+// returning nil. Resources are Any encoded; a transform changing a resource must marshal it back with the
+// same type URL. Dropping a response means Envoy will not ACK it, so this should be done with care.
+type ResponseTransform func(resp *discovery.DiscoveryResponse) *discovery.DiscoveryResponse
+
+// MetadataProvider returns gRPC metadata to add to a new stream to istiod. It is called on every connection,
+// so the values can be recomputed each time, unlike the static XDS headers. An error fails the connection.
+type MetadataProvider func(ctx context.Context) (map[string]string, error)
+
+// dnsServer is the part of the local DNS server used by the proxy, which feeds it the name tables from istiod.
+type dnsServer interface {
+	UpdateLookupTable(nt *nds.NameTable)
+}
+
+var _ dnsServer = &dns.LocalDNSServer{}
+
+// The lookup table of the dns server is served on the debug endpoints.
+var _ http.Handler = &dns.LocalDNSServer{}
+
 var proxyLog = log.RegisterScope("xdsproxy", "XDS Proxy in Istio Agent", 0)
 
 func initXdsProxy(ia *Agent) (*XdsProxy, error) {
 	var err error
 	proxy := &XdsProxy{
-		istiodAddress:  ia.proxyConfig.DiscoveryAddress,
-		clusterID:      ia.secOpts.ClusterID,
-		localDNSServer: ia.localDNSServer,
-		fileWatcher:    newFileWatcher(),
-		stopChan:       make(chan struct{}),
-		resetChan:      make(chan struct{}),
-		healthChecker:  health.NewWorkloadHealthChecker(ia.proxyConfig.ReadinessProbe),
-		agent:          ia,
+		istiodAddress:            ia.proxyConfig.DiscoveryAddress,
+		istiodFailoverAddresses:  ia.cfg.XDSFailoverAddresses,
+		downstreamGracePeriod:    ia.cfg.DownstreamGracePeriod,
+		fastReconnect:            ia.cfg.XDSFastReconnect,
+		events:                   newEventRecorder(ia.cfg.XDSEventLogSize),
+		logSampler:               newLogSampler(ia.cfg.XDSDebugLogSampleRate),
+		responseTransform:        ia.cfg.XDSResponseTransform,
+		clientCertProvider:       ia.cfg.XDSClientCertProvider,
+		metadataProvider:         ia.cfg.XDSMetadataProvider,
+		slowSendThreshold:        ia.cfg.XDSSlowSendThreshold,
+		dedupWindow:              ia.cfg.XDSRequestDedupWindow,
+		upstreams:                newUpstreamSelector(),
+		clusterID:                ia.secOpts.ClusterID,
+		fileWatcher:              newFileWatcher(),
+		after:                    time.After,
+		stopChan:                 make(chan struct{}),
+		resetChan:                make(chan struct{}),
+		healthChecker:            health.NewWorkloadHealthChecker(ia.proxyConfig.ReadinessProbe),
+		agent:                    ia,
+		subscriptions:            map[string]subscription{},
+		nameTableRefresh:         make(chan struct{}, 1),
+		resync:                   make(chan struct{}, 1),
+		warmupTimeout:            ia.cfg.XDSWarmupTimeout,
+		nameTableWarm:            make(chan struct{}),
+		breakerRejectDelay:       circuitBreakerRejectDelay,
+		maxDownstreamConnections: ia.cfg.XDSMaxDownstreamConnections,
+		requestsBufferSize:       ia.cfg.XDSRequestsBufferSize,
+		responsesBufferSize:      ia.cfg.XDSResponsesBufferSize,
+		disableNameTable:         ia.cfg.XDSDisableNameTable,
+		compressNameTable:        ia.cfg.XDSCompressNameTable,
+	}
+	if ia.cfg.XDSCircuitBreakerThreshold > 0 {
+		proxy.breaker = newCircuitBreaker(ia.cfg.XDSCircuitBreakerThreshold, ia.cfg.XDSCircuitBreakerWindow,
+			ia.cfg.XDSCircuitBreakerCooldown)
+	}
+	if ia.cfg.XDSRetryBudgetRate > 0 {
+		proxy.retryBudget = newRetryBudget(ia.cfg.XDSRetryBudgetRate, ia.cfg.XDSRetryBudgetBurst)
+	}
+	if len(ia.cfg.XDSAllowedPeerUIDs) > 0 || len(ia.cfg.XDSAllowedPeerGIDs) > 0 {
+		proxy.downstreamPeerCheck = newPeerCredChecker(ia.cfg.XDSAllowedPeerUIDs, ia.cfg.XDSAllowedPeerGIDs)
+	}
+	proxy.newUpstreamClient = proxy.dialUpstreamClient
+	if proxy.capture, err = newSessionCapture(ia.cfg.XDSCaptureFile); err != nil {
+		return nil, err
+	}
+	if ia.cfg.XDSNameTableDebounce > 0 {
+		proxy.nameTables = newNameTableDebouncer(ia.cfg.XDSNameTableDebounce, func(nt *nds.NameTable) {
+			proxy.localDNSServer.UpdateLookupTable(nt)
+			proxy.markNameTableWarm()
+		})
+	}
+	// Name tables are only meant for the dns server, Envoy does not know about them.
+	proxy.Subscribe(v3.NameTableType, proxy.updateNameTable, false)
+
+	if ia.localDNSServer != nil {
+		proxy.localDNSServer = ia.localDNSServer
 	}
 
 	proxyLog.Infof("Initializing with upstream address %s and cluster %s", proxy.istiodAddress, proxy.clusterID)
@@ -117,7 +329,7 @@ func initXdsProxy(ia *Agent) (*XdsProxy, error) {
 		return nil, err
 	}
 
-	if proxy.istiodDialOptions, err = proxy.buildUpstreamClientDialOpts(ia); err != nil {
+	if proxy.istiodDialOptions, proxy.failoverDialOptions, err = proxy.buildUpstreamDialOpts(ia); err != nil {
 		return nil, err
 	}
 
@@ -130,6 +342,12 @@ func initXdsProxy(ia *Agent) (*XdsProxy, error) {
 	if err = proxy.initCertificateWatches(ia, proxy.stopChan); err != nil {
 		return nil, err
 	}
+	go proxy.handleResets(proxy.stopChan)
+
+	if len(proxy.istiodFailoverAddresses) > 0 {
+		proxyLog.Infof("Failover upstream addresses: %v", proxy.istiodFailoverAddresses)
+		go proxy.upstreams.run(upstreamProbeInterval, proxy.stopChan)
+	}
 
 	go proxy.healthChecker.PerformApplicationHealthCheck(func(healthEvent *health.ProbeEvent) {
 		var req *discovery.DiscoveryRequest
@@ -151,119 +369,493 @@ func initXdsProxy(ia *Agent) (*XdsProxy, error) {
 
 // SendRequest sends a request to the currently connected proxy
 func (p *XdsProxy) SendRequest(req *discovery.DiscoveryRequest) {
+	p.SendRequestWithDeadline(req, time.Time{})
+}
+
+// SendRequestWithDeadline sends a request to the currently connected proxy, unless it is still queued at the
+// deadline, in which case it is dropped. A zero deadline never expires.
+func (p *XdsProxy) SendRequestWithDeadline(req *discovery.DiscoveryRequest, deadline time.Time) {
 	p.connectedMutex.RLock()
 	defer p.connectedMutex.RUnlock()
 	// TODO especially for health check purposes, we need a way to ensure the send succeeded. Otherwise,
 	// requests send to a disconnecting proxy will be permanently dropped.
 	if p.connected != nil {
-		p.connected.requestsChan <- req
+		p.connected.requestsChan <- &upstreamRequest{req: req, deadline: deadline}
 	}
 }
 
+// Subscribe delivers the responses from istiod for typeURL to handler, in the order they are received.
+// Unless forwardToEnvoy is set, Envoy does not get them and the proxy ACKs them on behalf of the subsystem.
+// Requests for typeURL are sent with SendRequest.
+func (p *XdsProxy) Subscribe(typeURL string, handler ResponseHandler, forwardToEnvoy bool) {
+	p.subscriptionsMutex.Lock()
+	defer p.subscriptionsMutex.Unlock()
+	p.subscriptions[typeURL] = subscription{handler: handler, forwardToEnvoy: forwardToEnvoy}
+}
+
+func (p *XdsProxy) subscription(typeURL string) (subscription, bool) {
+	p.subscriptionsMutex.RLock()
+	defer p.subscriptionsMutex.RUnlock()
+	sub, f := p.subscriptions[typeURL]
+	return sub, f
+}
+
 func (p *XdsProxy) RegisterStream(c *ProxyConnection) {
 	p.connectedMutex.Lock()
 	defer p.connectedMutex.Unlock()
-	if p.connected != nil {
+	if p.maxDownstreamConnections > 1 {
+		if p.downstreams == nil {
+			p.downstreams = map[uint64]*ProxyConnection{}
+		}
+		p.downstreams[c.id] = c
+		for len(p.downstreams) > p.maxDownstreamConnections {
+			oldest := p.oldestDownstream()
+			close(oldest.stopChan)
+			delete(p.downstreams, oldest.id)
+		}
+	} else if p.connected != nil {
 		close(p.connected.stopChan)
 	}
 	p.connected = c
+	p.parked = nil
+}
+
+// unregisterStream forgets about a stream that is no longer served, if more than one may be. The requests of the
+// agent subsystems then go to the most recent stream left.
+func (p *XdsProxy) unregisterStream(c *ProxyConnection) {
+	if p.maxDownstreamConnections <= 1 {
+		return
+	}
+	p.connectedMutex.Lock()
+	defer p.connectedMutex.Unlock()
+	if p.downstreams[c.id] != c {
+		return
+	}
+	delete(p.downstreams, c.id)
+	if p.connected != c {
+		return
+	}
+	p.connected = nil
+	for _, con := range p.downstreams {
+		if p.connected == nil || con.id > p.connected.id {
+			p.connected = con
+		}
+	}
+}
+
+// oldestDownstream returns the stream served the longest. connectedMutex is held.
+func (p *XdsProxy) oldestDownstream() *ProxyConnection {
+	var oldest *ProxyConnection
+	for _, con := range p.downstreams {
+		if oldest == nil || con.id < oldest.id {
+			oldest = con
+		}
+	}
+	return oldest
 }
 
 type ProxyConnection struct {
+	// id identifies the connection, in the order connections are made.
+	id              uint64
 	upstreamError   chan error
 	downstreamError chan error
-	requestsChan    chan *discovery.DiscoveryRequest
+	requestsChan    chan *upstreamRequest
 	responsesChan   chan *discovery.DiscoveryResponse
 	stopChan        chan struct{}
 	downstream      discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+	// firstNDSSent is only accessed by the goroutine receiving from the current downstream.
+	firstNDSSent bool
+
+	// node is the ID of the Envoy on the downstream, only recorded when a downstream grace period is set.
+	node string
+	// resume hands a new downstream over to this connection while it waits out the grace period.
+	resume chan *resumedDownstream
+	// resumed is the downstream that took over this connection, if any.
+	resumed *resumedDownstream
+	// claimed is set, under connectedMutex, once a new downstream has taken over this connection.
+	claimed bool
+	// done is closed once the connection is no longer served.
+	done chan struct{}
+	// upstreamConn is the connection to istiod the upstream stream is opened on, owned by HandleUpstream.
+	upstreamConn io.Closer
+}
+
+// connectionNumber is the ID of the last connection made.
+var connectionNumber uint64
+
+// defaultConnectionBufferSize is the default capacity of the request and response queues of a connection.
+const defaultConnectionBufferSize = 10
+
+func newProxyConnection(downstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) *ProxyConnection {
+	return newBufferedProxyConnection(downstream, defaultConnectionBufferSize, defaultConnectionBufferSize)
+}
+
+// newBufferedProxyConnection returns a connection queuing up to requests requests to istiod and responses
+// responses to Envoy. Zero or negative sizes stand for the default.
+func newBufferedProxyConnection(downstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer,
+	requests, responses int) *ProxyConnection {
+	if requests <= 0 {
+		requests = defaultConnectionBufferSize
+	}
+	if responses <= 0 {
+		responses = defaultConnectionBufferSize
+	}
+	return &ProxyConnection{
+		id:              atomic.AddUint64(&connectionNumber, 1),
+		upstreamError:   make(chan error),
+		downstreamError: make(chan error),
+		requestsChan:    make(chan *upstreamRequest, requests),
+		responsesChan:   make(chan *discovery.DiscoveryResponse, responses),
+		stopChan:        make(chan struct{}),
+		downstream:      downstream,
+		resume:          make(chan *resumedDownstream, 1),
+		done:            make(chan struct{}),
+	}
+}
+
+// upstreamRequest is a request queued for istiod. Requests from agent subsystems may have a deadline,
+// after which they are dropped rather than sent. Requests from Envoy never expire.
+type upstreamRequest struct {
+	req      *discovery.DiscoveryRequest
+	deadline time.Time
+	// fromEnvoy is set for the requests Envoy sent, rather than the agent subsystems.
+	fromEnvoy bool
+}
+
+func (r *upstreamRequest) expired() bool {
+	return !r.deadline.IsZero() && time.Now().After(r.deadline)
+}
+
+// resumedDownstream is an Envoy stream that reconnected within the downstream grace period
+// and is served over the upstream connection of its previous stream.
+type resumedDownstream struct {
+	stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer
+	// detached receives the result once the proxy stops serving this stream.
+	detached chan error
+}
+
+// detach releases the resumed downstream, if any, returning err to its stream.
+func (con *ProxyConnection) detach(err error) {
+	if con.resumed != nil {
+		con.resumed.detached <- err
+		con.resumed = nil
+	}
+}
+
+// takeParked returns the connection waiting out its downstream grace period for node, if any.
+func (p *XdsProxy) takeParked(node string) *ProxyConnection {
+	p.connectedMutex.Lock()
+	defer p.connectedMutex.Unlock()
+	if p.parked == nil || node == "" || p.parked.node != node {
+		return nil
+	}
+	con := p.parked
+	con.claimed = true
+	p.parked = nil
+	return con
+}
+
+// awaitDownstream waits up to the downstream grace period for the same Envoy to reconnect,
+// returning true if it did and con is now serving the new stream.
+func (p *XdsProxy) awaitDownstream(con *ProxyConnection) bool {
+	p.connectedMutex.Lock()
+	if p.connected != con || con.node == "" {
+		p.connectedMutex.Unlock()
+		return false
+	}
+	p.parked = con
+	p.connectedMutex.Unlock()
+
+	timer := time.NewTimer(p.downstreamGracePeriod)
+	defer timer.Stop()
+	var next *resumedDownstream
+	select {
+	case next = <-con.resume:
+	case <-timer.C:
+	case <-con.stopChan:
+	}
+
+	p.connectedMutex.Lock()
+	if p.parked == con {
+		p.parked = nil
+	}
+	claimed := con.claimed
+	con.claimed = false
+	p.connectedMutex.Unlock()
+	if next == nil {
+		if !claimed {
+			return false
+		}
+		// The new stream claimed the connection just as we stopped waiting; it always hands itself over.
+		next = <-con.resume
+	}
+	con.downstream = next.stream
+	con.resumed = next
+	return true
 }
 
 // Every time envoy makes a fresh connection to the agent, we reestablish a new connection to the upstream xds
 // This ensures that a new connection between istiod and agent doesn't end up consuming pending messages from envoy
 // as the new connection may not go to the same istiod. Vice versa case also applies.
+// The exception is an Envoy reconnecting within the downstream grace period, which reuses the upstream connection
+// of its previous stream.
 func (p *XdsProxy) StreamAggregatedResources(downstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
 	proxyLog.Infof("Envoy ADS stream established")
 
-	con := &ProxyConnection{
-		upstreamError:   make(chan error),
-		downstreamError: make(chan error),
-		requestsChan:    make(chan *discovery.DiscoveryRequest, 10),
-		responsesChan:   make(chan *discovery.DiscoveryResponse, 10),
-		stopChan:        make(chan struct{}),
-		downstream:      downstream,
+	con := newBufferedProxyConnection(downstream, p.requestsBufferSize, p.responsesBufferSize)
+	defer close(con.done)
+
+	var firstReq *discovery.DiscoveryRequest
+	if p.downstreamGracePeriod > 0 {
+		// Envoy identifies itself on the first request, which tells us if it can resume a previous connection.
+		var err error
+		if firstReq, err = downstream.Recv(); err != nil {
+			return err
+		}
+		con.node = firstReq.GetNode().GetId()
+		if parked := p.takeParked(con.node); parked != nil {
+			proxyLog.Infof("Envoy %s reconnected within the grace period, reusing the upstream connection", con.node)
+			resumed := &resumedDownstream{stream: downstream, detached: make(chan error, 1)}
+			parked.resume <- resumed
+			go p.handleDownstream(parked, downstream, firstReq)
+			return <-resumed.detached
+		}
 	}
 
 	p.RegisterStream(con)
+	defer p.unregisterStream(con)
+	if p.warmingUp() {
+		// The name table is requested as soon as the upstream connects, rather than along with Envoy's first request.
+		con.firstNDSSent = true
+	}
 
 	// Handle downstream xds
-	firstNDSSent := false
-	go func() {
-		for {
+	go p.handleDownstream(con, downstream, firstReq)
+
+	// The budget is waited on first, so that the breaker only lets a connection through once it is attempted.
+	if p.retryBudget != nil {
+		if err := p.retryBudget.wait(downstream.Context()); err != nil {
+			return err
+		}
+	}
+	if p.breaker != nil && !p.breaker.allow() {
+		metrics.IstiodConnectionShortCircuits.Increment()
+		// Envoy reconnects right away, hold it back while istiod is likely still failing.
+		select {
+		case <-time.After(p.breakerRejectDelay):
+		case <-downstream.Context().Done():
+		}
+		return status.Error(codes.Unavailable, "istiod connections are suspended after consecutive failures")
+	}
+	p.notifyConnection(ConnectionConnecting, "Envoy stream established")
+	xds, upstreamConn, err := p.newUpstreamClient()
+	if err != nil {
+		p.reportUpstreamOutcome(err)
+		p.notifyConnection(ConnectionDisconnected, err.Error())
+		return err
+	}
+	// HandleUpstream closes it, or as soon as a fast reconnect replaces it.
+	con.upstreamConn = upstreamConn
+
+	// The upstream stream is torn down as soon as Envoy goes away, unless Envoy may resume it within the grace period.
+	streamCtx := context.Background()
+	if p.downstreamGracePeriod == 0 {
+		streamCtx = downstream.Context()
+	}
+	ctx := metadata.AppendToOutgoingContext(streamCtx, "ClusterID", p.clusterID)
+	// We must propagate upstream termination to Envoy. This ensures that we resume the full XDS sequence on new connection
+	return p.HandleUpstream(ctx, con, xds)
+}
+
+// reportUpstreamOutcome reports the outcome of a connection to istiod, which fails if err is set, to the circuit
+// breaker. The connection only succeeds once the stream is open.
+func (p *XdsProxy) reportUpstreamOutcome(err error) {
+	if p.breaker == nil {
+		return
+	}
+	if err != nil {
+		p.breaker.failure()
+	} else {
+		p.breaker.success()
+	}
+}
+
+// upstreamHeaders returns the metadata for a new stream to istiod: the static XDS headers, overridden by
+// the ones of the metadata provider, if set.
+func (p *XdsProxy) upstreamHeaders(ctx context.Context) (map[string]string, error) {
+	headers := map[string]string{}
+	for k, v := range p.agent.cfg.XDSHeaders {
+		headers[k] = v
+	}
+	if p.metadataProvider == nil {
+		return headers, nil
+	}
+	dynamic, err := p.metadataProvider(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range dynamic {
+		headers[k] = v
+	}
+	return headers, nil
+}
+
+// handleDownstream forwards the requests from Envoy to istiod, starting with req if set.
+func (p *XdsProxy) handleDownstream(con *ProxyConnection,
+	downstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer, req *discovery.DiscoveryRequest) {
+	for {
+		if req == nil {
 			// From Envoy
-			req, err := downstream.Recv()
-			if err != nil {
-				con.downstreamError <- err
-				return
-			}
-			// forward to istiod
-			con.requestsChan <- req
-			if p.localDNSServer != nil && !firstNDSSent && req.TypeUrl == v3.ListenerType {
-				// fire off an initial NDS request
-				con.requestsChan <- &discovery.DiscoveryRequest{
-					TypeUrl: v3.NameTableType,
+			var err error
+			if req, err = downstream.Recv(); err != nil {
+				select {
+				case con.downstreamError <- err:
+				case <-con.done:
 				}
-				firstNDSSent = true
+				return
 			}
 		}
-	}()
+		// forward to istiod
+		con.requestsChan <- &upstreamRequest{req: req, fromEnvoy: true}
+		if p.interceptsNameTable() && !con.firstNDSSent && (req.TypeUrl == v3.ListenerType || req.TypeUrl == v3.ClusterType) {
+			// fire off an initial NDS request, on whichever of LDS or CDS Envoy sends first
+			con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{
+				TypeUrl: v3.NameTableType,
+			}}
+			con.firstNDSSent = true
+		}
+		req = nil
+	}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	upstreamConn, err := grpc.DialContext(ctx, p.istiodAddress, p.istiodDialOptions...)
+// dialUpstreamClient is the default upstreamClientFactory, returning an ADS client over a gRPC connection to istiod.
+func (p *XdsProxy) dialUpstreamClient() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+	conn, err := p.dialUpstream()
 	if err != nil {
-		proxyLog.Errorf("failed to connect to upstream %s: %v", p.istiodAddress, err)
-		metrics.IstiodConnectionFailures.Increment()
-		return err
+		return nil, nil, err
 	}
-	defer upstreamConn.Close()
+	return discovery.NewAggregatedDiscoveryServiceClient(conn), conn, nil
+}
 
-	xds := discovery.NewAggregatedDiscoveryServiceClient(upstreamConn)
-	ctx = metadata.AppendToOutgoingContext(context.Background(), "ClusterID", p.clusterID)
-	if p.agent.cfg.XDSHeaders != nil {
-		for k, v := range p.agent.cfg.XDSHeaders {
-			ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+// dialUpstream connects to the first reachable istiod. Addresses known to be healthy are tried in
+// priority order before the ones that failed previously.
+func (p *XdsProxy) dialUpstream() (*grpc.ClientConn, error) {
+	addresses := p.upstreams.order(append([]string{p.istiodAddress}, p.istiodFailoverAddresses...))
+	var err error
+	for _, addr := range addresses {
+		p.dialOptionsMutex.RLock()
+		dialOptions, f := p.failoverDialOptions[addr]
+		if !f {
+			dialOptions = p.istiodDialOptions
 		}
+		p.dialOptionsMutex.RUnlock()
+		if len(addresses) > 1 {
+			// The dial must block to detect an unreachable istiod, otherwise the failure only shows up
+			// on stream creation and we never move on to the next address.
+			dialOptions = append(append([]grpc.DialOption{}, dialOptions...),
+				grpc.WithBlock(), grpc.FailOnNonTempDialError(true))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		var conn *grpc.ClientConn
+		conn, err = grpc.DialContext(ctx, addr, dialOptions...)
+		cancel()
+		if err == nil {
+			p.upstreams.connected(addr)
+			return conn, nil
+		}
+		proxyLog.Errorf("failed to connect to upstream %s: %v", addr, err)
+		metrics.IstiodConnectionFailures.Increment()
+		p.upstreams.markDown(addr)
 	}
-	// We must propagate upstream termination to Envoy. This ensures that we resume the full XDS sequence on new connection
-	return p.HandleUpstream(ctx, con, xds)
+	return nil, err
 }
 
-func (p *XdsProxy) HandleUpstream(ctx context.Context, con *ProxyConnection, xds discovery.AggregatedDiscoveryServiceClient) error {
-	proxyLog.Infof("connecting to upstream XDS server: %s", p.istiodAddress)
-	defer proxyLog.Infof("disconnected from XDS server: %s", p.istiodAddress)
-	upstream, err := xds.StreamAggregatedResources(ctx,
-		grpc.MaxCallRecvMsgSize(defaultClientMaxReceiveMessageSize))
+func (p *XdsProxy) HandleUpstream(ctx context.Context, con *ProxyConnection, xds discovery.AggregatedDiscoveryServiceClient) (err error) {
+	// A downstream that resumed this connection is waiting for it to finish.
+	defer func() { con.detach(err) }()
+	// current is the connection of the upstream stream, replaced on fast reconnects.
+	current := con.upstreamConn
+	defer func() {
+		if current != nil {
+			_ = current.Close()
+		}
+	}()
+	upstreamAddress := p.upstreams.activeAddress()
+	proxyLog.Infof("connecting to upstream XDS server: %s", upstreamAddress)
+	defer func() { proxyLog.Infof("disconnected from XDS server: %s", upstreamAddress) }()
+	upstream, correlation, err := p.openUpstream(ctx, xds)
+	// Without a blocking dial, an unreachable istiod only shows up here.
+	p.reportUpstreamOutcome(err)
 	if err != nil {
-		proxyLog.Errorf("failed to create upstream grpc client: %v", err)
+		p.notifyConnection(ConnectionDisconnected, err.Error())
 		return err
 	}
-
-	// Handle upstream xds
-	go func() {
-		for {
-			// from istiod
-			resp, err := upstream.Recv()
+	p.notifyConnection(ConnectionConnected, upstreamAddress)
+	// reason is why the connection is torn down, the error returned if not set.
+	var reason string
+	defer func() {
+		if reason == "" {
+			reason = "stream closed"
 			if err != nil {
-				con.upstreamError <- err
-				return
+				reason = err.Error()
 			}
-			con.responsesChan <- resp
+		}
+		p.notifyConnection(ConnectionDisconnected, reason)
+	}()
+
+	// Subscribed responses are handled apart from the responses forwarded to Envoy, so that a slow send
+	// to Envoy does not hold up the agent subsystems, like DNS updates. A single goroutine keeps them in order.
+	subscribed := make(chan subscribedResponse, 10)
+	stopSubscribed := make(chan struct{})
+	defer close(stopSubscribed)
+	go p.handleSubscribed(con, subscribed, stopSubscribed)
+
+	// Handle upstream xds
+	go p.receiveUpstream(con, upstream, correlation, subscribed, stopSubscribed)
+
+	// The last requests are replayed to the new upstream with fast reconnects, and requested again in full on a resync.
+	sent := newSentRequests()
+	if p.warmingUp() {
+		warmup := &discovery.DiscoveryRequest{TypeUrl: v3.NameTableType}
+		if err = p.sendUpstream(ctx, upstream, correlation, warmup); err != nil {
+			return err
+		}
+		sent.record(warmup)
+		// Envoy's requests and responses wait until the first name table is in, so that its first DNS queries resolve.
+		p.awaitNameTable(ctx)
+	}
+
+	// While the upstream reconnects, requests, refresh and resync are nil to hold the requests back, and the
+	// responses already received are still forwarded to Envoy.
+	requests, refresh, resync := con.requestsChan, p.nameTableRefresh, p.resync
+	// Duplicates are only suppressed on the stream the original went to.
+	dedup := newRequestDeduper(p.dedupWindow)
+	var reconnected chan reconnectedUpstream
+	defer func() {
+		if reconnected != nil {
+			go func(r <-chan reconnectedUpstream) {
+				if next := <-r; next.closer != nil {
+					_ = next.closer.Close()
+				}
+			}(reconnected)
 		}
 	}()
 
 	for {
 		select {
 		case err := <-con.upstreamError:
+			if p.fastReconnect && err == io.EOF {
+				// istiod closed the stream cleanly, as it does when draining. Another istiod picks it up
+				// rather than Envoy starting over.
+				proxyLog.Infof("upstream XDS server %s closed the stream, reconnecting", upstreamAddress)
+				metrics.IstiodFastReconnects.Increment()
+				p.notifyConnection(ConnectionReconnecting, "upstream closed the stream")
+				_ = upstream.CloseSend()
+				requests, refresh, resync = nil, nil, nil
+				reconnected = make(chan reconnectedUpstream, 1)
+				go func(r chan<- reconnectedUpstream) { r <- p.reconnectUpstream(ctx) }(reconnected)
+				continue
+			}
 			// error from upstream Istiod.
 			if isExpectedGRPCError(err) {
 				proxyLog.Debugf("upstream terminated with status %v", err)
@@ -272,6 +864,7 @@ func (p *XdsProxy) HandleUpstream(ctx context.Context, con *ProxyConnection, xds
 				proxyLog.Warnf("upstream terminated with unexpected error %v", err)
 				metrics.IstiodConnectionErrors.Increment()
 			}
+			reason = fmt.Sprintf("upstream terminated: %v", err)
 			_ = upstream.CloseSend()
 			return nil
 		case err := <-con.downstreamError:
@@ -283,63 +876,337 @@ func (p *XdsProxy) HandleUpstream(ctx context.Context, con *ProxyConnection, xds
 				proxyLog.Warnf("downstream terminated with unexpected error %v", err)
 				metrics.EnvoyConnectionErrors.Increment()
 			}
+			con.detach(err)
+			if p.downstreamGracePeriod > 0 && isExpectedGRPCError(err) && p.awaitDownstream(con) {
+				// Envoy reconnected within the grace period, keep serving it over the same upstream.
+				continue
+			}
 			// On downstream error, we will return. This propagates the error to downstream envoy which will trigger reconnect
+			reason = fmt.Sprintf("downstream terminated: %v", err)
 			return err
-		case req, ok := <-con.requestsChan:
+		case next := <-reconnected:
+			reconnected = nil
+			if next.err != nil {
+				proxyLog.Warnf("failed to reconnect to an upstream XDS server: %v", next.err)
+				reason = fmt.Sprintf("failed to reconnect: %v", next.err)
+				return nil
+			}
+			// The connection istiod closed the stream on is not used anymore.
+			if current != nil {
+				_ = current.Close()
+			}
+			upstream, correlation, current = next.upstream, next.correlation, next.closer
+			dedup = newRequestDeduper(p.dedupWindow)
+			upstreamAddress = p.upstreams.activeAddress()
+			proxyLog.Infof("reconnected to upstream XDS server: %s", upstreamAddress)
+			p.notifyConnection(ConnectionConnected, upstreamAddress)
+			go p.receiveUpstream(con, upstream, correlation, subscribed, stopSubscribed)
+			for _, req := range sent.replay() {
+				if err = p.sendUpstream(ctx, upstream, correlation, req); err != nil {
+					return err
+				}
+			}
+			requests, refresh, resync = con.requestsChan, p.nameTableRefresh, p.resync
+		case req, ok := <-requests:
 			if !ok {
 				return nil
 			}
-			proxyLog.Debugf("request for type url %s", req.TypeUrl)
-			metrics.XdsProxyRequests.Increment()
-			if err = sendUpstreamWithTimeout(ctx, upstream, req); err != nil {
-				proxyLog.Errorf("upstream send error for type url %s: %v", req.TypeUrl, err)
+			if req.expired() {
+				proxyLog.Warnf("dropping request for type url %s, its deadline passed before it could be sent", req.req.TypeUrl)
+				metrics.XdsProxyExpiredRequests.Increment()
+				continue
+			}
+			if req.fromEnvoy && dedup.duplicate(req.req) {
+				p.debugf("suppressing duplicate request for type url %s", req.req.TypeUrl)
+				metrics.XdsProxyDuplicateRequests.Increment()
+				continue
+			}
+			if err = p.sendUpstream(ctx, upstream, correlation, req.req); err != nil {
 				return err
 			}
+			sent.record(req.req)
+		case <-refresh:
+			// A request without version or nonce makes istiod send the full name table again.
+			refreshReq := &discovery.DiscoveryRequest{TypeUrl: v3.NameTableType}
+			if err = p.sendUpstream(ctx, upstream, correlation, refreshReq); err != nil {
+				return err
+			}
+			sent.record(refreshReq)
+		case <-resync:
+			proxyLog.Infof("resyncing %d subscriptions with upstream XDS server: %s", len(sent.typeURLs), upstreamAddress)
+			metrics.XdsProxyResyncs.Increment()
+			for _, req := range sent.resync() {
+				if err = p.sendUpstream(ctx, upstream, correlation, req); err != nil {
+					return err
+				}
+			}
 		case resp, ok := <-con.responsesChan:
 			if !ok {
 				return nil
 			}
-			proxyLog.Debugf("response for type url %s", resp.TypeUrl)
 			metrics.XdsProxyResponses.Increment()
-			switch resp.TypeUrl {
-			case v3.NameTableType:
-				// intercept. This is for the dns server
-				if p.localDNSServer != nil && len(resp.Resources) > 0 {
-					var nt nds.NameTable
-					// TODO we should probably send ACK and not update nametable here
-					if err = ptypes.UnmarshalAny(resp.Resources[0], &nt); err != nil {
-						log.Errorf("failed to unmarshall name table: %v", err)
-					}
-					p.localDNSServer.UpdateLookupTable(&nt)
-				}
-
-				// Send ACK
-				con.requestsChan <- &discovery.DiscoveryRequest{
-					VersionInfo:   resp.VersionInfo,
-					TypeUrl:       v3.NameTableType,
-					ResponseNonce: resp.Nonce,
-				}
-			default:
-				// TODO: Validate the known type urls before forwarding them to Envoy.
-				if err := con.downstream.Send(resp); err != nil {
-					proxyLog.Errorf("downstream send error: %v", err)
-					// we cannot return partial error and hope to restart just the downstream
-					// as we are blindly proxying req/responses. For now, the best course of action
-					// is to terminate upstream connection as well and restart afresh.
-					return err
+			p.events.recordResponse(resp)
+			p.capture.captureResponse(resp)
+			if p.responseTransform != nil {
+				if resp = p.responseTransform(resp); resp == nil {
+					p.debugf("response dropped by transform")
+					continue
 				}
 			}
+			p.teeResponse(resp)
+			// TODO: Validate the known type urls before forwarding them to Envoy.
+			if err := con.downstream.Send(resp); err != nil {
+				proxyLog.Errorf("downstream send error for type url %s with %d resources: %v", resp.TypeUrl, len(resp.Resources), err)
+				metrics.EnvoyDownstreamSendErrors.Increment()
+				// we cannot return partial error and hope to restart just the downstream
+				// as we are blindly proxying req/responses. For now, the best course of action
+				// is to terminate upstream connection as well and restart afresh.
+				return err
+			}
 		case <-con.stopChan:
+			reason = "replaced by another Envoy stream"
 			_ = upstream.CloseSend()
 			return nil
 		}
 	}
 }
 
+// openUpstream opens an ADS stream to istiod over xds, with the XDS headers and a new correlation ID.
+func (p *XdsProxy) openUpstream(ctx context.Context, xds discovery.AggregatedDiscoveryServiceClient) (
+	discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient, *xdsCorrelation, error) {
+	headers, err := p.upstreamHeaders(ctx)
+	if err != nil {
+		proxyLog.Errorf("failed to get the metadata for the upstream XDS server: %v", err)
+		return nil, nil, err
+	}
+	for k, v := range headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+	}
+	correlation := newXdsCorrelation()
+	ctx = metadata.AppendToOutgoingContext(ctx, correlationIDHeader, correlation.id)
+	upstream, err := xds.StreamAggregatedResources(ctx,
+		grpc.MaxCallRecvMsgSize(defaultClientMaxReceiveMessageSize))
+	if err != nil {
+		// The connection is up, so istiod refused or could not serve the stream, unlike a connection failure.
+		proxyLog.Errorf("failed to create upstream grpc client: %v", err)
+		metrics.IstiodStreamCreationFailures.Increment()
+		return nil, nil, err
+	}
+	return upstream, correlation, nil
+}
+
+// receiveUpstream hands the responses from istiod over to their subscriptions and to Envoy, until the
+// stream fails with the error sent on the upstreamError channel of con.
+func (p *XdsProxy) receiveUpstream(con *ProxyConnection,
+	upstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient, correlation *xdsCorrelation,
+	subscribed chan<- subscribedResponse, stopSubscribed <-chan struct{}) {
+	headersRead := false
+	for {
+		// from istiod
+		resp, err := upstream.Recv()
+		if err != nil {
+			select {
+			case con.upstreamError <- err:
+			case <-con.done:
+			}
+			return
+		}
+		if !headersRead {
+			// The headers are in by the first response, Header does not block.
+			if md, err := upstream.Header(); err == nil {
+				correlation.headers(md)
+			}
+			headersRead = true
+		}
+		requestID := correlation.response(resp)
+		p.debugf("response for type url %s, nonce %q, to request %s", resp.TypeUrl, resp.Nonce, requestID)
+		metrics.XdsProxyResponseBytes.Record(float64(proto.Size(resp)))
+		if sub, f := p.subscription(resp.TypeUrl); f {
+			select {
+			case subscribed <- subscribedResponse{resp: resp, sub: sub}:
+			case <-stopSubscribed:
+				return
+			}
+			if !sub.forwardToEnvoy {
+				continue
+			}
+		}
+		con.responsesChan <- resp
+	}
+}
+
+func (p *XdsProxy) sendUpstream(ctx context.Context, upstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient,
+	correlation *xdsCorrelation, req *discovery.DiscoveryRequest) error {
+	req = p.advertiseCapabilities(req)
+	requestID := correlation.request(req)
+	p.debugf("request %s for type url %s, nonce %q", requestID, req.TypeUrl, req.ResponseNonce)
+	metrics.XdsProxyRequests.Increment()
+	p.events.recordRequest(req)
+	p.capture.captureRequest(req)
+	if err := sendUpstreamWithTimeout(ctx, upstream, req, p.slowSendThreshold); err != nil {
+		proxyLog.Errorf("upstream send error for type url %s: %v", req.TypeUrl, err)
+		return err
+	}
+	p.state.requested(req.TypeUrl)
+	return nil
+}
+
+// advertiseCapabilities adds the capabilities of the agent to the node metadata of req, if it identifies the
+// node. req is left as is, as Envoy's requests are recorded for replays.
+func (p *XdsProxy) advertiseCapabilities(req *discovery.DiscoveryRequest) *discovery.DiscoveryRequest {
+	if !p.compressNameTable || !p.interceptsNameTable() || req.GetNode() == nil {
+		return req
+	}
+	req = proto.Clone(req).(*discovery.DiscoveryRequest)
+	if req.Node.Metadata == nil {
+		req.Node.Metadata = &structpb.Struct{}
+	}
+	if req.Node.Metadata.Fields == nil {
+		req.Node.Metadata.Fields = map[string]*structpb.Value{}
+	}
+	req.Node.Metadata.Fields[nameTableCompressionMetadata] = &structpb.Value{
+		Kind: &structpb.Value_StringValue{StringValue: xds.NameTableCompressionGzip},
+	}
+	return req
+}
+
+// RefreshNameTable asks istiod to send the full name table again, for instance when it is suspected to be stale.
+// It is sent on the current upstream connection, or the next one. Refreshes requested while one is pending
+// are coalesced.
+func (p *XdsProxy) RefreshNameTable() {
+	if p.disableNameTable {
+		proxyLog.Debugf("name table disabled, not refreshing it")
+		return
+	}
+	select {
+	case p.nameTableRefresh <- struct{}{}:
+	default:
+		proxyLog.Debugf("name table refresh already pending")
+	}
+}
+
+// handleSubscribed delivers the subscribed responses from istiod to their handlers, until stop is closed.
+func (p *XdsProxy) handleSubscribed(con *ProxyConnection, subscribed <-chan subscribedResponse, stop <-chan struct{}) {
+	for {
+		select {
+		case s := <-subscribed:
+			resp := s.resp
+			err := s.sub.handler(resp)
+			if s.sub.forwardToEnvoy {
+				// Envoy ACKs the response, and it is accounted for when forwarded.
+				if err != nil {
+					proxyLog.Warnf("failed to handle response for type url %s: %v", resp.TypeUrl, err)
+				}
+				continue
+			}
+			metrics.XdsProxyResponses.Increment()
+			p.events.recordResponse(resp)
+			p.capture.captureResponse(resp)
+
+			// Send ACK, or NACK if the subsystem rejected the response
+			ack := &discovery.DiscoveryRequest{
+				VersionInfo:   resp.VersionInfo,
+				TypeUrl:       resp.TypeUrl,
+				ResponseNonce: resp.Nonce,
+			}
+			if err != nil {
+				proxyLog.Errorf("rejecting response for type url %s: %v", resp.TypeUrl, err)
+				ack.ErrorDetail = &google_rpc.Status{
+					Code:    int32(codes.InvalidArgument),
+					Message: err.Error(),
+				}
+			}
+			select {
+			case con.requestsChan <- &upstreamRequest{req: ack}:
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// updateNameTable feeds the name tables from istiod to the dns server. With a debounce, the response is
+// ACKed once the table is decoded, before it is built into the dns server.
+func (p *XdsProxy) updateNameTable(resp *discovery.DiscoveryResponse) error {
+	if !p.interceptsNameTable() || len(resp.Resources) == 0 {
+		return nil
+	}
+	var nt nds.NameTable
+	if err := xds.UnmarshalNameTable(resp.Resources[0], &nt); err != nil {
+		return fmt.Errorf("failed to unmarshall name table: %v", err)
+	}
+	p.state.nameTable(resp.VersionInfo)
+	if p.nameTables != nil {
+		p.nameTables.update(&nt)
+		return nil
+	}
+	p.localDNSServer.UpdateLookupTable(&nt)
+	p.markNameTableWarm()
+	return nil
+}
+
+// markNameTableWarm records that a name table was built into the dns server.
+func (p *XdsProxy) markNameTableWarm() {
+	p.nameTableWarmOnce.Do(func() {
+		close(p.nameTableWarm)
+	})
+}
+
+// warmingUp reports whether the name table is requested as soon as the upstream connects, ahead of Envoy's requests.
+func (p *XdsProxy) warmingUp() bool {
+	return p.warmupTimeout > 0 && p.interceptsNameTable()
+}
+
+// interceptsNameTable reports whether the name tables from istiod are requested and built into the dns server.
+func (p *XdsProxy) interceptsNameTable() bool {
+	return p.localDNSServer != nil && !p.disableNameTable
+}
+
+// awaitNameTable waits up to the warm-up timeout for the first name table to be built into the dns server.
+func (p *XdsProxy) awaitNameTable(ctx context.Context) {
+	timer := time.NewTimer(p.warmupTimeout)
+	defer timer.Stop()
+	select {
+	case <-p.nameTableWarm:
+	case <-timer.C:
+		proxyLog.Warnf("no name table received within %v, serving Envoy without it", p.warmupTimeout)
+	case <-ctx.Done():
+	case <-p.stopChan:
+	}
+}
+
 func (p *XdsProxy) DeltaAggregatedResources(server discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
 	return errors.New("delta XDS is not implemented")
 }
 
+// debugHandlers returns the debug endpoints of the proxy, keyed by path.
+func (p *XdsProxy) debugHandlers() map[string]http.Handler {
+	handlers := map[string]http.Handler{}
+	if p.events != nil {
+		handlers["/debug/xds-events"] = p.events
+	}
+	handlers["/debug/resync"] = http.HandlerFunc(p.serveResync)
+	handlers["/debug/xds-proxy"] = http.HandlerFunc(p.serveSnapshot)
+	if p.localDNSServer != nil {
+		handlers["/debug/refresh-name-table"] = http.HandlerFunc(p.serveRefreshNameTable)
+		if table, ok := p.localDNSServer.(http.Handler); ok {
+			handlers["/debug/dns-table"] = table
+		}
+	}
+	return handlers
+}
+
+func (p *XdsProxy) serveRefreshNameTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	p.RefreshNameTable()
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func (p *XdsProxy) close() {
 	close(p.stopChan)
 	if p.downstreamGrpcServer != nil {
@@ -351,6 +1218,9 @@ func (p *XdsProxy) close() {
 	if p.fileWatcher != nil {
 		p.fileWatcher.Close()
 	}
+	if err := p.capture.Close(); err != nil {
+		proxyLog.Errorf("failed to write the XDS capture: %v", err)
+	}
 }
 
 // isExpectedGRPCError checks a gRPC error code and determines whether it is an expected error when
@@ -372,6 +1242,8 @@ func isExpectedGRPCError(err error) bool {
 
 type fileTokenSource struct {
 	path string
+	// checkExpiry rejects the token if it is a JWT past its "exp" claim.
+	checkExpiry bool
 }
 
 var _ = oauth2.TokenSource(&fileTokenSource{})
@@ -387,6 +1259,17 @@ func (ts *fileTokenSource) Token() (*oauth2.Token, error) {
 		proxyLog.Errorf("read empty token from file %q", ts.path)
 		return nil, fmt.Errorf("read empty token from file %q", ts.path)
 	}
+	if ts.checkExpiry {
+		expired, err := util.IsJwtExpired(tok, time.Now())
+		if err != nil {
+			proxyLog.Errorf("failed to parse the JWT of token file %q: %v", ts.path, err)
+			return nil, fmt.Errorf("failed to parse the JWT of token file %q: %v", ts.path, err)
+		}
+		if expired {
+			proxyLog.Errorf("token in file %q has expired, it is not refreshed", ts.path)
+			return nil, fmt.Errorf("token in file %q has expired, it is not refreshed", ts.path)
+		}
+	}
 
 	return &oauth2.Token{
 		AccessToken: tok,
@@ -394,18 +1277,59 @@ func (ts *fileTokenSource) Token() (*oauth2.Token, error) {
 }
 
 func (p *XdsProxy) initDownstreamServer() error {
-	l, err := uds.NewListener(xdsUdsPath)
+	l, err := newDownstreamListener(xdsUdsPath)
 	if err != nil {
 		return err
 	}
-	grpcs := grpc.NewServer()
-	discovery.RegisterAggregatedDiscoveryServiceServer(grpcs, p)
-	reflection.Register(grpcs)
-	p.downstreamGrpcServer = grpcs
+	p.downstreamGrpcServer = p.newDownstreamServer()
 	p.downstreamListener = l
 	return nil
 }
 
+// newDownstreamServer returns the gRPC server Envoy connects to, checking the credentials of the peers if enabled.
+func (p *XdsProxy) newDownstreamServer() *grpc.Server {
+	var opts []grpc.ServerOption
+	if p.downstreamPeerCheck != nil {
+		opts = append(opts,
+			grpc.Creds(peerCredTransport{}),
+			grpc.StreamInterceptor(p.downstreamPeerCheck.streamInterceptor),
+			grpc.UnaryInterceptor(p.downstreamPeerCheck.unaryInterceptor))
+	}
+	grpcs := grpc.NewServer(opts...)
+	discovery.RegisterAggregatedDiscoveryServiceServer(grpcs, p)
+	reflection.Register(grpcs)
+	return grpcs
+}
+
+// newDownstreamListener listens for Envoy on the unix socket at socketPath, creating its directory if missing.
+func newDownstreamListener(socketPath string) (net.Listener, error) {
+	if err := os.MkdirAll(path.Dir(socketPath), 0750); err != nil {
+		return nil, &udsListenError{path: socketPath, err: err}
+	}
+	l, err := uds.NewListener(socketPath)
+	if err != nil {
+		return nil, &udsListenError{path: socketPath, err: err}
+	}
+	return l, nil
+}
+
+// udsListenError is the failure to listen on the unix socket Envoy connects to. Locked down environments
+// commonly run into it, so it tells how to fix it.
+type udsListenError struct {
+	path string
+	err  error
+}
+
+func (e *udsListenError) Error() string {
+	return fmt.Sprintf("failed to listen for Envoy on unix socket %s: %v. The agent must be able to create the socket "+
+		"in %s; if the file system is read-only or not writable by the agent's user, mount a writable volume, "+
+		"such as an emptyDir, on it", e.path, e.err, path.Dir(e.path))
+}
+
+func (e *udsListenError) Unwrap() error {
+	return e.err
+}
+
 // getCertKeyPaths returns the paths for key and cert.
 func (p *XdsProxy) getCertKeyPaths(agent *Agent) (string, string) {
 	var key, cert string
@@ -421,14 +1345,43 @@ func (p *XdsProxy) getCertKeyPaths(agent *Agent) (string, string) {
 			return "", ""
 		}
 	} else if agent.secOpts.FileMountedCerts {
-		key = agent.proxyConfig.ProxyMetadata[MetadataClientCertKey]
-		cert = agent.proxyConfig.ProxyMetadata[MetadataClientCertChain]
+		keyMetadata, certMetadata := agent.clientCertMetadataKeys()
+		key = agent.proxyConfig.ProxyMetadata[keyMetadata]
+		cert = agent.proxyConfig.ProxyMetadata[certMetadata]
 	}
 	return key, cert
 }
 
+// buildUpstreamDialOpts returns the dial options of the discovery address, and those of each failover address.
+func (p *XdsProxy) buildUpstreamDialOpts(sa *Agent) ([]grpc.DialOption, map[string][]grpc.DialOption, error) {
+	dialOptions, err := p.buildUpstreamClientDialOpts(sa)
+	if err != nil {
+		return nil, nil, err
+	}
+	var failover map[string][]grpc.DialOption
+	for _, addr := range p.istiodFailoverAddresses {
+		if failover == nil {
+			failover = map[string][]grpc.DialOption{}
+		}
+		if failover[addr], err = p.buildAddressDialOpts(sa, addr); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dialOptions, failover, nil
+}
+
+// buildUpstreamClientDialOpts returns the dial options of the discovery address.
 func (p *XdsProxy) buildUpstreamClientDialOpts(sa *Agent) ([]grpc.DialOption, error) {
-	tlsOpts, err := p.getTLSDialOption(sa)
+	return p.buildAddressDialOpts(sa, sa.proxyConfig.DiscoveryAddress)
+}
+
+// buildAddressDialOpts returns the dial options of the istiod at address, verified under the host of address.
+func (p *XdsProxy) buildAddressDialOpts(sa *Agent, address string) ([]grpc.DialOption, error) {
+	_, token, err := controlPlaneAuth(sa)
+	if err != nil {
+		return nil, err
+	}
+	tlsOpts, err := p.getTLSDialOption(sa, address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build TLS dial option to talk to upstream: %v", err)
 	}
@@ -446,29 +1399,54 @@ func (p *XdsProxy) buildUpstreamClientDialOpts(sa *Agent) ([]grpc.DialOption, er
 	dialOptions := []grpc.DialOption{
 		tlsOpts,
 		keepaliveOption, initialWindowSizeOption, initialConnWindowSizeOption, msgSizeOption,
+		grpc.WithStatsHandler(upstreamStatsHandler{}),
 	}
 
-	// TODO: This is not a valid way of detecting if we are on VM vs k8s
-	// Some end users do not use Istiod for CA but run on k8s with file mounted certs
-	// In these cases, while we fallback to mTLS to istiod using the provisioned certs
-	// it would be ideal to keep using token plus k8s ca certs for control plane communication
-	// as the intention behind provisioned certs on k8s pods is only for data plane comm.
-	if sa.proxyConfig.ControlPlaneAuthPolicy != meshconfig.AuthenticationPolicy_NONE {
-		if sa.secOpts.ProvCert == "" || !sa.secOpts.FileMountedCerts {
-			dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(oauth.TokenSource{TokenSource: &fileTokenSource{sa.secOpts.JWTPath}}))
+	if sa.proxyConfig.ControlPlaneAuthPolicy != meshconfig.AuthenticationPolicy_NONE && token {
+		tokenSource, err := sa.xdsTokenSource()
+		if err != nil {
+			return nil, err
 		}
+		dialOptions = append(dialOptions, grpc.WithPerRPCCredentials(oauth.TokenSource{TokenSource: tokenSource}))
 	}
 	return dialOptions, nil
 }
 
+// controlPlaneAuth returns whether the client certificate and the JWT token are presented to istiod.
+func controlPlaneAuth(sa *Agent) (clientCert bool, token bool, err error) {
+	switch sa.cfg.XDSAuthMode {
+	case XDSAuthAuto:
+		// TODO: This is not a valid way of detecting if we are on VM vs k8s
+		// Some end users do not use Istiod for CA but run on k8s with file mounted certs
+		// In these cases, while we fallback to mTLS to istiod using the provisioned certs
+		// it would be ideal to keep using token plus k8s ca certs for control plane communication
+		// as the intention behind provisioned certs on k8s pods is only for data plane comm.
+		// XDSAuthToken does so explicitly.
+		return true, sa.secOpts.ProvCert == "" || !sa.secOpts.FileMountedCerts, nil
+	case XDSAuthMTLS:
+		return true, false, nil
+	case XDSAuthToken:
+		return false, true, nil
+	case XDSAuthBoth:
+		return true, true, nil
+	}
+	return false, false, fmt.Errorf("unknown control plane auth mode %q, expected one of %q, %q or %q",
+		sa.cfg.XDSAuthMode, XDSAuthMTLS, XDSAuthToken, XDSAuthBoth)
+}
+
 // initCertificateWatches sets up  watches for the certs and resets upstream if they change.
 func (p *XdsProxy) initCertificateWatches(agent *Agent, stop <-chan struct{}) error {
-	keyFile, certFile := p.getCertKeyPaths(agent)
-	rootCert := agent.FindRootCAForXDS()
+	var keyFile, certFile string
+	// The in-memory client certificate is read on each handshake, there are no files to watch.
+	if p.clientCertProvider == nil {
+		keyFile, certFile = p.getCertKeyPaths(agent)
+	}
+	rootCert := agent.xdsRootCert()
 
 	var watching bool
 
-	for _, file := range []string{rootCert, certFile, keyFile} {
+	files := append([]string{rootCert, certFile, keyFile}, agent.cfg.XDSAdditionalRootCerts...)
+	for _, file := range files {
 		if len(file) > 0 {
 			proxyLog.Infof("adding watcher for certificate %s", file)
 			if err := p.fileWatcher.Add(file); err != nil {
@@ -480,6 +1458,14 @@ func (p *XdsProxy) initCertificateWatches(agent *Agent, stop <-chan struct{}) er
 	if !watching {
 		return nil
 	}
+	// The watcher blocks until the events of a file are read, so they are read as they come and coalesced
+	// into a single change pending until the debounce timer is started.
+	changed := make(chan struct{}, 1)
+	for _, file := range files {
+		if len(file) > 0 {
+			go p.forwardCertificateEvents(p.fileWatcher.Events(file), changed, stop)
+		}
+	}
 	go func() {
 		var keyCertTimerC <-chan time.Time
 		for {
@@ -488,14 +1474,14 @@ func (p *XdsProxy) initCertificateWatches(agent *Agent, stop <-chan struct{}) er
 				keyCertTimerC = nil
 				proxyLog.Info("xds connection certificates have changed, resetting the upstream connection")
 				// Close upstream connection.
-				p.resetChan <- struct{}{}
-			case <-p.fileWatcher.Events(certFile):
-				if keyCertTimerC == nil {
-					keyCertTimerC = time.After(watchDebounceDelay)
+				select {
+				case p.resetChan <- struct{}{}:
+				case <-stop:
+					return
 				}
-			case <-p.fileWatcher.Events(keyFile):
+			case <-changed:
 				if keyCertTimerC == nil {
-					keyCertTimerC = time.After(watchDebounceDelay)
+					keyCertTimerC = p.after(watchDebounceDelay)
 				}
 			case <-stop:
 				return
@@ -506,11 +1492,69 @@ func (p *XdsProxy) initCertificateWatches(agent *Agent, stop <-chan struct{}) er
 	return nil
 }
 
+// forwardCertificateEvents signals changed on each event of a watched certificate file, unless a change is
+// already pending, until stop is closed or the watch ends.
+func (p *XdsProxy) forwardCertificateEvents(events <-chan fsnotify.Event, changed chan<- struct{},
+	stop <-chan struct{}) {
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// handleResets resets the upstream connections each time resetChan is signaled, until stop is closed.
+func (p *XdsProxy) handleResets(stop <-chan struct{}) {
+	for {
+		select {
+		case <-p.resetChan:
+			p.resetUpstream()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// resetUpstream rebuilds the dial options, so that a rotated root certificate is trusted, and closes the streams
+// served. Envoy then reconnects, over a new upstream connection dialed with the new options.
+func (p *XdsProxy) resetUpstream() {
+	dialOptions, failover, err := p.buildUpstreamDialOpts(p.agent)
+	if err != nil {
+		proxyLog.Errorf("failed to rebuild the upstream dial options, keeping the previous ones: %v", err)
+	} else {
+		p.dialOptionsMutex.Lock()
+		p.istiodDialOptions = dialOptions
+		p.failoverDialOptions = failover
+		p.dialOptionsMutex.Unlock()
+	}
+
+	p.connectedMutex.Lock()
+	defer p.connectedMutex.Unlock()
+	if len(p.downstreams) > 0 {
+		for id, con := range p.downstreams {
+			close(con.stopChan)
+			delete(p.downstreams, id)
+		}
+	} else if p.connected != nil {
+		close(p.connected.stopChan)
+	}
+	p.connected = nil
+}
+
 // Returns the TLS option to use when talking to Istiod
 // If provisioned cert is set, it will return a mTLS related config
 // Else it will return a one-way TLS related config with the assumption
 // that the consumer code will use tokens to authenticate the upstream.
-func (p *XdsProxy) getTLSDialOption(agent *Agent) (grpc.DialOption, error) {
+func (p *XdsProxy) getTLSDialOption(agent *Agent, address string) (grpc.DialOption, error) {
 	if agent.proxyConfig.ControlPlaneAuthPolicy == meshconfig.AuthenticationPolicy_NONE {
 		return grpc.WithInsecure(), nil
 	}
@@ -518,59 +1562,112 @@ func (p *XdsProxy) getTLSDialOption(agent *Agent) (grpc.DialOption, error) {
 	if err != nil {
 		return nil, err
 	}
+	clientCert, _, err := controlPlaneAuth(agent)
+	if err != nil {
+		return nil, err
+	}
 
 	config := tls.Config{
 		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-			var certificate tls.Certificate
-			key, cert := p.getCertKeyPaths(agent)
-			if key != "" && cert != "" {
-				// Load the certificate from disk
-				certificate, err = tls.LoadX509KeyPair(cert, key)
-				if err != nil {
-					return nil, err
-				}
+			if !clientCert {
+				// No certificate is sent.
+				return &tls.Certificate{}, nil
 			}
-			return &certificate, nil
+			return p.getClientCertificate(agent)
 		},
 		RootCAs: rootCert,
 	}
 
 	// strip the port from the address
-	parts := strings.Split(agent.proxyConfig.DiscoveryAddress, ":")
-	config.ServerName = parts[0]
+	config.ServerName = address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		config.ServerName = host
+	}
 	// For debugging on localhost (with port forward)
 	// This matches the logic for the CA; this code should eventually be shared
 	if strings.Contains(config.ServerName, "localhost") {
 		config.ServerName = "istiod.istio-system.svc"
 	}
 	config.MinVersion = tls.VersionTLS12
+	if len(agent.cfg.XDSServerIdentities) > 0 {
+		config.VerifyPeerCertificate = verifyServerIdentity(agent.cfg.XDSServerIdentities)
+	}
 	transportCreds := credentials.NewTLS(&config)
 	return grpc.WithTransportCredentials(transportCreds), nil
 }
 
+// verifyServerIdentity returns the tls.Config VerifyPeerCertificate function accepting the istiod certificates with
+// one of identities as a URI SAN. It only runs once the certificate chain is verified against the root CAs.
+func verifyServerIdentity(identities []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return errors.New("no verified certificate chain for istiod")
+		}
+		leaf := verifiedChains[0][0]
+		sans := make([]string, 0, len(leaf.URIs))
+		for _, uri := range leaf.URIs {
+			sans = append(sans, uri.String())
+			for _, id := range identities {
+				if uri.String() == id {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("istiod certificate identities %v do not match any of the expected ones %v", sans, identities)
+	}
+}
+
+// getClientCertificate returns the certificate presented to istiod. The in-memory provider is used if
+// set, otherwise the certificate is loaded from disk. An empty certificate is returned if there is none yet.
+func (p *XdsProxy) getClientCertificate(agent *Agent) (*tls.Certificate, error) {
+	if p.clientCertProvider != nil {
+		return p.clientCertProvider.GetClientCertificate()
+	}
+	var certificate tls.Certificate
+	key, cert := p.getCertKeyPaths(agent)
+	if key != "" && cert != "" {
+		// Load the certificate from disk
+		var err error
+		certificate, err = tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &certificate, nil
+}
+
 func (p *XdsProxy) getRootCertificate(agent *Agent) (*x509.CertPool, error) {
 	var certPool *x509.CertPool
 	var err error
-	var rootCert []byte
-	xdsCACertPath := agent.FindRootCAForXDS()
-	rootCert, err = ioutil.ReadFile(xdsCACertPath)
-	if err != nil {
-		return nil, err
+	if agent.cfg.XDSRootCertsFromSystem {
+		if certPool, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("failed to load the system root certificates: %v", err)
+		}
+	} else {
+		certPool = x509.NewCertPool()
 	}
 
-	certPool = x509.NewCertPool()
-	ok := certPool.AppendCertsFromPEM(rootCert)
-	if !ok {
-		return nil, fmt.Errorf("failed to create TLS dial option with root certificates")
+	for _, xdsCACertPath := range append([]string{agent.xdsRootCert()}, agent.cfg.XDSAdditionalRootCerts...) {
+		var rootCert []byte
+		rootCert, err = ioutil.ReadFile(xdsCACertPath)
+		if err != nil {
+			return nil, err
+		}
+		ok := certPool.AppendCertsFromPEM(rootCert)
+		if !ok {
+			return nil, fmt.Errorf("failed to create TLS dial option with root certificates from %s", xdsCACertPath)
+		}
 	}
 	return certPool, nil
 }
 
-// sendUpstreamWithTimeout sends discovery request with default send timeout.
+// sendUpstreamWithTimeout sends discovery request with default send timeout. Sends that succeed
+// but take longer than slowThreshold are reported, if it is set.
 func sendUpstreamWithTimeout(ctx context.Context, upstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient,
-	request *discovery.DiscoveryRequest) error {
+	request *discovery.DiscoveryRequest, slowThreshold time.Duration) error {
 	timeoutCtx, cancel := context.WithTimeout(ctx, sendTimeout)
 	defer cancel()
+	start := time.Now()
 	errChan := make(chan error, 1)
 	go func() {
 		errChan <- upstream.Send(request)
@@ -580,6 +1677,9 @@ func sendUpstreamWithTimeout(ctx context.Context, upstream discovery.AggregatedD
 	case <-timeoutCtx.Done():
 		return timeoutCtx.Err()
 	case err := <-errChan:
+		if took := time.Since(start); err == nil && slowThreshold > 0 && took > slowThreshold {
+			reportSlowSend(request.TypeUrl, took)
+		}
 		return err
 	}
 }
@@ -16,21 +16,63 @@ package istioagent
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
+	"go.opencensus.io/stats/view"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/pilot/pkg/dns"
+	"istio.io/istio/pilot/pkg/networking/util"
+	nds "istio.io/istio/pilot/pkg/proto"
 	"istio.io/istio/pilot/pkg/xds"
 	v3 "istio.io/istio/pilot/pkg/xds/v3"
 	"istio.io/istio/pkg/config/mesh"
+	"istio.io/istio/pkg/istio-agent/health"
 	"istio.io/istio/pkg/security"
 	"istio.io/istio/pkg/test/env"
+	"istio.io/pkg/filewatcher"
+	"istio.io/pkg/log"
 )
 
 // Validates basic xds proxy flow by proxying one CDS requests end to end.
@@ -133,7 +175,7 @@ func TestXdsProxyReconnects(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		proxy.istiodAddress = listener.Addr().String()
+		proxy.istiodAddress = addr
 		proxy.istiodDialOptions = []grpc.DialOption{grpc.WithBlock(), grpc.WithInsecure()}
 
 		// Setup gRPC server
@@ -149,7 +191,7 @@ func TestXdsProxyReconnects(t *testing.T) {
 
 		// Stop server, setup a new one. This simulates an Istiod pod being torn down
 		grpcServer.Stop()
-		listener, err = net.Listen("tcp", listener.Addr().String())
+		listener, err = net.Listen("tcp", addr)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -164,6 +206,2262 @@ func TestXdsProxyReconnects(t *testing.T) {
 	})
 }
 
+// Validates a request and response round trip through the proxy, with an injected upstream client.
+func TestXdsProxyInjectedUpstreamClient(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		return &fakeADSClient{upstream: upstream}, ioutil.NopCloser(nil), nil
+	}
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: &core.Node{Id: "sidecar~0.0.0.0~debug~cluster.local"}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case req := <-upstream.requests:
+		if req.TypeUrl != v3.ClusterType {
+			t.Fatalf("unexpected request forwarded upstream: %v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not forwarded upstream")
+	}
+
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, VersionInfo: "1", Nonce: "nonce"}
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TypeUrl != v3.ClusterType || resp.Nonce != "nonce" {
+		t.Fatalf("unexpected response forwarded downstream: %v", resp)
+	}
+	close(upstream.responses)
+}
+
+// Validates that with fast reconnects, a stream istiod closes cleanly moves over to a new upstream connection,
+// which gets the last requests replayed, rather than the stream to Envoy ending.
+func TestXdsProxyFastReconnect(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.fastReconnect = true
+	upstreams := make(chan *fakeUpstream, 2)
+	// closed receives the number of each connection to istiod closed, in the order they are made.
+	closed := make(chan int, 2)
+	var conns int32
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		upstream := newFakeUpstream()
+		upstreams <- upstream
+		n := int(atomic.AddInt32(&conns, 1))
+		return &fakeADSClient{upstream: upstream}, closerFunc(func() error {
+			closed <- n
+			return nil
+		}), nil
+	}
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	node := &core.Node{Id: "sidecar~0.0.0.0~debug~cluster.local"}
+	if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	first := <-upstreams
+	<-first.requests
+
+	// istiod drains: it sends a last response and closes the stream.
+	first.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, VersionInfo: "1", Nonce: "first"}
+	close(first.responses)
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Nonce != "first" {
+		t.Fatalf("expected the response in flight to be forwarded, got %v", resp)
+	}
+
+	var second *fakeUpstream
+	select {
+	case second = <-upstreams:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the proxy did not reconnect to istiod")
+	}
+	select {
+	case req := <-second.requests:
+		if req.TypeUrl != v3.ClusterType || req.GetNode().GetId() != node.Id || req.ResponseNonce != "" {
+			t.Fatalf("expected the cluster request to be replayed with the node and without nonce, got %v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the last request was not replayed")
+	}
+	// The connection of the stream istiod closed goes away with it, rather than with Envoy's stream.
+	select {
+	case n := <-closed:
+		if n != 1 {
+			t.Fatalf("expected the first connection to be closed, got connection %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection istiod closed the stream on was not closed")
+	}
+	second.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, VersionInfo: "2", Nonce: "second"}
+	resp, err = downstream.Recv()
+	if err != nil {
+		t.Fatalf("expected Envoy's stream to carry on, got %v", err)
+	}
+	if resp.Nonce != "second" {
+		t.Fatalf("unexpected response forwarded downstream: %v", resp)
+	}
+	close(second.responses)
+}
+
+// Validates that a fast reconnect is held back by the circuit breaker like any connection to istiod.
+func TestXdsProxyFastReconnectCircuitBreaker(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.fastReconnect = true
+	proxy.breaker = newCircuitBreaker(1, time.Minute, time.Minute)
+	upstreams := make(chan *fakeUpstream, 2)
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		upstream := newFakeUpstream()
+		upstreams <- upstream
+		return &fakeADSClient{upstream: upstream}, ioutil.NopCloser(nil), nil
+	}
+	shortCircuits := counterValue(t, "istiod_connection_short_circuits")
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}); err != nil {
+		t.Fatal(err)
+	}
+	first := <-upstreams
+	<-first.requests
+
+	// Connections to istiod fail meanwhile, and the breaker opens.
+	proxy.breaker.failure()
+	close(first.responses)
+	if _, err := downstream.Recv(); err == nil {
+		t.Fatal("expected Envoy's stream to end when the reconnect is short circuited")
+	}
+	select {
+	case <-upstreams:
+		t.Fatal("expected the breaker to skip the reconnect")
+	default:
+	}
+	if d := counterValue(t, "istiod_connection_short_circuits") - shortCircuits; d != 1 {
+		t.Errorf("expected 1 short circuited connection, got %v", d)
+	}
+}
+
+// Validates the observers see the transitions of the connection to istiod over the life of an Envoy stream.
+func TestXdsProxyConnectionObserver(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.fastReconnect = true
+	upstreams := make(chan *fakeUpstream, 2)
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		upstream := newFakeUpstream()
+		upstreams <- upstream
+		return &fakeADSClient{upstream: upstream}, ioutil.NopCloser(nil), nil
+	}
+	type transition struct {
+		state  ConnectionState
+		reason string
+	}
+	transitions := make(chan transition, 10)
+	proxy.ObserveConnection(func(state ConnectionState, reason string) {
+		transitions <- transition{state, reason}
+	})
+	expect := func(want ConnectionState) transition {
+		t.Helper()
+		select {
+		case got := <-transitions:
+			if got.state != want {
+				t.Fatalf("expected the connection to be %v, got %v (%s)", want, got.state, got.reason)
+			}
+			return got
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the connection did not become %v", want)
+		}
+		return transition{}
+	}
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}); err != nil {
+		t.Fatal(err)
+	}
+	expect(ConnectionConnecting)
+	expect(ConnectionConnected)
+
+	// istiod closes the stream cleanly, and another one picks it up.
+	first := <-upstreams
+	close(first.responses)
+	expect(ConnectionReconnecting)
+	expect(ConnectionConnected)
+
+	// Envoy goes away.
+	second := <-upstreams
+	_ = conn.Close()
+	if got := expect(ConnectionDisconnected); !strings.Contains(got.reason, "downstream") {
+		t.Fatalf("expected the connection to be torn down by the downstream, got %q", got.reason)
+	}
+	close(second.responses)
+}
+
+// Validates responses subscribed to by an agent subsystem go to it instead of Envoy, and are ACKed by the proxy.
+func TestXdsProxySubscribe(t *testing.T) {
+	const syntheticType = "type.googleapis.com/istio.test.Synthetic"
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		return &fakeADSClient{upstream: upstream}, ioutil.NopCloser(nil), nil
+	}
+	received := make(chan *discovery.DiscoveryResponse, 1)
+	proxy.Subscribe(syntheticType, func(resp *discovery.DiscoveryResponse) error {
+		received <- resp
+		return nil
+	}, false)
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: &core.Node{Id: "sidecar~0.0.0.0~debug~cluster.local"}}); err != nil {
+		t.Fatal(err)
+	}
+	<-upstream.requests
+
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: syntheticType, VersionInfo: "1", Nonce: "synthetic"}
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, VersionInfo: "1", Nonce: "cluster"}
+
+	select {
+	case resp := <-received:
+		if resp.Nonce != "synthetic" {
+			t.Fatalf("unexpected response delivered to the subsystem: %v", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribed response was not delivered")
+	}
+	select {
+	case ack := <-upstream.requests:
+		if ack.TypeUrl != syntheticType || ack.ResponseNonce != "synthetic" || ack.ErrorDetail != nil {
+			t.Fatalf("expected an ACK for the subscribed response, got %v", ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribed response was not ACKed")
+	}
+	// Envoy only gets the response it asked for.
+	resp, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.TypeUrl != v3.ClusterType {
+		t.Fatalf("unexpected response forwarded downstream: %v", resp)
+	}
+	close(upstream.responses)
+}
+
+// Validates the response bytes are accounted for both decoded and on the wire, which is smaller with compression.
+func TestXdsProxyResponseBytes(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.Listener)
+	proxy.istiodDialOptions = append(proxy.istiodDialOptions,
+		grpc.WithStatsHandler(upstreamStatsHandler{}),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	bytesBefore := counterValue(t, "xds_proxy_response_bytes")
+	wireBefore := counterValue(t, "xds_proxy_response_wire_bytes")
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	sendDownstream(t, downstream)
+
+	decoded := counterValue(t, "xds_proxy_response_bytes") - bytesBefore
+	wire := counterValue(t, "xds_proxy_response_wire_bytes") - wireBefore
+	if decoded == 0 || wire == 0 {
+		t.Fatalf("expected both byte counters to be populated, got %v decoded and %v on the wire", decoded, wire)
+	}
+	if wire >= decoded {
+		t.Fatalf("expected compressed responses to be smaller on the wire, got %v decoded and %v on the wire", decoded, wire)
+	}
+}
+
+// Validates that after failing over to a secondary istiod, the proxy returns to the primary once it is healthy.
+func TestXdsProxyFailoverReturnsToPrimary(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+
+	// Reserve an address for the primary, but keep it down for now.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := l.Addr().String()
+	l.Close()
+	secondary := serveDiscovery(t, f, "127.0.0.1:0")
+
+	proxy.istiodAddress = primary
+	proxy.istiodFailoverAddresses = []string{secondary}
+	proxy.istiodDialOptions = []grpc.DialOption{grpc.WithInsecure()}
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	sendDownstream(t, downstream)
+	if got := proxy.upstreams.activeAddress(); got != secondary {
+		t.Fatalf("expected to fail over to %s, got %s", secondary, got)
+	}
+
+	// Bring the primary back, and let the health probe notice.
+	serveDiscovery(t, f, primary)
+	proxy.upstreams.probeDown()
+
+	downstream = stream(t, conn)
+	sendDownstream(t, downstream)
+	if got := proxy.upstreams.activeAddress(); got != primary {
+		t.Fatalf("expected to return to primary %s, got %s", primary, got)
+	}
+}
+
+// Validates that an Envoy reconnecting within the downstream grace period reuses the upstream connection.
+func TestXdsProxyDownstreamGracePeriod(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.downstreamGracePeriod = 5 * time.Second
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	var dials int32
+	proxy.istiodDialOptions = []grpc.DialOption{
+		grpc.WithBlock(),
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return f.Listener.Dial()
+		}),
+	}
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	sendDownstream(t, downstream)
+
+	downstream.CloseSend()
+	downstream = stream(t, conn)
+	sendDownstream(t, downstream)
+	if got := atomic.LoadInt32(&dials); got != 1 {
+		t.Fatalf("expected the upstream connection to be reused, got %d dials", got)
+	}
+}
+
+// Validates that the upstream connection is torn down, without leaking goroutines, when Envoy does not
+// come back within the grace period.
+func TestXdsProxyDownstreamGracePeriodExpired(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.downstreamGracePeriod = 200 * time.Millisecond
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.Listener)
+	before := proxyGoroutines()
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	sendDownstream(t, downstream)
+	downstream.CloseSend()
+
+	// The upstream stream is kept while Envoy may still come back.
+	time.Sleep(50 * time.Millisecond)
+	if got := len(f.Discovery.Clients()); got != 1 {
+		t.Fatalf("expected the upstream stream to be kept within the grace period, got %d streams", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.Discovery.Clients()) != 0 || proxyGoroutines() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the upstream stream to be closed after the grace period, got %d streams and %d goroutines",
+				len(f.Discovery.Clients()), proxyGoroutines()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// proxyGoroutines returns the number of goroutines serving an Envoy stream in the XDS proxy.
+func proxyGoroutines() int {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	count := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		for _, fn := range []string{"StreamAggregatedResources", "HandleUpstream", "handleDownstream",
+			"receiveUpstream", "awaitDownstream"} {
+			if strings.Contains(g, "istio-agent.(*XdsProxy)."+fn+"(") {
+				count++
+				break
+			}
+		}
+	}
+	return count
+}
+
+// Validates that the response transform is applied before responses reach Envoy.
+func TestXdsProxyResponseTransform(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	removed := false
+	proxy.responseTransform = func(resp *discovery.DiscoveryResponse) *discovery.DiscoveryResponse {
+		if resp.TypeUrl != v3.ClusterType {
+			return resp
+		}
+		filtered := resp.Resources[:0]
+		for _, res := range resp.Resources {
+			c := &cluster.Cluster{}
+			if err := ptypes.UnmarshalAny(res, c); err != nil {
+				t.Errorf("failed to unmarshal cluster: %v", err)
+			}
+			if c.Name == util.BlackHoleCluster {
+				removed = true
+				continue
+			}
+			filtered = append(filtered, res)
+		}
+		resp.Resources = filtered
+		return resp
+	}
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+
+	if err := downstream.Send(&discovery.DiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node: &core.Node{
+			Id: "sidecar~0.0.0.0~debug~cluster.local",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := downstream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !removed {
+		t.Fatalf("expected the transform to remove %s", util.BlackHoleCluster)
+	}
+	for _, r := range res.Resources {
+		c := &cluster.Cluster{}
+		if err := ptypes.UnmarshalAny(r, c); err != nil {
+			t.Fatal(err)
+		}
+		if c.Name == util.BlackHoleCluster {
+			t.Fatalf("expected %s to be filtered from the response", util.BlackHoleCluster)
+		}
+	}
+}
+
+// Validates that the initial NDS request is sent once, on CDS when Envoy requests it before LDS.
+func TestXdsProxyInitialNDSOnCDS(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.localDNSServer = &dns.LocalDNSServer{}
+	proxy.events = newEventRecorder(100)
+	f := xds.NewFakeDiscoveryServer(t, xds.FakeOptions{})
+	setDialOptions(proxy, f.Listener)
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	sendDownstreamWithType(t, downstream, v3.ClusterType)
+	sendDownstreamWithType(t, downstream, v3.ListenerType)
+
+	ndsRequests := 0
+	for _, e := range proxy.events.list() {
+		if e.Direction == eventRequest && e.TypeURL == v3.NameTableType && e.Nonce == "" {
+			ndsRequests++
+		}
+	}
+	if ndsRequests != 1 {
+		t.Fatalf("expected exactly one initial NDS request, got %d", ndsRequests)
+	}
+}
+
+// Validates the connections to istiod are skipped while the circuit breaker is open, and resume after the cool-down.
+func TestXdsProxyCircuitBreaker(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	var elapsed int64
+	proxy.breaker = newCircuitBreaker(2, time.Minute, time.Minute)
+	proxy.breaker.now = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&elapsed))) }
+	proxy.breakerRejectDelay = 0
+	var dials, failing int32 = 0, 1
+	upstream := newFakeUpstream()
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, nil, errors.New("istiod is down")
+		}
+		return &fakeADSClient{upstream: upstream}, ioutil.NopCloser(nil), nil
+	}
+	shortCircuits := counterValue(t, "istiod_connection_short_circuits")
+
+	conn := setupDownstreamConnection(t)
+	connect := func() error {
+		downstream := stream(t, conn)
+		if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: &core.Node{Id: "sidecar~0.0.0.0~debug~cluster.local"}}); err != nil {
+			t.Fatal(err)
+		}
+		_, err := downstream.Recv()
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := connect(); err == nil {
+			t.Fatal("expected the stream to fail while istiod is down")
+		}
+	}
+	if got := atomic.LoadInt32(&dials); got != 2 {
+		t.Fatalf("expected the breaker to skip the dial after 2 failures, got %d dials", got)
+	}
+	if d := counterValue(t, "istiod_connection_short_circuits") - shortCircuits; d != 1 {
+		t.Errorf("expected 1 short circuited connection, got %v", d)
+	}
+
+	// istiod is back, the trial connection after the cool-down goes through.
+	atomic.StoreInt32(&failing, 0)
+	atomic.StoreInt64(&elapsed, int64(time.Minute))
+	go func() {
+		req := <-upstream.requests
+		upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: req.TypeUrl}
+	}()
+	if err := connect(); err != nil {
+		t.Fatalf("expected the connection to resume after the cool-down: %v", err)
+	}
+	if got := atomic.LoadInt32(&dials); got != 3 {
+		t.Fatalf("expected a dial after the cool-down, got %d dials", got)
+	}
+	close(upstream.responses)
+}
+
+// Validates that a connection given up while waiting on the retry budget does not hold the circuit breaker
+// half-open, which would suspend the connections to istiod for good.
+func TestXdsProxyCircuitBreakerRetryBudget(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	var elapsed int64
+	proxy.breaker = newCircuitBreaker(1, time.Minute, time.Minute)
+	proxy.breaker.now = func() time.Time { return time.Now().Add(time.Duration(atomic.LoadInt64(&elapsed))) }
+	proxy.breakerRejectDelay = 0
+	proxy.retryBudget = newRetryBudget(0.001, 1)
+	var blocked int32
+	waiting := make(chan struct{}, 1)
+	proxy.retryBudget.after = func(time.Duration) <-chan time.Time {
+		if atomic.LoadInt32(&blocked) == 1 {
+			waiting <- struct{}{}
+			return nil
+		}
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		return c
+	}
+	var dials, failing int32 = 0, 1
+	upstream := newFakeUpstream()
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		atomic.AddInt32(&dials, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			return nil, nil, errors.New("istiod is down")
+		}
+		return &fakeADSClient{upstream: upstream}, ioutil.NopCloser(nil), nil
+	}
+
+	conn := setupDownstreamConnection(t)
+	connect := func(ctx context.Context) error {
+		downstream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}); err != nil {
+			t.Fatal(err)
+		}
+		_, err = downstream.Recv()
+		return err
+	}
+	// The failed dial opens the breaker.
+	if err := connect(ctx); err == nil {
+		t.Fatal("expected the stream to fail while istiod is down")
+	}
+
+	// After the cool-down, Envoy goes away while the connection waits on the exhausted budget.
+	atomic.StoreInt64(&elapsed, int64(time.Minute))
+	atomic.StoreInt32(&blocked, 1)
+	cctx, cancel := context.WithCancel(ctx)
+	errs := make(chan error, 1)
+	go func() { errs <- connect(cctx) }()
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to wait on the retry budget")
+	}
+	cancel()
+	if err := <-errs; err == nil {
+		t.Fatal("expected the stream to end with Envoy")
+	}
+
+	// istiod is back, the next connection is still let through by the breaker.
+	atomic.StoreInt32(&blocked, 0)
+	atomic.StoreInt32(&failing, 0)
+	go func() {
+		req := <-upstream.requests
+		upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: req.TypeUrl}
+	}()
+	if err := connect(ctx); err != nil {
+		t.Fatalf("expected the connection to go through the breaker: %v", err)
+	}
+	if got := atomic.LoadInt32(&dials); got != 2 {
+		t.Fatalf("expected a dial after the cool-down, got %d dials", got)
+	}
+	close(upstream.responses)
+}
+
+// Validates that the circuit breaker trips against an unreachable istiod, which the default non-blocking
+// dial does not detect.
+func TestXdsProxyCircuitBreakerUnreachable(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.breaker = newCircuitBreaker(2, time.Minute, time.Minute)
+	proxy.breakerRejectDelay = 0
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on the address anymore, connections are refused.
+	proxy.istiodAddress = l.Addr().String()
+	l.Close()
+	proxy.istiodDialOptions = []grpc.DialOption{grpc.WithInsecure()}
+	trips := counterValue(t, "istiod_circuit_breaker_trips")
+
+	conn := setupDownstreamConnection(t)
+	for i := 0; i < 2; i++ {
+		downstream := stream(t, conn)
+		if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := downstream.Recv(); err == nil {
+			t.Fatal("expected the stream to fail while istiod is unreachable")
+		}
+	}
+	if d := counterValue(t, "istiod_circuit_breaker_trips") - trips; d != 1 {
+		t.Fatalf("expected the breaker to trip, got %v trips", d)
+	}
+	if proxy.breaker.allow() {
+		t.Fatal("expected the breaker to skip connections to the unreachable istiod")
+	}
+}
+
+// Validates the upstream stream is torn down as soon as Envoy goes away.
+func TestXdsProxyDownstreamCancel(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	client := &fakeADSClient{upstream: upstream}
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		return client, ioutil.NopCloser(nil), nil
+	}
+
+	conn := setupDownstreamConnection(t)
+	downstreamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	downstream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(downstreamCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: &core.Node{Id: "sidecar~0.0.0.0~debug~cluster.local"}}); err != nil {
+		t.Fatal(err)
+	}
+	<-upstream.requests
+
+	cancel()
+	select {
+	case <-client.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream stream context was not cancelled with the downstream")
+	}
+	close(upstream.responses)
+}
+
+// Validates that concurrent Envoy streams, as during a hot restart, each get their own upstream when allowed.
+func TestXdsProxyMultipleDownstreams(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.maxDownstreamConnections = 2
+	clients := make(chan *fakeADSClient, 3)
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		client := &fakeADSClient{upstream: newFakeUpstream()}
+		clients <- client
+		return client, ioutil.NopCloser(nil), nil
+	}
+	conn := setupDownstreamConnection(t)
+
+	connect := func(node string) (discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient, *fakeUpstream) {
+		t.Helper()
+		downstream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: &core.Node{Id: node}}); err != nil {
+			t.Fatal(err)
+		}
+		var upstream *fakeUpstream
+		select {
+		case client := <-clients:
+			upstream = client.upstream
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no upstream connection for %s", node)
+		}
+		select {
+		case req := <-upstream.requests:
+			if req.Node.GetId() != node {
+				t.Fatalf("expected the request of %s upstream, got one from %s", node, req.Node.GetId())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("request of %s was not forwarded upstream", node)
+		}
+		return downstream, upstream
+	}
+	old, oldUpstream := connect("old")
+	current, currentUpstream := connect("new")
+
+	// Neither stream closed the other, each is served by its own upstream.
+	for _, tt := range []struct {
+		downstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+		upstream   *fakeUpstream
+		nonce      string
+	}{
+		{old, oldUpstream, "old"},
+		{current, currentUpstream, "new"},
+	} {
+		tt.upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: tt.nonce}
+		resp, err := tt.downstream.Recv()
+		if err != nil {
+			t.Fatalf("stream of %s: %v", tt.nonce, err)
+		}
+		if resp.Nonce != tt.nonce {
+			t.Fatalf("stream of %s got the response for %s", tt.nonce, resp.Nonce)
+		}
+	}
+
+	// A third stream closes the oldest one.
+	_, thirdUpstream := connect("third")
+	if _, err := old.Recv(); err == nil {
+		t.Fatal("expected the oldest stream to be closed")
+	}
+	currentUpstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "still"}
+	if resp, err := current.Recv(); err != nil || resp.Nonce != "still" {
+		t.Fatalf("expected the newer stream to be served, got %v, %v", resp, err)
+	}
+	close(oldUpstream.responses)
+	close(currentUpstream.responses)
+	close(thirdUpstream.responses)
+}
+
+// Validates the replayed and resynced subscriptions are requested in the order Envoy warms them up.
+func TestSentRequestsDependencyOrder(t *testing.T) {
+	sent := newSentRequests()
+	node := &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"}
+	for i, typeURL := range []string{v3.RouteType, v3.NameTableType, v3.ListenerType, v3.EndpointType, v3.ClusterType} {
+		req := &discovery.DiscoveryRequest{TypeUrl: typeURL, ResponseNonce: "nonce"}
+		if i == 0 {
+			req.Node = node
+		}
+		sent.record(req)
+	}
+	want := []string{v3.ClusterType, v3.EndpointType, v3.ListenerType, v3.RouteType, v3.NameTableType}
+	for name, reqs := range map[string][]*discovery.DiscoveryRequest{
+		"replay": sent.replay(),
+		"resync": sent.resync(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			var got []string
+			for _, req := range reqs {
+				got = append(got, req.TypeUrl)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got type urls %v, want %v", got, want)
+			}
+			if name == "replay" && reqs[0].Node != node {
+				t.Errorf("expected the first request replayed to carry the node, got %v", reqs[0])
+			}
+		})
+	}
+}
+
+func TestProxyConnectionBufferSizes(t *testing.T) {
+	for _, tt := range []struct {
+		name                string
+		requests, responses int
+		wantReq, wantResp   int
+	}{
+		{"asymmetric", 3, 50, 3, 50},
+		{"defaults", 0, 0, defaultConnectionBufferSize, defaultConnectionBufferSize},
+		{"negative", -1, 20, defaultConnectionBufferSize, 20},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			con := newBufferedProxyConnection(&fakeDownstream{}, tt.requests, tt.responses)
+			if got := cap(con.requestsChan); got != tt.wantReq {
+				t.Errorf("requests buffer: got %d, want %d", got, tt.wantReq)
+			}
+			if got := cap(con.responsesChan); got != tt.wantResp {
+				t.Errorf("responses buffer: got %d, want %d", got, tt.wantResp)
+			}
+		})
+	}
+}
+
+// Validates that name tables are applied while a send to Envoy is stuck.
+func TestXdsProxyNameTableNotBlockedByDownstream(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	dnsServer := &fakeDNSServer{tables: make(chan *nds.NameTable, 1)}
+	proxy.localDNSServer = dnsServer
+	upstream := newFakeUpstream()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10), block: unblock}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	// Envoy is slow to take the listeners, while istiod sends a name table.
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ListenerType}
+	nt, err := ptypes.MarshalAny(&nds.NameTable{Table: map[string]*nds.NameTable_NameInfo{
+		"example.com": {Ips: []string{"1.2.3.4"}, Registry: "External"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.NameTableType, Resources: []*any.Any{nt}}
+
+	select {
+	case got := <-dnsServer.tables:
+		if _, f := got.Table["example.com"]; !f {
+			t.Fatalf("unexpected name table %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("name table was not applied while the downstream send was blocked")
+	}
+}
+
+// Validates that gzip compressed name tables are requested and built, as well as uncompressed ones.
+func TestXdsProxyCompressedNameTable(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	dnsServer := &fakeDNSServer{tables: make(chan *nds.NameTable, 1)}
+	proxy.localDNSServer = dnsServer
+	proxy.compressNameTable = true
+	upstream := newFakeUpstream()
+	defer close(upstream.responses)
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{
+		TypeUrl: v3.ClusterType,
+		Node:    &core.Node{Id: "sidecar~1.1.1.1~debug~cluster.local"},
+	}, fromEnvoy: true}
+	select {
+	case req := <-upstream.requests:
+		got := req.GetNode().GetMetadata().GetFields()[nameTableCompressionMetadata].GetStringValue()
+		if got != xds.NameTableCompressionGzip {
+			t.Fatalf("expected the node metadata to accept gzip compressed name tables, got %v", req.GetNode())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not forwarded")
+	}
+
+	for _, compressed := range []bool{true, false} {
+		ip := "1.2.3.4"
+		if !compressed {
+			ip = "5.6.7.8"
+		}
+		nt := &nds.NameTable{Table: map[string]*nds.NameTable_NameInfo{
+			"example.com": {Ips: []string{ip}, Registry: "External"},
+		}}
+		var res *any.Any
+		var err error
+		if compressed {
+			res, err = xds.CompressNameTable(nt)
+		} else {
+			// An istiod ignoring the node metadata still sends uncompressed name tables.
+			res, err = ptypes.MarshalAny(nt)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.NameTableType, Nonce: ip, Resources: []*any.Any{res}}
+		select {
+		case got := <-dnsServer.tables:
+			if info, f := got.Table["example.com"]; !f || len(info.Ips) != 1 || info.Ips[0] != ip {
+				t.Fatalf("unexpected name table %v, compressed: %v", got, compressed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("name table was not built, compressed: %v", compressed)
+		}
+	}
+}
+
+func TestDownstreamListener(t *testing.T) {
+	t.Run("missing parent directory", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "etc", "istio", "proxy", "XDS")
+		l, err := newDownstreamListener(socket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		if _, err := os.Stat(socket); err != nil {
+			t.Fatalf("expected the socket to be created: %v", err)
+		}
+	})
+	t.Run("permission denied", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root is not denied permissions")
+		}
+		dir := filepath.Join(t.TempDir(), "readonly")
+		if err := os.Mkdir(dir, 0500); err != nil {
+			t.Fatal(err)
+		}
+		socket := filepath.Join(dir, "proxy", "XDS")
+		_, err := newDownstreamListener(socket)
+		if err == nil {
+			t.Fatal("expected an error listening in a read-only directory")
+		}
+		var listenErr *udsListenError
+		if !errors.As(err, &listenErr) || !os.IsPermission(errors.Unwrap(err)) {
+			t.Errorf("expected a permission error, got %v", err)
+		}
+		if !strings.Contains(err.Error(), socket) || !strings.Contains(err.Error(), "writable volume") {
+			t.Errorf("expected the error to mention the path and how to fix it, got %v", err)
+		}
+	})
+}
+
+// Validates that a burst of name tables is ACKed right away, but only the last one is built.
+func TestXdsProxyNameTableDebounce(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	dnsServer := &fakeDNSServer{tables: make(chan *nds.NameTable, 3)}
+	proxy.localDNSServer = dnsServer
+	proxy.nameTables = newNameTableDebouncer(200*time.Millisecond, dnsServer.UpdateLookupTable)
+	upstream := newFakeUpstream()
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		nt, err := ptypes.MarshalAny(&nds.NameTable{Table: map[string]*nds.NameTable_NameInfo{
+			"example.com": {Ips: []string{ip}, Registry: "External"},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.NameTableType, Nonce: ip, Resources: []*any.Any{nt}}
+	}
+	for _, nonce := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		select {
+		case ack := <-upstream.requests:
+			if ack.ResponseNonce != nonce || ack.ErrorDetail != nil {
+				t.Fatalf("expected an ACK of %s, got %v", nonce, ack)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("name table %s was not ACKed", nonce)
+		}
+	}
+
+	select {
+	case got := <-dnsServer.tables:
+		if ips := got.Table["example.com"].GetIps(); !reflect.DeepEqual(ips, []string{"3.3.3.3"}) {
+			t.Fatalf("expected the last name table to be built, got %v", ips)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("name table was not built")
+	}
+	select {
+	case got := <-dnsServer.tables:
+		t.Fatalf("expected a single build, got another one with %v", got)
+	case <-time.After(500 * time.Millisecond):
+	}
+	close(upstream.responses)
+}
+
+// Validates name tables are ACKed but not built into the dns server when disabled.
+func TestXdsProxyNameTableDisabled(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	dnsServer := &fakeDNSServer{tables: make(chan *nds.NameTable, 1)}
+	proxy.localDNSServer = dnsServer
+	proxy.disableNameTable = true
+	upstream := newFakeUpstream()
+	con := newProxyConnection(&fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)})
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	nt, err := ptypes.MarshalAny(&nds.NameTable{Table: map[string]*nds.NameTable_NameInfo{
+		"example.com": {Ips: []string{"1.1.1.1"}, Registry: "External"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.NameTableType, Nonce: "nonce", Resources: []*any.Any{nt}}
+	select {
+	case ack := <-upstream.requests:
+		if ack.ResponseNonce != "nonce" || ack.ErrorDetail != nil {
+			t.Fatalf("expected an ACK of the name table, got %v", ack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("name table was not ACKed")
+	}
+	select {
+	case got := <-dnsServer.tables:
+		t.Fatalf("expected the name table not to be built, got %v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Refreshes are not sent either.
+	proxy.RefreshNameTable()
+	select {
+	case req := <-upstream.requests:
+		t.Fatalf("expected no name table request, got %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(upstream.responses)
+}
+
+// Validates the name table is only requested along with Envoy's first listeners if the name tables are intercepted.
+func TestXdsProxyInitialNameTableRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		dnsServer bool
+		disabled  bool
+		requested bool
+	}{
+		{"intercepted", true, false, true},
+		{"disabled", true, true, false},
+		{"without dns server", false, false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := setupXdsProxy(t)
+			proxy.localDNSServer = nil
+			if tt.dnsServer {
+				proxy.localDNSServer = &fakeDNSServer{tables: make(chan *nds.NameTable, 1)}
+			}
+			proxy.disableNameTable = tt.disabled
+			con := newProxyConnection(&fakeDownstream{})
+			defer close(con.done)
+			go proxy.handleDownstream(con, con.downstream, &discovery.DiscoveryRequest{TypeUrl: v3.ListenerType})
+
+			if req := <-con.requestsChan; req.req.TypeUrl != v3.ListenerType {
+				t.Fatalf("expected the listeners to be requested first, got %v", req.req)
+			}
+			select {
+			case req := <-con.requestsChan:
+				if !tt.requested || req.req.TypeUrl != v3.NameTableType {
+					t.Fatalf("unexpected request %v", req.req)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.requested {
+					t.Fatal("expected the name table to be requested")
+				}
+			}
+		})
+	}
+}
+
+// Validates that Envoy's configuration is held back until the first name table is built when warming up.
+func TestXdsProxyWarmup(t *testing.T) {
+	for _, nameTable := range []bool{true, false} {
+		t.Run(fmt.Sprintf("name-table-%t", nameTable), func(t *testing.T) {
+			proxy := setupXdsProxy(t)
+			dnsServer := &fakeDNSServer{tables: make(chan *nds.NameTable, 1)}
+			proxy.localDNSServer = dnsServer
+			proxy.warmupTimeout = time.Hour
+			if !nameTable {
+				proxy.warmupTimeout = 200 * time.Millisecond
+			}
+			upstream := newFakeUpstream()
+			defer close(upstream.responses)
+			downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+			con := newProxyConnection(downstream)
+			defer close(con.done)
+			go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+			select {
+			case req := <-upstream.requests:
+				if req.TypeUrl != v3.NameTableType {
+					t.Fatalf("expected the name table to be requested first, got %v", req)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("name table was not requested")
+			}
+			upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType}
+			if !nameTable {
+				// The warm-up is bounded, Envoy gets its configuration without the name table.
+				select {
+				case <-downstream.sent:
+				case <-time.After(5 * time.Second):
+					t.Fatal("response was held back past the warm-up timeout")
+				}
+				return
+			}
+			select {
+			case resp := <-downstream.sent:
+				t.Fatalf("response %v was forwarded before the name table", resp)
+			case <-time.After(200 * time.Millisecond):
+			}
+
+			nt, err := ptypes.MarshalAny(&nds.NameTable{Table: map[string]*nds.NameTable_NameInfo{
+				"example.com": {Ips: []string{"1.2.3.4"}, Registry: "External"},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.NameTableType, Resources: []*any.Any{nt}}
+			select {
+			case <-dnsServer.tables:
+			case <-time.After(5 * time.Second):
+				t.Fatal("name table was not built")
+			}
+			select {
+			case resp := <-downstream.sent:
+				if resp.TypeUrl != v3.ClusterType {
+					t.Fatalf("unexpected response %v", resp)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("response was not forwarded once the name table was built")
+			}
+		})
+	}
+}
+
+// Validates the time istiod takes to answer a request is recorded for its type url, ACKs included, and only for the
+// request a response answers.
+func TestXdsProxyResponseLatency(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	defer close(upstream.responses)
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	exchange := func(req *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+		t.Helper()
+		con.requestsChan <- &upstreamRequest{req: req}
+		select {
+		case <-upstream.requests:
+		case <-time.After(5 * time.Second):
+			t.Fatal("request was not forwarded upstream")
+		}
+		upstream.responses <- resp
+		select {
+		case <-downstream.sent:
+		case <-time.After(5 * time.Second):
+			t.Fatal("response was not forwarded downstream")
+		}
+	}
+	before := distributionCount(t, "xds_proxy_response_latency_seconds", v3.ClusterType)
+	exchange(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}, &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "1"})
+	if d := distributionCount(t, "xds_proxy_response_latency_seconds", v3.ClusterType) - before; d != 1 {
+		t.Fatalf("expected a latency sample for %s, got %d", v3.ClusterType, d)
+	}
+	// The next push answers the ACK of the first response.
+	exchange(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "1"},
+		&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "2"})
+	if d := distributionCount(t, "xds_proxy_response_latency_seconds", v3.ClusterType) - before; d != 2 {
+		t.Fatalf("expected a latency sample for the ACK, got %d samples", d)
+	}
+	// An ACK of a stale nonce is not answered by the next push.
+	exchange(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: "1"},
+		&discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "3"})
+	if d := distributionCount(t, "xds_proxy_response_latency_seconds", v3.ClusterType) - before; d != 2 {
+		t.Fatalf("expected no latency sample for a stale ACK, got %d samples", d)
+	}
+}
+
+// Validates the upstream stream carries a correlation ID, which the requests and responses are logged with.
+func TestXdsProxyCorrelationID(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "proxy.log")
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{logFile}
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	level := proxyLog.GetOutputLevel()
+	proxyLog.SetOutputLevel(log.DebugLevel)
+	defer func() {
+		proxyLog.SetOutputLevel(level)
+		_ = log.Configure(log.DefaultOptions())
+	}()
+
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	client := &fakeADSClient{upstream: upstream}
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, client)
+
+	con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}}
+	<-upstream.requests
+	ids := client.outgoing.Get(correlationIDHeader)
+	if len(ids) != 1 || ids[0] == "" {
+		t.Fatalf("expected a correlation ID in the upstream metadata, got %v", client.outgoing)
+	}
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "nonce"}
+	<-downstream.sent
+
+	_ = log.Sync()
+	logs, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestID := ids[0] + "/1"
+	for _, want := range []string{
+		"request " + requestID + " for type url " + v3.ClusterType,
+		// istiod did not echo the correlation ID.
+		"to request " + requestID + ` (by type url and nonce "nonce")`,
+	} {
+		if !strings.Contains(string(logs), want) {
+			t.Errorf("expected %q in the logs, got %q", want, logs)
+		}
+	}
+	close(upstream.responses)
+}
+
+// Validates the metadata provider is called for each new stream, and its headers are sent along with the static ones.
+func TestXdsProxyMetadataProvider(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.agent.cfg.XDSHeaders = map[string]string{"static": "header", "attestation": "static"}
+	calls := 0
+	proxy.metadataProvider = func(context.Context) (map[string]string, error) {
+		calls++
+		return map[string]string{"attestation": fmt.Sprintf("token-%d", calls)}, nil
+	}
+	clients := make(chan *fakeADSClient, 2)
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		client := &fakeADSClient{upstream: newFakeUpstream()}
+		clients <- client
+		return client, ioutil.NopCloser(nil), nil
+	}
+
+	conn := setupDownstreamConnection(t)
+	for i := 1; i <= 2; i++ {
+		downstream := stream(t, conn)
+		if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, Node: &core.Node{Id: "sidecar~0.0.0.0~debug~cluster.local"}}); err != nil {
+			t.Fatal(err)
+		}
+		client := <-clients
+		<-client.upstream.requests
+		if got, want := client.outgoing.Get("attestation"), []string{fmt.Sprintf("token-%d", i)}; !reflect.DeepEqual(got, want) {
+			t.Errorf("stream %d: expected the attestation header %v, got %v", i, want, got)
+		}
+		if got := client.outgoing.Get("static"); !reflect.DeepEqual(got, []string{"header"}) {
+			t.Errorf("stream %d: expected the static header, got %v", i, got)
+		}
+		close(client.upstream.responses)
+	}
+}
+
+// Validates a request repeating the previous one of its type is not forwarded, while an ACK advancing the nonce is.
+func TestXdsProxyDuplicateRequests(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.dedupWindow = time.Minute
+	upstream := newFakeUpstream()
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	for _, req := range []*discovery.DiscoveryRequest{
+		{TypeUrl: v3.ClusterType},
+		{TypeUrl: v3.ClusterType},
+		{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a"},
+		{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a"},
+		{TypeUrl: v3.ClusterType, VersionInfo: "2", ResponseNonce: "b"},
+	} {
+		con.requestsChan <- &upstreamRequest{req: req, fromEnvoy: true}
+	}
+	// An agent request is never suppressed.
+	con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "2", ResponseNonce: "b"}}
+
+	for _, want := range []string{"", "a", "b", "b"} {
+		select {
+		case req := <-upstream.requests:
+			if req.ResponseNonce != want {
+				t.Fatalf("expected the request with nonce %q to be forwarded, got %v", want, req)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the request with nonce %q was not forwarded", want)
+		}
+	}
+	select {
+	case req := <-upstream.requests:
+		t.Fatalf("unexpected request forwarded: %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(upstream.responses)
+}
+
+// Validates only a sample of the per-message debug lines is logged with sampling, while every warning is.
+func TestXdsProxyDebugLogSampling(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "proxy.log")
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{logFile}
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	level := proxyLog.GetOutputLevel()
+	proxyLog.SetOutputLevel(log.DebugLevel)
+	defer func() {
+		proxyLog.SetOutputLevel(level)
+		_ = log.Configure(log.DefaultOptions())
+	}()
+
+	proxy := setupXdsProxy(t)
+	proxy.logSampler = newLogSampler(5)
+	upstream := newFakeUpstream()
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	expired := time.Now().Add(-time.Second)
+	for i := 0; i < 3; i++ {
+		con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{TypeUrl: v3.ListenerType}, deadline: expired}
+	}
+	for i := 0; i < 10; i++ {
+		con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, ResponseNonce: fmt.Sprint(i)}}
+		<-upstream.requests
+	}
+
+	_ = log.Sync()
+	logs, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(logs), "for type url "+v3.ClusterType+", nonce"); got != 2 {
+		t.Errorf("expected 2 of the 10 request lines to be logged, got %d:\n%s", got, logs)
+	}
+	if !strings.Contains(string(logs), "(4 messages not logged since)") {
+		t.Errorf("expected the messages left out to be counted, got:\n%s", logs)
+	}
+	if got := strings.Count(string(logs), "its deadline passed"); got != 3 {
+		t.Errorf("expected every warning to be logged, got %d:\n%s", got, logs)
+	}
+	close(upstream.responses)
+}
+
+type fakeCertProvider struct {
+	cert *tls.Certificate
+}
+
+func (f *fakeCertProvider) GetClientCertificate() (*tls.Certificate, error) {
+	return f.cert, nil
+}
+
+// Validates the in-memory client certificate is used instead of the certificate files.
+func TestXdsProxyClientCertProvider(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	// Point the files somewhere that does not exist, so any attempt to load them fails.
+	missing := path.Join(t.TempDir(), "missing")
+	proxy.agent.proxyConfig.ProxyMetadata[MetadataClientCertChain] = path.Join(missing, "cert-chain.pem")
+	proxy.agent.proxyConfig.ProxyMetadata[MetadataClientCertKey] = path.Join(missing, "key.pem")
+	if _, err := proxy.getClientCertificate(proxy.agent); err == nil {
+		t.Fatal("expected loading the missing certificate files to fail")
+	}
+
+	want := &tls.Certificate{Certificate: [][]byte{[]byte("in-memory")}}
+	proxy.clientCertProvider = &fakeCertProvider{cert: want}
+	got, err := proxy.getClientCertificate(proxy.agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Fatalf("got certificate %v, want the in-memory one", got)
+	}
+}
+
+// fakeClock fires the channels of after once the time is advanced past their deadline.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []fakeTimer
+	// started receives the duration of each timer started.
+	started chan time.Duration
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now(), started: make(chan time.Duration, 100)}
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{deadline: c.now.Add(d), c: ch})
+	c.started <- d
+	return ch
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.deadline.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// Validates certificate events within the debounce delay reset the upstream connection once, after the delay.
+func TestXdsProxyCertificateWatchDebounce(t *testing.T) {
+	agent := setupXdsProxy(t).agent
+	newWatcher, watcher := filewatcher.NewFakeWatcher(func(string, bool) {})
+	clock := newFakeClock()
+	proxy := &XdsProxy{
+		resetChan:   make(chan struct{}, 10),
+		fileWatcher: newWatcher(),
+		after:       clock.after,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := proxy.initCertificateWatches(agent, stop); err != nil {
+		t.Fatal(err)
+	}
+	keyFile, certFile := proxy.getCertKeyPaths(agent)
+
+	// The events channels are unbuffered, so each event has been received once injected.
+	watcher.InjectEvent(certFile, fsnotify.Event{Name: certFile, Op: fsnotify.Write})
+	if d := <-clock.started; d != watchDebounceDelay {
+		t.Fatalf("debounce timer of %v started, want %v", d, watchDebounceDelay)
+	}
+	watcher.InjectEvent(keyFile, fsnotify.Event{Name: keyFile, Op: fsnotify.Write})
+
+	clock.advance(watchDebounceDelay - time.Millisecond)
+	select {
+	case <-proxy.resetChan:
+		t.Fatal("upstream reset before the debounce delay")
+	case <-time.After(50 * time.Millisecond):
+	}
+	clock.advance(time.Millisecond)
+	select {
+	case <-proxy.resetChan:
+	case <-time.After(time.Second):
+		t.Fatal("upstream not reset after the debounce delay")
+	}
+	select {
+	case <-proxy.resetChan:
+		t.Fatal("upstream reset more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if n := len(clock.started); n != 0 {
+		t.Fatalf("%d more debounce timers started, want none", n)
+	}
+}
+
+// Validates that rotating an additional root certificate resets the upstream connection too.
+func TestXdsProxyAdditionalRootCertWatch(t *testing.T) {
+	agent := setupXdsProxy(t).agent
+	extraRoot := filepath.Join(t.TempDir(), "extra-root.pem")
+	agent.cfg.XDSAdditionalRootCerts = []string{extraRoot}
+	newWatcher, watcher := filewatcher.NewFakeWatcher(func(string, bool) {})
+	clock := newFakeClock()
+	proxy := &XdsProxy{
+		resetChan:   make(chan struct{}, 10),
+		fileWatcher: newWatcher(),
+		after:       clock.after,
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := proxy.initCertificateWatches(agent, stop); err != nil {
+		t.Fatal(err)
+	}
+
+	watcher.InjectEvent(extraRoot, fsnotify.Event{Name: extraRoot, Op: fsnotify.Write})
+	if d := <-clock.started; d != watchDebounceDelay {
+		t.Fatalf("debounce timer of %v started, want %v", d, watchDebounceDelay)
+	}
+	clock.advance(watchDebounceDelay)
+	select {
+	case <-proxy.resetChan:
+	case <-time.After(time.Second):
+		t.Fatal("upstream not reset after the additional root certificate rotated")
+	}
+}
+
+// Validates a name table refresh sends a fresh NDS request upstream, coalescing concurrent refreshes.
+func TestXdsProxyRefreshNameTable(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.localDNSServer = &fakeDNSServer{tables: make(chan *nds.NameTable, 1)}
+	upstream := newFakeUpstream()
+	con := newProxyConnection(&fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)})
+	defer close(con.done)
+
+	// Refreshes requested before the upstream picks them up are coalesced.
+	rec := httptest.NewRecorder()
+	proxy.debugHandlers()["/debug/refresh-name-table"].ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/refresh-name-table", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	proxy.RefreshNameTable()
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	select {
+	case req := <-upstream.requests:
+		if req.TypeUrl != v3.NameTableType || req.VersionInfo != "" || req.ResponseNonce != "" {
+			t.Fatalf("expected a fresh NDS request, got %v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no NDS request sent upstream")
+	}
+	select {
+	case req := <-upstream.requests:
+		t.Fatalf("expected the refreshes to be coalesced, got another request %v", req)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Once sent, a new refresh goes out again.
+	proxy.RefreshNameTable()
+	select {
+	case req := <-upstream.requests:
+		if req.TypeUrl != v3.NameTableType {
+			t.Fatalf("expected a fresh NDS request, got %v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no NDS request sent upstream")
+	}
+	close(upstream.responses)
+}
+
+// Validates a resync requests the full state of every subscription again, without versions or nonces.
+func TestXdsProxyResync(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	con := newProxyConnection(&fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)})
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	for _, req := range []*discovery.DiscoveryRequest{
+		{TypeUrl: v3.ClusterType, VersionInfo: "1", ResponseNonce: "a"},
+		{TypeUrl: v3.EndpointType, VersionInfo: "2", ResponseNonce: "b", ResourceNames: []string{"outbound|80||foo"}},
+	} {
+		con.requestsChan <- &upstreamRequest{req: req, fromEnvoy: true}
+		<-upstream.requests
+	}
+
+	assertResync := func() {
+		t.Helper()
+		for _, want := range []string{v3.ClusterType, v3.EndpointType} {
+			select {
+			case req := <-upstream.requests:
+				if req.TypeUrl != want || req.VersionInfo != "" || req.ResponseNonce != "" {
+					t.Fatalf("expected a full %s request, got %v", want, req)
+				}
+				if want == v3.EndpointType && !reflect.DeepEqual(req.ResourceNames, []string{"outbound|80||foo"}) {
+					t.Fatalf("expected the resource names to be kept, got %v", req.ResourceNames)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no full %s request sent upstream", want)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.debugHandlers()["/debug/resync"].ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/resync", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	assertResync()
+
+	// Envoy ACKs the full state, and a later resync still covers every subscription.
+	con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType, VersionInfo: "3", ResponseNonce: "c"}, fromEnvoy: true}
+	if req := <-upstream.requests; req.ResponseNonce != "c" {
+		t.Fatalf("expected the ACK to be forwarded, got %v", req)
+	}
+	proxy.Resync()
+	assertResync()
+	close(upstream.responses)
+}
+
+// Validates a failure to send to Envoy is counted and tears down the stream.
+func TestXdsProxyDownstreamSendError(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	sendErr := errors.New("envoy stopped reading")
+	con := newProxyConnection(&fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10), err: sendErr})
+	defer close(con.done)
+	before := counterValue(t, "envoy_downstream_send_errors")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+	}()
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType}
+	select {
+	case err := <-done:
+		if err != sendErr {
+			t.Fatalf("expected the stream to end with the send error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream was not torn down")
+	}
+	if got := counterValue(t, "envoy_downstream_send_errors"); got != before+1 {
+		t.Fatalf("expected envoy_downstream_send_errors to be %v, got %v", before+1, got)
+	}
+	close(upstream.responses)
+}
+
+// Validates a failure to open the stream once connected to istiod is counted apart from connection failures.
+func TestXdsProxyStreamCreationFailure(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	proxy.newUpstreamClient = func() (discovery.AggregatedDiscoveryServiceClient, io.Closer, error) {
+		return &fakeADSClient{err: status.Error(codes.PermissionDenied, "unauthorized")}, ioutil.NopCloser(nil), nil
+	}
+	connectionFailures := counterValue(t, "istiod_connection_failures")
+	streamFailures := counterValue(t, "istiod_stream_creation_failures")
+
+	conn := setupDownstreamConnection(t)
+	downstream := stream(t, conn)
+	if err := downstream.Send(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downstream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected Envoy's stream to end with the stream creation error, got %v", err)
+	}
+	if got := counterValue(t, "istiod_stream_creation_failures"); got != streamFailures+1 {
+		t.Fatalf("expected istiod_stream_creation_failures to be %v, got %v", streamFailures+1, got)
+	}
+	if got := counterValue(t, "istiod_connection_failures"); got != connectionFailures {
+		t.Fatalf("expected istiod_connection_failures to stay %v, got %v", connectionFailures, got)
+	}
+}
+
+func counterValue(t *testing.T, name string) float64 {
+	t.Helper()
+	data, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for counter %s: %v", name, err)
+	}
+	if len(data) == 0 {
+		return 0
+	}
+	return data[0].Data.(*view.SumData).Value
+}
+
+// distributionCount returns the number of samples of a distribution for the type url.
+func distributionCount(t *testing.T, name string, typeURL string) int64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get value for distribution %s: %v", name, err)
+	}
+	for _, row := range rows {
+		for _, tag := range row.Tags {
+			if tag.Value == typeURL {
+				return row.Data.(*view.DistributionData).Count
+			}
+		}
+	}
+	return 0
+}
+
+// Validates an agent request still queued at its deadline is dropped, while requests without one are sent.
+func TestXdsProxyRequestDeadline(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	upstream := newFakeUpstream()
+	con := newProxyConnection(&fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)})
+	defer close(con.done)
+	proxy.RegisterStream(con)
+	before := counterValue(t, "xds_proxy_expired_requests")
+
+	// Queue the requests before the upstream is connected, so the first one is past its deadline once it can be sent.
+	proxy.SendRequestWithDeadline(&discovery.DiscoveryRequest{TypeUrl: health.HealthInfoTypeURL}, time.Now().Add(time.Millisecond))
+	proxy.SendRequest(&discovery.DiscoveryRequest{TypeUrl: v3.ClusterType})
+	time.Sleep(10 * time.Millisecond)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	select {
+	case req := <-upstream.requests:
+		if req.TypeUrl != v3.ClusterType {
+			t.Fatalf("expected the expired request to be dropped, got %v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request without deadline was not sent")
+	}
+	if got := counterValue(t, "xds_proxy_expired_requests"); got != before+1 {
+		t.Fatalf("expected xds_proxy_expired_requests to be %v, got %v", before+1, got)
+	}
+	close(upstream.responses)
+}
+
+// Validates a slow, but successful, upstream send is reported.
+func TestSendUpstreamSlow(t *testing.T) {
+	var reported []string
+	defer func(r func(string, time.Duration)) { reportSlowSend = r }(reportSlowSend)
+	reportSlowSend = func(typeURL string, took time.Duration) {
+		reported = append(reported, typeURL)
+	}
+	upstream := newFakeUpstream()
+	upstream.sendDelay = 50 * time.Millisecond
+
+	if err := sendUpstreamWithTimeout(ctx, upstream, &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 0 {
+		t.Fatalf("expected no slow send under the threshold, got %v", reported)
+	}
+	if err := sendUpstreamWithTimeout(ctx, upstream, &discovery.DiscoveryRequest{TypeUrl: v3.ListenerType}, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported[0] != v3.ListenerType {
+		t.Fatalf("expected the slow send to be reported, got %v", reported)
+	}
+	if len(upstream.requests) != 2 {
+		t.Fatalf("expected both requests to be sent, got %d", len(upstream.requests))
+	}
+}
+
+// Validates the root CAs of all configured files are trusted for the XDS connection, and no others.
+func TestXdsProxyAdditionalRootCerts(t *testing.T) {
+	dir := t.TempDir()
+	oldCA, oldCAKey := newTestCA(t, "old-ca")
+	newCA, newCAKey := newTestCA(t, "new-ca")
+	untrustedCA, untrustedCAKey := newTestCA(t, "untrusted-ca")
+	writeCA := func(name string, ca *x509.Certificate) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	agent := &Agent{
+		cfg: &AgentConfig{
+			XDSRootCerts:           writeCA("old-root.pem", oldCA),
+			XDSAdditionalRootCerts: []string{writeCA("new-root.pem", newCA)},
+		},
+	}
+
+	pool, err := (&XdsProxy{}).getRootCertificate(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		ca      *x509.Certificate
+		caKey   *ecdsa.PrivateKey
+		trusted bool
+	}{
+		{"old CA", oldCA, oldCAKey, true},
+		{"new CA", newCA, newCAKey, true},
+		{"untrusted CA", untrustedCA, untrustedCAKey, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			leaf := newTestLeaf(t, tt.ca, tt.caKey)
+			_, err := leaf.Verify(x509.VerifyOptions{DNSName: "istiod.istio-system.svc", Roots: pool})
+			if tt.trusted && err != nil {
+				t.Errorf("expected istiod certificate to be trusted: %v", err)
+			}
+			if !tt.trusted && err == nil {
+				t.Error("expected istiod certificate to be rejected")
+			}
+		})
+	}
+
+	agent.cfg.XDSAdditionalRootCerts = append(agent.cfg.XDSAdditionalRootCerts, filepath.Join(dir, "missing.pem"))
+	if _, err := (&XdsProxy{}).getRootCertificate(agent); err == nil {
+		t.Error("expected an error for a missing root CA file")
+	}
+}
+
+// Validates istiod certificates are only accepted with one of the expected identities.
+func TestXdsProxyServerIdentity(t *testing.T) {
+	ca, caKey := newTestCA(t, "ca")
+	issue := func(identity string) [][]*x509.Certificate {
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: "istiod"},
+			DNSNames:    []string{"istiod.istio-system.svc"},
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		if identity != "" {
+			uri, err := url.Parse(identity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			template.URIs = []*url.URL{uri}
+		}
+		leaf, _ := newTestCert(t, template, ca, caKey)
+		return [][]*x509.Certificate{{leaf, ca}}
+	}
+	verify := verifyServerIdentity([]string{
+		"spiffe://cluster.local/ns/istio-system/sa/istiod",
+		"spiffe://cluster.local/ns/istio-system/sa/istiod-canary",
+	})
+	for _, tt := range []struct {
+		name     string
+		identity string
+		accepted bool
+	}{
+		{"expected identity", "spiffe://cluster.local/ns/istio-system/sa/istiod", true},
+		{"other expected identity", "spiffe://cluster.local/ns/istio-system/sa/istiod-canary", true},
+		{"wrong service account", "spiffe://cluster.local/ns/istio-system/sa/default", false},
+		{"wrong trust domain", "spiffe://evil.local/ns/istio-system/sa/istiod", false},
+		{"no identity", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verify(nil, issue(tt.identity))
+			if tt.accepted && err != nil {
+				t.Errorf("expected istiod certificate to be accepted: %v", err)
+			}
+			if !tt.accepted && err == nil {
+				t.Error("expected istiod certificate to be rejected")
+			}
+		})
+	}
+	if err := verify(nil, nil); err == nil {
+		t.Error("expected an error without a verified chain")
+	}
+}
+
+// Validates the credentials presented to istiod in each control plane auth mode.
+func TestXdsProxyControlPlaneAuthMode(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t, "ca")
+	rootFile := filepath.Join(dir, "root.pem")
+	if err := ioutil.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("fake-token"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	addr, calls := startTestIstiod(t, ca, caKey)
+
+	for _, tt := range []struct {
+		name       string
+		mode       XDSAuthMode
+		provCert   string
+		clientCert bool
+		token      bool
+	}{
+		{"auto", XDSAuthAuto, "", true, true},
+		{"auto with provisioned certs", XDSAuthAuto, dir, true, false},
+		{"mtls", XDSAuthMTLS, "", true, false},
+		{"token", XDSAuthToken, dir, false, true},
+		{"both", XDSAuthBoth, dir, true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := setupXdsProxy(t)
+			proxy.clientCertProvider = &fakeCertProvider{
+				cert: &tls.Certificate{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey},
+			}
+			agent := proxy.agent
+			agent.proxyConfig.ControlPlaneAuthPolicy = meshconfig.AuthenticationPolicy_MUTUAL_TLS
+			agent.proxyConfig.DiscoveryAddress = addr
+			agent.cfg.XDSRootCerts = rootFile
+			agent.cfg.XDSAuthMode = tt.mode
+			agent.secOpts.JWTPath = tokenFile
+			agent.secOpts.ProvCert = tt.provCert
+
+			opts, err := proxy.buildUpstreamClientDialOpts(agent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := grpc.Dial(addr, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+				t.Fatal(err)
+			}
+			got := <-calls
+			if got.clientCert != tt.clientCert {
+				t.Errorf("client certificate presented: got %v, want %v", got.clientCert, tt.clientCert)
+			}
+			if got.token != tt.token {
+				t.Errorf("token presented: got %v, want %v", got.token, tt.token)
+			}
+		})
+	}
+
+	proxy := setupXdsProxy(t)
+	proxy.agent.cfg.XDSAuthMode = "jwt"
+	if _, err := proxy.buildUpstreamClientDialOpts(proxy.agent); err == nil {
+		t.Error("expected an error for an unknown auth mode")
+	}
+}
+
+// Validates the file mounted certificates and the root CA are read from the configured proxy metadata keys.
+func TestXdsProxyCertMetadataKeys(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t, "ca")
+	rootFile := filepath.Join(dir, "root.pem")
+	if err := ioutil.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	agent := &Agent{
+		proxyConfig: &meshconfig.ProxyConfig{ProxyMetadata: map[string]string{
+			MetadataClientCertKey:   "default-key.pem",
+			MetadataClientCertChain: "default-chain.pem",
+			"CUSTOM_KEY":            "custom-key.pem",
+			"CUSTOM_CHAIN":          "custom-chain.pem",
+		}},
+		cfg:     &AgentConfig{XDSRootCerts: filepath.Join(dir, "missing.pem")},
+		secOpts: &security.Options{FileMountedCerts: true},
+	}
+	proxy := &XdsProxy{}
+	if key, cert := proxy.getCertKeyPaths(agent); key != "default-key.pem" || cert != "default-chain.pem" {
+		t.Errorf("got key %q and certificate %q, want the ones of the default metadata keys", key, cert)
+	}
+	agent.cfg.XDSClientCertKeyMetadata = "CUSTOM_KEY"
+	agent.cfg.XDSClientCertChainMetadata = "CUSTOM_CHAIN"
+	if key, cert := proxy.getCertKeyPaths(agent); key != "custom-key.pem" || cert != "custom-chain.pem" {
+		t.Errorf("got key %q and certificate %q, want the ones of the custom metadata keys", key, cert)
+	}
+
+	// The root CA of FindRootCAForXDS does not exist, the one in the metadata is used instead.
+	if _, err := proxy.getRootCertificate(agent); err == nil {
+		t.Fatal("expected an error for a missing root CA file")
+	}
+	agent.proxyConfig.ProxyMetadata[MetadataXDSRootCert] = rootFile
+	checkRoot := func() {
+		t.Helper()
+		pool, err := proxy.getRootCertificate(agent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newTestLeaf(t, ca, caKey).Verify(x509.VerifyOptions{DNSName: "istiod.istio-system.svc", Roots: pool}); err != nil {
+			t.Errorf("expected the root CA of the metadata to be trusted: %v", err)
+		}
+	}
+	checkRoot()
+	delete(agent.proxyConfig.ProxyMetadata, MetadataXDSRootCert)
+	agent.cfg.XDSRootCertMetadata = "CUSTOM_ROOT"
+	agent.proxyConfig.ProxyMetadata["CUSTOM_ROOT"] = rootFile
+	checkRoot()
+}
+
+// Validates that rotating the root certificate file resets the upstream connection, with dial options trusting
+// the new root certificate.
+func TestXdsProxyResetRotatedRootCert(t *testing.T) {
+	dir := t.TempDir()
+	oldCA, _ := newTestCA(t, "old-ca")
+	newCA, newCAKey := newTestCA(t, "new-ca")
+	rootFile := filepath.Join(dir, "root.pem")
+	writeRoot := func(ca *x509.Certificate) {
+		if err := ioutil.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRoot(oldCA)
+	addr, _ := startTestIstiod(t, newCA, newCAKey)
+
+	proxy := setupXdsProxy(t)
+	proxy.clientCertProvider = &fakeCertProvider{cert: &tls.Certificate{}}
+	proxy.istiodAddress = addr
+	agent := proxy.agent
+	agent.proxyConfig.ControlPlaneAuthPolicy = meshconfig.AuthenticationPolicy_MUTUAL_TLS
+	agent.proxyConfig.DiscoveryAddress = addr
+	agent.cfg.XDSRootCerts = rootFile
+	agent.cfg.XDSAuthMode = XDSAuthMTLS
+	opts, err := proxy.buildUpstreamClientDialOpts(agent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.istiodDialOptions = opts
+
+	check := func() error {
+		conn, err := proxy.dialUpstream()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+		return err
+	}
+	if err := check(); err == nil {
+		t.Fatal("expected istiod to be untrusted before the root certificate rotates")
+	}
+
+	// The proxy handles the resets signaled by the watch of the root certificate file.
+	stop := make(chan struct{})
+	defer close(stop)
+	if err := proxy.initCertificateWatches(agent, stop); err != nil {
+		t.Fatal(err)
+	}
+	writeRoot(newCA)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := check()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected istiod to be trusted after the root certificate rotated: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Validates that each failover address is verified under its own name, rather than the one of the discovery
+// address.
+func TestXdsProxyFailoverTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCA(t, "ca")
+	rootFile := filepath.Join(dir, "root.pem")
+	if err := ioutil.WriteFile(rootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := startTestIstiod(t, ca, caKey)
+
+	// The primary is down, under a name the certificate of istiod is not valid for.
+	l, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 is not available: %v", err)
+	}
+	primary := l.Addr().String()
+	l.Close()
+
+	proxy := setupXdsProxy(t)
+	proxy.clientCertProvider = &fakeCertProvider{cert: &tls.Certificate{}}
+	proxy.istiodAddress = primary
+	proxy.istiodFailoverAddresses = []string{addr}
+	agent := proxy.agent
+	agent.proxyConfig.ControlPlaneAuthPolicy = meshconfig.AuthenticationPolicy_MUTUAL_TLS
+	agent.proxyConfig.DiscoveryAddress = primary
+	agent.cfg.XDSRootCerts = rootFile
+	agent.cfg.XDSAuthMode = XDSAuthMTLS
+	if proxy.istiodDialOptions, proxy.failoverDialOptions, err = proxy.buildUpstreamDialOpts(agent); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := proxy.dialUpstream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := proxy.upstreams.activeAddress(); got != addr {
+		t.Fatalf("expected to fail over to %s, got %s", addr, got)
+	}
+}
+
+// closerFunc is an io.Closer calling itself.
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// istiodCall is the credentials presented on a call to the test istiod.
+type istiodCall struct {
+	token      bool
+	clientCert bool
+}
+
+// startTestIstiod serves the gRPC health service over TLS, with an istiod certificate issued by ca, until the
+// test ends. It returns its address and the credentials presented on each call.
+func startTestIstiod(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) (string, <-chan istiodCall) {
+	t.Helper()
+	serverCert, serverKey := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "istiod"},
+		DNSNames:    []string{"istiod.istio-system.svc"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	calls := make(chan istiodCall, 10)
+	server := grpc.NewServer(
+		grpc.Creds(credentials.NewTLS(&tls.Config{
+			Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+			ClientAuth:   tls.RequestClientCert,
+		})),
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler) (interface{}, error) {
+			var call istiodCall
+			md, _ := metadata.FromIncomingContext(ctx)
+			call.token = len(md.Get("authorization")) > 0
+			if p, ok := peer.FromContext(ctx); ok {
+				if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+					call.clientCert = len(info.State.PeerCertificates) > 0
+				}
+			}
+			calls <- call
+			return handler(ctx, req)
+		}))
+	grpc_health_v1.RegisterHealthServer(server, grpchealth.NewServer())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), calls
+}
+
+func newTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	return newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+}
+
+func newTestLeaf(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	leaf, _ := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "istiod"},
+		DNSNames:    []string{"istiod.istio-system.svc"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	return leaf
+}
+
+// newTestCert issues template with a new key, signed by parent, or self-signed if parent is nil.
+func newTestCert(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+type fakeDNSServer struct {
+	tables chan *nds.NameTable
+}
+
+func (f *fakeDNSServer) UpdateLookupTable(nt *nds.NameTable) {
+	f.tables <- nt
+}
+
+// fakeUpstream is an upstream ADS stream fed with responses by the test.
+type fakeUpstream struct {
+	grpc.ClientStream
+	requests  chan *discovery.DiscoveryRequest
+	responses chan *discovery.DiscoveryResponse
+	// sendDelay slows down each Send.
+	sendDelay time.Duration
+	// header is the response header metadata of istiod.
+	header metadata.MD
+}
+
+func newFakeUpstream() *fakeUpstream {
+	return &fakeUpstream{
+		requests:  make(chan *discovery.DiscoveryRequest, 100),
+		responses: make(chan *discovery.DiscoveryResponse, 100),
+	}
+}
+
+func (u *fakeUpstream) Send(req *discovery.DiscoveryRequest) error {
+	time.Sleep(u.sendDelay)
+	u.requests <- req
+	return nil
+}
+
+func (u *fakeUpstream) Recv() (*discovery.DiscoveryResponse, error) {
+	resp, ok := <-u.responses
+	if !ok {
+		return nil, io.EOF
+	}
+	return resp, nil
+}
+
+func (u *fakeUpstream) CloseSend() error {
+	return nil
+}
+
+func (u *fakeUpstream) Header() (metadata.MD, error) {
+	return u.header, nil
+}
+
+type fakeADSClient struct {
+	upstream *fakeUpstream
+	// err, if set, fails opening the stream.
+	err error
+	// ctx and outgoing are the context and metadata the stream was opened with.
+	ctx      context.Context
+	outgoing metadata.MD
+}
+
+func (c *fakeADSClient) StreamAggregatedResources(ctx context.Context,
+	_ ...grpc.CallOption) (discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient, error) {
+	c.ctx = ctx
+	c.outgoing, _ = metadata.FromOutgoingContext(ctx)
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.upstream, nil
+}
+
+func (c *fakeADSClient) DeltaAggregatedResources(context.Context,
+	...grpc.CallOption) (discovery.AggregatedDiscoveryService_DeltaAggregatedResourcesClient, error) {
+	return nil, errors.New("not implemented")
+}
+
+// fakeDownstream is an Envoy stream recording the responses sent to it. Sends wait for block to be closed, if set,
+// and fail with err, if set.
+type fakeDownstream struct {
+	grpc.ServerStream
+	sent  chan *discovery.DiscoveryResponse
+	block chan struct{}
+	err   error
+}
+
+func (d *fakeDownstream) Send(resp *discovery.DiscoveryResponse) error {
+	if d.block != nil {
+		<-d.block
+	}
+	if d.err != nil {
+		return d.err
+	}
+	d.sent <- resp
+	return nil
+}
+
+func (d *fakeDownstream) Recv() (*discovery.DiscoveryRequest, error) {
+	select {}
+}
+
+// serveDiscovery serves the fake discovery server over a real TCP listener on addr, returning the bound address.
+func serveDiscovery(t *testing.T, f *xds.FakeDiscoveryServer, addr string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	t.Cleanup(grpcServer.Stop)
+	f.Discovery.Register(grpcServer)
+	go grpcServer.Serve(listener)
+	return addr
+}
+
 func stream(t *testing.T, conn *grpc.ClientConn) discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient {
 	t.Helper()
 	adsClient := discovery.NewAggregatedDiscoveryServiceClient(conn)
@@ -175,9 +2473,14 @@ func stream(t *testing.T, conn *grpc.ClientConn) discovery.AggregatedDiscoverySe
 }
 
 func sendDownstream(t *testing.T, downstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient) {
+	t.Helper()
+	sendDownstreamWithType(t, downstream, v3.ClusterType)
+}
+
+func sendDownstreamWithType(t *testing.T, downstream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient, typeURL string) {
 	t.Helper()
 	err := downstream.Send(&discovery.DiscoveryRequest{
-		TypeUrl: v3.ClusterType,
+		TypeUrl: typeURL,
 		Node: &core.Node{
 			Id: "sidecar~0.0.0.0~debug~cluster.local",
 		},
@@ -189,8 +2492,8 @@ func sendDownstream(t *testing.T, downstream discovery.AggregatedDiscoveryServic
 	if err != nil {
 		t.Fatal(err)
 	}
-	if res == nil || res.TypeUrl != v3.ClusterType {
-		t.Fatalf("Expected to get cluster response but got %v", res)
+	if res == nil || res.TypeUrl != typeURL {
+		t.Fatalf("Expected to get %s response but got %v", typeURL, res)
 	}
 }
 
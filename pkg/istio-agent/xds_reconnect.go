@@ -0,0 +1,142 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// sentRequests remembers the last request sent upstream for each type URL, so that a new upstream stream
+// can pick up the subscriptions of the one istiod closed, and so that they can be resynced in full.
+// A nil sentRequests records nothing.
+// It is only used by the goroutine handling the upstream.
+type sentRequests struct {
+	// node is the node Envoy identified itself with on its first request.
+	node *core.Node
+	// last is the last request of each type URL, typeURLs the type URLs in the order first requested.
+	last     map[string]*discovery.DiscoveryRequest
+	typeURLs []string
+}
+
+func newSentRequests() *sentRequests {
+	return &sentRequests{last: map[string]*discovery.DiscoveryRequest{}}
+}
+
+func (s *sentRequests) record(req *discovery.DiscoveryRequest) {
+	if s == nil {
+		return
+	}
+	if req.Node != nil && s.node == nil {
+		s.node = req.Node
+	}
+	if _, f := s.last[req.TypeUrl]; !f {
+		s.typeURLs = append(s.typeURLs, req.TypeUrl)
+	}
+	s.last[req.TypeUrl] = req
+}
+
+// replay returns the requests opening the same subscriptions on a new stream. They keep the versions and
+// resource names, but the nonces of the previous istiod mean nothing to the new one. The first carries the node.
+func (s *sentRequests) replay() []*discovery.DiscoveryRequest {
+	if s == nil {
+		return nil
+	}
+	out := make([]*discovery.DiscoveryRequest, 0, len(s.typeURLs))
+	for _, typeURL := range dependencyOrder(s.typeURLs) {
+		req := proto.Clone(s.last[typeURL]).(*discovery.DiscoveryRequest)
+		req.ResponseNonce = ""
+		req.ErrorDetail = nil
+		req.Node = nil
+		if len(out) == 0 {
+			req.Node = s.node
+		}
+		out = append(out, req)
+	}
+	return out
+}
+
+// typeDependencyOrder ranks the type URLs in the order Envoy warms up the resources of an ADS stream: clusters,
+// their endpoints, then listeners and their routes.
+var typeDependencyOrder = map[string]int{
+	v3.ClusterType:  0,
+	v3.EndpointType: 1,
+	v3.ListenerType: 2,
+	v3.RouteType:    3,
+}
+
+// dependencyOrder returns typeURLs in the order Envoy warms up their resources, so that the requests sent on its
+// behalf do not get responses for resources depending on others it does not have yet, which it would NACK. The
+// other type URLs come last, in the order given.
+func dependencyOrder(typeURLs []string) []string {
+	rank := func(typeURL string) int {
+		if r, f := typeDependencyOrder[typeURL]; f {
+			return r
+		}
+		return len(typeDependencyOrder)
+	}
+	out := append([]string(nil), typeURLs...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return rank(out[i]) < rank(out[j])
+	})
+	return out
+}
+
+// reconnectedUpstream is the stream to the istiod the proxy reconnected to, or the error reconnecting.
+type reconnectedUpstream struct {
+	upstream    discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	correlation *xdsCorrelation
+	closer      io.Closer
+	err         error
+}
+
+// reconnectUpstream opens a new stream to istiod, once the previous one was closed by istiod. The istiod that
+// closed it is likely going away, so the other addresses are tried first.
+func (p *XdsProxy) reconnectUpstream(ctx context.Context) reconnectedUpstream {
+	if addr := p.upstreams.activeAddress(); addr != "" {
+		p.upstreams.markDown(addr)
+	}
+	// Like any connection to istiod, within the retry budget and the circuit breaker.
+	if p.retryBudget != nil {
+		if err := p.retryBudget.wait(ctx); err != nil {
+			return reconnectedUpstream{err: err}
+		}
+	}
+	if p.breaker != nil && !p.breaker.allow() {
+		metrics.IstiodConnectionShortCircuits.Increment()
+		return reconnectedUpstream{err: errors.New("istiod connections are suspended after consecutive failures")}
+	}
+	xds, closer, err := p.newUpstreamClient()
+	if err != nil {
+		p.reportUpstreamOutcome(err)
+		return reconnectedUpstream{err: err}
+	}
+	upstream, correlation, err := p.openUpstream(ctx, xds)
+	p.reportUpstreamOutcome(err)
+	if err != nil {
+		_ = closer.Close()
+		return reconnectedUpstream{err: err}
+	}
+	return reconnectedUpstream{upstream: upstream, correlation: correlation, closer: closer}
+}
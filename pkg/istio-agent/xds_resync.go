@@ -0,0 +1,63 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"net/http"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/golang/protobuf/proto"
+)
+
+// Resync asks istiod to send the full state of every subscription of the current upstream stream again, for
+// instance when the configuration of Envoy is suspected to have drifted from istiod's. It is sent on the current
+// upstream connection, or the next one. Resyncs requested while one is pending are coalesced.
+//
+// The proxy only forwards state of the world streams, so there is no incremental state of its own to drop:
+// requesting each type URL without version or nonce is enough for istiod to push everything again.
+func (p *XdsProxy) Resync() {
+	select {
+	case p.resync <- struct{}{}:
+	default:
+		proxyLog.Debugf("resync already pending")
+	}
+}
+
+func (p *XdsProxy) serveResync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	p.Resync()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// resync returns the requests asking for the full state of the same subscriptions on the current stream. They
+// keep the resource names, but drop the versions and nonces so that istiod considers nothing as already sent.
+func (s *sentRequests) resync() []*discovery.DiscoveryRequest {
+	if s == nil {
+		return nil
+	}
+	out := make([]*discovery.DiscoveryRequest, 0, len(s.typeURLs))
+	for _, typeURL := range dependencyOrder(s.typeURLs) {
+		req := proto.Clone(s.last[typeURL]).(*discovery.DiscoveryRequest)
+		req.VersionInfo = ""
+		req.ResponseNonce = ""
+		req.ErrorDetail = nil
+		req.Node = nil
+		out = append(out, req)
+	}
+	return out
+}
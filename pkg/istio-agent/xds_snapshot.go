@@ -0,0 +1,146 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProxySnapshot is the state of the XDS proxy, served as JSON on /debug/xds-proxy for istioctl.
+type ProxySnapshot struct {
+	// UpstreamAddress is the address of the istiod the proxy last connected to.
+	UpstreamAddress string `json:"upstreamAddress,omitempty"`
+	// ConnectionState is the state of the connection to istiod, and ConnectionReason the reason of the last
+	// transition, at LastTransition.
+	ConnectionState  string    `json:"connectionState"`
+	ConnectionReason string    `json:"connectionReason,omitempty"`
+	LastTransition   time.Time `json:"lastTransition,omitempty"`
+	// LastDisconnectReason is why the connection to istiod was last lost, or handed over to another istiod.
+	LastDisconnectReason string `json:"lastDisconnectReason,omitempty"`
+	// Streams is the number of Envoy streams served.
+	Streams int `json:"streams"`
+	// SubscribedTypes are the type URLs requested from istiod over the current connection, sorted.
+	SubscribedTypes []string `json:"subscribedTypes,omitempty"`
+	// AgentSubscriptions are the type URLs the agent subsystems subscribed to, sorted.
+	AgentSubscriptions []string `json:"agentSubscriptions,omitempty"`
+	// NameTableVersion is the version of the last name table received from istiod.
+	NameTableVersion string `json:"nameTableVersion,omitempty"`
+}
+
+// proxyState tracks the state of the XDS proxy not kept anywhere else, for its snapshots. It is updated from
+// the goroutines serving the connections.
+type proxyState struct {
+	mu sync.Mutex
+	// seen is set once the connection made its first transition, the proxy is disconnected until then.
+	seen                 bool
+	state                ConnectionState
+	reason               string
+	since                time.Time
+	lastDisconnectReason string
+	subscribed           map[string]struct{}
+	nameTableVersion     string
+}
+
+// transition records the connection to istiod moved to state. A new connection starts with no subscription.
+func (s *proxyState) transition(state ConnectionState, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen = true
+	s.state, s.reason, s.since = state, reason, time.Now()
+	switch state {
+	case ConnectionConnected:
+		s.subscribed = nil
+	case ConnectionReconnecting, ConnectionDisconnected:
+		s.lastDisconnectReason = reason
+	}
+}
+
+// requested records a request for typeURL was sent to istiod.
+func (s *proxyState) requested(typeURL string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscribed == nil {
+		s.subscribed = map[string]struct{}{}
+	}
+	s.subscribed[typeURL] = struct{}{}
+}
+
+// nameTable records the version of the name table received from istiod.
+func (s *proxyState) nameTable(version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nameTableVersion = version
+}
+
+// Snapshot returns the current state of the proxy.
+func (p *XdsProxy) Snapshot() ProxySnapshot {
+	p.state.mu.Lock()
+	snapshot := ProxySnapshot{
+		ConnectionState:      ConnectionDisconnected.String(),
+		LastDisconnectReason: p.state.lastDisconnectReason,
+		NameTableVersion:     p.state.nameTableVersion,
+		SubscribedTypes:      sortedKeys(p.state.subscribed),
+	}
+	if p.state.seen {
+		snapshot.ConnectionState = p.state.state.String()
+		snapshot.ConnectionReason = p.state.reason
+		snapshot.LastTransition = p.state.since
+	}
+	p.state.mu.Unlock()
+
+	if p.upstreams != nil {
+		snapshot.UpstreamAddress = p.upstreams.activeAddress()
+	}
+	p.connectedMutex.RLock()
+	if p.downstreams != nil {
+		snapshot.Streams = len(p.downstreams)
+	} else if p.connected != nil {
+		snapshot.Streams = 1
+	}
+	p.connectedMutex.RUnlock()
+	p.subscriptionsMutex.RLock()
+	for typeURL := range p.subscriptions {
+		snapshot.AgentSubscriptions = append(snapshot.AgentSubscriptions, typeURL)
+	}
+	p.subscriptionsMutex.RUnlock()
+	sort.Strings(snapshot.AgentSubscriptions)
+	return snapshot
+}
+
+func (p *XdsProxy) serveSnapshot(w http.ResponseWriter, _ *http.Request) {
+	b, err := json.MarshalIndent(p.Snapshot(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,96 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// Validates the snapshot served for istioctl reflects the upstream and the state of the connection to it.
+func TestXdsProxySnapshot(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	snapshot := func() ProxySnapshot {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		proxy.debugHandlers()["/debug/xds-proxy"].ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/xds-proxy", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", rec.Code, rec.Body.String())
+		}
+		var s ProxySnapshot
+		if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	waitFor := func(desc string, ok func(ProxySnapshot) bool) ProxySnapshot {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			s := snapshot()
+			if ok(s) {
+				return s
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the snapshot to %s, got %+v", desc, s)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if s := snapshot(); s.ConnectionState != "disconnected" || s.Streams != 0 || s.UpstreamAddress != "" {
+		t.Fatalf("expected a disconnected proxy without streams, got %+v", s)
+	}
+
+	// A dial to istiod records the address connected to.
+	proxy.upstreams.connected("istiod.istio-system.svc:15012")
+	upstream := newFakeUpstream()
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	proxy.RegisterStream(con)
+	done := make(chan error, 1)
+	go func() { done <- proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream}) }()
+	con.requestsChan <- &upstreamRequest{req: &discovery.DiscoveryRequest{TypeUrl: v3.ClusterType}, fromEnvoy: true}
+	<-upstream.requests
+
+	s := waitFor("show the cluster subscription", func(s ProxySnapshot) bool {
+		return len(s.SubscribedTypes) > 0
+	})
+	if s.ConnectionState != "connected" || s.UpstreamAddress != "istiod.istio-system.svc:15012" || s.Streams != 1 {
+		t.Fatalf("expected a stream connected to istiod.istio-system.svc:15012, got %+v", s)
+	}
+	if !reflect.DeepEqual(s.SubscribedTypes, []string{v3.ClusterType}) {
+		t.Fatalf("expected the cluster subscription, got %v", s.SubscribedTypes)
+	}
+
+	// istiod closes the stream.
+	close(upstream.responses)
+	<-done
+	s = waitFor("be disconnected", func(s ProxySnapshot) bool {
+		return s.ConnectionState == "disconnected"
+	})
+	if s.LastDisconnectReason == "" {
+		t.Fatalf("expected the reason of the disconnect, got %+v", s)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+// ConnectionState is the state of the connection of the XDS proxy to istiod.
+type ConnectionState int
+
+const (
+	// ConnectionConnecting is the state while the proxy opens a connection to istiod for an Envoy stream.
+	ConnectionConnecting ConnectionState = iota
+	// ConnectionConnected is the state once the stream to istiod is open.
+	ConnectionConnected
+	// ConnectionReconnecting is the state while the proxy opens a new stream to another istiod, after istiod
+	// closed the previous one.
+	ConnectionReconnecting
+	// ConnectionDisconnected is the state once the connection to istiod failed or was torn down.
+	ConnectionDisconnected
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionConnecting:
+		return "connecting"
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionReconnecting:
+		return "reconnecting"
+	case ConnectionDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectionObserver is told of each transition of the connection to istiod, with the reason of the transition.
+// It is called from the goroutines serving the connections, so it must not block.
+type ConnectionObserver func(state ConnectionState, reason string)
+
+// ObserveConnection registers an observer of the transitions of the connection to istiod.
+func (p *XdsProxy) ObserveConnection(observer ConnectionObserver) {
+	p.observersMutex.Lock()
+	defer p.observersMutex.Unlock()
+	p.observers = append(p.observers, observer)
+}
+
+// notifyConnection tells the observers the connection to istiod moved to state.
+func (p *XdsProxy) notifyConnection(state ConnectionState, reason string) {
+	p.state.transition(state, reason)
+	p.observersMutex.RLock()
+	observers := p.observers
+	p.observersMutex.RUnlock()
+	for _, observer := range observers {
+		observer(state, reason)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"sync"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	"istio.io/istio/pkg/istio-agent/metrics"
+)
+
+// TeeSink receives copies of the responses forwarded to Envoy, for instance to archive the configuration the data
+// plane received. It is called from its own goroutine, one response at a time, in the order they are forwarded.
+// The responses are shared with Envoy's stream, so they must not be modified.
+type TeeSink func(resp *discovery.DiscoveryResponse)
+
+// responseTee queues the responses of its type URLs for its sink.
+type responseTee struct {
+	typeURLs map[string]struct{}
+	queue    chan *discovery.DiscoveryResponse
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Tee delivers the responses for typeURLs forwarded to Envoy to sink too. Up to buffer responses are queued for
+// the sink, the ones beyond are dropped rather than holding up Envoy. The returned function stops the deliveries.
+func (p *XdsProxy) Tee(sink TeeSink, buffer int, typeURLs ...string) func() {
+	t := &responseTee{
+		typeURLs: make(map[string]struct{}, len(typeURLs)),
+		queue:    make(chan *discovery.DiscoveryResponse, buffer),
+		stop:     make(chan struct{}),
+	}
+	for _, typeURL := range typeURLs {
+		t.typeURLs[typeURL] = struct{}{}
+	}
+	go func() {
+		for {
+			select {
+			case resp := <-t.queue:
+				sink(resp)
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+
+	p.teesMutex.Lock()
+	p.tees = append(p.tees, t)
+	p.teesMutex.Unlock()
+	return func() {
+		t.stopOnce.Do(func() {
+			p.teesMutex.Lock()
+			defer p.teesMutex.Unlock()
+			for i, other := range p.tees {
+				if other == t {
+					p.tees = append(p.tees[:i:i], p.tees[i+1:]...)
+					break
+				}
+			}
+			close(t.stop)
+		})
+	}
+}
+
+// teeResponse queues resp for the tees of its type URL, without blocking.
+func (p *XdsProxy) teeResponse(resp *discovery.DiscoveryResponse) {
+	p.teesMutex.RLock()
+	defer p.teesMutex.RUnlock()
+	for _, t := range p.tees {
+		if _, f := t.typeURLs[resp.TypeUrl]; !f {
+			continue
+		}
+		select {
+		case t.queue <- resp:
+		default:
+			metrics.XdsProxyTeeDrops.With(metrics.TypeURLTag.Value(resp.TypeUrl)).Increment()
+		}
+	}
+}
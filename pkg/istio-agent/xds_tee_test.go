@@ -0,0 +1,99 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package istioagent
+
+import (
+	"testing"
+	"time"
+
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+
+	v3 "istio.io/istio/pilot/pkg/xds/v3"
+)
+
+// Validates that the teed types are delivered to the sink, while Envoy still receives every response.
+func TestXdsProxyTee(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	teed := make(chan *discovery.DiscoveryResponse, 10)
+	stop := proxy.Tee(func(resp *discovery.DiscoveryResponse) { teed <- resp }, 10, v3.ListenerType)
+	defer stop()
+	upstream := newFakeUpstream()
+	defer close(upstream.responses)
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType, Nonce: "cds"}
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ListenerType, Nonce: "lds"}
+	for _, nonce := range []string{"cds", "lds"} {
+		select {
+		case resp := <-downstream.sent:
+			if resp.Nonce != nonce {
+				t.Fatalf("expected Envoy to receive %s, got %v", nonce, resp)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Envoy did not receive %s", nonce)
+		}
+	}
+	select {
+	case resp := <-teed:
+		if resp.Nonce != "lds" {
+			t.Fatalf("expected only the listeners to be teed, got %v", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listeners were not teed")
+	}
+
+	stop()
+	upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ListenerType, Nonce: "after-stop"}
+	<-downstream.sent
+	select {
+	case resp := <-teed:
+		t.Fatalf("unexpected response teed after stop: %v", resp)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Validates that a sink not keeping up drops the responses beyond its buffer, rather than holding up Envoy.
+func TestXdsProxyTeeDropsWhenFull(t *testing.T) {
+	proxy := setupXdsProxy(t)
+	block := make(chan struct{})
+	defer close(block)
+	stop := proxy.Tee(func(*discovery.DiscoveryResponse) { <-block }, 1, v3.ClusterType)
+	defer stop()
+	upstream := newFakeUpstream()
+	defer close(upstream.responses)
+	downstream := &fakeDownstream{sent: make(chan *discovery.DiscoveryResponse, 10)}
+	con := newProxyConnection(downstream)
+	defer close(con.done)
+	go proxy.HandleUpstream(ctx, con, &fakeADSClient{upstream: upstream})
+
+	drops := counterValue(t, "xds_proxy_tee_drops")
+	for i := 0; i < 5; i++ {
+		upstream.responses <- &discovery.DiscoveryResponse{TypeUrl: v3.ClusterType}
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-downstream.sent:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Envoy received %d responses out of 5 while the sink was blocked", i)
+		}
+	}
+	// The sink holds one response and its buffer another, the others are dropped.
+	if got := counterValue(t, "xds_proxy_tee_drops") - drops; got < 3 {
+		t.Errorf("expected at least 3 drops, got %v", got)
+	}
+}
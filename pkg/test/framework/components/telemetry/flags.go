@@ -24,9 +24,12 @@ var (
 	RetryDelay time.Duration
 	// RetryTimeout is the retry timeout used in tests.
 	RetryTimeout time.Duration
+	// RetryJitter is the fraction of the retry delay added at random to each delay in tests.
+	RetryJitter float64
 )
 
 func init() {
 	flag.DurationVar(&RetryDelay, "istio.test.telemetry.retryDelay", time.Second*3, "Default retry delay used in tests")
 	flag.DurationVar(&RetryTimeout, "istio.test.telemetry.retryTimeout", time.Second*80, "Default retry timeout used in tests")
+	flag.Float64Var(&RetryJitter, "istio.test.telemetry.retryJitter", 0, "Default retry jitter used in tests, as a fraction of the retry delay")
 }
@@ -17,6 +17,7 @@ package retry
 import (
 	"errors"
 	"fmt"
+	"math/rand"
 	"time"
 
 	"istio.io/istio/pkg/test"
@@ -43,9 +44,18 @@ type config struct {
 	error    string
 	timeout  time.Duration
 	delay    time.Duration
+	jitter   float64
 	converge int
 }
 
+// nextDelay returns the delay before the next attempt, with the jitter added.
+func (c config) nextDelay() time.Duration {
+	if c.jitter <= 0 {
+		return c.delay
+	}
+	return c.delay + time.Duration(rand.Float64()*c.jitter*float64(c.delay))
+}
+
 // Option for a retry operation.
 type Option func(cfg *config)
 
@@ -63,6 +73,14 @@ func Delay(delay time.Duration) Option {
 	}
 }
 
+// Jitter adds a random duration of up to the given fraction of the delay to each delay between attempts, so
+// that concurrent retries of the same operation do not stay in lockstep.
+func Jitter(fraction float64) Option {
+	return func(cfg *config) {
+		cfg.jitter = fraction
+	}
+}
+
 // Converge sets the number of successes in a row needed to count a success.
 // This is useful to avoid the case where tests like `coin.Flip() == HEADS` will always
 // return success due to random variance.
@@ -183,7 +201,7 @@ func Do(fn RetriableFunc, options ...Option) (interface{}, error) {
 				convergeStr = fmt.Sprintf(", %d/%d successes", successes, cfg.converge)
 			}
 			return nil, fmt.Errorf("timeout while waiting after %d attempts%s (last error: %v)", attempts, convergeStr, lasterr)
-		case <-time.After(cfg.delay):
+		case <-time.After(cfg.nextDelay()):
 		}
 
 	}
@@ -49,3 +49,26 @@ func TestConverge(t *testing.T) {
 		}
 	})
 }
+
+func TestJitter(t *testing.T) {
+	cfg := defaultConfig
+	for _, option := range []Option{Delay(time.Second), Jitter(0.5)} {
+		option(&cfg)
+	}
+	seen := map[time.Duration]struct{}{}
+	for i := 0; i < 100; i++ {
+		d := cfg.nextDelay()
+		if d < time.Second || d > time.Second*3/2 {
+			t.Fatalf("delay %v out of the jitter range", d)
+		}
+		seen[d] = struct{}{}
+	}
+	if len(seen) < 2 {
+		t.Fatal("expected the delays to vary")
+	}
+
+	cfg.jitter = 0
+	if d := cfg.nextDelay(); d != time.Second {
+		t.Fatalf("expected the delay without jitter, got %v", d)
+	}
+}
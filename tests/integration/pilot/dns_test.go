@@ -0,0 +1,142 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pilot
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/echo"
+	"istio.io/istio/pkg/test/util/retry"
+	"istio.io/istio/tests/integration/pilot/common"
+)
+
+var (
+	kdigStatus = regexp.MustCompile(`status: ([A-Z]+)`)
+	kdigRecord = regexp.MustCompile(`(?m)^(\S+)\s+(\d+)\s+IN\s+(A|CNAME)\s+(\S+)$`)
+)
+
+// dnsAnswer is the result of a query sent from inside a pod.
+type dnsAnswer struct {
+	status string
+	// records are the answers, as "name type data"
+	records []string
+}
+
+// TestDNSCapture checks that the DNS queries of the apps are answered by the agent, from the name table of istiod,
+// and that the names it does not know are forwarded to the cluster nameserver.
+func TestDNSCapture(t *testing.T) {
+	framework.
+		NewTest(t).
+		Features("traffic.dns.capture").
+		Run(func(ctx framework.TestContext) {
+			ns := apps.Namespace.Name()
+			fqdn := fmt.Sprintf("%s.%s.svc.cluster.local.", common.PodBSvc, ns)
+			for _, client := range apps.PodA {
+				client := client
+				ctx.NewSubTest(fmt.Sprintf("from %s", client.Config().Cluster.Name())).Run(func(ctx framework.TestContext) {
+					svc, err := client.Config().Cluster.CoreV1().Services(ns).Get(context.TODO(), common.PodBSvc, metav1.GetOptions{})
+					if err != nil {
+						ctx.Fatal(err)
+					}
+					clusterIP := svc.Spec.ClusterIP
+					cases := []struct {
+						name string
+						host string
+						// expected answer, unless the status is not NOERROR
+						status  string
+						records []string
+					}{
+						{
+							name:    "fqdn",
+							host:    fqdn,
+							status:  "NOERROR",
+							records: []string{fqdn + " A " + clusterIP},
+						},
+						{
+							// The cluster nameserver does not know about the shortname as an absolute name,
+							// only the agent answers it.
+							name:    "shortname",
+							host:    common.PodBSvc + ".",
+							status:  "NOERROR",
+							records: []string{common.PodBSvc + ". A " + clusterIP},
+						},
+						{
+							// The agent short circuits the search namespaces with a CNAME.
+							name:   "fqdn expanded with the search namespace",
+							host:   fqdn + ns + ".svc.cluster.local.",
+							status: "NOERROR",
+							records: []string{
+								fqdn + ns + ".svc.cluster.local. CNAME " + fqdn,
+								fqdn + " A " + clusterIP,
+							},
+						},
+						{
+							// Not in the name table, forwarded upstream.
+							name:   "unknown name",
+							host:   fmt.Sprintf("nonexistent.%s.svc.cluster.local.", ns),
+							status: "NXDOMAIN",
+						},
+					}
+					for _, tt := range cases {
+						tt := tt
+						ctx.NewSubTest(tt.name).Run(func(ctx framework.TestContext) {
+							retry.UntilSuccessOrFail(ctx, func() error {
+								got, err := resolve(client, tt.host)
+								if err != nil {
+									return err
+								}
+								if got.status != tt.status {
+									return fmt.Errorf("expected status %s for %s, got %s", tt.status, tt.host, got.status)
+								}
+								if tt.status == "NOERROR" && strings.Join(got.records, "\n") != strings.Join(tt.records, "\n") {
+									return fmt.Errorf("expected answers %v for %s, got %v", tt.records, tt.host, got.records)
+								}
+								return nil
+							}, retry.Converge(3))
+						})
+					}
+				})
+			}
+		})
+}
+
+// resolve queries host from the app container of client, whose DNS traffic is captured by the sidecar.
+func resolve(client echo.Instance, host string) (dnsAnswer, error) {
+	workloads, err := client.Workloads()
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+	out, stderr, err := client.Config().Cluster.PodExec(workloads[0].PodName(), client.Config().Namespace.Name(),
+		"app", "kdig "+host+" A")
+	if err != nil {
+		return dnsAnswer{}, fmt.Errorf("failed to resolve %s: %v: %s", host, err, stderr)
+	}
+	status := kdigStatus.FindStringSubmatch(out)
+	if status == nil {
+		return dnsAnswer{}, fmt.Errorf("no status in the answer for %s: %s", host, out)
+	}
+	answer := dnsAnswer{status: status[1]}
+	for _, rr := range kdigRecord.FindAllStringSubmatch(out, -1) {
+		answer.records = append(answer.records, rr[1]+" "+rr[3]+" "+rr[4])
+	}
+	return answer, nil
+}
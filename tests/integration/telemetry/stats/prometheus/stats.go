@@ -74,8 +74,9 @@ func GetServerInstances() echo.Instances {
 }
 
 // TestStatsFilter includes common test logic for stats and mx exchange filters running
-// with nullvm and wasm runtime.
-func TestStatsFilter(t *testing.T, feature features.Feature) {
+// with nullvm and wasm runtime. The retry of the traffic and query loop defaults to the telemetry
+// retry flags; opts override them.
+func TestStatsFilter(t *testing.T, feature features.Feature, opts ...retry.Option) {
 	framework.NewTest(t).
 		Features(feature).
 		Run(func(ctx framework.TestContext) {
@@ -106,7 +107,7 @@ func TestStatsFilter(t *testing.T, feature features.Feature) {
 						}
 
 						return nil
-					}, retry.Delay(telemetry.RetryDelay), retry.Timeout(telemetry.RetryTimeout))
+					}, retryOptions(opts)...)
 					if err != nil {
 						return err
 					}
@@ -116,12 +117,20 @@ func TestStatsFilter(t *testing.T, feature features.Feature) {
 			if err := g.Wait(); err != nil {
 				t.Fatalf("test failed: %v", err)
 			}
+
+			// The server never calls the client, so the series of such requests must not exist.
+			for _, cltInstance := range client {
+				c := cltInstance.Config().Cluster
+				if err := QueryPrometheusExpectEmpty(t, c, buildBogusQuery(), GetPromInstance()); err != nil {
+					t.Errorf("test failed: %v", err)
+				}
+			}
 		})
 }
 
 // TestStatsTCPFilter includes common test logic for stats and mx exchange filters running
-// with nullvm and wasm runtime for TCP.
-func TestStatsTCPFilter(t *testing.T, feature features.Feature) {
+// with nullvm and wasm runtime for TCP. opts override the default retry of the traffic and query loop.
+func TestStatsTCPFilter(t *testing.T, feature features.Feature, opts ...retry.Option) {
 	framework.NewTest(t).
 		Features(feature).
 		Run(func(ctx framework.TestContext) {
@@ -142,7 +151,7 @@ func TestStatsTCPFilter(t *testing.T, feature features.Feature) {
 						}
 
 						return nil
-					}, retry.Delay(telemetry.RetryDelay), retry.Timeout(telemetry.RetryTimeout))
+					}, retryOptions(opts)...)
 					if err != nil {
 						return err
 					}
@@ -155,6 +164,16 @@ func TestStatsTCPFilter(t *testing.T, feature features.Feature) {
 		})
 }
 
+// retryOptions returns the retry options of the traffic and query loop: the telemetry retry flags,
+// followed by the given overrides.
+func retryOptions(overrides []retry.Option) []retry.Option {
+	return append([]retry.Option{
+		retry.Delay(telemetry.RetryDelay),
+		retry.Timeout(telemetry.RetryTimeout),
+		retry.Jitter(telemetry.RetryJitter),
+	}, overrides...)
+}
+
 // TestSetup set up echo app for stats testing.
 func TestSetup(ctx resource.Context) (err error) {
 	appNsInst, err = namespace.New(ctx, namespace.Config{
@@ -267,6 +286,13 @@ func buildQuery() (sourceQuery, destinationQuery, appQuery string) {
 	return BuildQueryCommon(labels, ns.Name())
 }
 
+// buildBogusQuery returns a query for requests from the server to the client, which no traffic matches.
+func buildBogusQuery() string {
+	ns := GetAppNamespace()
+	return fmt.Sprintf(`istio_requests_total{reporter="source",source_app="server",destination_app="client",source_workload_namespace=%q}`,
+		ns.Name())
+}
+
 func buildTCPQuery() (destinationQuery string) {
 	ns := GetAppNamespace()
 	destinationQuery = `istio_tcp_connections_opened_total{reporter="destination",`
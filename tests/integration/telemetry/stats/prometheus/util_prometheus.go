@@ -16,11 +16,14 @@
 package prometheus
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/prometheus/common/model"
+
 	"istio.io/istio/pkg/test/framework/resource"
 
 	"istio.io/istio/pkg/test/framework/components/prometheus"
@@ -59,6 +62,36 @@ func QueryFirstPrometheus(t *testing.T, cluster resource.Cluster, query string,
 	return nil
 }
 
+const (
+	// emptyQueryDuration is how long a query must stay empty, a couple of scrape intervals.
+	emptyQueryDuration = 30 * time.Second
+	emptyQueryDelay    = 5 * time.Second
+	// emptyQueryTimeout bounds the wait for the query to stay empty, including failed queries.
+	emptyQueryTimeout = 2 * time.Minute
+)
+
+// QueryPrometheusExpectEmpty queries prometheus until the query stayed empty for a couple of scrape intervals,
+// and returns an error if it does not within emptyQueryTimeout. A single empty result proves little, as series
+// only show up once scraped. Any sample, as well as a failed query, restarts the wait.
+func QueryPrometheusExpectEmpty(t *testing.T, cluster resource.Cluster, query string, promInst prometheus.Instance) error {
+	t.Logf("query prometheus expecting no samples with: %v", query)
+	return retry.UntilSuccess(func() error {
+		val, _, err := promInst.APIForCluster(cluster).Query(context.Background(), query, time.Now())
+		if err != nil {
+			return fmt.Errorf("error querying Prometheus: %v", err)
+		}
+		vector, ok := val.(model.Vector)
+		if !ok {
+			return fmt.Errorf("unexpected value type %v (query: %q)", val.Type(), query)
+		}
+		if len(vector) > 0 {
+			return fmt.Errorf("expected no samples, got: %s (query: %q)", vector.String(), query)
+		}
+		return nil
+	}, retry.Converge(int(emptyQueryDuration/emptyQueryDelay)), retry.Delay(emptyQueryDelay),
+		retry.Timeout(emptyQueryTimeout))
+}
+
 func ValidateMetric(t *testing.T, cluster resource.Cluster, prometheus prometheus.Instance, query, metricName string, want float64) {
 	var got float64
 	retry.UntilSuccessOrFail(t, func() error {
@@ -32,6 +32,9 @@ import (
 
 var otelInst opentelemetry.Instance
 
+// propagationFormats are the trace context propagation formats the proxies are configured with.
+var propagationFormats = []tracing.PropagationFormat{tracing.B3, tracing.W3CTraceContext}
+
 // TestProxyTracing exercises the trace generation features of Istio, based on
 // the Envoy Trace driver for OpenCensusAgent. This test creates an
 // OpenTelemetry collector and a zipkin instance. Spans are forwarded from the
@@ -70,6 +73,48 @@ func TestProxyTracing(t *testing.T) {
 		})
 }
 
+// TestClientTracing exercises the propagation of client trace contexts by the Envoy Trace driver for
+// OpenCensusAgent. For each configured propagation format, the test sends requests carrying a sampled trace
+// context in that format, and verifies that the resulting traces continue from the span of the client.
+func TestClientTracing(t *testing.T) {
+	framework.NewTest(t).
+		Features("observability.telemetry.tracing.client").
+		Run(func(ctx framework.TestContext) {
+			appNsInst := tracing.GetAppNamespace()
+			for _, format := range propagationFormats {
+				format := format
+				for _, cl := range ctx.Clusters() {
+					clName := cl.Name()
+					t.Run(fmt.Sprintf("%s/%s", format, clName), func(t *testing.T) {
+						if cl.NetworkName() != ctx.Clusters().Default().NetworkName() {
+							t.Skip("tracing fails on cross-network client; see https://github.com/istio/istio/issues/28890")
+						}
+						retry.UntilSuccessOrFail(t, func() error {
+							headers, parentSpanID, err := tracing.ContextHeaders(format)
+							if err != nil {
+								return fmt.Errorf("cannot build %s trace context: %v", format, err)
+							}
+							err = tracing.SendTraffic(t, headers, cl)
+							if err != nil {
+								return fmt.Errorf("cannot send traffic from cluster %s: %v", clName, err)
+							}
+
+							traces, err := tracing.GetZipkinInstance().QueryTraces(300,
+								fmt.Sprintf("server.%s.svc.cluster.local:80/*", appNsInst.Name()), "")
+							if err != nil {
+								return fmt.Errorf("cannot get traces from zipkin: %v", err)
+							}
+							if !tracing.VerifyEchoTracesFromParent(t, appNsInst.Name(), clName, traces, parentSpanID) {
+								return fmt.Errorf("cannot find expected traces continuing %s span %s", format, parentSpanID)
+							}
+							return nil
+						}, retry.Delay(3*time.Second), retry.Timeout(80*time.Second))
+					})
+				}
+			}
+		})
+}
+
 func TestMain(m *testing.M) {
 	framework.NewSuite(m).
 		Label(label.CustomSetup).
@@ -83,15 +128,7 @@ func setupConfig(ctx resource.Context, cfg *istio.Config) {
 	if cfg == nil {
 		return
 	}
-	cfg.ControlPlaneValues = `
-meshConfig:
-  enableTracing: true
-  defaultConfig:
-    tracing:
-      openCensusAgent:
-        address: "dns:opentelemetry-collector.istio-system.svc:55678"
-        context: [B3]
-`
+	cfg.ControlPlaneValues = tracing.OpenCensusAgentValues(propagationFormats...)
 	cfg.Values["pilot.traceSampling"] = "100.0"
 	cfg.Values["global.proxy.tracer"] = "openCensusAgent"
 }
@@ -16,7 +16,11 @@
 package tracing
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
 	"testing"
 
 	"istio.io/istio/pkg/config/protocol"
@@ -42,6 +46,82 @@ const (
 	TraceHeader = "x-client-trace-id"
 )
 
+// PropagationFormat is a trace context propagation format of the OpenCensusAgent tracer, as named in the mesh
+// config.
+type PropagationFormat string
+
+const (
+	// B3 is the Zipkin B3 multi header format.
+	B3 PropagationFormat = "B3"
+	// W3CTraceContext is the W3C Trace Context format, with the traceparent header.
+	W3CTraceContext PropagationFormat = "W3C_TRACE_CONTEXT"
+	// CloudTraceContext is the Google Cloud Trace format, with the x-cloud-trace-context header.
+	CloudTraceContext PropagationFormat = "CLOUD_TRACE_CONTEXT"
+)
+
+// OpenCensusAgentValues returns the control plane values tracing with the OpenCensusAgent tracer of the
+// OpenTelemetry collector, propagating the trace context in the given formats.
+func OpenCensusAgentValues(formats ...PropagationFormat) string {
+	names := make([]string, 0, len(formats))
+	for _, f := range formats {
+		names = append(names, string(f))
+	}
+	return fmt.Sprintf(`
+meshConfig:
+  enableTracing: true
+  defaultConfig:
+    tracing:
+      openCensusAgent:
+        address: "dns:opentelemetry-collector.istio-system.svc:55678"
+        context: [%s]
+`, strings.Join(names, ", "))
+}
+
+// ContextHeaders returns the headers of a new sampled trace context in format, and the ID of the span they make
+// the parent of the spans of the request.
+func ContextHeaders(format PropagationFormat) (map[string][]string, string, error) {
+	traceID, err := randomHex(16)
+	if err != nil {
+		return nil, "", err
+	}
+	spanID, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	switch format {
+	case B3:
+		return map[string][]string{
+			"x-b3-traceid": {traceID},
+			"x-b3-spanid":  {spanID},
+			"x-b3-sampled": {"1"},
+		}, spanID, nil
+	case W3CTraceContext:
+		return map[string][]string{
+			"traceparent": {fmt.Sprintf("00-%s-%s-01", traceID, spanID)},
+		}, spanID, nil
+	case CloudTraceContext:
+		// The span ID is a decimal number in this format.
+		id, err := strconv.ParseUint(spanID, 16, 64)
+		if err != nil {
+			return nil, "", err
+		}
+		return map[string][]string{
+			"x-cloud-trace-context": {fmt.Sprintf("%s/%d;o=1", traceID, id)},
+		}, spanID, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported trace context propagation format %q", format)
+	}
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 func GetIstioInstance() *istio.Instance {
 	return &ist
 }
@@ -114,12 +194,18 @@ func TestSetup(ctx resource.Context) (err error) {
 }
 
 func VerifyEchoTraces(t *testing.T, namespace, clName string, traces []zipkin.Trace) bool {
+	return VerifyEchoTracesFromParent(t, namespace, clName, traces, "")
+}
+
+// VerifyEchoTracesFromParent verifies the traces hold the spans of the echo call, starting from a child of the
+// span parentSpanID, the span of a propagated trace context, or from the root span if empty.
+func VerifyEchoTracesFromParent(t *testing.T, namespace, clName string, traces []zipkin.Trace, parentSpanID string) bool {
 	wtr := WantTraceRoot(namespace, clName)
 	for _, trace := range traces {
 		// compare each candidate trace with the wanted trace
 		for _, s := range trace.Spans {
-			// find the root span of candidate trace and do recursive comparison
-			if s.ParentSpanID == "" && CompareTrace(t, s, wtr) {
+			// find the first span of the call in the candidate trace and do recursive comparison
+			if s.ParentSpanID == parentSpanID && CompareTrace(t, s, wtr) {
 				return true
 			}
 		}
@@ -0,0 +1,185 @@
+// +build integ
+// Copyright Istio Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xdsproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kubeApiMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"istio.io/istio/pkg/config/constants"
+	echoclient "istio.io/istio/pkg/test/echo/client"
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/echo"
+	"istio.io/istio/pkg/test/framework/resource"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+const (
+	proxyContainer = "istio-proxy"
+	// rotationLog is logged by the XDS proxy as it resets its connection to istiod for rotated certificates.
+	rotationLog = "xds connection certificates have changed"
+)
+
+// TestXdsProxyCertRotation verifies that the XDS proxy reconnecting to istiod, as its client certificates rotate,
+// is seamless to the data plane: Envoy keeps its configuration over the reconnect, so no request fails.
+func TestXdsProxyCertRotation(t *testing.T) {
+	framework.NewTest(t).
+		Features("security.control-plane.xds-proxy.cert-rotation").
+		Run(func(ctx framework.TestContext) {
+			cl := ctx.Clusters().Default()
+			workload := client.WorkloadsOrFail(t)[0]
+			restartWithCerts(t, cl, workload)
+
+			before := strings.Count(workload.Sidecar().LogsOrFail(t), rotationLog)
+			tr := startTraffic(t)
+			retry.UntilSuccessOrFail(t, func() error {
+				logs, err := workload.Sidecar().Logs()
+				if err != nil {
+					return err
+				}
+				if strings.Count(logs, rotationLog) <= before {
+					return errors.New("the XDS proxy has not reconnected for rotated certificates yet")
+				}
+				return nil
+			}, retry.Delay(5*time.Second), retry.Timeout(3*time.Minute))
+			// Keep the traffic flowing while Envoy resubscribes over the new connection.
+			time.Sleep(10 * time.Second)
+			ok, failed := tr.stop()
+
+			if ok == 0 {
+				t.Fatal("no request went through")
+			}
+			if len(failed) > 0 {
+				t.Fatalf("%d of %d requests failed across the reconnect, want 100%% success: %v",
+					len(failed), ok+len(failed), failed)
+			}
+			t.Logf("%d requests succeeded across the reconnect", ok)
+		})
+}
+
+// restartWithCerts restarts the sidecar of workload once it has written its workload certificates. The XDS proxy
+// only watches the client certificates found as it starts, which are then those of certDir.
+func restartWithCerts(t *testing.T, cl resource.Cluster, workload echo.Workload) {
+	t.Helper()
+	cert := path.Join(certDir, constants.CertChainFilename)
+	retry.UntilSuccessOrFail(t, func() error {
+		_, _, err := cl.PodExec(workload.PodName(), appNs.Name(), proxyContainer, "ls "+cert)
+		return err
+	}, retry.Delay(time.Second), retry.Timeout(time.Minute))
+
+	restarts := func() (int32, error) {
+		pod, err := cl.CoreV1().Pods(appNs.Name()).Get(context.TODO(), workload.PodName(), kubeApiMeta.GetOptions{})
+		if err != nil {
+			return 0, err
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name == proxyContainer {
+				return status.RestartCount, nil
+			}
+		}
+		return 0, fmt.Errorf("no %s container in pod %s", proxyContainer, workload.PodName())
+	}
+	initial, err := restarts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The exec fails as the container goes away, the certificates are kept in its volume.
+	_, _, _ = cl.PodExec(workload.PodName(), appNs.Name(), proxyContainer, "kill 1")
+
+	retry.UntilSuccessOrFail(t, func() error {
+		count, err := restarts()
+		if err != nil {
+			return err
+		}
+		if count == initial {
+			return fmt.Errorf("the %s container has not restarted yet", proxyContainer)
+		}
+		logs, err := workload.Sidecar().Logs()
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(logs, "adding watcher for certificate "+cert) {
+			return fmt.Errorf("the XDS proxy does not watch %s", cert)
+		}
+		_, err = client.Call(echo.CallOptions{Target: server, PortName: "http"})
+		return err
+	}, retry.Delay(2*time.Second), retry.Timeout(2*time.Minute))
+}
+
+// traffic sends requests from the client to the server until stopped.
+type traffic struct {
+	stopCh chan struct{}
+	done   chan struct{}
+
+	mu     sync.Mutex
+	ok     int
+	failed []string
+}
+
+func startTraffic(t *testing.T) *traffic {
+	t.Helper()
+	tr := &traffic{
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(tr.done)
+		for {
+			select {
+			case <-tr.stopCh:
+				return
+			default:
+			}
+			responses, err := client.Call(echo.CallOptions{Target: server, PortName: "http", Count: 10})
+			tr.record(responses, err)
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+	return tr
+}
+
+func (tr *traffic) record(responses echoclient.ParsedResponses, err error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if err != nil {
+		tr.failed = append(tr.failed, err.Error())
+		return
+	}
+	for _, r := range responses {
+		if r.IsOK() {
+			tr.ok++
+		} else {
+			tr.failed = append(tr.failed, fmt.Sprintf("status code %s", r.Code))
+		}
+	}
+}
+
+// stop stops the traffic, returning the number of requests that succeeded and the failures.
+func (tr *traffic) stop() (int, []string) {
+	close(tr.stopCh)
+	<-tr.done
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.ok, tr.failed
+}
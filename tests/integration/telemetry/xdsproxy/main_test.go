@@ -0,0 +1,105 @@
+// +build integ
+// Copyright Istio Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package xdsproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"istio.io/istio/pkg/config/protocol"
+	"istio.io/istio/pkg/test/framework"
+	"istio.io/istio/pkg/test/framework/components/echo"
+	"istio.io/istio/pkg/test/framework/components/echo/echoboot"
+	"istio.io/istio/pkg/test/framework/components/istio"
+	"istio.io/istio/pkg/test/framework/components/namespace"
+	"istio.io/istio/pkg/test/framework/label"
+	"istio.io/istio/pkg/test/framework/resource"
+)
+
+// certDir is where the sidecars write their workload certificates, which the XDS proxy connects to istiod with.
+const certDir = "/etc/istio/proxy"
+
+var (
+	inst           istio.Instance
+	appNs          namespace.Instance
+	client, server echo.Instance
+)
+
+func TestMain(m *testing.M) {
+	framework.NewSuite(m).
+		Label(label.CustomSetup).
+		Setup(istio.Setup(&inst, setupConfig)).
+		Setup(testSetup).
+		Run()
+}
+
+func setupConfig(_ resource.Context, cfg *istio.Config) {
+	if cfg == nil {
+		return
+	}
+	// The sidecars write their workload certificates to certDir, which the XDS proxy then uses as its client
+	// certificates. These are issued for two minutes, so that they rotate within the wait of the rotation test.
+	// The root certificate stays the mounted one.
+	cfg.ControlPlaneValues = fmt.Sprintf(`
+values:
+  meshConfig:
+    defaultConfig:
+      proxyMetadata:
+        OUTPUT_CERTS: %[1]s
+        PROV_CERT: %[1]s
+        SECRET_TTL: 2m
+        XDS_ROOT_CA: /var/run/secrets/istio/root-cert.pem
+`, certDir)
+}
+
+func testSetup(ctx resource.Context) (err error) {
+	appNs, err = namespace.New(ctx, namespace.Config{
+		Prefix: "xds-proxy",
+		Inject: true,
+	})
+	if err != nil {
+		return
+	}
+	echos, err := echoboot.NewBuilder(ctx).
+		WithConfig(echo.Config{
+			Service:   "client",
+			Namespace: appNs,
+			Cluster:   ctx.Clusters().Default(),
+			Subsets:   []echo.SubsetConfig{{}},
+		}).
+		WithConfig(echo.Config{
+			Service:   "server",
+			Namespace: appNs,
+			Cluster:   ctx.Clusters().Default(),
+			Subsets:   []echo.SubsetConfig{{}},
+			Ports: []echo.Port{
+				{
+					Name:         "http",
+					Protocol:     protocol.HTTP,
+					InstancePort: 8090,
+				},
+			},
+		}).
+		Build()
+	if err != nil {
+		return
+	}
+	if client, err = echos.Get(echo.Service("client")); err != nil {
+		return
+	}
+	server, err = echos.Get(echo.Service("server"))
+	return
+}